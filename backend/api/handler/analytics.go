@@ -179,7 +179,7 @@ func GetServiceUtilization(c *gin.Context) {
 
 // GetServiceMetrics godoc
 // @Summary 获取单个服务的详细性能指标
-// @Description 获取指定MCP服务的详细性能指标，例如随时间变化的请求数、延迟分布等。
+// @Description 获取指定MCP服务的详细性能指标，例如随时间变化的请求数、延迟分布等。没有 analytics.view_all 权限的用户只能看到自己的请求。
 // @Tags Analytics
 // @Accept json
 // @Produce json
@@ -221,9 +221,14 @@ func GetServiceMetrics(c *gin.Context) {
 		return
 	}
 
-	// Fetch stats for the specific service
+	// Fetch stats for the specific service, only the user's own requests without analytics.view_all
 	// For production, consider time range filtering and ordering (e.g., by CreatedAt DESC)
-	serviceStats, err := statThing.Where("service_id = ?", serviceID).All()
+	var serviceStats []*model.ProxyRequestStat
+	if hasPermission(c, model.PermissionAnalyticsViewAll) {
+		serviceStats, err = statThing.Where("service_id = ?", serviceID).All()
+	} else {
+		serviceStats, err = statThing.Where("service_id = ? AND user_id = ?", serviceID, getUserIDFromContext(c)).All()
+	}
 	if err != nil {
 		common.RespError(c, http.StatusInternalServerError, fmt.Sprintf("Error fetching statistics for service %s", serviceIDStr), err)
 		return
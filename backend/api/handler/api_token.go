@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiTokenRequest is the body of CreateAPIToken
+type apiTokenRequest struct {
+	Name      string   `json:"name"`
+	Services  []string `json:"services"`   // Services and virtual servers the token is limited to, empty for every service
+	ReadOnly  bool     `json:"read_only"`  // Only tools annotated read-only may be listed and called
+	ExpiresAt int64    `json:"expires_at"` // Unix seconds, 0 for never
+}
+
+// apiTokenResponse describes a token without the token itself
+func apiTokenResponse(token *model.APIToken) gin.H {
+	return gin.H{
+		"id":           token.ID,
+		"name":         token.Name,
+		"token_prefix": token.TokenPrefix,
+		"services":     token.GetServices(),
+		"read_only":    token.ReadOnly,
+		"expires_at":   token.ExpiresAt,
+		"expired":      token.IsExpired(),
+		"last_used_at": token.LastUsedAt,
+		"last_used_ip": token.LastUsedIP,
+		"created_at":   token.CreatedAt,
+	}
+}
+
+// ListAPITokens godoc
+// @Summary List the API tokens of the current user
+// @Tags API Tokens
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/tokens [get]
+func ListAPITokens(c *gin.Context) {
+	respondAPITokens(c, getUserIDFromContext(c))
+}
+
+// respondAPITokens responds with the tokens of a user
+func respondAPITokens(c *gin.Context, userID int64) {
+	lang := c.GetString("lang")
+	tokens, err := model.GetUserAPITokens(userID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_api_tokens_failed", lang), err)
+		return
+	}
+	result := make([]gin.H, 0, len(tokens))
+	for _, token := range tokens {
+		result = append(result, apiTokenResponse(token))
+	}
+	common.RespSuccess(c, result)
+}
+
+// CreateAPIToken godoc
+// @Summary Create an API token for the /proxy endpoints
+// @Description The token is returned in the token field of the response only once; only its hash is stored
+// @Tags API Tokens
+// @Accept json
+// @Produce json
+// @Param body body apiTokenRequest true "Token name, services, read-only flag and expiry"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/tokens [post]
+func CreateAPIToken(c *gin.Context) {
+	lang := c.GetString("lang")
+	user, err := model.GetUserById(getUserIDFromContext(c), false)
+	if err != nil {
+		common.RespError(c, http.StatusUnauthorized, i18n.Translate("user_not_found", lang), err)
+		return
+	}
+	createAPITokenFor(c, user)
+}
+
+// createAPITokenFor creates the token described by the request body for user, limited to
+// services user may use, and responds with it
+func createAPITokenFor(c *gin.Context, user *model.User) {
+	lang := c.GetString("lang")
+	var req apiTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("api_token_name_required", lang))
+		return
+	}
+	if req.ExpiresAt < 0 || (req.ExpiresAt > 0 && req.ExpiresAt <= time.Now().Unix()) {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_api_token_expiry", lang))
+		return
+	}
+	for _, name := range req.Services {
+		err := model.CheckProxyAccess(user, name)
+		if errors.Is(err, model.ErrProxyTargetNotFound) || errors.Is(err, model.ErrProxyAccessDenied) {
+			common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_api_token_services", lang), err)
+			return
+		}
+		if err != nil {
+			common.RespError(c, http.StatusInternalServerError, i18n.Translate("create_api_token_failed", lang), err)
+			return
+		}
+	}
+
+	token, tokenString, err := model.CreateAPIToken(user.ID, req.Name, req.Services, req.ReadOnly, req.ExpiresAt)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("create_api_token_failed", lang), err)
+		return
+	}
+	response := apiTokenResponse(token)
+	response["token"] = tokenString
+	common.RespSuccess(c, response)
+}
+
+// DeleteAPIToken godoc
+// @Summary Revoke an API token of the current user
+// @Tags API Tokens
+// @Produce json
+// @Param id path int true "Token ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/tokens/{id} [delete]
+func DeleteAPIToken(c *gin.Context) {
+	revokeAPIToken(c, getUserIDFromContext(c), c.Param("id"))
+}
+
+// revokeAPIToken revokes the token of a user with the given ID
+func revokeAPIToken(c *gin.Context, userID int64, tokenID string) {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(tokenID, 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang), err)
+		return
+	}
+	token, err := model.GetUserAPIToken(userID, id)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("api_token_not_found", lang), err)
+		return
+	}
+	if err := model.DeleteAPIToken(token); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("revoke_api_token_failed", lang), err)
+		return
+	}
+	common.RespSuccessStr(c, i18n.Translate("api_token_revoked", lang))
+}
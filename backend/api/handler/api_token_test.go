@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"toWers/backend/api/middleware"
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupAPITokenRouter(userID int64) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	self := router.Group("/api/user", func(c *gin.Context) { c.Set("user_id", userID) })
+	self.GET("/token", GenerateToken)
+	self.GET("/tokens", ListAPITokens)
+	self.POST("/tokens", CreateAPIToken)
+	self.DELETE("/tokens/:id", DeleteAPIToken)
+	router.Any("/proxy/:serviceName/*action", middleware.TokenAuth(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetInt64("userID"), "read_only": c.GetBool("readOnly")})
+	})
+	return router
+}
+
+func createAPITokenRequest(body gin.H) *http.Request {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, "/api/user/tokens", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestAPITokens_ScopedReadOnlyAndRevocable(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	user := &model.User{Username: "token-owner", DisplayName: "Token Owner", Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+	require.NoError(t, model.UserDB.Save(user))
+	for _, name := range []string{"github", "notion"} {
+		require.NoError(t, model.CreateService(&model.MCPService{Name: name, DisplayName: name, Type: model.ServiceTypeSSE, Command: "http://localhost:1/sse", Enabled: true}))
+	}
+	router := setupAPITokenRouter(user.ID)
+
+	w, _ := serveJSON(t, router, createAPITokenRequest(gin.H{"name": "ci", "services": []string{"missing"}}))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "tokens can only be limited to existing services")
+	w, _ = serveJSON(t, router, createAPITokenRequest(gin.H{"name": "ci", "expires_at": time.Now().Add(-time.Hour).Unix()}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, body := serveJSON(t, router, createAPITokenRequest(gin.H{"name": "ci", "services": []string{"github"}, "read_only": true}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	created := body["data"].(map[string]interface{})
+	apiToken := created["token"].(string)
+	assert.Contains(t, apiToken, model.APITokenPrefix)
+	assert.Contains(t, apiToken, created["token_prefix"])
+
+	req := proxyRequest("github", "Bearer "+apiToken)
+	req.RemoteAddr = "203.0.113.7:41000"
+	_, proxied := serveJSON(t, router, req)
+	assert.EqualValues(t, user.ID, proxied["user_id"])
+	assert.Equal(t, true, proxied["read_only"])
+	w, _ = serveJSON(t, router, proxyRequest("notion", "Bearer "+apiToken))
+	assert.Equal(t, http.StatusForbidden, w.Code, "the token is limited to github")
+
+	// The token is never listed again; its last use is
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/tokens", nil)
+	w, body = serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	tokens := body["data"].([]interface{})
+	require.Len(t, tokens, 1)
+	listed := tokens[0].(map[string]interface{})
+	assert.NotContains(t, listed, "token")
+	assert.Equal(t, []interface{}{"github"}, listed["services"])
+	assert.NotZero(t, listed["last_used_at"])
+	assert.Equal(t, "203.0.113.7", listed["last_used_ip"])
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/api/user/tokens/%v", created["id"]), nil)
+	w, _ = serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, proxied = serveJSON(t, router, proxyRequest("github", "Bearer "+apiToken))
+	assert.EqualValues(t, 0, proxied["user_id"], "revoked tokens are rejected")
+
+	// Expired tokens are rejected
+	_, expiring, err := model.CreateAPIToken(user.ID, "expiring", nil, false, time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+	token, _, err := model.ValidateAPIToken(expiring)
+	require.NoError(t, err)
+	token.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	require.NoError(t, model.APITokenDB.Save(token))
+	_, proxied = serveJSON(t, router, proxyRequest("notion", "Bearer "+expiring))
+	assert.EqualValues(t, 0, proxied["user_id"])
+}
+
+func TestAPITokens_GenerateTokenReplacesDefault(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	user := &model.User{Username: "default-owner", DisplayName: "Default Owner", Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+	require.NoError(t, model.UserDB.Save(user))
+	router := setupAPITokenRouter(user.ID)
+	generate := func() string {
+		req, _ := http.NewRequest(http.MethodGet, "/api/user/token", nil)
+		w, body := serveJSON(t, router, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return body["data"].(string)
+	}
+
+	first := generate()
+	second := generate()
+	_, proxied := serveJSON(t, router, proxyRequest("github", "Bearer "+first))
+	assert.EqualValues(t, 0, proxied["user_id"], "regenerating revokes the previous default token")
+	_, proxied = serveJSON(t, router, proxyRequest("github", "Bearer "+second))
+	assert.EqualValues(t, user.ID, proxied["user_id"])
+	assert.Equal(t, false, proxied["read_only"])
+
+	tokens, err := model.GetUserAPITokens(user.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.Equal(t, model.DefaultAPITokenName, tokens[0].Name)
+}
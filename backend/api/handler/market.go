@@ -530,6 +530,15 @@ func InstallOrAddService(c *gin.Context) {
 		Category            model.ServiceCategory  `json:"category"`               // Optional: for creating MCPService
 		Headers             map[string]string      `json:"headers"`                // Optional: for SSE/HTTP services custom headers
 		CustomArgs          []string               `json:"custom_args"`            // Optional: for stdio services custom arguments
+		// Optional: execution policy of the package, applied to the installation probe and the created service
+		SandboxEnabled      bool   `json:"sandbox_enabled"`
+		SandboxWorkDir      string `json:"sandbox_work_dir"`
+		SandboxMemoryMB     int    `json:"sandbox_memory_mb"`
+		SandboxCPUSeconds   int    `json:"sandbox_cpu_seconds"`
+		SandboxMaxOpenFiles int    `json:"sandbox_max_open_files"`
+		SandboxIsolate      bool   `json:"sandbox_isolate"`
+		SandboxReadOnly     bool   `json:"sandbox_read_only"`
+		SandboxKillOnExceed bool   `json:"sandbox_kill_on_exceed"`
 	}
 
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
@@ -690,10 +699,22 @@ func InstallOrAddService(c *gin.Context) {
 			Enabled:               true, // 安装时直接启用服务
 			HealthStatus:          string(market.StatusPending),
 			InstallerUserID:       userID, // 记录安装者
+			SandboxEnabled:        requestBody.SandboxEnabled,
+			SandboxWorkDir:        requestBody.SandboxWorkDir,
+			SandboxMemoryMB:       requestBody.SandboxMemoryMB,
+			SandboxCPUSeconds:     requestBody.SandboxCPUSeconds,
+			SandboxMaxOpenFiles:   requestBody.SandboxMaxOpenFiles,
+			SandboxIsolate:        requestBody.SandboxIsolate,
+			SandboxReadOnly:       requestBody.SandboxReadOnly,
+			SandboxKillOnExceed:   requestBody.SandboxKillOnExceed,
 		}
 		if newService.Category == "" {
 			newService.Category = model.CategoryAI
 		}
+		if err := newService.ValidateSandboxPolicy(); err != nil {
+			common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_sandbox_policy", lang), err)
+			return
+		}
 
 		// Check if the processed service name already exists
 		existingServiceByName, errByName := model.GetServiceByName(newService.Name)
@@ -804,6 +825,7 @@ func InstallOrAddService(c *gin.Context) {
 			Command:        newService.Command,
 			Args:           args,
 			EnvVars:        envVarsForTask,
+			SandboxPolicy:  newService.GetSandboxPolicy(),
 		}
 
 		log.Printf("[InstallOrAddService] About to submit installation task for ServiceID=%d, Package=%s, Manager=%s, Version=%s, EnvVars=%v",
@@ -1415,9 +1437,7 @@ func PatchEnvVar(c *gin.Context) {
 		return
 	}
 
-	isAdmin := user.Role == common.RoleAdminUser
-
-	if isAdmin {
+	if user.HasPermission(model.PermissionServiceEdit) {
 		// 管理员：更新服务的默认环境变量配置
 		service, err := model.GetServiceByID(req.ServiceID)
 		if err != nil {
@@ -1452,54 +1472,15 @@ func PatchEnvVar(c *gin.Context) {
 			return
 		}
 
+		// 滚动重启使用该环境变量的运行中实例
+		proxy.ReloadService(service)
+
 		log.Printf("[PatchEnvVar] Admin user %d updated default env %s=%s for service %d (%s)", userID, req.VarName, req.VarValue, service.ID, service.Name)
 		common.RespSuccessStr(c, "Default environment variable updated successfully")
 
 	} else {
 		// 普通用户：保存为个人配置
-		// 查找或创建变量定义
-		configOpt, err := model.GetConfigOptionByKey(req.ServiceID, req.VarName)
-		if err != nil {
-			if err.Error() == model.ErrRecordNotFound.Error() || err.Error() == "config_service_not_found" || strings.Contains(err.Error(), "not found") {
-				// 如果ConfigService不存在，创建一个
-				service, serviceErr := model.GetServiceByID(req.ServiceID)
-				if serviceErr != nil {
-					common.RespError(c, http.StatusNotFound, i18n.Translate("service_not_found", lang), serviceErr)
-					return
-				}
-
-				newConfigOption := model.ConfigService{
-					ServiceID:   req.ServiceID,
-					Key:         req.VarName,
-					DisplayName: req.VarName,
-					Description: fmt.Sprintf("Environment variable %s for %s", req.VarName, service.DisplayName),
-					Type:        model.ConfigTypeString,
-					Required:    true,
-				}
-				if strings.Contains(strings.ToLower(req.VarName), "token") || strings.Contains(strings.ToLower(req.VarName), "key") || strings.Contains(strings.ToLower(req.VarName), "secret") {
-					newConfigOption.Type = model.ConfigTypeSecret
-				}
-				if errCreate := model.CreateConfigOption(&newConfigOption); errCreate != nil {
-					log.Printf("Failed to create ConfigService for key %s, serviceID %d: %v", req.VarName, req.ServiceID, errCreate)
-					common.RespError(c, http.StatusInternalServerError, "Failed to create config option", errCreate)
-					return
-				}
-				configOpt = &newConfigOption
-			} else {
-				common.RespError(c, http.StatusInternalServerError, "Failed to get config option", err)
-				return
-			}
-		}
-
-		// 保存用户配置
-		userConfig := &model.UserConfig{
-			UserID:    userID,
-			ServiceID: req.ServiceID,
-			ConfigID:  configOpt.ID,
-			Value:     req.VarValue,
-		}
-		if err := model.SaveUserConfig(userConfig); err != nil {
-			common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_user_config_failed", lang), err)
+		if !savePersonalEnvVar(c, userID, req.ServiceID, req.VarName, req.VarValue) {
 			return
 		}
 
@@ -1508,6 +1489,76 @@ func PatchEnvVar(c *gin.Context) {
 	}
 }
 
+// savePersonalEnvVar saves an environment variable of a service for a user as their own
+// configuration and reloads their running instance. It writes an error response and returns
+// false if the variable cannot be saved.
+func savePersonalEnvVar(c *gin.Context, userID, serviceID int64, varName, varValue string) bool {
+	lang := c.GetString("lang")
+
+	configOpt := findOrCreateConfigOption(c, serviceID, varName)
+	if configOpt == nil {
+		return false
+	}
+
+	// 保存用户配置
+	userConfig := &model.UserConfig{
+		UserID:    userID,
+		ServiceID: serviceID,
+		ConfigID:  configOpt.ID,
+		Value:     varValue,
+	}
+	if err := model.SaveUserConfig(userConfig); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_user_config_failed", lang), err)
+		return false
+	}
+
+	// 滚动重启该用户正在运行的实例
+	if service, err := model.GetServiceByID(serviceID); err == nil {
+		proxy.ReloadUserInstance(service, userID)
+	}
+	return true
+}
+
+// findOrCreateConfigOption returns the definition of the variable varName of a service, creating
+// it if needed. It writes an error response and returns nil on failure.
+func findOrCreateConfigOption(c *gin.Context, serviceID int64, varName string) *model.ConfigService {
+	lang := c.GetString("lang")
+
+	configOpt, err := model.GetConfigOptionByKey(serviceID, varName)
+	if err != nil {
+		if err.Error() == model.ErrRecordNotFound.Error() || err.Error() == "config_service_not_found" || strings.Contains(err.Error(), "not found") {
+			// 如果ConfigService不存在，创建一个
+			service, serviceErr := model.GetServiceByID(serviceID)
+			if serviceErr != nil {
+				common.RespError(c, http.StatusNotFound, i18n.Translate("service_not_found", lang), serviceErr)
+				return nil
+			}
+
+			newConfigOption := model.ConfigService{
+				ServiceID:   serviceID,
+				Key:         varName,
+				DisplayName: varName,
+				Description: fmt.Sprintf("Environment variable %s for %s", varName, service.DisplayName),
+				Type:        model.ConfigTypeString,
+				Required:    true,
+			}
+			if strings.Contains(strings.ToLower(varName), "token") || strings.Contains(strings.ToLower(varName), "key") || strings.Contains(strings.ToLower(varName), "secret") {
+				newConfigOption.Type = model.ConfigTypeSecret
+			}
+			if errCreate := model.CreateConfigOption(&newConfigOption); errCreate != nil {
+				log.Printf("Failed to create ConfigService for key %s, serviceID %d: %v", varName, serviceID, errCreate)
+				common.RespError(c, http.StatusInternalServerError, "Failed to create config option", errCreate)
+				return nil
+			}
+			configOpt = &newConfigOption
+		} else {
+			common.RespError(c, http.StatusInternalServerError, "Failed to get config option", err)
+			return nil
+		}
+	}
+	return configOpt
+}
+
 // CreateCustomService godoc
 // @Summary 创建自定义服务
 // @Description 创建一个自定义的MCP服务（支持stdio、sse、streamableHttp类型）
@@ -2177,9 +2228,9 @@ func StreamBatchImportProgress(c *gin.Context) {
 		return
 	}
 
-	// Check if user is admin (similar to AdminAuth middleware)
-	if claims.Role < common.RoleAdminUser {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+	// Check the permission (similar to the RequirePermission middleware)
+	if user, err := model.GetUserById(claims.UserID, false); err != nil || user == nil || !user.HasPermission(model.PermissionServiceInstall) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission required: " + model.PermissionServiceInstall})
 		return
 	}
 
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/library/proxy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListMCPInstances godoc
+// @Summary List running MCP instances
+// @Description List every live MCP instance, global and user-specific, with its processes, memory, uptime and in-flight requests
+// @Tags MCP Instances
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/mcp_instances [get]
+func ListMCPInstances(c *gin.Context) {
+	common.RespSuccess(c, proxy.ListInstances())
+}
+
+// GetMCPInstance godoc
+// @Summary Inspect a running MCP instance
+// @Tags MCP Instances
+// @Produce json
+// @Param key path string true "Instance cache key, e.g. user-1-service-2-shared"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Router /api/mcp_instances/{key} [get]
+func GetMCPInstance(c *gin.Context) {
+	lang := c.GetString("lang")
+	info, err := proxy.InspectInstance(c.Param("key"))
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("instance_not_found", lang), err)
+		return
+	}
+	common.RespSuccess(c, info)
+}
+
+// RestartMCPInstance godoc
+// @Summary Restart a running MCP instance
+// @Description Shut the instance down and start it again with its service's current configuration
+// @Tags MCP Instances
+// @Produce json
+// @Param key path string true "Instance cache key"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/mcp_instances/{key}/restart [post]
+func RestartMCPInstance(c *gin.Context) {
+	lang := c.GetString("lang")
+	info, err := proxy.RestartInstance(c.Request.Context(), c.Param("key"))
+	if errors.Is(err, proxy.ErrInstanceNotFound) {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("instance_not_found", lang), err)
+		return
+	}
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("restart_instance_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, info)
+}
+
+// KillMCPInstance godoc
+// @Summary Kill a running MCP instance
+// @Description Kill the instance's processes at once and drop it; the next request to it starts a new instance
+// @Tags MCP Instances
+// @Produce json
+// @Param key path string true "Instance cache key"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Router /api/mcp_instances/{key}/kill [post]
+func KillMCPInstance(c *gin.Context) {
+	lang := c.GetString("lang")
+	if err := proxy.KillInstance(c.Param("key")); err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("instance_not_found", lang), err)
+		return
+	}
+	common.RespSuccessStr(c, i18n.Translate("instance_killed", lang))
+}
@@ -0,0 +1,363 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/model"
+	"toWers/backend/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Endpoints of toWers as the authorization server of its /proxy endpoints, see service/mcp_oauth_service.go.
+// The protocol endpoints answer in the formats of the OAuth RFCs rather than common.APIResponse.
+
+// mcpOAuthConsentPath is the page of the web UI where users approve authorization requests
+const mcpOAuthConsentPath = "/oauth/consent"
+
+func respOAuthError(c *gin.Context, status int, err error) {
+	var oauthErr *service.OAuthError
+	if !errors.As(err, &oauthErr) {
+		common.SysError("[MCPOAuth] " + err.Error())
+		oauthErr = &service.OAuthError{Code: "server_error"}
+		status = http.StatusInternalServerError
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, oauthErr)
+}
+
+// GetProtectedResourceMetadata godoc
+// @Summary OAuth protected resource metadata of the /proxy endpoints (RFC 9728)
+// @Tags MCP OAuth
+// @Produce json
+// @Success 200 {object} object
+// @Router /.well-known/oauth-protected-resource [get]
+func GetProtectedResourceMetadata(c *gin.Context) {
+	issuer := service.MCPOAuthIssuer()
+	metadata := gin.H{
+		"resource":                 issuer + "/proxy",
+		"authorization_servers":    []string{issuer},
+		"bearer_methods_supported": []string{"header"},
+		"resource_name":            common.SystemName,
+	}
+	// /.well-known/oauth-protected-resource/proxy/<service>/... describes a single service
+	if parts := strings.Split(strings.Trim(c.Param("resource"), "/"), "/"); len(parts) >= 2 && parts[0] == "proxy" {
+		metadata["resource"] = issuer + "/" + strings.Join(parts, "/")
+		metadata["scopes_supported"] = []string{model.OAuthScopePrefix + parts[1]}
+	}
+	c.JSON(http.StatusOK, metadata)
+}
+
+// GetAuthorizationServerMetadata godoc
+// @Summary OAuth authorization server metadata (RFC 8414)
+// @Tags MCP OAuth
+// @Produce json
+// @Success 200 {object} object
+// @Router /.well-known/oauth-authorization-server [get]
+func GetAuthorizationServerMetadata(c *gin.Context) {
+	issuer := service.MCPOAuthIssuer()
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                         issuer,
+		"authorization_endpoint":                         issuer + "/api/mcp_oauth/authorize",
+		"token_endpoint":                                 issuer + "/api/mcp_oauth/token",
+		"registration_endpoint":                          issuer + "/api/mcp_oauth/register",
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"token_endpoint_auth_methods_supported":          []string{"none", "client_secret_post", "client_secret_basic"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// mcpOAuthRegistrationRequest is the client metadata of a dynamic client registration (RFC 7591)
+type mcpOAuthRegistrationRequest struct {
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+// RegisterMCPOAuthClient godoc
+// @Summary Register an MCP client (RFC 7591)
+// @Tags MCP OAuth
+// @Accept json
+// @Produce json
+// @Param body body mcpOAuthRegistrationRequest true "Client metadata"
+// @Success 201 {object} object
+// @Failure 400 {object} object
+// @Router /api/mcp_oauth/register [post]
+func RegisterMCPOAuthClient(c *gin.Context) {
+	var req mcpOAuthRegistrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respOAuthError(c, http.StatusBadRequest, &service.OAuthError{Code: "invalid_client_metadata", Description: err.Error()})
+		return
+	}
+	switch req.TokenEndpointAuthMethod {
+	case "":
+		req.TokenEndpointAuthMethod = "client_secret_basic" // RFC 7591 default
+	case "none", "client_secret_post", "client_secret_basic":
+	default:
+		respOAuthError(c, http.StatusBadRequest, &service.OAuthError{Code: "invalid_client_metadata", Description: "unsupported token_endpoint_auth_method"})
+		return
+	}
+
+	client, secret, err := service.RegisterMCPOAuthClient(req.ClientName, req.RedirectURIs, req.TokenEndpointAuthMethod != "none")
+	if err != nil {
+		respOAuthError(c, http.StatusBadRequest, err)
+		return
+	}
+	response := gin.H{
+		"client_id":                  client.ClientID,
+		"client_id_issued_at":        client.CreatedAt.Unix(),
+		"client_name":                client.ClientName,
+		"redirect_uris":              client.GetRedirectURIs(),
+		"grant_types":                []string{"authorization_code", "refresh_token"},
+		"response_types":             []string{"code"},
+		"token_endpoint_auth_method": req.TokenEndpointAuthMethod,
+	}
+	if secret != "" {
+		response["client_secret"] = secret
+		response["client_secret_expires_at"] = 0
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, response)
+}
+
+// AuthorizeMCPOAuth godoc
+// @Summary Authorization endpoint
+// @Description Validate the authorization request of an MCP client and send the user to the consent page of the web UI
+// @Tags MCP OAuth
+// @Param client_id query string true "Client ID"
+// @Param redirect_uri query string true "Registered redirect URI"
+// @Param response_type query string true "code"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string true "S256"
+// @Param scope query string false "Space separated mcp:<service> scopes"
+// @Param state query string false "Client state"
+// @Success 302
+// @Failure 400 {object} object
+// @Router /api/mcp_oauth/authorize [get]
+func AuthorizeMCPOAuth(c *gin.Context) {
+	request, redirectURI, err := service.StartMCPOAuthAuthorization(c.Request.URL.Query())
+	if err != nil {
+		var oauthErr *service.OAuthError
+		if redirectURI != "" && errors.As(err, &oauthErr) {
+			c.Redirect(http.StatusFound, service.MCPOAuthErrorRedirect(redirectURI, c.Query("state"), oauthErr))
+			return
+		}
+		respOAuthError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.Redirect(http.StatusFound, mcpOAuthConsentPath+"?"+url.Values{"request_id": {request.ID}}.Encode())
+}
+
+// consentService is a service users can allow an MCP client to use
+type consentService struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// GetMCPOAuthRequest godoc
+// @Summary Get a pending authorization request
+// @Description Return the client, the requested scope, what the user already granted the client and the services the user can allow it
+// @Tags MCP OAuth
+// @Produce json
+// @Param id path string true "Authorization request ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Router /api/mcp_oauth/requests/{id} [get]
+func GetMCPOAuthRequest(c *gin.Context) {
+	lang := c.GetString("lang")
+	request, err := service.GetMCPOAuthRequest(c.Param("id"))
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("authorization_request_not_found", lang), err)
+		return
+	}
+	user, err := model.GetUserById(getUserIDFromContext(c), false)
+	if err != nil {
+		common.RespError(c, http.StatusUnauthorized, i18n.Translate("user_not_found", lang), err)
+		return
+	}
+
+	services := []consentService{}
+	enabled, err := model.GetEnabledServices()
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_authorization_request_failed", lang), err)
+		return
+	}
+	for _, svc := range enabled {
+		if _, allowed, err := model.ResolveServiceAccess(user, svc); err == nil && allowed {
+			services = append(services, consentService{Name: svc.Name, DisplayName: svc.DisplayName})
+		}
+	}
+	virtualServers, err := model.GetAllVirtualServers()
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_authorization_request_failed", lang), err)
+		return
+	}
+	for _, vs := range virtualServers {
+		if vs.Enabled {
+			services = append(services, consentService{Name: vs.Name, DisplayName: vs.DisplayName})
+		}
+	}
+
+	var grantedScope string
+	if consent, err := model.GetOAuthConsent(user.ID, request.ClientID); err == nil {
+		grantedScope = consent.Scope
+	}
+	common.RespSuccess(c, gin.H{
+		"request":       request,
+		"services":      services,
+		"granted_scope": grantedScope,
+	})
+}
+
+// mcpOAuthDecision is the user's answer to an authorization request
+type mcpOAuthDecision struct {
+	Approve  bool     `json:"approve"`
+	Services []string `json:"services"` // Names of the services the client may use
+}
+
+// DecideMCPOAuthRequest godoc
+// @Summary Approve or deny a pending authorization request
+// @Description Record the services the user allows the client to use and return the URL sending the user back to the client
+// @Tags MCP OAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Authorization request ID"
+// @Param body body mcpOAuthDecision true "Decision"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Router /api/mcp_oauth/requests/{id} [post]
+func DecideMCPOAuthRequest(c *gin.Context) {
+	lang := c.GetString("lang")
+	var decision mcpOAuthDecision
+	if err := c.ShouldBindJSON(&decision); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	user, err := model.GetUserById(getUserIDFromContext(c), false)
+	if err != nil {
+		common.RespError(c, http.StatusUnauthorized, i18n.Translate("user_not_found", lang), err)
+		return
+	}
+
+	var redirectURL string
+	if decision.Approve {
+		redirectURL, err = service.ApproveMCPOAuthRequest(c.Param("id"), user, decision.Services)
+	} else {
+		redirectURL, err = service.DenyMCPOAuthRequest(c.Param("id"))
+	}
+	if errors.Is(err, service.ErrAuthorizationRequestNotFound) {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("authorization_request_not_found", lang), err)
+		return
+	}
+	var oauthErr *service.OAuthError
+	if errors.As(err, &oauthErr) {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_consent", lang), err)
+		return
+	}
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_consent_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, gin.H{"redirect_url": redirectURL})
+}
+
+// MCPOAuthToken godoc
+// @Summary Token endpoint
+// @Description Exchange an authorization code, or a refresh token, for an access token to the /proxy endpoints
+// @Tags MCP OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code or refresh_token"
+// @Success 200 {object} service.MCPOAuthTokenResponse
+// @Failure 400 {object} object
+// @Failure 401 {object} object
+// @Router /api/mcp_oauth/token [post]
+func MCPOAuthToken(c *gin.Context) {
+	clientID, clientSecret, ok := c.Request.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	var response *service.MCPOAuthTokenResponse
+	var err error
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		response, err = service.ExchangeMCPOAuthCode(clientID, clientSecret, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+	case "refresh_token":
+		response, err = service.RefreshMCPOAuthToken(clientID, clientSecret, c.PostForm("refresh_token"))
+	default:
+		err = &service.OAuthError{Code: "unsupported_grant_type"}
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		var oauthErr *service.OAuthError
+		if errors.As(err, &oauthErr) && oauthErr.Code == "invalid_client" {
+			status = http.StatusUnauthorized
+		}
+		respOAuthError(c, status, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// ListMCPOAuthConsents godoc
+// @Summary List the MCP clients the current user granted access
+// @Tags MCP OAuth
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/mcp_oauth/consents [get]
+func ListMCPOAuthConsents(c *gin.Context) {
+	lang := c.GetString("lang")
+	consents, err := model.GetUserOAuthConsents(getUserIDFromContext(c))
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_consents_failed", lang), err)
+		return
+	}
+	result := make([]gin.H, 0, len(consents))
+	for _, consent := range consents {
+		clientName := ""
+		if client, err := model.GetOAuthClient(consent.ClientID); err == nil {
+			clientName = client.ClientName
+		}
+		result = append(result, gin.H{
+			"client_id":   consent.ClientID,
+			"client_name": clientName,
+			"scope":       consent.Scope,
+			"updated_at":  consent.UpdatedAt,
+		})
+	}
+	common.RespSuccess(c, result)
+}
+
+// RevokeMCPOAuthConsent godoc
+// @Summary Revoke the access of an MCP client
+// @Description Delete what the current user granted the client and the tokens issued to it
+// @Tags MCP OAuth
+// @Produce json
+// @Param client_id path string true "Client ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/mcp_oauth/consents/{client_id} [delete]
+func RevokeMCPOAuthConsent(c *gin.Context) {
+	lang := c.GetString("lang")
+	if err := model.DeleteOAuthConsent(getUserIDFromContext(c), c.Param("client_id")); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("revoke_consent_failed", lang), err)
+		return
+	}
+	common.RespSuccessStr(c, i18n.Translate("consent_revoked", lang))
+}
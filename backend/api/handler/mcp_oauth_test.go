@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"toWers/backend/api/middleware"
+	"toWers/backend/common"
+	"toWers/backend/model"
+	"toWers/backend/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupMCPOAuthRouter(userID int64) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/.well-known/oauth-protected-resource/*resource", GetProtectedResourceMetadata)
+	router.GET("/.well-known/oauth-authorization-server", GetAuthorizationServerMetadata)
+	router.POST("/api/mcp_oauth/register", RegisterMCPOAuthClient)
+	router.GET("/api/mcp_oauth/authorize", AuthorizeMCPOAuth)
+	router.POST("/api/mcp_oauth/token", MCPOAuthToken)
+	loggedIn := router.Group("/api/mcp_oauth", func(c *gin.Context) { c.Set("user_id", userID) })
+	loggedIn.GET("/requests/:id", GetMCPOAuthRequest)
+	loggedIn.POST("/requests/:id", DecideMCPOAuthRequest)
+	loggedIn.DELETE("/consents/:client_id", RevokeMCPOAuthConsent)
+	router.Any("/proxy/:serviceName/*action", middleware.TokenAuth(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetInt64("userID")})
+	})
+	return router
+}
+
+func serveJSON(t *testing.T, router *gin.Engine, req *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var body map[string]interface{}
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	}
+	return w, body
+}
+
+func tokenRequest(form url.Values) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/api/mcp_oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func proxyRequest(service, authorization string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/proxy/"+service+"/mcp", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return req
+}
+
+func TestMCPOAuth_AuthorizationCodeFlow(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+	common.OptionMap["ServerAddress"] = "https://towers.example.com"
+
+	user := &model.User{Username: "oauth-user", DisplayName: "OAuth User", Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+	require.NoError(t, model.UserDB.Save(user))
+	for _, name := range []string{"github", "notion"} {
+		require.NoError(t, model.CreateService(&model.MCPService{Name: name, DisplayName: name, Type: model.ServiceTypeSSE, Command: "http://localhost:1/sse", Enabled: true}))
+	}
+	router := setupMCPOAuthRouter(user.ID)
+
+	// Discovery from the challenge of an unauthenticated request
+	w, _ := serveJSON(t, router, proxyRequest("github", ""))
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `resource_metadata="https://towers.example.com/.well-known/oauth-protected-resource/proxy/github"`)
+	req, _ := http.NewRequest(http.MethodGet, "/.well-known/oauth-protected-resource/proxy/github/mcp", nil)
+	_, resource := serveJSON(t, router, req)
+	assert.Equal(t, []interface{}{"https://towers.example.com"}, resource["authorization_servers"])
+	assert.Equal(t, []interface{}{"mcp:github"}, resource["scopes_supported"])
+	req, _ = http.NewRequest(http.MethodGet, "/.well-known/oauth-authorization-server", nil)
+	_, metadata := serveJSON(t, router, req)
+	assert.Equal(t, "https://towers.example.com/api/mcp_oauth/token", metadata["token_endpoint"])
+
+	// Dynamic client registration of a public client
+	registration, _ := json.Marshal(map[string]interface{}{"client_name": "Editor", "redirect_uris": []string{"http://127.0.0.1:8765/callback"}, "token_endpoint_auth_method": "none"})
+	req, _ = http.NewRequest(http.MethodPost, "/api/mcp_oauth/register", bytes.NewReader(registration))
+	w, client := serveJSON(t, router, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	clientID := client["client_id"].(string)
+	assert.Nil(t, client["client_secret"])
+	registration, _ = json.Marshal(map[string]interface{}{"redirect_uris": []string{"http://evil.example.com/callback"}})
+	req, _ = http.NewRequest(http.MethodPost, "/api/mcp_oauth/register", bytes.NewReader(registration))
+	w, _ = serveJSON(t, router, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "plain http redirect URIs are only allowed on loopback")
+
+	// Authorization request, sent to the consent page
+	verifier := "a-code-verifier-long-enough-for-the-test-1234567890"
+	challenge := sha256.Sum256([]byte(verifier))
+	authorize := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {"http://127.0.0.1:8765/callback"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"scope":                 {"mcp:github"},
+		"state":                 {"xyz"},
+	}
+	req, _ = http.NewRequest(http.MethodGet, "/api/mcp_oauth/authorize?"+authorize.Encode(), nil)
+	w, _ = serveJSON(t, router, req)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	consentURL, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, mcpOAuthConsentPath, consentURL.Path)
+	requestID := consentURL.Query().Get("request_id")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/mcp_oauth/requests/"+requestID, nil)
+	w, pending := serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	data := pending["data"].(map[string]interface{})
+	assert.Equal(t, "Editor", data["request"].(map[string]interface{})["client_name"])
+	assert.Len(t, data["services"], 2)
+
+	decision, _ := json.Marshal(mcpOAuthDecision{Approve: true, Services: []string{"github"}})
+	req, _ = http.NewRequest(http.MethodPost, "/api/mcp_oauth/requests/"+requestID, bytes.NewReader(decision))
+	w, approved := serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	callback, err := url.Parse(approved["data"].(map[string]interface{})["redirect_url"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, "xyz", callback.Query().Get("state"))
+	code := callback.Query().Get("code")
+
+	// Code exchange, checked against the PKCE challenge
+	exchange := url.Values{"grant_type": {"authorization_code"}, "client_id": {clientID}, "code": {code}, "redirect_uri": {"http://127.0.0.1:8765/callback"}, "code_verifier": {"wrong-verifier"}}
+	w, failed := serveJSON(t, router, tokenRequest(exchange))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", failed["error"])
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	// A failed exchange consumed the code, go through consent again
+	req, _ = http.NewRequest(http.MethodGet, "/api/mcp_oauth/authorize?"+authorize.Encode(), nil)
+	w, _ = serveJSON(t, router, req)
+	consentURL, _ = url.Parse(w.Header().Get("Location"))
+	req, _ = http.NewRequest(http.MethodPost, "/api/mcp_oauth/requests/"+consentURL.Query().Get("request_id"), bytes.NewReader(decision))
+	_, approved = serveJSON(t, router, req)
+	callback, _ = url.Parse(approved["data"].(map[string]interface{})["redirect_url"].(string))
+	exchange.Set("code", callback.Query().Get("code"))
+	exchange.Set("code_verifier", verifier)
+	w, tokens := serveJSON(t, router, tokenRequest(exchange))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	accessToken := tokens["access_token"].(string)
+	refreshToken := tokens["refresh_token"].(string)
+	assert.True(t, strings.HasPrefix(accessToken, service.MCPOAuthAccessTokenPrefix))
+	assert.Equal(t, "mcp:github", tokens["scope"])
+
+	// The access token only opens the consented service
+	w, proxied := serveJSON(t, router, proxyRequest("github", "Bearer "+accessToken))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.EqualValues(t, user.ID, proxied["user_id"])
+	w, _ = serveJSON(t, router, proxyRequest("notion", "Bearer "+accessToken))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+	w, _ = serveJSON(t, router, proxyRequest("github", "Bearer "+service.MCPOAuthAccessTokenPrefix+"unknown"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+
+	// Refresh rotates both tokens
+	refresh := url.Values{"grant_type": {"refresh_token"}, "client_id": {clientID}, "refresh_token": {refreshToken}}
+	w, refreshed := serveJSON(t, router, tokenRequest(refresh))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotEqual(t, accessToken, refreshed["access_token"])
+	w, _ = serveJSON(t, router, proxyRequest("github", "Bearer "+accessToken))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the previous access token is replaced")
+	w, _ = serveJSON(t, router, tokenRequest(refresh))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the previous refresh token is replaced")
+	w, _ = serveJSON(t, router, proxyRequest("github", "Bearer "+refreshed["access_token"].(string)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Revoking the consent revokes the tokens
+	req, _ = http.NewRequest(http.MethodDelete, "/api/mcp_oauth/consents/"+clientID, nil)
+	w, _ = serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w, _ = serveJSON(t, router, proxyRequest("github", "Bearer "+refreshed["access_token"].(string)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	refresh.Set("refresh_token", refreshed["refresh_token"].(string))
+	w, _ = serveJSON(t, router, tokenRequest(refresh))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMCPOAuth_UserTokenAuthCanBeDisabled(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+	user := &model.User{Username: "token-user", DisplayName: "Token User", Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+	require.NoError(t, model.UserDB.Save(user))
+	_, apiToken, err := model.CreateAPIToken(user.ID, "cli", nil, false, 0)
+	require.NoError(t, err)
+	router := setupMCPOAuthRouter(user.ID)
+
+	req, _ := http.NewRequest(http.MethodGet, "/proxy/github/sse?key="+apiToken, nil)
+	_, proxied := serveJSON(t, router, req)
+	assert.EqualValues(t, user.ID, proxied["user_id"])
+
+	common.OptionMap["ProxyUserTokenAuthEnabled"] = "false"
+	_, proxied = serveJSON(t, router, req)
+	assert.EqualValues(t, 0, proxied["user_id"])
+	_, proxied = serveJSON(t, router, proxyRequest("github", "Bearer "+apiToken))
+	assert.EqualValues(t, 0, proxied["user_id"])
+}
@@ -46,6 +46,7 @@ func UpdateMCPService(c *gin.Context) {
 	// 保存原始值用于比较
 	oldPackageManager := service.PackageManager
 	oldSourcePackageName := service.SourcePackageName
+	oldOAuthClientSecret := service.OAuthClientSecret
 	// Preserve original Command and ArgsJSON before binding, so we can see if user explicitly changed them
 	// or if our PackageManager logic should take precedence if they become empty after binding.
 	// However, the current logic is that PackageManager dictates Command/ArgsJSON if they are empty.
@@ -75,6 +76,66 @@ func UpdateMCPService(c *gin.Context) {
 		}
 	}
 
+	// 验证FilterJSON (如果提供)
+	if filter, err := service.GetCapabilityFilter(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_filter_json", lang), err)
+		return
+	} else if err := filter.Validate(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_filter_json", lang), err)
+		return
+	}
+
+	// 验证ToolOverridesJSON (如果提供)
+	if overrides, err := service.GetToolOverrides(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_tool_overrides_json", lang), err)
+		return
+	} else if err := model.ValidateToolOverrides(overrides); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_tool_overrides_json", lang), err)
+		return
+	}
+
+	// 验证超时、重试和熔断设置
+	if err := service.ValidateCallPolicy(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_call_policy", lang), err)
+		return
+	}
+
+	// 验证实例数量和空闲超时设置
+	if err := service.ValidateInstancePolicy(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_instance_policy", lang), err)
+		return
+	}
+
+	// 验证stdio工作进程池设置
+	if err := service.ValidateWorkerPool(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_worker_pool", lang), err)
+		return
+	}
+
+	// 验证自定义请求头及其 ${user.KEY} 占位符
+	if err := service.ValidateHeaders(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_headers_json", lang), err)
+		return
+	}
+
+	// 验证stdio进程的沙箱执行策略
+	if err := service.ValidateSandboxPolicy(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_sandbox_policy", lang), err)
+		return
+	}
+
+	// 验证上游OAuth设置，新填写的客户端密钥加密保存
+	if err := service.ValidateOAuth(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_oauth_settings", lang), err)
+		return
+	}
+	if service.OAuthClientSecret != oldOAuthClientSecret {
+		if err := service.SetOAuthClientSecret(service.OAuthClientSecret); err != nil {
+			common.RespError(c, http.StatusInternalServerError, i18n.Translate("update_service_failed", lang), err)
+			return
+		}
+	}
+
 	// 如果是marketplace服务（stdio类型且PackageManager不为空），验证相关字段
 	if service.Type == model.ServiceTypeStdio && service.PackageManager != "" {
 		if service.SourcePackageName == "" {
@@ -109,6 +170,8 @@ func UpdateMCPService(c *gin.Context) {
 		common.RespError(c, http.StatusInternalServerError, i18n.Translate("update_service_failed", lang), err)
 		return
 	}
+	// 滚动重启配置已变更的运行中实例，新会话使用新配置，旧会话结束后关闭旧实例
+	proxy.ReloadService(service)
 
 	jsonBytes, err := model.MCPServiceDB.ToJSON(service)
 	if err != nil {
@@ -152,6 +215,7 @@ func ToggleMCPService(c *gin.Context) {
 		common.RespError(c, http.StatusInternalServerError, i18n.Translate("toggle_service_status_failed", lang), err)
 		return
 	}
+	proxy.RefreshVirtualServersWithMember(id)
 
 	status := i18n.Translate("enabled", lang)
 	if !service.Enabled {
@@ -229,6 +293,75 @@ func CheckMCPServiceHealth(c *gin.Context) {
 	common.RespSuccess(c, healthData)
 }
 
+// GetMCPServiceLogs godoc
+// @Summary 获取stdio服务进程的stderr日志
+// @Description 返回服务各实例最近的stderr输出；follow=true 时以SSE持续推送新日志
+// @Tags MCP Services
+// @Produce json
+// @Param id path int true "服务ID"
+// @Param instance query string false "实例名称，为空时返回全部实例"
+// @Param lines query int false "返回的行数，默认200"
+// @Param follow query bool false "是否以SSE持续推送"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/logs [get]
+func GetMCPServiceLogs(c *gin.Context) {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_service_id", lang), err)
+		return
+	}
+	if _, err := model.GetServiceByID(id); err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("service_not_found", lang), err)
+		return
+	}
+	lines := 200
+	if linesStr := c.Query("lines"); linesStr != "" {
+		if lines, err = strconv.Atoi(linesStr); err != nil || lines < 0 {
+			common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_log_lines", lang))
+			return
+		}
+	}
+	instance := c.Query("instance")
+
+	if c.Query("follow") != "true" {
+		common.RespSuccess(c, gin.H{
+			"instances": proxy.ProcessLogInstances(id),
+			"lines":     proxy.TailProcessLogs(id, instance, lines),
+		})
+		return
+	}
+
+	// SSE 模式：先发送最近的日志，再持续推送新日志，直到客户端断开
+	tail, followed := proxy.FollowProcessLogs(c.Request.Context(), id, instance, lines)
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		common.RespErrorStr(c, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+	send := func(line proxy.ProcessLogLine) {
+		jsonData, err := json.Marshal(line)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: log\ndata: %s\n\n", jsonData)
+	}
+	for _, line := range tail {
+		send(line)
+	}
+	flusher.Flush()
+	for line := range followed {
+		send(line)
+		flusher.Flush()
+	}
+}
+
 // 辅助函数：验证服务类型
 func isValidServiceType(sType model.ServiceType) bool {
 	return sType == model.ServiceTypeStdio ||
@@ -3,8 +3,10 @@ package handler
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"toWers/backend/common"
 	"toWers/backend/library/proxy"
+	"toWers/backend/library/sandbox"
 	"toWers/backend/model"
 	"toWers/backend/service"
 
@@ -42,6 +44,22 @@ func UpdateOption(c *gin.Context) {
 	switch option.Key {
 	case "ServerAddress":
 		proxy.ClearSSEProxyCache()
+	case "MaxLiveInstances":
+		if limit, err := strconv.Atoi(option.Value); option.Value != "" && (err != nil || limit < 0) {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "MaxLiveInstances 必须是非负整数（0 表示不限制）",
+			})
+			return
+		}
+	case "EnvPassthrough":
+		if err := sandbox.ValidatePassthrough(common.ParseEnvPassthrough(option.Value)); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "EnvPassthrough 格式错误：" + err.Error(),
+			})
+			return
+		}
 	case "GitHubOAuthEnabled":
 		if option.Value == "true" && common.GetGitHubClientId() == "" {
 			c.JSON(http.StatusOK, gin.H{
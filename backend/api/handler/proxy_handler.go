@@ -50,75 +50,91 @@ func checkDailyRequestLimit(serviceID int64, userID int64, rpdLimit int) error {
 		return nil
 	}
 
-	// Get today's request count from cache
-	cacheClient := thing.Cache()
-	if cacheClient == nil {
-		common.SysError(fmt.Sprintf("[RPD] Cache client is nil for service %d, user %d", serviceID, userID))
-		// If cache is not available, allow the request to proceed (fail open)
-		return nil
-	}
-
 	today := time.Now().Format("2006-01-02")
 	// Use a different cache key for user-specific request counts (different from global service counts)
 	cacheKey := fmt.Sprintf("user_request:%s:%d:%d:count", today, serviceID, userID)
+	count := dailyRequestCount(cacheKey)
 
-	ctx := context.Background()
-	countStr, err := cacheClient.Get(ctx, cacheKey)
-	if err != nil {
-		// If key doesn't exist, count is 0
-		return nil
+	if count >= int64(rpdLimit) {
+		return fmt.Errorf("daily request limit exceeded: %d/%d requests used today", count, rpdLimit)
 	}
 
-	count, err := strconv.ParseInt(countStr, 10, 64)
+	return nil
+}
+
+// checkTeamRequestLimits checks if a team of the user has exceeded its daily request limit for the service
+func checkTeamRequestLimits(serviceID int64, userID int64) error {
+	teamIDs, err := model.GetUserTeamIDs(userID)
 	if err != nil {
-		common.SysError(fmt.Sprintf("[RPD] Failed to parse cache count value for user %d, service %d: %v", userID, serviceID, err))
-		// If parsing fails, allow the request to proceed (fail open)
+		common.SysError(fmt.Sprintf("[RPD] Failed to get teams of user %d: %v", userID, err))
+		// If teams cannot be loaded, allow the request to proceed (fail open)
 		return nil
 	}
-
-	if count >= int64(rpdLimit) {
-		return fmt.Errorf("daily request limit exceeded: %d/%d requests used today", count, rpdLimit)
+	today := time.Now().Format("2006-01-02")
+	for _, teamID := range teamIDs {
+		team, err := model.GetTeamByID(teamID)
+		if err != nil || team.RPDLimit <= 0 {
+			continue
+		}
+		count := dailyRequestCount(model.TeamRequestCountKey(today, serviceID, teamID))
+		if count >= int64(team.RPDLimit) {
+			return fmt.Errorf("daily request limit of team %s exceeded: %d/%d requests used today", team.Name, count, team.RPDLimit)
+		}
 	}
-
 	return nil
 }
 
-// tryGetOrCreateUserSpecificHandler attempts to find or create a handler tailored for a specific user.
-// proxyType should be "sseproxy" or "httpproxy"
-func tryGetOrCreateUserSpecificHandler(c *gin.Context, mcpDBService *model.MCPService, userID int64, proxyType string) (http.Handler, error) {
-
-	// Prepare user-specific environment variables
-	currentEnvMap := make(map[string]string)
-	// Populate currentEnvMap from DefaultEnvsJSON first
-	if mcpDBService.DefaultEnvsJSON != "" && mcpDBService.DefaultEnvsJSON != "{}" {
-		if err := json.Unmarshal([]byte(mcpDBService.DefaultEnvsJSON), &currentEnvMap); err != nil {
-			common.SysError(fmt.Sprintf("[ProxyHandler] Error unmarshalling DefaultEnvsJSON for %s (user-specific): %v", mcpDBService.Name, err))
-			currentEnvMap = make(map[string]string)
-		}
+// checkRequestLimits checks the daily request limits (RPD) of the user and of their teams for the
+// service. Service accounts may have a limit of their own, replacing the service's.
+func checkRequestLimits(svc *model.MCPService, user *model.User) error {
+	rpdLimit := svc.RPDLimit
+	if user.IsServiceAccount && user.RPDLimit > 0 {
+		rpdLimit = user.RPDLimit
+	}
+	if err := checkDailyRequestLimit(svc.ID, user.ID, rpdLimit); err != nil {
+		common.SysLog(fmt.Sprintf("[RPD] User %d exceeded limit for %s: %v", user.ID, svc.Name, err))
+		return err
 	}
+	// Teams may share a daily request limit across their members
+	if err := checkTeamRequestLimits(svc.ID, user.ID); err != nil {
+		common.SysLog(fmt.Sprintf("[RPD] Team of user %d exceeded limit for %s: %v", user.ID, svc.Name, err))
+		return err
+	}
+	return nil
+}
 
-	// Fetch and merge user-specific ENVs
-	userEnvs, userEnvErr := model.GetUserSpecificEnvs(userID, mcpDBService.ID)
-	if userEnvErr != nil {
-		common.SysError(fmt.Sprintf("[ProxyHandler] Error fetching user-specific ENVs for user %d, service %s: %v", userID, mcpDBService.Name, userEnvErr))
+// dailyRequestCount reads a daily request count from cache. Counts that cannot be read are 0, so
+// limits fail open when the cache is unavailable.
+func dailyRequestCount(cacheKey string) int64 {
+	cacheClient := thing.Cache()
+	if cacheClient == nil {
+		common.SysError(fmt.Sprintf("[RPD] Cache client is nil reading %s", cacheKey))
+		return 0
 	}
 
-	if len(userEnvs) > 0 {
-		for k, v := range userEnvs {
-			currentEnvMap[k] = v // User-specific ENVs override DefaultEnvsJSON
-		}
+	countStr, err := cacheClient.Get(context.Background(), cacheKey)
+	if err != nil {
+		// If key doesn't exist, count is 0
+		return 0
 	}
 
-	// Marshal the merged env map back to JSON
-	mergedEnvsJSONBytes, marshalErr := json.Marshal(currentEnvMap)
-	if marshalErr != nil {
-		common.SysError(fmt.Sprintf("[ProxyHandler] Error marshalling merged ENVs for user %d, service %s: %v. Proceeding with original DefaultEnvsJSON.", userID, mcpDBService.Name, marshalErr))
-		mergedEnvsJSONBytes = []byte(mcpDBService.DefaultEnvsJSON)
+	count, err := strconv.ParseInt(countStr, 10, 64)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[RPD] Failed to parse cache count value of %s: %v", cacheKey, err))
+		return 0
 	}
-	mergedEnvsJSON := string(mergedEnvsJSONBytes)
+	return count
+}
+
+// tryGetOrCreateUserSpecificHandler attempts to find or create a handler tailored for a specific user.
+// proxyType should be "sseproxy" or "httpproxy"
+func tryGetOrCreateUserSpecificHandler(c *gin.Context, mcpDBService *model.MCPService, userID int64, proxyType string) (http.Handler, error) {
 
-	// Create user-specific shared MCP instance
-	ctx := c.Request.Context()
+	// User-specific ENVs override DefaultEnvsJSON
+	mergedEnvsJSON := proxy.UserEnvsJSON(mcpDBService, userID)
+
+	// Create user-specific shared MCP instance. It outlives this request, so it must not end with it.
+	ctx := context.WithoutCancel(c.Request.Context())
 	userSharedCacheKey := fmt.Sprintf("user-%d-service-%d-shared", userID, mcpDBService.ID)
 	instanceNameDetail := fmt.Sprintf("user-%d-shared-svc-%d", userID, mcpDBService.ID)
 
@@ -150,8 +166,9 @@ func tryGetOrCreateUserSpecificHandler(c *gin.Context, mcpDBService *model.MCPSe
 // proxyType should be "sseproxy" or "httpproxy"
 func tryGetOrCreateGlobalHandler(c *gin.Context, mcpDBService *model.MCPService, proxyType string) (http.Handler, error) {
 
-	// Use unified global cache key and standardized parameters (same as ServiceFactory)
-	ctx := c.Request.Context()
+	// Use unified global cache key and standardized parameters (same as ServiceFactory).
+	// The instance outlives this request, so it must not end with it.
+	ctx := context.WithoutCancel(c.Request.Context())
 	globalSharedCacheKey := fmt.Sprintf("global-service-%d-shared", mcpDBService.ID)
 	instanceNameDetail := fmt.Sprintf("global-shared-svc-%d", mcpDBService.ID)
 	effectiveEnvs := mcpDBService.DefaultEnvsJSON
@@ -189,11 +206,20 @@ func ProxyHandler(c *gin.Context) {
 
 	// Only log if there's a query string for debugging
 	if c.Request.URL.RawQuery != "" {
-		common.SysLog(fmt.Sprintf("[ProxyHandler] %s %s?%s", requestMethod, requestPath, c.Request.URL.RawQuery))
+		query := c.Request.URL.Query()
+		if query.Has("key") {
+			query.Set("key", "REDACTED") // Long-lived user token
+		}
+		common.SysLog(fmt.Sprintf("[ProxyHandler] %s %s?%s", requestMethod, requestPath, query.Encode()))
 	}
 
 	mcpDBService, err := model.GetServiceByName(serviceName)
 	if err != nil || mcpDBService == nil {
+		// Virtual servers share the /proxy/:serviceName namespace with regular services
+		if vs, vsErr := model.GetVirtualServerByName(serviceName); vsErr == nil && vs != nil {
+			serveVirtualServer(c, vs, action)
+			return
+		}
 		common.SysError(fmt.Sprintf("[ProxyHandler] Service not found: %s, error: %v", serviceName, err))
 		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Service not found: " + serviceName})
 		return
@@ -226,20 +252,32 @@ func ProxyHandler(c *gin.Context) {
 		return
 	}
 
-	// Check daily request limit (RPD) if user is authenticated and limit is set
-	if userID > 0 && mcpDBService.RPDLimit > 0 {
-		if rpdErr := checkDailyRequestLimit(mcpDBService.ID, userID, mcpDBService.RPDLimit); rpdErr != nil {
-			common.SysLog(fmt.Sprintf("[RPD] User %d exceeded limit for %s: %v", userID, serviceName, rpdErr))
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"success":    false,
-				"message":    rpdErr.Error(),
-				"error_code": "DAILY_LIMIT_EXCEEDED",
-			})
-			return
-		}
+	// Enforce service-level access (AdminOnly and per-user/per-role permissions). Tool, prompt and
+	// resource level access is enforced inside the proxied MCP server through the request context.
+	user, resolver, ok := resolveProxyAccess(c, userID)
+	if !ok {
+		return
+	}
+	if _, allowed := resolver(mcpDBService.ID); !allowed {
+		common.SysLog(fmt.Sprintf("WARN: [ProxyHandler] Access denied: user %d to service %s", userID, serviceName))
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Access denied to service: " + serviceName})
+		return
+	}
+	c.Request = c.Request.WithContext(proxy.WithAccessResolver(c.Request.Context(), resolver))
+
+	if rpdErr := checkRequestLimits(mcpDBService, user); rpdErr != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"success":    false,
+			"message":    rpdErr.Error(),
+			"error_code": "DAILY_LIMIT_EXCEEDED",
+		})
+		return
 	}
 
-	if userID > 0 && mcpDBService.AllowUserOverride && mcpDBService.Type == model.ServiceTypeStdio {
+	// Users get instances of their own for stdio services, which run with their environment, for
+	// remote services whose headers take values from their configuration, and for remote services
+	// they authorize with OAuth themselves
+	if userID > 0 && mcpDBService.HasUserInstances() {
 		// Determine proxy type based on action (SSE vs Streamable endpoint routing)
 		proxyType := "sseproxy" // default to SSE
 		if action == "/mcp" {
@@ -248,6 +286,16 @@ func ProxyHandler(c *gin.Context) {
 		// Note: Both /sse and /message are SSE type endpoints and use sseproxy
 
 		targetHandler, handlerErr = tryGetOrCreateUserSpecificHandler(c, mcpDBService, userID, proxyType)
+		if handlerErr != nil && mcpDBService.OAuthEnabled && mcpDBService.OAuthPerUser {
+			// The global instance holds no token of this user, there is nothing to fall back to
+			common.SysLog(fmt.Sprintf("WARN: [ProxyHandler] User %d has not authorized %s: %v", userID, serviceName, handlerErr))
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success":    false,
+				"message":    "Authorize " + serviceName + " in toWers before using it",
+				"error_code": "OAUTH_AUTHORIZATION_REQUIRED",
+			})
+			return
+		}
 		if handlerErr != nil {
 			common.SysError(fmt.Sprintf("[ProxyHandler] User-specific handler failed for %s (user %d), fallback to global: %v", serviceName, userID, handlerErr))
 			// Clear handlerErr so global fallback logic doesn't use this error message if global succeeds
@@ -352,3 +400,84 @@ func ProxyHandler(c *gin.Context) {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": finalErrMsg})
 	}
 }
+
+// serveVirtualServer handles proxy requests addressed to a virtual server composed of several services.
+func serveVirtualServer(c *gin.Context, vs *model.VirtualServer, action string) {
+	if !vs.Enabled {
+		common.SysLog(fmt.Sprintf("WARN: [ProxyHandler] Virtual server not enabled: %s", vs.Name))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "Service not enabled: " + vs.Name})
+		return
+	}
+
+	var userID int64
+	if idVal, exists := c.Get("userID"); exists {
+		if parsedID, parseErr := parseInt64(idVal); parseErr == nil {
+			userID = parsedID
+		}
+	}
+	if userID == 0 {
+		common.SysLog(fmt.Sprintf("WARN: [ProxyHandler] Unauthorized access: userID not found or invalid for virtual server %s", vs.Name))
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Authentication required. Please provide a valid user ID."})
+		return
+	}
+
+	// Access to each member is checked inside the composed server; members the user cannot use are hidden
+	user, resolver, ok := resolveProxyAccess(c, userID)
+	if !ok {
+		return
+	}
+	proxyType, requestType := "sseproxy", model.ProxyRequestTypeSSE
+	if action == "/mcp" {
+		proxyType, requestType = "httpproxy", model.ProxyRequestTypeHTTP
+	}
+	ctx := proxy.WithAccessResolver(c.Request.Context(), resolver)
+	ctx = proxy.WithMemberCallTracker(ctx, memberCallTracker(user, requestType, c.Request.URL.Path))
+	c.Request = c.Request.WithContext(ctx)
+
+	targetHandler, err := proxy.GetOrCreateVirtualProxyHandler(c.Request.Context(), vs, proxyType)
+	if err != nil {
+		finalErrMsg := fmt.Sprintf("Service handler unavailable for %s: %s", vs.Name, err.Error())
+		common.SysError(fmt.Sprintf("[ProxyHandler] Error: %s", finalErrMsg))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": finalErrMsg})
+		return
+	}
+	targetHandler.ServeHTTP(c.Writer, c.Request)
+}
+
+// memberCallTracker applies the daily request limits of user to the member services of a virtual
+// server and records their tool calls, as ProxyHandler does for the calls made to a service directly
+func memberCallTracker(user *model.User, requestType model.ProxyRequestType, requestPath string) proxy.MemberCallTracker {
+	return func(serviceID int64) (func(error), error) {
+		svc, err := model.GetServiceByID(serviceID)
+		if err != nil || svc == nil {
+			return nil, fmt.Errorf("service %d not found", serviceID)
+		}
+		if err := checkRequestLimits(svc, user); err != nil {
+			return nil, err
+		}
+		startTime := time.Now()
+		return func(callErr error) {
+			statusCode := http.StatusOK
+			if callErr != nil {
+				statusCode = http.StatusBadGateway
+			}
+			go model.RecordRequestStat(svc.ID, svc.Name, user.ID, requestType, "tools/call", requestPath, time.Since(startTime).Milliseconds(), statusCode, callErr == nil)
+		}, nil
+	}
+}
+
+// resolveProxyAccess loads the authenticated user and builds their access resolver, limiting the
+// request to read-only tools if it was authenticated with a read-only API token.
+// It writes an error response and returns false if the user cannot be loaded.
+func resolveProxyAccess(c *gin.Context, userID int64) (*model.User, proxy.AccessResolver, bool) {
+	user, err := model.GetUserById(userID, false)
+	if err != nil || user == nil {
+		common.SysLog(fmt.Sprintf("WARN: [ProxyHandler] Unauthorized access: user %d not found: %v", userID, err))
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Authentication required. Please provide a valid user ID."})
+		return nil, nil, false
+	}
+	if c.GetBool("readOnly") {
+		c.Request = c.Request.WithContext(proxy.WithReadOnly(c.Request.Context()))
+	}
+	return user, proxy.NewUserAccessResolver(user), true
+}
@@ -369,7 +369,10 @@ func TestTryGetOrCreateUserSpecificHandler_ProxyTypeParameter(t *testing.T) {
 	// Test user-specific SSE endpoint
 	w1 := httptest.NewRecorder()
 	req1, _ := http.NewRequest("GET", "/proxy/"+serviceName+"/sse", nil)
-	router.ServeHTTP(w1, req1.WithContext(ctx))
+	// The SSE stream stays open until the client goes away
+	sseCtx, sseCancel := context.WithTimeout(ctx, time.Second)
+	defer sseCancel()
+	router.ServeHTTP(w1, req1.WithContext(sseCtx))
 
 	// Should attempt user-specific handler for SSE
 	// Focus on verifying that the service was found and processing attempted
@@ -895,3 +898,46 @@ func TestProxyHandler_CacheConsistency(t *testing.T) {
 		// 404s are OK if they come from the handlers themselves, not the service lookup
 	}
 }
+
+// TestProxyHandler_AccessControl verifies AdminOnly and per-user service permissions on the proxy path
+func TestProxyHandler_AccessControl(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	contractor := &model.User{Username: "contractor", DisplayName: "Contractor", Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+	assert.NoError(t, model.UserDB.Save(contractor))
+
+	adminOnly := &model.MCPService{Name: "admin-only-svc", DisplayName: "Admin Only", Type: model.ServiceTypeSSE, Command: "http://localhost:1/sse", Enabled: true, AdminOnly: true}
+	assert.NoError(t, model.CreateService(adminOnly))
+	restricted := &model.MCPService{Name: "restricted-svc", DisplayName: "Restricted", Type: model.ServiceTypeSSE, Command: "http://localhost:1/sse", Enabled: true}
+	assert.NoError(t, model.CreateService(restricted))
+	assert.NoError(t, model.SaveServicePermission(&model.ServicePermission{ServiceID: restricted.ID, SubjectType: model.PermissionSubjectRole, SubjectID: common.RoleAdminUser}))
+
+	originalGetOrCreate := proxy.GetOrCreateSharedMcpInstanceWithKey
+	proxy.GetOrCreateSharedMcpInstanceWithKey = func(ctx context.Context, originalDbService *model.MCPService, cacheKey string, instanceNameDetail string, effectiveEnvsJSONForStdio string) (*proxy.SharedMcpInstance, error) {
+		return nil, fmt.Errorf("should not be reached")
+	}
+	defer func() { proxy.GetOrCreateSharedMcpInstanceWithKey = originalGetOrCreate }()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("userID", contractor.ID)
+		c.Next()
+	})
+	router.GET("/proxy/:serviceName/*action", ProxyHandler)
+
+	for _, name := range []string{adminOnly.Name, restricted.Name} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/proxy/"+name+"/sse", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, name)
+	}
+
+	// A user-specific grant opens the restricted service
+	assert.NoError(t, model.SaveServicePermission(&model.ServicePermission{ServiceID: restricted.ID, SubjectType: model.PermissionSubjectUser, SubjectID: contractor.ID}))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/proxy/"+restricted.Name+"/sse", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "access granted, handler creation fails in the mock")
+}
@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// customRoleRequest is the body of CreateCustomRole and UpdateCustomRole
+type customRoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// customRoleResponse describes a custom role with its permissions as a list
+func customRoleResponse(role *model.CustomRole) gin.H {
+	return gin.H{
+		"id":          role.ID,
+		"name":        role.Name,
+		"description": role.Description,
+		"permissions": role.GetPermissions(),
+		"created_at":  role.CreatedAt,
+		"updated_at":  role.UpdatedAt,
+	}
+}
+
+// hasPermission reports whether the current user has the permission
+func hasPermission(c *gin.Context, permission string) bool {
+	user := currentUser(c)
+	return user != nil && user.HasPermission(permission)
+}
+
+// currentUser returns the current user, or nil if they do not exist
+func currentUser(c *gin.Context) *model.User {
+	user, err := model.GetUserById(getUserIDFromContext(c), false)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// canManageUser reports whether the current user may manage target. Besides user.manage they
+// need every permission target has and more, so nobody acts on a peer or on a user with rights
+// they lack themselves.
+func canManageUser(c *gin.Context, target *model.User) bool {
+	user := currentUser(c)
+	return user != nil && user.HasPermission(model.PermissionUserManage) && user.OutranksPermissions(target.GetPermissions())
+}
+
+// canGrantRole reports whether the current user may give the built-in role level to a user
+func canGrantRole(c *gin.Context, role int) bool {
+	user := currentUser(c)
+	return user != nil && user.CanGrantRole(role)
+}
+
+// GetSelfPermissions godoc
+// @Summary List the permissions of the current user
+// @Description List the permissions granted by the built-in role and the custom role of the current user
+// @Tags Roles
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/self/permissions [get]
+func GetSelfPermissions(c *gin.Context) {
+	lang := c.GetString("lang")
+	user, err := model.GetUserById(getUserIDFromContext(c), false)
+	if err != nil || user == nil {
+		common.RespErrorStr(c, http.StatusUnauthorized, i18n.Translate("user_not_found", lang))
+		return
+	}
+	common.RespSuccess(c, user.GetPermissions())
+}
+
+// ListPermissions godoc
+// @Summary List permissions
+// @Description List every permission custom roles can grant
+// @Tags Roles
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/roles/permissions [get]
+func ListPermissions(c *gin.Context) {
+	common.RespSuccess(c, model.AllPermissions)
+}
+
+// ListCustomRoles godoc
+// @Summary List custom roles
+// @Tags Roles
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/roles [get]
+func ListCustomRoles(c *gin.Context) {
+	lang := c.GetString("lang")
+	roles, err := model.GetAllCustomRoles()
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_custom_roles_failed", lang), err)
+		return
+	}
+	result := make([]gin.H, 0, len(roles))
+	for _, role := range roles {
+		result = append(result, customRoleResponse(role))
+	}
+	common.RespSuccess(c, result)
+}
+
+// CreateCustomRole godoc
+// @Summary Create a custom role
+// @Description Create a named set of permissions to assign to users on top of their built-in role. Callers only grant permissions they have.
+// @Tags Roles
+// @Accept json
+// @Produce json
+// @Param body body customRoleRequest true "Name, description and permissions"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/roles [post]
+func CreateCustomRole(c *gin.Context) {
+	lang := c.GetString("lang")
+	var req customRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("custom_role_name_required", lang))
+		return
+	}
+	if _, err := model.GetCustomRoleByName(req.Name); err == nil {
+		common.RespErrorStr(c, http.StatusConflict, i18n.Translate("custom_role_name_taken", lang))
+		return
+	}
+	saveCustomRole(c, &model.CustomRole{Name: req.Name}, req)
+}
+
+// UpdateCustomRole godoc
+// @Summary Update a custom role
+// @Description Update the description and permissions of a custom role. Its users get the new permissions immediately. Callers only edit roles whose old and new permissions they have.
+// @Tags Roles
+// @Accept json
+// @Produce json
+// @Param id path int true "Role ID"
+// @Param body body customRoleRequest true "Description and permissions"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/roles/{id} [put]
+func UpdateCustomRole(c *gin.Context) {
+	lang := c.GetString("lang")
+	role := loadCustomRole(c)
+	if role == nil {
+		return
+	}
+	var req customRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	saveCustomRole(c, role, req)
+}
+
+// saveCustomRole validates the permissions of the request, saves them with the description on
+// role and responds with it. The current user must have every permission the role grants, before
+// and after the change.
+func saveCustomRole(c *gin.Context, role *model.CustomRole, req customRoleRequest) {
+	lang := c.GetString("lang")
+	for _, permission := range req.Permissions {
+		if !model.IsValidPermission(permission) {
+			common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_permission", lang)+": "+permission)
+			return
+		}
+	}
+	caller := currentUser(c)
+	if caller == nil || !caller.HasAllPermissions(req.Permissions) || !caller.HasAllPermissions(role.GetPermissions()) {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("no_permission_edit_custom_role", lang))
+		return
+	}
+	role.Description = req.Description
+	if err := role.SetPermissions(req.Permissions); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	if err := model.SaveCustomRole(role); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_custom_role_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, customRoleResponse(role))
+}
+
+// DeleteCustomRole godoc
+// @Summary Delete a custom role
+// @Description Delete a custom role. Its users keep their built-in role only.
+// @Tags Roles
+// @Produce json
+// @Param id path int true "Role ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/roles/{id} [delete]
+func DeleteCustomRole(c *gin.Context) {
+	lang := c.GetString("lang")
+	role := loadCustomRole(c)
+	if role == nil {
+		return
+	}
+	if err := model.DeleteCustomRole(role); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("delete_custom_role_failed", lang), err)
+		return
+	}
+	common.SysLog("[RBAC] Deleted custom role " + role.Name)
+	common.RespSuccessStr(c, i18n.Translate("custom_role_deleted", lang))
+}
+
+// AssignCustomRole godoc
+// @Summary Assign a custom role to a user
+// @Description Set the custom role of a user, or remove it with role_id 0. Callers only assign roles whose permissions they have, to users with fewer permissions than theirs.
+// @Tags Roles
+// @Accept json
+// @Produce json
+// @Param user_id path int true "User ID"
+// @Param body body map[string]interface{} true "role_id"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/roles/users/{user_id} [put]
+func AssignCustomRole(c *gin.Context) {
+	lang := c.GetString("lang")
+	userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang), err)
+		return
+	}
+	var req struct {
+		RoleID int64 `json:"role_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	user, err := model.GetUserById(userID, false)
+	if err != nil || user == nil {
+		common.RespErrorStr(c, http.StatusNotFound, i18n.Translate("user_not_found", lang))
+		return
+	}
+	caller := currentUser(c)
+	if caller == nil || !caller.OutranksPermissions(user.GetPermissions()) {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("no_permission_manage_user_with_more_permissions", lang))
+		return
+	}
+	if req.RoleID != 0 {
+		role, err := model.GetCustomRoleByID(req.RoleID)
+		if errors.Is(err, model.ErrCustomRoleNotFound) {
+			common.RespError(c, http.StatusBadRequest, i18n.Translate("custom_role_not_found", lang), err)
+			return
+		}
+		if !caller.HasAllPermissions(role.GetPermissions()) {
+			common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("no_permission_assign_custom_role", lang))
+			return
+		}
+	}
+	user.CustomRoleID = req.RoleID
+	if err := user.Update(false); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("assign_custom_role_failed", lang), err)
+		return
+	}
+	common.SysLog("[RBAC] Set custom role of user " + user.Username + " to " + strconv.FormatInt(req.RoleID, 10))
+	common.RespSuccess(c, gin.H{"user_id": user.ID, "custom_role_id": user.CustomRoleID, "permissions": user.GetPermissions()})
+}
+
+// loadCustomRole loads the custom role of the id path parameter. It writes an error response and
+// returns nil if it does not exist.
+func loadCustomRole(c *gin.Context) *model.CustomRole {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang), err)
+		return nil
+	}
+	role, err := model.GetCustomRoleByID(id)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("custom_role_not_found", lang), err)
+		return nil
+	}
+	return role
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"toWers/backend/api/middleware"
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRoleRouter(userID int64) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api", func(c *gin.Context) {
+		c.Set("user_id", userID)
+	})
+	api.GET("/user/self/permissions", GetSelfPermissions)
+	roles := api.Group("/roles", middleware.RequirePermission(model.PermissionRoleManage))
+	roles.POST("", CreateCustomRole)
+	roles.PUT("/:id", UpdateCustomRole)
+	roles.DELETE("/:id", DeleteCustomRole)
+	roles.PUT("/users/:user_id", AssignCustomRole)
+	ok := func(c *gin.Context) { common.RespSuccess(c, nil) }
+	api.POST("/mcp_instances/:key/restart", middleware.RequirePermission(model.PermissionServiceRestart), ok)
+	api.POST("/user/", middleware.RequirePermission(model.PermissionUserManage), ok)
+	api.PUT("/option/", middleware.RequirePermission(model.PermissionOptionEdit), ok)
+	return router
+}
+
+func TestRBAC_CustomRolesGrantPermissions(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	newUser := func(username string, role int) *model.User {
+		user := &model.User{Username: username, DisplayName: username, Role: role, Status: common.UserStatusEnabled}
+		require.NoError(t, model.UserDB.Save(user))
+		return user
+	}
+	root := newUser("root-user", common.RoleRootUser)
+	admin := newUser("admin", common.RoleAdminUser)
+	operator := newUser("operator", common.RoleCommonUser)
+	rootRouter := setupRoleRouter(root.ID)
+	opsRouter := setupRoleRouter(operator.ID)
+	status := func(router *gin.Engine, method, path string) int {
+		w, _ := serveJSON(t, router, jsonRequest(method, path, gin.H{}))
+		return w.Code
+	}
+
+	// Built-in roles keep their previous rights
+	assert.Equal(t, http.StatusOK, status(rootRouter, http.MethodPut, "/api/option/"))
+	assert.Equal(t, http.StatusOK, status(setupRoleRouter(admin.ID), http.MethodPost, "/api/user/"))
+	assert.Equal(t, http.StatusForbidden, status(setupRoleRouter(admin.ID), http.MethodPut, "/api/option/"))
+	assert.Equal(t, http.StatusForbidden, status(setupRoleRouter(admin.ID), http.MethodPost, "/api/roles"))
+	assert.Equal(t, http.StatusForbidden, status(opsRouter, http.MethodPost, "/api/mcp_instances/stdio-1/restart"))
+
+	// An ops role restarts services without managing users
+	w, _ := serveJSON(t, rootRouter, jsonRequest(http.MethodPost, "/api/roles", gin.H{"name": "ops", "permissions": []string{"service.bogus"}}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, body := serveJSON(t, rootRouter, jsonRequest(http.MethodPost, "/api/roles", gin.H{"name": "ops", "permissions": []string{model.PermissionServiceRestart, model.PermissionServiceViewLogs}}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	rolePath := fmt.Sprintf("/api/roles/%v", body["data"].(map[string]interface{})["id"])
+	w, _ = serveJSON(t, rootRouter, jsonRequest(http.MethodPost, "/api/roles", gin.H{"name": "ops"}))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w, _ = serveJSON(t, rootRouter, jsonRequest(http.MethodPut, fmt.Sprintf("/api/roles/users/%d", operator.ID), gin.H{"role_id": body["data"].(map[string]interface{})["id"]}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, http.StatusOK, status(opsRouter, http.MethodPost, "/api/mcp_instances/stdio-1/restart"))
+	assert.Equal(t, http.StatusForbidden, status(opsRouter, http.MethodPost, "/api/user/"))
+	req, _ := http.NewRequest(http.MethodGet, "/api/user/self/permissions", nil)
+	_, body = serveJSON(t, opsRouter, req)
+	assert.ElementsMatch(t, []interface{}{model.PermissionServiceRestart, model.PermissionServiceViewLogs}, body["data"])
+
+	// Changes to the role apply immediately, and deleting it revokes them
+	w, _ = serveJSON(t, rootRouter, jsonRequest(http.MethodPut, rolePath, gin.H{"permissions": []string{model.PermissionUserManage}}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusOK, status(opsRouter, http.MethodPost, "/api/user/"))
+	assert.Equal(t, http.StatusForbidden, status(opsRouter, http.MethodPost, "/api/mcp_instances/stdio-1/restart"))
+
+	req, _ = http.NewRequest(http.MethodDelete, rolePath, nil)
+	w, _ = serveJSON(t, rootRouter, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, status(opsRouter, http.MethodPost, "/api/user/"))
+	operator, err := model.GetUserById(operator.ID, false)
+	require.NoError(t, err)
+	assert.Zero(t, operator.CustomRoleID)
+}
+
+func TestRBAC_NoEscalation(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	newUser := func(username string, role int) *model.User {
+		user := &model.User{Username: username, DisplayName: username, Role: role, Status: common.UserStatusEnabled}
+		require.NoError(t, model.UserDB.Save(user))
+		return user
+	}
+	newRole := func(name string, permissions ...string) *model.CustomRole {
+		role := &model.CustomRole{Name: name}
+		require.NoError(t, role.SetPermissions(permissions))
+		require.NoError(t, model.SaveCustomRole(role))
+		return role
+	}
+	root := newUser("root-user", common.RoleRootUser)
+	admin := newUser("admin", common.RoleAdminUser)
+	hr := newUser("hr", common.RoleCommonUser)
+	dev := newUser("dev", common.RoleCommonUser)
+	hrRole := newRole("hr", model.PermissionUserManage, model.PermissionRoleManage)
+	editorRole := newRole("editor", model.PermissionServiceEdit)
+	hr.CustomRoleID = hrRole.ID
+	require.NoError(t, model.UserDB.Save(hr))
+
+	userRouter := func(userID int64) *gin.Engine {
+		router := gin.New()
+		api := router.Group("/api/user", func(c *gin.Context) {
+			c.Set("user_id", userID)
+		})
+		api.GET("/:id", GetUser)
+		api.DELETE("/:id", DeleteUser)
+		return router
+	}
+	success := func(router *gin.Engine, method, path string) bool {
+		req, _ := http.NewRequest(method, path, nil)
+		_, body := serveJSON(t, router, req)
+		return body["success"] == true
+	}
+	assign := func(router *gin.Engine, user *model.User, role *model.CustomRole) int {
+		w, _ := serveJSON(t, router, jsonRequest(http.MethodPut, fmt.Sprintf("/api/roles/users/%d", user.ID), gin.H{"role_id": role.ID}))
+		return w.Code
+	}
+
+	// Users are managed only by those who have every permission they have
+	hrRouter := userRouter(hr.ID)
+	assert.True(t, success(hrRouter, http.MethodGet, fmt.Sprintf("/api/user/%d", dev.ID)))
+	assert.False(t, success(hrRouter, http.MethodGet, fmt.Sprintf("/api/user/%d", admin.ID)))
+	assert.False(t, success(userRouter(admin.ID), http.MethodDelete, fmt.Sprintf("/api/user/%d", root.ID)))
+	assert.False(t, success(userRouter(admin.ID), http.MethodGet, fmt.Sprintf("/api/user/%d", hr.ID)), "admins lack role.manage")
+	peer := newUser("peer-admin", common.RoleAdminUser)
+	assert.False(t, success(userRouter(admin.ID), http.MethodDelete, fmt.Sprintf("/api/user/%d", peer.ID)), "admins do not manage their peers")
+	assert.True(t, success(userRouter(root.ID), http.MethodGet, fmt.Sprintf("/api/user/%d", hr.ID)))
+
+	// Custom roles are assigned only if the caller has all their permissions
+	hrRolesRouter := setupRoleRouter(hr.ID)
+	assert.Equal(t, http.StatusForbidden, assign(hrRolesRouter, dev, editorRole))
+	assert.Equal(t, http.StatusForbidden, assign(hrRolesRouter, admin, hrRole))
+	assert.Equal(t, http.StatusOK, assign(hrRolesRouter, dev, hrRole))
+	assert.Equal(t, http.StatusOK, assign(setupRoleRouter(root.ID), dev, editorRole))
+
+	// Custom roles only grant permissions their editor has, including the ones they grant now
+	w, _ := serveJSON(t, hrRolesRouter, jsonRequest(http.MethodPut, fmt.Sprintf("/api/roles/%d", hrRole.ID), gin.H{"permissions": []string{model.PermissionUserManage, model.PermissionRoleManage, model.PermissionOptionEdit}}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w, _ = serveJSON(t, hrRolesRouter, jsonRequest(http.MethodPut, fmt.Sprintf("/api/roles/%d", editorRole.ID), gin.H{"permissions": []string{}}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w, _ = serveJSON(t, hrRolesRouter, jsonRequest(http.MethodPost, "/api/roles", gin.H{"name": "editor-2", "permissions": []string{model.PermissionServiceEdit}}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w, _ = serveJSON(t, hrRolesRouter, jsonRequest(http.MethodPost, "/api/roles", gin.H{"name": "recruiter", "permissions": []string{model.PermissionUserManage}}))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Service editors have full access to services like admins
+	svc := &model.MCPService{Name: "github", DisplayName: "GitHub", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true, AdminOnly: true}
+	require.NoError(t, model.CreateService(svc))
+	dev, err := model.GetUserById(dev.ID, false)
+	require.NoError(t, err)
+	_, allowed, err := model.ResolveServiceAccess(dev, svc)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	_, allowed, err = model.ResolveServiceAccess(hr, svc)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceAccountRequest is the body of CreateServiceAccount and UpdateServiceAccount
+type serviceAccountRequest struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Status      *int   `json:"status"`
+	RPDLimit    *int   `json:"rpd_limit"` // Daily request limit per service, 0 for the service's own
+}
+
+// canManageServiceAccount reports whether the current user manages account: admins of the team
+// owning it and users with the team.manage permission do, and users with the user.manage
+// permission manage those they own and those of owners they may manage as users
+func canManageServiceAccount(c *gin.Context, account *model.User) bool {
+	userID := getUserIDFromContext(c)
+	if account.OwnerTeamID != 0 && (model.IsTeamAdmin(account.OwnerTeamID, userID) || hasPermission(c, model.PermissionTeamManage)) {
+		return true
+	}
+	if !hasPermission(c, model.PermissionUserManage) {
+		return false
+	}
+	if account.OwnerID == userID {
+		return true
+	}
+	owner, err := model.GetUserById(account.OwnerID, false)
+	if err != nil || owner == nil {
+		return canManageUser(c, account)
+	}
+	return canManageUser(c, owner)
+}
+
+// loadServiceAccount loads the service account of the id path parameter if the current user
+// manages it. It writes an error response and returns nil otherwise.
+func loadServiceAccount(c *gin.Context) *model.User {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang), err)
+		return nil
+	}
+	account, err := model.GetServiceAccountByID(id)
+	if err != nil || !canManageServiceAccount(c, account) {
+		common.RespErrorStr(c, http.StatusNotFound, i18n.Translate("service_account_not_found", lang))
+		return nil
+	}
+	return account
+}
+
+// ListServiceAccounts godoc
+// @Summary List service accounts
+// @Description List the service accounts the current user manages: their own, those of users with fewer permissions and those of the teams they manage
+// @Tags Service Accounts
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts [get]
+func ListServiceAccounts(c *gin.Context) {
+	lang := c.GetString("lang")
+	accounts, err := model.GetServiceAccounts(0)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_service_accounts_failed", lang), err)
+		return
+	}
+	managed := make([]*model.User, 0, len(accounts))
+	for _, account := range accounts {
+		if canManageServiceAccount(c, account) {
+			managed = append(managed, account)
+		}
+	}
+	common.RespSuccess(c, managed)
+}
+
+// CreateServiceAccount godoc
+// @Summary Create a service account
+// @Description Create a service account owned by the current admin. It cannot log in; create API tokens for it to call /proxy.
+// @Tags Service Accounts
+// @Accept json
+// @Produce json
+// @Param body body serviceAccountRequest true "Username, display name and RPD limit"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts [post]
+func CreateServiceAccount(c *gin.Context) {
+	createServiceAccount(c, 0)
+}
+
+// ListTeamServiceAccounts godoc
+// @Summary List the service accounts of a team
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/service_accounts [get]
+func ListTeamServiceAccounts(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	accounts, err := model.GetTeamServiceAccounts(team.ID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_service_accounts_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, accounts)
+}
+
+// CreateTeamServiceAccount godoc
+// @Summary Create a service account owned by a team
+// @Description Team admins create a service account that is a member of the team, reaching the team's services with its env config and limits. Admins of the team manage it from the service account endpoints.
+// @Tags Teams
+// @Accept json
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param body body serviceAccountRequest true "Username, display name and RPD limit"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/service_accounts [post]
+func CreateTeamServiceAccount(c *gin.Context) {
+	if team := loadTeam(c, true); team != nil {
+		createServiceAccount(c, team.ID)
+	}
+}
+
+// createServiceAccount creates a service account from the request body, owned by the team teamID
+// unless it is 0, and responds with it
+func createServiceAccount(c *gin.Context, teamID int64) {
+	lang := c.GetString("lang")
+	var req serviceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || (req.RPDLimit != nil && *req.RPDLimit < 0) {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang))
+		return
+	}
+	if model.IsUsernameAlreadyTaken(req.Username) {
+		common.RespErrorStr(c, http.StatusConflict, i18n.Translate("username_taken", lang))
+		return
+	}
+
+	account := &model.User{Username: req.Username, DisplayName: req.DisplayName}
+	if account.DisplayName == "" {
+		account.DisplayName = req.Username
+	}
+	if req.RPDLimit != nil {
+		account.RPDLimit = *req.RPDLimit
+	}
+	if err := model.CreateServiceAccount(account, getUserIDFromContext(c), teamID); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_service_account_failed", lang), err)
+		return
+	}
+	common.SysLog("[ServiceAccount] Created service account " + account.Username)
+	common.RespSuccess(c, account)
+}
+
+// UpdateServiceAccount godoc
+// @Summary Update a service account
+// @Description Update the display name, status or RPD limit of a service account
+// @Tags Service Accounts
+// @Accept json
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Param body body serviceAccountRequest true "Fields to update"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id} [put]
+func UpdateServiceAccount(c *gin.Context) {
+	lang := c.GetString("lang")
+	account := loadServiceAccount(c)
+	if account == nil {
+		return
+	}
+	var req serviceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	if (req.Status != nil && *req.Status != common.UserStatusEnabled && *req.Status != common.UserStatusDisabled) ||
+		(req.RPDLimit != nil && *req.RPDLimit < 0) {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang))
+		return
+	}
+	if req.DisplayName != "" {
+		account.DisplayName = req.DisplayName
+	}
+	if req.Status != nil {
+		account.Status = *req.Status
+	}
+	if req.RPDLimit != nil {
+		account.RPDLimit = *req.RPDLimit
+	}
+	if err := account.Update(false); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_service_account_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, account)
+}
+
+// DeleteServiceAccount godoc
+// @Summary Delete a service account
+// @Description Delete a service account along with its API tokens and env configs
+// @Tags Service Accounts
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id} [delete]
+func DeleteServiceAccount(c *gin.Context) {
+	lang := c.GetString("lang")
+	account := loadServiceAccount(c)
+	if account == nil {
+		return
+	}
+	if err := model.DeleteServiceAccount(account); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("delete_service_account_failed", lang), err)
+		return
+	}
+	common.SysLog("[ServiceAccount] Deleted service account " + account.Username)
+	common.RespSuccessStr(c, i18n.Translate("service_account_deleted", lang))
+}
+
+// ListServiceAccountTokens godoc
+// @Summary List the API tokens of a service account
+// @Tags Service Accounts
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id}/tokens [get]
+func ListServiceAccountTokens(c *gin.Context) {
+	if account := loadServiceAccount(c); account != nil {
+		respondAPITokens(c, account.ID)
+	}
+}
+
+// CreateServiceAccountToken godoc
+// @Summary Create an API token for a service account
+// @Description The token is returned in the token field of the response only once; only its hash is stored
+// @Tags Service Accounts
+// @Accept json
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Param body body apiTokenRequest true "Token name, services, read-only flag and expiry"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id}/tokens [post]
+func CreateServiceAccountToken(c *gin.Context) {
+	if account := loadServiceAccount(c); account != nil {
+		createAPITokenFor(c, account)
+	}
+}
+
+// DeleteServiceAccountToken godoc
+// @Summary Revoke an API token of a service account
+// @Tags Service Accounts
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Param token_id path int true "Token ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id}/tokens/{token_id} [delete]
+func DeleteServiceAccountToken(c *gin.Context) {
+	if account := loadServiceAccount(c); account != nil {
+		revokeAPIToken(c, account.ID, c.Param("token_id"))
+	}
+}
+
+// GetServiceAccountEnvVars godoc
+// @Summary List the env configs of a service account
+// @Tags Service Accounts
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id}/env_vars [get]
+func GetServiceAccountEnvVars(c *gin.Context) {
+	lang := c.GetString("lang")
+	account := loadServiceAccount(c)
+	if account == nil {
+		return
+	}
+	configs, err := model.GetUserConfigsWithDetails(account.ID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_user_configs_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, configs)
+}
+
+// PatchServiceAccountEnvVar godoc
+// @Summary Save an env config of a service account
+// @Description Save one environment variable of a service for the service account, like a user saves their own
+// @Tags Service Accounts
+// @Accept json
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Param body body map[string]interface{} true "service_id, var_name and var_value"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id}/env_var [patch]
+func PatchServiceAccountEnvVar(c *gin.Context) {
+	lang := c.GetString("lang")
+	account := loadServiceAccount(c)
+	if account == nil {
+		return
+	}
+	var req struct {
+		ServiceID int64  `json:"service_id" binding:"required"`
+		VarName   string `json:"var_name" binding:"required"`
+		VarValue  string `json:"var_value" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	if !savePersonalEnvVar(c, account.ID, req.ServiceID, req.VarName, req.VarValue) {
+		return
+	}
+	common.RespSuccessStr(c, i18n.Translate("env_var_saved_successfully", lang))
+}
+
+// GetServiceAccountUsage godoc
+// @Summary Get the usage of a service account
+// @Description Summarize the proxied requests of a service account per service over the last days
+// @Tags Service Accounts
+// @Produce json
+// @Param id path int true "Service account ID"
+// @Param days query int false "Number of days, 7 by default"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/user/service_accounts/{id}/usage [get]
+func GetServiceAccountUsage(c *gin.Context) {
+	lang := c.GetString("lang")
+	account := loadServiceAccount(c)
+	if account == nil {
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang))
+		return
+	}
+	usage, err := model.GetServiceUsage([]int64{account.ID}, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_service_account_usage_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, usage)
+}
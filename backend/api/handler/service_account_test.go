@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"toWers/backend/api/middleware"
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupServiceAccountRouter(adminID int64, role int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/api/user", func(c *gin.Context) {
+		c.Set("user_id", adminID)
+		c.Set("role", role)
+	})
+	admin.GET("/", GetAllUsers)
+	admin.GET("/service_accounts", ListServiceAccounts)
+	admin.POST("/service_accounts", CreateServiceAccount)
+	admin.PUT("/service_accounts/:id", UpdateServiceAccount)
+	admin.DELETE("/service_accounts/:id", DeleteServiceAccount)
+	admin.POST("/service_accounts/:id/tokens", CreateServiceAccountToken)
+	admin.PATCH("/service_accounts/:id/env_var", PatchServiceAccountEnvVar)
+	admin.GET("/service_accounts/:id/usage", GetServiceAccountUsage)
+	router.Any("/proxy/:serviceName/*action", middleware.TokenAuth(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetInt64("userID")})
+	})
+	return router
+}
+
+func jsonRequest(method, path string, body gin.H) *http.Request {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestServiceAccounts_ManagedSeparatelyFromUsers(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	admin := &model.User{Username: "ci-admin", DisplayName: "CI Admin", Role: common.RoleAdminUser, Status: common.UserStatusEnabled}
+	require.NoError(t, model.UserDB.Save(admin))
+	svc := &model.MCPService{Name: "github", DisplayName: "GitHub", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true}
+	require.NoError(t, model.CreateService(svc))
+	router := setupServiceAccountRouter(admin.ID, common.RoleAdminUser)
+
+	w, body := serveJSON(t, router, jsonRequest(http.MethodPost, "/api/user/service_accounts", gin.H{"username": "ci-agent", "rpd_limit": 1000}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	created := body["data"].(map[string]interface{})
+	accountPath := fmt.Sprintf("/api/user/service_accounts/%v", created["id"])
+	assert.Equal(t, true, created["is_service_account"])
+	assert.EqualValues(t, admin.ID, created["owner_id"])
+	w, _ = serveJSON(t, router, jsonRequest(http.MethodPost, "/api/user/service_accounts", gin.H{"username": "ci-agent"}))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Listed apart from human users, and unable to log in
+	req, _ := http.NewRequest(http.MethodGet, "/api/user/", nil)
+	_, body = serveJSON(t, router, req)
+	for _, user := range body["data"].([]interface{}) {
+		assert.NotEqual(t, "ci-agent", user.(map[string]interface{})["username"])
+	}
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/service_accounts", nil)
+	_, body = serveJSON(t, router, req)
+	assert.Len(t, body["data"], 1)
+	login := &model.User{Username: "ci-agent", Password: ""}
+	assert.Error(t, login.ValidateAndFill())
+
+	// Calls /proxy with its own token and env configs
+	w, body = serveJSON(t, router, jsonRequest(http.MethodPost, accountPath+"/tokens", gin.H{"name": "pipeline"}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	apiToken := body["data"].(map[string]interface{})["token"].(string)
+	_, proxied := serveJSON(t, router, proxyRequest("github", "Bearer "+apiToken))
+	assert.EqualValues(t, created["id"], proxied["user_id"])
+
+	w, _ = serveJSON(t, router, jsonRequest(http.MethodPatch, accountPath+"/env_var", gin.H{"service_id": svc.ID, "var_name": "GITHUB_TOKEN", "var_value": "ci-secret"}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	envs, err := model.GetUserSpecificEnvs(int64(created["id"].(float64)), svc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ci-secret", envs["GITHUB_TOKEN"])
+
+	// Requests are attributed to the account
+	model.RecordRequestStat(svc.ID, svc.Name, int64(created["id"].(float64)), model.ProxyRequestTypeHTTP, "tools/call", "/proxy/github/mcp", 40, http.StatusOK, true)
+	req, _ = http.NewRequest(http.MethodGet, accountPath+"/usage", nil)
+	w, body = serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	usage := body["data"].([]interface{})
+	require.Len(t, usage, 1)
+	assert.EqualValues(t, 1, usage[0].(map[string]interface{})["requests"])
+
+	// Other admins neither see nor manage it
+	other := setupServiceAccountRouter(admin.ID+100, common.RoleAdminUser)
+	w, _ = serveJSON(t, other, jsonRequest(http.MethodPut, accountPath, gin.H{"status": common.UserStatusDisabled}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w, _ = serveJSON(t, router, jsonRequest(http.MethodPut, accountPath, gin.H{"status": common.UserStatusDisabled}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, proxied = serveJSON(t, router, proxyRequest("github", "Bearer "+apiToken))
+	assert.EqualValues(t, 0, proxied["user_id"], "disabled service accounts are rejected")
+
+	req, _ = http.NewRequest(http.MethodDelete, accountPath, nil)
+	w, _ = serveJSON(t, router, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tokens, err := model.GetUserAPITokens(int64(created["id"].(float64)))
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func TestServiceAccounts_OwnedByTeam(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	newUser := func(username string) *model.User {
+		user := &model.User{Username: username, DisplayName: username, Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+		require.NoError(t, model.UserDB.Save(user))
+		return user
+	}
+	// Cached queries outlive the in-memory database, so the IDs here stay apart from the team tests'
+	for i := range 4 {
+		newUser(fmt.Sprintf("filler-%d", i))
+		require.NoError(t, model.SaveTeam(&model.Team{Name: fmt.Sprintf("filler-%d", i)}))
+	}
+	lead := newUser("ops-lead")
+	outsider := newUser("ops-outsider")
+	team := &model.Team{Name: "ops", DisplayName: "Ops"}
+	require.NoError(t, model.SaveTeam(team))
+	_, err := model.SaveTeamMember(team.ID, lead.ID, model.TeamRoleAdmin)
+	require.NoError(t, err)
+
+	routerFor := func(user *model.User) *gin.Engine {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		api := router.Group("/api", func(c *gin.Context) {
+			c.Set("user_id", user.ID)
+			c.Set("role", user.Role)
+		})
+		api.GET("/teams/:id/service_accounts", ListTeamServiceAccounts)
+		api.POST("/teams/:id/service_accounts", CreateTeamServiceAccount)
+		api.DELETE("/teams/:id/members/:user_id", RemoveTeamMember)
+		api.POST("/user/service_accounts/:id/tokens", CreateServiceAccountToken)
+		api.DELETE("/user/service_accounts/:id", DeleteServiceAccount)
+		return router
+	}
+	leadRouter, outsiderRouter := routerFor(lead), routerFor(outsider)
+	teamPath := fmt.Sprintf("/api/teams/%d", team.ID)
+
+	// Team admins create service accounts for their team, other users do not
+	w, _ := serveJSON(t, outsiderRouter, jsonRequest(http.MethodPost, teamPath+"/service_accounts", gin.H{"username": "ops-bot"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, body := serveJSON(t, leadRouter, jsonRequest(http.MethodPost, teamPath+"/service_accounts", gin.H{"username": "ops-bot"}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	created := body["data"].(map[string]interface{})
+	assert.EqualValues(t, team.ID, created["owner_team_id"])
+	accountID := int64(created["id"].(float64))
+	accountPath := fmt.Sprintf("/api/user/service_accounts/%d", accountID)
+	req, _ := http.NewRequest(http.MethodGet, teamPath+"/service_accounts", nil)
+	_, body = serveJSON(t, leadRouter, req)
+	assert.Len(t, body["data"], 1)
+
+	// It reaches the services of the team as a member
+	_, err = model.GetTeamMember(team.ID, accountID)
+	assert.NoError(t, err)
+
+	// Team admins manage its tokens without the user.manage permission
+	w, _ = serveJSON(t, leadRouter, jsonRequest(http.MethodPost, accountPath+"/tokens", gin.H{"name": "pager"}))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w, _ = serveJSON(t, outsiderRouter, jsonRequest(http.MethodPost, accountPath+"/tokens", gin.H{"name": "pager"}))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// It stays in the team until it is deleted
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/members/%d", teamPath, accountID), nil)
+	w, _ = serveJSON(t, leadRouter, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	req, _ = http.NewRequest(http.MethodDelete, accountPath, nil)
+	w, _ = serveJSON(t, leadRouter, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = model.GetTeamMember(team.ID, accountID)
+	assert.ErrorIs(t, err, model.ErrTeamMemberNotFound)
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// servicePermissionRequest is the request body for creating or updating a service permission
+type servicePermissionRequest struct {
+	SubjectType string                 `json:"subject_type"`
+	SubjectID   int64                  `json:"subject_id"`
+	Filter      model.CapabilityFilter `json:"filter"`
+}
+
+// ListServicePermissions godoc
+// @Summary List service permissions
+// @Description List the users and roles granted access to a service. A service without entries is open to all users.
+// @Tags MCP Services
+// @Produce json
+// @Param id path int true "Service ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/permissions [get]
+func ListServicePermissions(c *gin.Context) {
+	lang := c.GetString("lang")
+	serviceID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_service_id", lang), err)
+		return
+	}
+	permissions, err := model.GetServicePermissions(serviceID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_service_permissions_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, permissions)
+}
+
+// CreateServicePermission godoc
+// @Summary Grant access to a service
+// @Description Grant a user or a role access to a service, optionally limited to some tools, prompts and resources
+// @Tags MCP Services
+// @Accept json
+// @Produce json
+// @Param id path int true "Service ID"
+// @Param body body servicePermissionRequest true "Permission"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/permissions [post]
+func CreateServicePermission(c *gin.Context) {
+	lang := c.GetString("lang")
+	serviceID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_service_id", lang), err)
+		return
+	}
+	if _, err := model.GetServiceByID(serviceID); err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("service_not_found", lang), err)
+		return
+	}
+
+	permission := &model.ServicePermission{ServiceID: serviceID}
+	if !bindServicePermission(c, permission, lang) {
+		return
+	}
+	if err := model.SaveServicePermission(permission); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_service_permission_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, permission)
+}
+
+// UpdateServicePermission godoc
+// @Summary Update a service permission
+// @Tags MCP Services
+// @Accept json
+// @Produce json
+// @Param id path int true "Service ID"
+// @Param permission_id path int true "Permission ID"
+// @Param body body servicePermissionRequest true "Permission"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/permissions/{permission_id} [put]
+func UpdateServicePermission(c *gin.Context) {
+	lang := c.GetString("lang")
+	permission, ok := getServicePermissionFromPath(c, lang)
+	if !ok {
+		return
+	}
+	if !bindServicePermission(c, permission, lang) {
+		return
+	}
+	if err := model.SaveServicePermission(permission); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_service_permission_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, permission)
+}
+
+// DeleteServicePermission godoc
+// @Summary Revoke a service permission
+// @Tags MCP Services
+// @Produce json
+// @Param id path int true "Service ID"
+// @Param permission_id path int true "Permission ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/permissions/{permission_id} [delete]
+func DeleteServicePermission(c *gin.Context) {
+	lang := c.GetString("lang")
+	permission, ok := getServicePermissionFromPath(c, lang)
+	if !ok {
+		return
+	}
+	if err := model.DeleteServicePermission(permission.ID); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("delete_service_permission_failed", lang), err)
+		return
+	}
+	common.RespSuccessStr(c, i18n.Translate("service_permission_deleted_successfully", lang))
+}
+
+// getServicePermissionFromPath loads the permission addressed by the path and checks it belongs to the service
+func getServicePermissionFromPath(c *gin.Context, lang string) (*model.ServicePermission, bool) {
+	serviceID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_service_id", lang), err)
+		return nil, false
+	}
+	permissionID, err := strconv.ParseInt(c.Param("permission_id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_service_permission_id", lang), err)
+		return nil, false
+	}
+	permission, err := model.GetServicePermissionByID(permissionID)
+	if err != nil || permission.ServiceID != serviceID {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("service_permission_not_found", lang), err)
+		return nil, false
+	}
+	return permission, true
+}
+
+// bindServicePermission validates the request body and copies it onto permission
+func bindServicePermission(c *gin.Context, permission *model.ServicePermission, lang string) bool {
+	var req servicePermissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return false
+	}
+
+	switch req.SubjectType {
+	case model.PermissionSubjectUser:
+		if _, err := model.GetUserById(req.SubjectID, false); err != nil {
+			common.RespError(c, http.StatusBadRequest, i18n.Translate("user_not_found", lang), err)
+			return false
+		}
+	case model.PermissionSubjectTeam:
+		if _, err := model.GetTeamByID(req.SubjectID); err != nil {
+			common.RespError(c, http.StatusBadRequest, i18n.Translate("team_not_found", lang), err)
+			return false
+		}
+	case model.PermissionSubjectRole:
+		if req.SubjectID < 0 {
+			common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_permission_subject", lang))
+			return false
+		}
+	default:
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_permission_subject", lang))
+		return false
+	}
+	if err := req.Filter.Validate(); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_filter_json", lang), err)
+		return false
+	}
+
+	permission.SubjectType = req.SubjectType
+	permission.SubjectID = req.SubjectID
+	if err := permission.SetCapabilityFilter(req.Filter); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_filter_json", lang), err)
+		return false
+	}
+	return true
+}
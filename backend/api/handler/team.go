@@ -0,0 +1,539 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/library/proxy"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// teamRequest is the body of CreateTeam and UpdateTeam
+type teamRequest struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	RPDLimit    *int   `json:"rpd_limit"` // Daily requests per service of all members together, 0 for no team limit
+}
+
+// teamMemberRequest is the body of AddTeamMember and UpdateTeamMember
+type teamMemberRequest struct {
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"` // "member" or "admin", "member" by default
+}
+
+// loadTeam loads the team of the id path parameter if the current user may see it: users with
+// the team.manage permission see every team, other users the teams they belong to. With manage
+// set, team members must also be admins of the team. It writes an error response and returns nil
+// otherwise.
+func loadTeam(c *gin.Context, manage bool) *model.Team {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang), err)
+		return nil
+	}
+	team, err := model.GetTeamByID(id)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("team_not_found", lang), err)
+		return nil
+	}
+	if hasPermission(c, model.PermissionTeamManage) {
+		return team
+	}
+	member, err := model.GetTeamMember(team.ID, getUserIDFromContext(c))
+	if err != nil {
+		common.RespErrorStr(c, http.StatusNotFound, i18n.Translate("team_not_found", lang))
+		return nil
+	}
+	if manage && member.Role != model.TeamRoleAdmin {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("no_permission_manage_team", lang))
+		return nil
+	}
+	return team
+}
+
+// ListTeams godoc
+// @Summary List teams
+// @Description Users with the team.manage permission see every team, other users the teams they belong to
+// @Tags Teams
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams [get]
+func ListTeams(c *gin.Context) {
+	lang := c.GetString("lang")
+	if hasPermission(c, model.PermissionTeamManage) {
+		teams, err := model.GetAllTeams()
+		if err != nil {
+			common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_teams_failed", lang), err)
+			return
+		}
+		common.RespSuccess(c, teams)
+		return
+	}
+
+	memberships, err := model.GetUserTeamMemberships(getUserIDFromContext(c))
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_teams_failed", lang), err)
+		return
+	}
+	teams := make([]*model.Team, 0, len(memberships))
+	for _, membership := range memberships {
+		if team, err := model.GetTeamByID(membership.TeamID); err == nil {
+			teams = append(teams, team)
+		}
+	}
+	common.RespSuccess(c, teams)
+}
+
+// CreateTeam godoc
+// @Summary Create a team
+// @Tags Teams
+// @Accept json
+// @Produce json
+// @Param body body teamRequest true "Name, display name, description and RPD limit"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams [post]
+func CreateTeam(c *gin.Context) {
+	lang := c.GetString("lang")
+	var req teamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("team_name_required", lang))
+		return
+	}
+	if req.RPDLimit != nil && *req.RPDLimit < 0 {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang))
+		return
+	}
+	if _, err := model.GetTeamByName(req.Name); err == nil {
+		common.RespErrorStr(c, http.StatusConflict, i18n.Translate("team_name_taken", lang))
+		return
+	}
+
+	team := &model.Team{Name: req.Name, DisplayName: req.DisplayName, Description: req.Description}
+	if team.DisplayName == "" {
+		team.DisplayName = req.Name
+	}
+	if req.RPDLimit != nil {
+		team.RPDLimit = *req.RPDLimit
+	}
+	if err := model.SaveTeam(team); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_team_failed", lang), err)
+		return
+	}
+	common.SysLog("[Team] Created team " + team.Name)
+	common.RespSuccess(c, team)
+}
+
+// GetTeam godoc
+// @Summary Get a team
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id} [get]
+func GetTeam(c *gin.Context) {
+	if team := loadTeam(c, false); team != nil {
+		common.RespSuccess(c, team)
+	}
+}
+
+// UpdateTeam godoc
+// @Summary Update a team
+// @Description Update the display name, description or RPD limit of a team
+// @Tags Teams
+// @Accept json
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param body body teamRequest true "Fields to update"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id} [put]
+func UpdateTeam(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	var req teamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	if req.RPDLimit != nil && *req.RPDLimit < 0 {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang))
+		return
+	}
+	if req.DisplayName != "" {
+		team.DisplayName = req.DisplayName
+	}
+	if req.Description != "" {
+		team.Description = req.Description
+	}
+	if req.RPDLimit != nil {
+		team.RPDLimit = *req.RPDLimit
+	}
+	if err := model.SaveTeam(team); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_team_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, team)
+}
+
+// DeleteTeam godoc
+// @Summary Delete a team
+// @Description Delete a team along with its memberships, env config and service permissions
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id} [delete]
+func DeleteTeam(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	if err := model.DeleteTeam(team); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("delete_team_failed", lang), err)
+		return
+	}
+	common.SysLog("[Team] Deleted team " + team.Name)
+	common.RespSuccessStr(c, i18n.Translate("team_deleted", lang))
+}
+
+// ListTeamMembers godoc
+// @Summary List the members of a team
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/members [get]
+func ListTeamMembers(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, false)
+	if team == nil {
+		return
+	}
+	members, err := model.GetTeamMembers(team.ID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_teams_failed", lang), err)
+		return
+	}
+	result := make([]gin.H, 0, len(members))
+	for _, member := range members {
+		user, err := model.GetUserById(member.UserID, false)
+		if err != nil || user == nil {
+			continue // Deleted users keep their membership rows
+		}
+		result = append(result, gin.H{
+			"user_id":            member.UserID,
+			"username":           user.Username,
+			"display_name":       user.DisplayName,
+			"is_service_account": user.IsServiceAccount,
+			"role":               member.Role,
+			"created_at":         member.CreatedAt,
+		})
+	}
+	common.RespSuccess(c, result)
+}
+
+// AddTeamMember godoc
+// @Summary Add a member to a team
+// @Description Users with the team.manage permission add users or service accounts to a team, or change their role
+// @Tags Teams
+// @Accept json
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param body body teamMemberRequest true "User ID and role"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/members [post]
+func AddTeamMember(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, false)
+	if team == nil {
+		return
+	}
+	// Team admins manage the members they have, but do not pull other users into their team
+	if !hasPermission(c, model.PermissionTeamManage) {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("no_permission_add_team_member", lang))
+		return
+	}
+	var req teamMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	if user, err := model.GetUserById(req.UserID, false); err != nil || user == nil {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("user_not_found", lang))
+		return
+	}
+	saveTeamMember(c, team, req.UserID, req.Role)
+}
+
+// UpdateTeamMember godoc
+// @Summary Change the role of a team member
+// @Tags Teams
+// @Accept json
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param user_id path int true "User ID"
+// @Param body body teamMemberRequest true "Role"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/members/{user_id} [put]
+func UpdateTeamMember(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	member := loadTeamMember(c, team)
+	if member == nil {
+		return
+	}
+	var req teamMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	saveTeamMember(c, team, member.UserID, req.Role)
+}
+
+// RemoveTeamMember godoc
+// @Summary Remove a member from a team
+// @Description Team admins and users with the team.manage permission remove members; members may leave a team themselves
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param user_id path int true "User ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/members/{user_id} [delete]
+func RemoveTeamMember(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, false)
+	if team == nil {
+		return
+	}
+	member := loadTeamMember(c, team)
+	if member == nil {
+		return
+	}
+	userID := getUserIDFromContext(c)
+	if member.UserID != userID && !hasPermission(c, model.PermissionTeamManage) && !model.IsTeamAdmin(team.ID, userID) {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("no_permission_manage_team", lang))
+		return
+	}
+	// The service accounts of a team reach its services as members; they leave it by being deleted
+	if account, err := model.GetServiceAccountByID(member.UserID); err == nil && account.OwnerTeamID == team.ID {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("team_service_account_not_removable", lang))
+		return
+	}
+	if err := model.DeleteTeamMember(member); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_team_member_failed", lang), err)
+		return
+	}
+	reloadTeamMemberInstances([]int64{member.UserID})
+	common.RespSuccessStr(c, i18n.Translate("team_member_removed", lang))
+}
+
+// loadTeamMember loads the membership of the user_id path parameter in team. It writes an error
+// response and returns nil if the user is not a member.
+func loadTeamMember(c *gin.Context, team *model.Team) *model.TeamMember {
+	lang := c.GetString("lang")
+	userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang), err)
+		return nil
+	}
+	member, err := model.GetTeamMember(team.ID, userID)
+	if errors.Is(err, model.ErrTeamMemberNotFound) {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("team_member_not_found", lang), err)
+		return nil
+	}
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_teams_failed", lang), err)
+		return nil
+	}
+	return member
+}
+
+// saveTeamMember gives a user the role in team and responds with the membership
+func saveTeamMember(c *gin.Context, team *model.Team, userID int64, role string) {
+	lang := c.GetString("lang")
+	if role == "" {
+		role = model.TeamRoleMember
+	}
+	if role != model.TeamRoleMember && role != model.TeamRoleAdmin {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_team_role", lang))
+		return
+	}
+	member, err := model.SaveTeamMember(team.ID, userID, role)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_team_member_failed", lang), err)
+		return
+	}
+	reloadTeamMemberInstances([]int64{userID})
+	common.RespSuccess(c, member)
+}
+
+// GetTeamEnvVars godoc
+// @Summary List the env config of a team
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/env_vars [get]
+func GetTeamEnvVars(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	configs, err := model.GetAllTeamConfigs(team.ID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_team_configs_failed", lang), err)
+		return
+	}
+	result := make([]gin.H, 0, len(configs))
+	for _, config := range configs {
+		option, err := model.ConfigServiceDB.ByID(config.ConfigID)
+		if err != nil {
+			continue
+		}
+		result = append(result, gin.H{
+			"service_id": config.ServiceID,
+			"var_name":   option.Key,
+			"var_value":  config.Value,
+			"updated_at": config.UpdatedAt,
+		})
+	}
+	common.RespSuccess(c, result)
+}
+
+// PatchTeamEnvVar godoc
+// @Summary Save an env config of a team
+// @Description Save one environment variable of a service for every member of a team. Members' own values take precedence. The service must run instances per user, and only users with the service.edit permission may set a variable that is not one of its config options yet.
+// @Tags Teams
+// @Accept json
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param body body map[string]interface{} true "service_id, var_name and var_value"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/env_var [patch]
+func PatchTeamEnvVar(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	var req struct {
+		ServiceID int64  `json:"service_id" binding:"required"`
+		VarName   string `json:"var_name" binding:"required"`
+		VarValue  string `json:"var_value" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	service, err := model.GetServiceByID(req.ServiceID)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("service_not_found", lang), err)
+		return
+	}
+	// Team values reach members through their own instances only
+	if !service.HasUserInstances() {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("team_env_needs_user_instances", lang))
+		return
+	}
+	if _, err := model.GetConfigOptionByKey(req.ServiceID, req.VarName); err != nil && !hasPermission(c, model.PermissionServiceEdit) {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("env_var_not_declared", lang))
+		return
+	}
+	configOpt := findOrCreateConfigOption(c, req.ServiceID, req.VarName)
+	if configOpt == nil {
+		return
+	}
+	config := &model.TeamConfig{TeamID: team.ID, ServiceID: req.ServiceID, ConfigID: configOpt.ID, Value: req.VarValue}
+	if err := model.SaveTeamConfig(config); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_team_config_failed", lang), err)
+		return
+	}
+
+	if memberIDs, err := model.GetTeamMemberIDs(team.ID); err == nil {
+		for _, userID := range memberIDs {
+			proxy.ReloadUserInstance(service, userID)
+		}
+	}
+	common.RespSuccessStr(c, i18n.Translate("env_var_saved_successfully", lang))
+}
+
+// reloadTeamMemberInstances reloads the running instances of users whose teams changed, so
+// they pick up the env config of their new teams
+func reloadTeamMemberInstances(userIDs []int64) {
+	services, err := model.GetEnabledServices()
+	if err != nil {
+		common.SysError("[Team] Failed to list services to reload: " + err.Error())
+		return
+	}
+	for _, service := range services {
+		for _, userID := range userIDs {
+			proxy.ReloadUserInstance(service, userID)
+		}
+	}
+}
+
+// GetTeamUsage godoc
+// @Summary Get the usage of a team
+// @Description Summarize the proxied requests of all members of a team per service over the last days
+// @Tags Teams
+// @Produce json
+// @Param id path int true "Team ID"
+// @Param days query int false "Number of days, 7 by default"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Router /api/teams/{id}/usage [get]
+func GetTeamUsage(c *gin.Context) {
+	lang := c.GetString("lang")
+	team := loadTeam(c, true)
+	if team == nil {
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("invalid_param", lang))
+		return
+	}
+	memberIDs, err := model.GetTeamMemberIDs(team.ID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_team_usage_failed", lang), err)
+		return
+	}
+	usage, err := model.GetServiceUsage(memberIDs, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_team_usage_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, usage)
+}
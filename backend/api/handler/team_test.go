@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"toWers/backend/common"
+	"toWers/backend/library/proxy"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTeamRouter(userID int64, role int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	teams := router.Group("/api/teams", func(c *gin.Context) {
+		c.Set("user_id", userID)
+		c.Set("role", role)
+	})
+	teams.GET("", ListTeams)
+	teams.POST("", CreateTeam)
+	teams.GET("/:id", GetTeam)
+	teams.GET("/:id/members", ListTeamMembers)
+	teams.POST("/:id/members", AddTeamMember)
+	teams.DELETE("/:id/members/:user_id", RemoveTeamMember)
+	teams.PATCH("/:id/env_var", PatchTeamEnvVar)
+	teams.GET("/:id/usage", GetTeamUsage)
+	return router
+}
+
+func TestTeams_SharedServicesEnvAndLimits(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	newUser := func(username string, role int) *model.User {
+		user := &model.User{Username: username, DisplayName: username, Role: role, Status: common.UserStatusEnabled}
+		require.NoError(t, model.UserDB.Save(user))
+		return user
+	}
+	admin := newUser("root-admin", common.RoleAdminUser)
+	lead := newUser("lead", common.RoleCommonUser)
+	dev := newUser("dev", common.RoleCommonUser)
+	outsider := newUser("outsider", common.RoleCommonUser)
+	svc := &model.MCPService{Name: "github", DisplayName: "GitHub", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true, AllowUserOverride: true,
+		DefaultEnvsJSON: `{"GITHUB_TOKEN":"default","GITHUB_ORG":"public"}`}
+	require.NoError(t, model.CreateService(svc))
+
+	w, body := serveJSON(t, setupTeamRouter(admin.ID, common.RoleAdminUser), jsonRequest(http.MethodPost, "/api/teams", gin.H{"name": "platform", "rpd_limit": 2}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	teamID := int64(body["data"].(map[string]interface{})["id"].(float64))
+	teamPath := fmt.Sprintf("/api/teams/%d", teamID)
+	adminRouter := setupTeamRouter(admin.ID, common.RoleAdminUser)
+	w, _ = serveJSON(t, adminRouter, jsonRequest(http.MethodPost, teamPath+"/members", gin.H{"user_id": lead.ID, "role": model.TeamRoleAdmin}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w, _ = serveJSON(t, adminRouter, jsonRequest(http.MethodPost, teamPath+"/members", gin.H{"user_id": dev.ID}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Only users with team.manage add members; team admins and members cannot
+	leadRouter := setupTeamRouter(lead.ID, common.RoleCommonUser)
+	w, _ = serveJSON(t, leadRouter, jsonRequest(http.MethodPost, teamPath+"/members", gin.H{"user_id": outsider.ID}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	devRouter := setupTeamRouter(dev.ID, common.RoleCommonUser)
+	w, _ = serveJSON(t, devRouter, jsonRequest(http.MethodPost, teamPath+"/members", gin.H{"user_id": outsider.ID}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/members/%d", teamPath, lead.ID), nil)
+	w, _ = serveJSON(t, devRouter, req)
+	assert.Equal(t, http.StatusForbidden, w.Code, "members only remove themselves")
+	req, _ = http.NewRequest(http.MethodGet, teamPath+"/members", nil)
+	w, body = serveJSON(t, devRouter, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, body["data"], 2)
+	req, _ = http.NewRequest(http.MethodGet, teamPath, nil)
+	w, _ = serveJSON(t, setupTeamRouter(outsider.ID, common.RoleCommonUser), req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	req, _ = http.NewRequest(http.MethodGet, "/api/teams", nil)
+	_, body = serveJSON(t, devRouter, req)
+	assert.Len(t, body["data"], 1)
+
+	// Services enabled for the team are open to its members only
+	other := &model.ServicePermission{ServiceID: svc.ID, SubjectType: model.PermissionSubjectUser, SubjectID: lead.ID}
+	require.NoError(t, model.SaveServicePermission(other))
+	filter := model.CapabilityFilter{Tools: model.FilterRule{Allow: []string{"list_issues"}}}
+	filterJSON, _ := json.Marshal(filter)
+	teamPermission := &model.ServicePermission{ServiceID: svc.ID, SubjectType: model.PermissionSubjectTeam, SubjectID: teamID, FilterJSON: string(filterJSON)}
+	require.NoError(t, model.SaveServicePermission(teamPermission))
+	got, allowed, err := model.ResolveServiceAccess(dev, svc)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, filter.Tools.Allow, got.Tools.Allow)
+	_, allowed, err = model.ResolveServiceAccess(outsider, svc)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Team admins set the variables the service declares; only service editors declare new ones
+	w, _ = serveJSON(t, leadRouter, jsonRequest(http.MethodPatch, teamPath+"/env_var", gin.H{"service_id": svc.ID, "var_name": "GITHUB_TOKEN", "var_value": "team-token"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = serveJSON(t, adminRouter, jsonRequest(http.MethodPatch, teamPath+"/env_var", gin.H{"service_id": svc.ID, "var_name": "GITHUB_TOKEN", "var_value": "admin-token"}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	shared := &model.MCPService{Name: "shared-github", DisplayName: "Shared GitHub", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true}
+	require.NoError(t, model.CreateService(shared))
+	w, _ = serveJSON(t, adminRouter, jsonRequest(http.MethodPatch, teamPath+"/env_var", gin.H{"service_id": shared.ID, "var_name": "GITHUB_TOKEN", "var_value": "team-token"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "team env config does not apply to a service without user instances")
+
+	// Env config precedence is service default < team < user
+	w, _ = serveJSON(t, leadRouter, jsonRequest(http.MethodPatch, teamPath+"/env_var", gin.H{"service_id": svc.ID, "var_name": "GITHUB_TOKEN", "var_value": "team-token"}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var envs map[string]string
+	require.NoError(t, json.Unmarshal([]byte(proxy.UserEnvsJSON(svc, dev.ID)), &envs))
+	assert.Equal(t, map[string]string{"GITHUB_TOKEN": "team-token", "GITHUB_ORG": "public"}, envs)
+	option, err := model.GetConfigOptionByKey(svc.ID, "GITHUB_TOKEN")
+	require.NoError(t, err)
+	require.NoError(t, model.SaveUserConfig(&model.UserConfig{UserID: dev.ID, ServiceID: svc.ID, ConfigID: option.ID, Value: "dev-token"}))
+	require.NoError(t, json.Unmarshal([]byte(proxy.UserEnvsJSON(svc, dev.ID)), &envs))
+	assert.Equal(t, "dev-token", envs["GITHUB_TOKEN"])
+	require.NoError(t, json.Unmarshal([]byte(proxy.UserEnvsJSON(svc, outsider.ID)), &envs))
+	assert.Equal(t, "default", envs["GITHUB_TOKEN"])
+
+	// The team limit and usage add up the requests of all members
+	teamRequests := func() float64 {
+		req, _ := http.NewRequest(http.MethodGet, teamPath+"/usage", nil)
+		w, body := serveJSON(t, leadRouter, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		total := 0.0
+		for _, u := range body["data"].([]interface{}) {
+			total += u.(map[string]interface{})["requests"].(float64)
+		}
+		return total
+	}
+	before := teamRequests()
+	model.RecordRequestStat(svc.ID, svc.Name, lead.ID, model.ProxyRequestTypeHTTP, "tools/call", "/proxy/github/mcp", 30, http.StatusOK, true)
+	assert.NoError(t, checkTeamRequestLimits(svc.ID, dev.ID))
+	model.RecordRequestStat(svc.ID, svc.Name, dev.ID, model.ProxyRequestTypeHTTP, "tools/call", "/proxy/github/mcp", 50, http.StatusOK, true)
+	assert.Error(t, checkTeamRequestLimits(svc.ID, dev.ID))
+	assert.NoError(t, checkTeamRequestLimits(svc.ID, outsider.ID))
+	assert.Equal(t, before+2, teamRequests())
+
+	// Members who leave lose access to the team's services
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/members/%d", teamPath, dev.ID), nil)
+	w, _ = serveJSON(t, devRouter, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, allowed, err = model.ResolveServiceAccess(dev, svc)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestTeams_OldestTeamTakesPrecedence(t *testing.T) {
+	teardown := setupTestEnvironmentForProxyHandler()
+	defer teardown()
+
+	dev := &model.User{Username: "dev", DisplayName: "dev", Role: common.RoleCommonUser, Status: common.UserStatusEnabled}
+	require.NoError(t, model.UserDB.Save(dev))
+	svc := &model.MCPService{Name: "github", DisplayName: "GitHub", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true, AllowUserOverride: true}
+	require.NoError(t, model.CreateService(svc))
+	option := &model.ConfigService{ServiceID: svc.ID, Key: "GITHUB_ORG", DisplayName: "GITHUB_ORG", Type: model.ConfigTypeString}
+	require.NoError(t, model.CreateConfigOption(option))
+
+	// dev joins the newer team first, so membership order does not decide
+	var teams []*model.Team
+	for _, name := range []string{"platform", "security"} {
+		team := &model.Team{Name: name, DisplayName: name}
+		require.NoError(t, model.SaveTeam(team))
+		teams = append(teams, team)
+	}
+	for _, team := range []*model.Team{teams[1], teams[0]} {
+		_, err := model.SaveTeamMember(team.ID, dev.ID, model.TeamRoleMember)
+		require.NoError(t, err)
+		require.NoError(t, model.SaveTeamConfig(&model.TeamConfig{TeamID: team.ID, ServiceID: svc.ID, ConfigID: option.ID, Value: team.Name}))
+		filterJSON, _ := json.Marshal(model.CapabilityFilter{Tools: model.FilterRule{Allow: []string{team.Name}}})
+		require.NoError(t, model.SaveServicePermission(&model.ServicePermission{ServiceID: svc.ID, SubjectType: model.PermissionSubjectTeam, SubjectID: team.ID, FilterJSON: string(filterJSON)}))
+	}
+
+	envs, err := model.GetTeamEnvsForUser(dev.ID, svc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "platform", envs["GITHUB_ORG"])
+	filter, allowed, err := model.ResolveServiceAccess(dev, svc)
+	require.NoError(t, err)
+	require.True(t, allowed)
+	assert.Equal(t, []string{"platform"}, filter.Tools.Allow)
+}
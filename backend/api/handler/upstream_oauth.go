@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/library/proxy"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamOAuthService loads the service of the request and checks the current user may manage its
+// OAuth authorization: their own for services authorized per user, everyone's for admins only.
+// It writes the error response and returns nil otherwise.
+func upstreamOAuthService(c *gin.Context) (*model.MCPService, int64) {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_service_id", lang), err)
+		return nil, 0
+	}
+	service, err := model.GetServiceByID(id)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("service_not_found", lang), err)
+		return nil, 0
+	}
+	if !service.OAuthEnabled {
+		common.RespErrorStr(c, http.StatusBadRequest, i18n.Translate("oauth_not_enabled", lang))
+		return nil, 0
+	}
+
+	userID := getUserIDFromContext(c)
+	user, err := model.GetUserById(userID, false)
+	if err != nil {
+		common.RespError(c, http.StatusUnauthorized, i18n.Translate("user_not_found", lang), err)
+		return nil, 0
+	}
+	if !service.OAuthPerUser && !user.HasPermission(model.PermissionServiceEdit) && c.Request.Method != http.MethodGet {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("oauth_admin_required", lang))
+		return nil, 0
+	}
+	if _, allowed, err := model.ResolveServiceAccess(user, service); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("oauth_authorize_failed", lang), err)
+		return nil, 0
+	} else if !allowed {
+		common.RespErrorStr(c, http.StatusForbidden, i18n.Translate("service_access_denied", lang))
+		return nil, 0
+	}
+	return service, userID
+}
+
+// upstreamOAuthCookie holds the key identifying the browser that starts upstream authorizations,
+// so that only it completes them
+const upstreamOAuthCookie = "upstream_oauth"
+
+// upstreamOAuthBrowserKey returns the key of the browser of the request, giving it one for the
+// browser session if it has none yet. The cookie is sent back on the redirect from the
+// authorization server.
+func upstreamOAuthBrowserKey(c *gin.Context) string {
+	key, err := c.Cookie(upstreamOAuthCookie)
+	if err != nil || key == "" {
+		key = common.GetUUID()
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(upstreamOAuthCookie, key, 0, "/api", "", c.Request.TLS != nil, true)
+	return key
+}
+
+// StartUpstreamOAuth godoc
+// @Summary Start authorizing an upstream with OAuth
+// @Description Return the authorization server URL to open in the browser. Services authorized per user are authorized for the current user, others for everyone, by an admin.
+// @Tags MCP Services
+// @Produce json
+// @Param id path int true "Service ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 403 {object} common.APIResponse
+// @Failure 502 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/oauth/authorize [post]
+func StartUpstreamOAuth(c *gin.Context) {
+	lang := c.GetString("lang")
+	service, userID := upstreamOAuthService(c)
+	if service == nil {
+		return
+	}
+	authorizationURL, err := proxy.StartOAuthAuthorization(c.Request.Context(), service, userID, upstreamOAuthBrowserKey(c))
+	if err != nil {
+		common.RespError(c, http.StatusBadGateway, i18n.Translate("oauth_authorize_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, gin.H{"authorization_url": authorizationURL})
+}
+
+// GetUpstreamOAuthStatus godoc
+// @Summary Get the OAuth authorization of an upstream
+// @Tags MCP Services
+// @Produce json
+// @Param id path int true "Service ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/oauth [get]
+func GetUpstreamOAuthStatus(c *gin.Context) {
+	lang := c.GetString("lang")
+	service, userID := upstreamOAuthService(c)
+	if service == nil {
+		return
+	}
+	status, err := proxy.GetOAuthStatus(service, userID)
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("oauth_status_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, status)
+}
+
+// RevokeUpstreamOAuth godoc
+// @Summary Revoke the OAuth authorization of an upstream
+// @Description Delete the stored token and shut down the instances using it
+// @Tags MCP Services
+// @Produce json
+// @Param id path int true "Service ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 403 {object} common.APIResponse
+// @Router /api/mcp_services/{id}/oauth [delete]
+func RevokeUpstreamOAuth(c *gin.Context) {
+	lang := c.GetString("lang")
+	service, userID := upstreamOAuthService(c)
+	if service == nil {
+		return
+	}
+	if err := proxy.RevokeOAuthAuthorization(service, userID); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("oauth_revoke_failed", lang), err)
+		return
+	}
+	common.RespSuccessStr(c, i18n.Translate("oauth_revoked", lang))
+}
+
+// UpstreamOAuthCallback godoc
+// @Summary OAuth redirect endpoint for upstream authorization servers
+// @Description Exchange the authorization code for a token, then redirect to the services page with the outcome. Only the browser that started the authorization completes it.
+// @Tags MCP Services
+// @Param state query string true "State of the authorization request"
+// @Param code query string false "Authorization code"
+// @Param error query string false "Error returned by the authorization server"
+// @Success 302
+// @Router /api/oauth/upstream/callback [get]
+func UpstreamOAuthCallback(c *gin.Context) {
+	var serviceID int64
+	var err error
+	if authErr := c.Query("error"); authErr != "" {
+		err = fmt.Errorf("authorization denied: %s %s", authErr, c.Query("error_description"))
+	} else if c.Query("code") == "" {
+		err = errors.New("authorization code missing")
+	} else {
+		browserKey, _ := c.Cookie(upstreamOAuthCookie)
+		serviceID, _, err = proxy.CompleteOAuthAuthorization(c.Request.Context(), c.Query("state"), c.Query("code"), browserKey)
+	}
+	result := url.Values{}
+	if err != nil {
+		common.SysLog(fmt.Sprintf("WARN: [OAuth] Upstream authorization failed: %v", err))
+		result.Set("oauth", "error")
+		result.Set("message", err.Error())
+	} else {
+		result.Set("oauth", "success")
+		result.Set("service_id", strconv.FormatInt(serviceID, 10))
+	}
+	c.Redirect(http.StatusFound, "/services?"+result.Encode())
+}
@@ -70,8 +70,14 @@ func GetUser(c *gin.Context) {
 		})
 		return
 	}
-	myRole := c.GetInt("role")
-	if myRole <= user.Role {
+	if user.IsServiceAccount {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": i18n.Translate("manage_service_account_separately", lang),
+		})
+		return
+	}
+	if !canManageUser(c, user) {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": i18n.Translate("no_permission_get_same_or_higher_user", lang),
@@ -104,17 +110,16 @@ func GenerateToken(c *gin.Context) {
 		})
 		return
 	}
-	user, err := model.GetUserById(id, true)
-	if err != nil {
+	// Replace the full access "Default" token; the token is only returned this once
+	if err := model.DeleteUserAPITokensByName(id, model.DefaultAPITokenName); err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": err.Error(),
 		})
 		return
 	}
-	user.Token = model.GenerateUserToken()
-
-	if err := user.Update(false); err != nil {
+	_, token, err := model.CreateAPIToken(id, model.DefaultAPITokenName, nil, false, 0)
+	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": err.Error(),
@@ -125,7 +130,7 @@ func GenerateToken(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
-		"data":    user.Token,
+		"data":    token,
 	})
 	return
 }
@@ -213,10 +218,15 @@ func UpdateUser(c *gin.Context) {
 		})
 		return
 	}
+	if originUser.IsServiceAccount {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": i18n.Translate("manage_service_account_separately", lang),
+		})
+		return
+	}
 
-	myRole := c.GetInt("role")
-
-	if myRole <= originUser.Role && int64(originUser.ID) != myID {
+	if int64(originUser.ID) != myID && !canManageUser(c, originUser) {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": i18n.Translate("no_permission_update_same_or_higher_user", lang),
@@ -228,34 +238,18 @@ func UpdateUser(c *gin.Context) {
 	if requestPayload.Role != nil {
 		requestedRole := *requestPayload.Role // Dereference the pointer to get the actual role value
 
-		// Only proceed with role checks if the role is actually different from current
-		if requestedRole != originUser.Role {
-			if int64(originUser.ID) == myID { // Trying to change own role
-				if requestedRole > myRole {
-					c.JSON(http.StatusOK, gin.H{
-						"success": false,
-						"message": i18n.Translate("no_permission_promote_self_to_higher_role", lang),
-					})
-					return
-				}
-			} else { // Trying to change another user's role
-				// Cannot set another user's role to be higher than my own role, unless I am root.
-				if requestedRole > myRole && myRole != common.RoleRootUser {
-					c.JSON(http.StatusOK, gin.H{
-						"success": false,
-						"message": i18n.Translate("no_permission_promote_other_to_higher_role", lang),
-					})
-					return
-				}
-			}
-			// General check: if not root, cannot assign any role (to self or other) that is greater than myRole.
-			if requestedRole > myRole && myRole != common.RoleRootUser {
-				c.JSON(http.StatusOK, gin.H{
-					"success": false,
-					"message": i18n.Translate("no_permission_set_role_higher_than_own", lang),
-				})
-				return
+		// Only proceed with role checks if the role is actually different from current.
+		// Nobody may give a role, to themselves or others, with permissions they lack.
+		if requestedRole != originUser.Role && !canGrantRole(c, requestedRole) {
+			key := "no_permission_promote_other_to_higher_role"
+			if int64(originUser.ID) == myID {
+				key = "no_permission_promote_self_to_higher_role"
 			}
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": i18n.Translate(key, lang),
+			})
+			return
 		}
 	}
 
@@ -385,8 +379,14 @@ func DeleteUser(c *gin.Context) {
 		})
 		return
 	}
-	myRole := c.GetInt("role")
-	if myRole <= originUser.Role {
+	if originUser.IsServiceAccount {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": i18n.Translate("manage_service_account_separately", lang),
+		})
+		return
+	}
+	if originUser.ID == getUserIDFromContext(c) || !canManageUser(c, originUser) {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": i18n.Translate("no_permission_delete_same_or_higher_user", lang),
@@ -544,8 +544,13 @@ func CreateUser(c *gin.Context) {
 		requestPayload.DisplayName = requestPayload.Username
 	}
 
-	myRole := c.GetInt("role")
-	if requestPayload.Role >= myRole {
+	// Set default role to common user if not provided
+	userRole := requestPayload.Role
+	if userRole == 0 {
+		userRole = common.RoleCommonUser
+	}
+
+	if !canGrantRole(c, userRole) {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": i18n.Translate("cannot_create_user_with_higher_or_equal_role", lang),
@@ -553,12 +558,6 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
-	// Set default role to common user if not provided
-	userRole := requestPayload.Role
-	if userRole == 0 {
-		userRole = common.RoleCommonUser
-	}
-
 	// Create a clean user object with the parsed data
 	cleanUser := model.User{
 		Username:    requestPayload.Username,
@@ -618,9 +617,15 @@ func ManageUser(c *gin.Context) {
 		}
 		return
 	}
+	if user.IsServiceAccount {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": i18n.Translate("manage_service_account_separately", lang),
+		})
+		return
+	}
 
-	myRole := c.GetInt("role")
-	if myRole <= user.Role && myRole != common.RoleRootUser {
+	if !canManageUser(c, user) {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": i18n.Translate("no_permission_update_same_or_higher_user", lang),
@@ -655,7 +660,7 @@ func ManageUser(c *gin.Context) {
 			return
 		}
 	case "promote":
-		if myRole != common.RoleRootUser {
+		if !canGrantRole(c, common.RoleAdminUser) {
 			c.JSON(http.StatusOK, gin.H{
 				"success": false,
 				"message": i18n.Translate("admin_cannot_promote_to_admin", lang),
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"toWers/backend/common"
+	"toWers/backend/common/i18n"
+	"toWers/backend/library/proxy"
+	"toWers/backend/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// virtualServerRequest is the request body for creating or updating a virtual server
+type virtualServerRequest struct {
+	Name        string                      `json:"name"`
+	DisplayName string                      `json:"display_name"`
+	Description string                      `json:"description"`
+	Enabled     *bool                       `json:"enabled"`
+	Members     []model.VirtualServerMember `json:"members"`
+}
+
+// ListVirtualServers godoc
+// @Summary List virtual servers
+// @Description List all virtual servers composed from installed MCP services
+// @Tags Virtual Servers
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/virtual_servers [get]
+func ListVirtualServers(c *gin.Context) {
+	lang := c.GetString("lang")
+	servers, err := model.GetAllVirtualServers()
+	if err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("get_virtual_server_list_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, servers)
+}
+
+// GetVirtualServer godoc
+// @Summary Get a virtual server
+// @Tags Virtual Servers
+// @Produce json
+// @Param id path int true "Virtual server ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Router /api/virtual_servers/{id} [get]
+func GetVirtualServer(c *gin.Context) {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_virtual_server_id", lang), err)
+		return
+	}
+	vs, err := model.GetVirtualServerByID(id)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("virtual_server_not_found", lang), err)
+		return
+	}
+	common.RespSuccess(c, vs)
+}
+
+// CreateVirtualServer godoc
+// @Summary Create a virtual server
+// @Description Compose several MCP services into one proxy endpoint, served at /proxy/{name}/sse and /proxy/{name}/mcp
+// @Tags Virtual Servers
+// @Accept json
+// @Produce json
+// @Param body body virtualServerRequest true "Virtual server"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/virtual_servers [post]
+func CreateVirtualServer(c *gin.Context) {
+	lang := c.GetString("lang")
+	var req virtualServerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+
+	vs := &model.VirtualServer{Enabled: true}
+	if err := applyVirtualServerRequest(vs, &req, lang); err != nil {
+		common.RespErrorStr(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := model.SaveVirtualServer(vs); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_virtual_server_failed", lang), err)
+		return
+	}
+	common.RespSuccess(c, vs)
+}
+
+// UpdateVirtualServer godoc
+// @Summary Update a virtual server
+// @Description Update a virtual server; running composed instances are rebuilt on the next request
+// @Tags Virtual Servers
+// @Accept json
+// @Produce json
+// @Param id path int true "Virtual server ID"
+// @Param body body virtualServerRequest true "Virtual server"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 404 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/virtual_servers/{id} [put]
+func UpdateVirtualServer(c *gin.Context) {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_virtual_server_id", lang), err)
+		return
+	}
+	vs, err := model.GetVirtualServerByID(id)
+	if err != nil {
+		common.RespError(c, http.StatusNotFound, i18n.Translate("virtual_server_not_found", lang), err)
+		return
+	}
+
+	var req virtualServerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_request_data", lang), err)
+		return
+	}
+	if err := applyVirtualServerRequest(vs, &req, lang); err != nil {
+		common.RespErrorStr(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := model.SaveVirtualServer(vs); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("save_virtual_server_failed", lang), err)
+		return
+	}
+	proxy.InvalidateVirtualServer(context.Background(), vs.ID)
+	common.RespSuccess(c, vs)
+}
+
+// DeleteVirtualServer godoc
+// @Summary Delete a virtual server
+// @Tags Virtual Servers
+// @Produce json
+// @Param id path int true "Virtual server ID"
+// @Security ApiKeyAuth
+// @Success 200 {object} common.APIResponse
+// @Failure 400 {object} common.APIResponse
+// @Failure 500 {object} common.APIResponse
+// @Router /api/virtual_servers/{id} [delete]
+func DeleteVirtualServer(c *gin.Context) {
+	lang := c.GetString("lang")
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		common.RespError(c, http.StatusBadRequest, i18n.Translate("invalid_virtual_server_id", lang), err)
+		return
+	}
+	if err := model.DeleteVirtualServer(id); err != nil {
+		common.RespError(c, http.StatusInternalServerError, i18n.Translate("delete_virtual_server_failed", lang), err)
+		return
+	}
+	proxy.InvalidateVirtualServer(context.Background(), id)
+	common.RespSuccessStr(c, i18n.Translate("virtual_server_deleted_successfully", lang))
+}
+
+// applyVirtualServerRequest validates req and copies it onto vs.
+// Names are shared with regular services under /proxy, so they must not collide with either.
+func applyVirtualServerRequest(vs *model.VirtualServer, req *virtualServerRequest, lang string) error {
+	if req.Name != "" {
+		vs.Name = req.Name
+	}
+	if vs.Name == "" {
+		return errors.New(i18n.Translate("service_name_cannot_be_empty", lang))
+	}
+	if existing, err := model.GetServiceByName(vs.Name); err == nil && existing != nil {
+		return fmt.Errorf(i18n.Translate("service_name_already_exists", lang), vs.Name)
+	}
+	if existing, err := model.GetVirtualServerByName(vs.Name); err == nil && existing != nil && existing.ID != vs.ID {
+		return fmt.Errorf(i18n.Translate("service_name_already_exists", lang), vs.Name)
+	}
+
+	if req.DisplayName != "" {
+		vs.DisplayName = req.DisplayName
+	}
+	if vs.DisplayName == "" {
+		vs.DisplayName = vs.Name
+	}
+	if req.Description != "" {
+		vs.Description = req.Description
+	}
+	if req.Enabled != nil {
+		vs.Enabled = *req.Enabled
+	}
+
+	if req.Members != nil {
+		prefixes := make(map[string]bool)
+		for _, member := range req.Members {
+			svc, err := model.GetServiceByID(member.ServiceID)
+			if err != nil || svc == nil {
+				return fmt.Errorf("%s: %d", i18n.Translate("service_not_found", lang), member.ServiceID)
+			}
+			prefix := member.Prefix
+			if prefix == "" {
+				prefix = svc.Name
+			}
+			if prefixes[prefix] {
+				return fmt.Errorf(i18n.Translate("virtual_server_duplicate_prefix", lang), prefix)
+			}
+			prefixes[prefix] = true
+		}
+		if err := vs.SetMembers(req.Members); err != nil {
+			return err
+		}
+	}
+	return nil
+}
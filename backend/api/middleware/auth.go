@@ -77,44 +77,64 @@ func UserAuth() func(c *gin.Context) {
 	}
 }
 
-// TokenAuth is a middleware for proxy endpoints that validates user tokens from URL parameters
-// It supports both JWT Bearer tokens in headers and user tokens in URL query parameters
+// TokenAuth is a middleware for proxy endpoints. MCP clients authorize through the OAuth flow of
+// toWers and send the access token as a Bearer token, which only grants the services the user
+// consented to. API tokens are accepted as well, in the header or the key query parameter, unless
+// the ProxyUserTokenAuthEnabled option is off; they may be limited to some services and to
+// read-only tools.
 func TokenAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var userID int64
 		var username string
 		var role int
+		serviceName := c.Param("serviceName")
 
-		// First, try to get user token from Authorization header
+		var tokenString string
 		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" {
-			parts := strings.Split(authHeader, " ")
-			if len(parts) == 2 && parts[0] == "Bearer" {
-				tokenString := parts[1]
-				user := model.ValidateUserTokenByTokenString(tokenString)
-				if user != nil && user.Status == common.UserStatusEnabled {
-					userID = user.ID
-					username = user.Username
-					role = user.Role
-				}
-			}
+		if parts := strings.Split(authHeader, " "); len(parts) == 2 && parts[0] == "Bearer" {
+			tokenString = parts[1]
 		}
 
-		// If header token validation failed or no header token, try user token from URL query parameter
-		if userID == 0 {
-			userToken := c.Query("key")
-			if userToken != "" {
-				user := model.ValidateUserTokenByTokenString(userToken)
-				if user != nil && user.Status == common.UserStatusEnabled {
-					userID = user.ID
-					username = user.Username
-					role = user.Role
+		if strings.HasPrefix(tokenString, service.MCPOAuthAccessTokenPrefix) {
+			token, user, err := service.ValidateMCPOAuthAccessToken(tokenString)
+			if err != nil {
+				proxyAuthChallenge(c, serviceName, `error="invalid_token"`)
+				c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid or expired access token"})
+				c.Abort()
+				return
+			}
+			if !token.AllowsService(serviceName) {
+				proxyAuthChallenge(c, serviceName, `error="insufficient_scope"`)
+				c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "The access token does not grant access to service: " + serviceName})
+				c.Abort()
+				return
+			}
+			userID = user.ID
+			username = user.Username
+			role = user.Role
+		} else if common.GetProxyUserTokenAuthEnabled() {
+			// API token from the Authorization header, then from the URL query parameter
+			for _, apiToken := range []string{tokenString, c.Query("key")} {
+				token, user, err := model.ValidateAPIToken(apiToken)
+				if err != nil {
+					continue
+				}
+				if !token.AllowsService(serviceName) {
+					c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "The API token does not grant access to service: " + serviceName})
+					c.Abort()
+					return
+				}
+				if err := token.RecordUse(c.ClientIP()); err != nil {
+					common.SysError(fmt.Sprintf("[TokenAuth] Failed to record use of API token %d: %v", token.ID, err))
 				}
+				userID = user.ID
+				username = user.Username
+				role = user.Role
+				c.Set("readOnly", token.ReadOnly)
+				break
 			}
 		}
 
-		// If still no valid user found, continue without authentication
-		// This allows the proxy to work in global mode if no valid authentication is provided
 		if userID > 0 {
 			c.Set("userID", userID)
 			c.Set("user_id", userID) // Also set this for compatibility
@@ -122,13 +142,26 @@ func TokenAuth() gin.HandlerFunc {
 			c.Set("role", role)
 			common.SysLog(fmt.Sprintf("[TokenAuth] Authenticated user %d (%s) for proxy request", userID, username))
 		} else {
-			common.SysLog("[TokenAuth] No valid authentication found, proceeding with global access")
+			// The proxy handler rejects the request; the challenge tells MCP clients where to authorize
+			proxyAuthChallenge(c, serviceName, "")
+			common.SysLog("[TokenAuth] No valid authentication found")
 		}
 
 		c.Next()
 	}
 }
 
+// proxyAuthChallenge sets the WWW-Authenticate header pointing MCP clients to the protected
+// resource metadata of a service (RFC 9728), from which they discover the authorization server
+func proxyAuthChallenge(c *gin.Context, serviceName, params string) {
+	challenge := fmt.Sprintf(`Bearer resource_metadata="%s/.well-known/oauth-protected-resource/proxy/%s", scope="%s%s"`,
+		service.MCPOAuthIssuer(), serviceName, model.OAuthScopePrefix, serviceName)
+	if params != "" {
+		challenge += ", " + params
+	}
+	c.Header("WWW-Authenticate", challenge)
+}
+
 // JWTAuth is a middleware that validates JWT tokens
 func JWTAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -266,6 +299,34 @@ func RootAuth() gin.HandlerFunc {
 	}
 }
 
+// RequirePermission middleware verifies the user has the permission, granted by their built-in
+// role or their custom role. The user is loaded again so role changes apply immediately.
+// Note: This middleware assumes JWTAuth has already been called to set user info in context
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := model.GetUserById(c.GetInt64("user_id"), false)
+		if err != nil || user == nil || user.Status != common.UserStatusEnabled {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"message": "Unauthorized operation, not logged in or invalid token",
+			})
+			c.Abort()
+			return
+		}
+
+		if !user.HasPermission(permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"message": "Permission required: " + permission,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // NoTokenAuth is a special middleware for endpoints that shouldn't use token authentication
 // It's needed because some endpoints might already use session authentication
 func NoTokenAuth() gin.HandlerFunc {
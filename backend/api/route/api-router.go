@@ -3,6 +3,7 @@ package route
 import (
 	"toWers/backend/api/handler"
 	"toWers/backend/api/middleware"
+	"toWers/backend/model"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,6 +23,7 @@ func SetApiRouter(route *gin.Engine) {
 		apiRouter.GET("/oauth/github", middleware.CriticalRateLimit(), handler.GitHubOAuth)
 		apiRouter.GET("/oauth/google", middleware.CriticalRateLimit(), handler.GoogleOAuth)
 		apiRouter.GET("/oauth/wechat", middleware.CriticalRateLimit(), handler.WeChatAuth)
+		apiRouter.GET("/oauth/upstream/callback", middleware.CriticalRateLimit(), handler.UpstreamOAuthCallback)
 
 		// Authentication routes
 		authRoutes := apiRouter.Group("/auth")
@@ -42,6 +44,24 @@ func SetApiRouter(route *gin.Engine) {
 			authOauthRoutes.GET("/email/bind", middleware.CriticalRateLimit(), handler.EmailBind)
 		}
 
+		// Authorization server of the /proxy endpoints for MCP clients
+		mcpOAuthRoutes := apiRouter.Group("/mcp_oauth")
+		{
+			mcpOAuthRoutes.POST("/register", middleware.CriticalRateLimit(), handler.RegisterMCPOAuthClient)
+			mcpOAuthRoutes.GET("/authorize", handler.AuthorizeMCPOAuth)
+			mcpOAuthRoutes.POST("/token", handler.MCPOAuthToken)
+
+			// Consent of the logged-in user
+			consentRoutes := mcpOAuthRoutes.Group("/")
+			consentRoutes.Use(middleware.JWTAuth())
+			{
+				consentRoutes.GET("/requests/:id", handler.GetMCPOAuthRequest)
+				consentRoutes.POST("/requests/:id", handler.DecideMCPOAuthRequest)
+				consentRoutes.GET("/consents", handler.ListMCPOAuthConsents)
+				consentRoutes.DELETE("/consents/:client_id", handler.RevokeMCPOAuthConsent)
+			}
+		}
+
 		// User routes - keeping legacy endpoints for backwards compatibility
 		apiRouter.POST("/user/register", middleware.CriticalRateLimit(), middleware.TurnstileCheck(), handler.Register)
 		apiRouter.POST("/user/login", middleware.CriticalRateLimit(), handler.Login)
@@ -57,14 +77,18 @@ func SetApiRouter(route *gin.Engine) {
 				selfRoute.GET("/self", handler.GetSelf)
 				selfRoute.PUT("/self", handler.UpdateSelf)
 				selfRoute.DELETE("/self", handler.DeleteSelf)
+				selfRoute.GET("/self/permissions", handler.GetSelfPermissions)
 				selfRoute.GET("/token", handler.GenerateToken)
+				selfRoute.GET("/tokens", handler.ListAPITokens)
+				selfRoute.POST("/tokens", handler.CreateAPIToken)
+				selfRoute.DELETE("/tokens/:id", handler.DeleteAPIToken)
 				selfRoute.POST("/change-password", handler.ChangePassword)
 			}
 
-			// Admin-only endpoints
+			// User management endpoints
 			adminRoute := userRoute.Group("/")
-			adminRoute.Use(middleware.JWTAuth())   // First authenticate with JWT
-			adminRoute.Use(middleware.AdminAuth()) // Then check admin privileges
+			adminRoute.Use(middleware.JWTAuth())                                     // First authenticate with JWT
+			adminRoute.Use(middleware.RequirePermission(model.PermissionUserManage)) // Then check the permission
 			{
 				adminRoute.GET("/", handler.GetAllUsers)
 				adminRoute.GET("/search", handler.SearchUsers)
@@ -73,13 +97,31 @@ func SetApiRouter(route *gin.Engine) {
 				adminRoute.POST("/manage", handler.ManageUser)
 				adminRoute.PUT("/", handler.UpdateUser)
 				adminRoute.DELETE("/:id", handler.DeleteUser)
+
+				// Service accounts, managed separately from human users
+				adminRoute.GET("/service_accounts", handler.ListServiceAccounts)
+				adminRoute.POST("/service_accounts", handler.CreateServiceAccount)
+			}
+
+			// Service account endpoints, also open to the admins of the team owning the account
+			serviceAccountRoute := userRoute.Group("/service_accounts")
+			serviceAccountRoute.Use(middleware.JWTAuth())
+			{
+				serviceAccountRoute.PUT("/:id", handler.UpdateServiceAccount)
+				serviceAccountRoute.DELETE("/:id", handler.DeleteServiceAccount)
+				serviceAccountRoute.GET("/:id/tokens", handler.ListServiceAccountTokens)
+				serviceAccountRoute.POST("/:id/tokens", handler.CreateServiceAccountToken)
+				serviceAccountRoute.DELETE("/:id/tokens/:token_id", handler.DeleteServiceAccountToken)
+				serviceAccountRoute.GET("/:id/env_vars", handler.GetServiceAccountEnvVars)
+				serviceAccountRoute.PATCH("/:id/env_var", handler.PatchServiceAccountEnvVar)
+				serviceAccountRoute.GET("/:id/usage", handler.GetServiceAccountUsage)
 			}
 		}
 
-		// Option routes (Root admin only)
+		// Option routes (root admins by default)
 		optionRoute := apiRouter.Group("/option")
-		optionRoute.Use(middleware.JWTAuth())  // First authenticate with JWT
-		optionRoute.Use(middleware.RootAuth()) // Then check root privileges
+		optionRoute.Use(middleware.JWTAuth())                                     // First authenticate with JWT
+		optionRoute.Use(middleware.RequirePermission(model.PermissionOptionEdit)) // Then check the permission
 		{
 			optionRoute.GET("/", handler.GetOptions)
 			optionRoute.PUT("/", handler.UpdateOption)
@@ -92,16 +134,24 @@ func SetApiRouter(route *gin.Engine) {
 			mcpServiceRoute.Use(middleware.JWTAuth())
 			{
 				mcpServiceRoute.POST("/:id/health/check", handler.CheckMCPServiceHealth)
+				mcpServiceRoute.GET("/:id/oauth", handler.GetUpstreamOAuthStatus)
+				mcpServiceRoute.POST("/:id/oauth/authorize", handler.StartUpstreamOAuth)
+				mcpServiceRoute.DELETE("/:id/oauth", handler.RevokeUpstreamOAuth)
 			}
 
-			// Admin-only endpoints (write operations)
+			// Write operations
 			adminMCPServiceRoute := mcpServiceRoute.Group("/")
-			adminMCPServiceRoute.Use(middleware.JWTAuth())   // First authenticate with JWT
-			adminMCPServiceRoute.Use(middleware.AdminAuth()) // Then check admin privileges
+			adminMCPServiceRoute.Use(middleware.JWTAuth())                                      // First authenticate with JWT
+			adminMCPServiceRoute.Use(middleware.RequirePermission(model.PermissionServiceEdit)) // Then check the permission
 			{
 				adminMCPServiceRoute.PUT("/:id", handler.UpdateMCPService)
 				adminMCPServiceRoute.POST("/:id/toggle", handler.ToggleMCPService)
+				adminMCPServiceRoute.GET("/:id/permissions", handler.ListServicePermissions)
+				adminMCPServiceRoute.POST("/:id/permissions", handler.CreateServicePermission)
+				adminMCPServiceRoute.PUT("/:id/permissions/:permission_id", handler.UpdateServicePermission)
+				adminMCPServiceRoute.DELETE("/:id/permissions/:permission_id", handler.DeleteServicePermission)
 			}
+			mcpServiceRoute.GET("/:id/logs", middleware.RequirePermission(model.PermissionServiceViewLogs), handler.GetMCPServiceLogs)
 		}
 
 		// Market API routes
@@ -115,9 +165,9 @@ func SetApiRouter(route *gin.Engine) {
 			marketRoute.GET("/install_status/:id", handler.GetInstallationStatus)
 			marketRoute.PATCH("/env_var", handler.PatchEnvVar)
 
-			// Admin-only endpoints
+			// Installation endpoints
 			adminMarketRoute := marketRoute.Group("/")
-			adminMarketRoute.Use(middleware.AdminAuth()) // JWTAuth already applied by parent group
+			adminMarketRoute.Use(middleware.RequirePermission(model.PermissionServiceInstall)) // JWTAuth already applied by parent group
 			{
 				adminMarketRoute.POST("/install_or_add_service", handler.InstallOrAddService)
 				adminMarketRoute.POST("/batch-import", handler.StartBatchImport)
@@ -126,6 +176,68 @@ func SetApiRouter(route *gin.Engine) {
 			}
 		}
 
+		// Virtual server routes
+		virtualServerRoute := apiRouter.Group("/virtual_servers")
+		virtualServerRoute.Use(middleware.JWTAuth())
+		virtualServerRoute.Use(middleware.RequirePermission(model.PermissionVirtualServerManage))
+		{
+			virtualServerRoute.GET("", handler.ListVirtualServers)
+			virtualServerRoute.POST("", handler.CreateVirtualServer)
+			virtualServerRoute.GET("/:id", handler.GetVirtualServer)
+			virtualServerRoute.PUT("/:id", handler.UpdateVirtualServer)
+			virtualServerRoute.DELETE("/:id", handler.DeleteVirtualServer)
+		}
+
+		// Team routes. Members see their teams; team admins manage members, env config, usage and service accounts.
+		teamRoute := apiRouter.Group("/teams")
+		teamRoute.Use(middleware.JWTAuth())
+		{
+			teamRoute.GET("", handler.ListTeams)
+			teamRoute.GET("/:id", handler.GetTeam)
+			teamRoute.GET("/:id/members", handler.ListTeamMembers)
+			teamRoute.POST("/:id/members", handler.AddTeamMember)
+			teamRoute.PUT("/:id/members/:user_id", handler.UpdateTeamMember)
+			teamRoute.DELETE("/:id/members/:user_id", handler.RemoveTeamMember)
+			teamRoute.GET("/:id/env_vars", handler.GetTeamEnvVars)
+			teamRoute.PATCH("/:id/env_var", handler.PatchTeamEnvVar)
+			teamRoute.GET("/:id/usage", handler.GetTeamUsage)
+			teamRoute.GET("/:id/service_accounts", handler.ListTeamServiceAccounts)
+			teamRoute.POST("/:id/service_accounts", handler.CreateTeamServiceAccount)
+
+			// Team management endpoints
+			adminTeamRoute := teamRoute.Group("")
+			adminTeamRoute.Use(middleware.RequirePermission(model.PermissionTeamManage)) // JWTAuth already applied by parent group
+			{
+				adminTeamRoute.POST("", handler.CreateTeam)
+				adminTeamRoute.PUT("/:id", handler.UpdateTeam)
+				adminTeamRoute.DELETE("/:id", handler.DeleteTeam)
+			}
+		}
+
+		// Custom role routes
+		roleRoute := apiRouter.Group("/roles")
+		roleRoute.Use(middleware.JWTAuth())
+		roleRoute.Use(middleware.RequirePermission(model.PermissionRoleManage))
+		{
+			roleRoute.GET("/permissions", handler.ListPermissions)
+			roleRoute.GET("", handler.ListCustomRoles)
+			roleRoute.POST("", handler.CreateCustomRole)
+			roleRoute.PUT("/:id", handler.UpdateCustomRole)
+			roleRoute.DELETE("/:id", handler.DeleteCustomRole)
+			roleRoute.PUT("/users/:user_id", handler.AssignCustomRole)
+		}
+
+		// Running MCP instance routes
+		mcpInstanceRoute := apiRouter.Group("/mcp_instances")
+		mcpInstanceRoute.Use(middleware.JWTAuth())
+		mcpInstanceRoute.Use(middleware.RequirePermission(model.PermissionServiceRestart))
+		{
+			mcpInstanceRoute.GET("", handler.ListMCPInstances)
+			mcpInstanceRoute.GET("/:key", handler.GetMCPInstance)
+			mcpInstanceRoute.POST("/:key/restart", handler.RestartMCPInstance)
+			mcpInstanceRoute.POST("/:key/kill", handler.KillMCPInstance)
+		}
+
 		// SSE endpoint for batch import progress (no middleware, handles auth internally)
 		// This must be outside the marketRoute group to avoid JWTAuth middleware
 		apiRouter.GET("/mcp_market/batch-import/progress/:task_id", handler.StreamBatchImportProgress)
@@ -162,6 +274,11 @@ func SetApiRouter(route *gin.Engine) {
 		analyticsRoute.GET("/system/overview", handler.GetSystemOverview)
 	}
 
+	// OAuth discovery for MCP clients of the /proxy endpoints
+	route.GET("/.well-known/oauth-protected-resource", handler.GetProtectedResourceMetadata)
+	route.GET("/.well-known/oauth-protected-resource/*resource", handler.GetProtectedResourceMetadata)
+	route.GET("/.well-known/oauth-authorization-server", handler.GetAuthorizationServerMetadata)
+
 	// Define routes under /proxy, outside the /api group
 	proxyRouter := route.Group("/proxy")
 	proxyRouter.Use(middleware.LangMiddleware()) // Apply similar general middlewares
@@ -1,5 +1,10 @@
 package common
 
+import (
+	"strconv"
+	"strings"
+)
+
 // GetGitHubClientId gets GitHub client ID
 func GetGitHubClientId() string {
 	return OptionMap["GitHubClientId"]
@@ -116,3 +121,33 @@ func GetEnableGzip() bool {
 	// We treat any value other than "false" as true for safety.
 	return OptionMap["EnableGzip"] != "false"
 }
+
+// GetProxyUserTokenAuthEnabled checks whether /proxy endpoints still accept user API tokens,
+// in the Authorization header or the key query parameter, besides OAuth access tokens.
+// Defaults to true if the option is not explicitly set to "false".
+func GetProxyUserTokenAuthEnabled() bool {
+	return OptionMap["ProxyUserTokenAuthEnabled"] != "false"
+}
+
+// GetMaxLiveInstances gets the cap on MCP instances running at once across all services.
+// 0 (or an unset or invalid value) means no cap.
+func GetMaxLiveInstances() int {
+	limit, err := strconv.Atoi(OptionMap["MaxLiveInstances"])
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// GetEnvPassthrough gets the environment variables of toWers that MCP processes may inherit
+// beyond the minimal baseline. Entries ending with * allow every variable with that prefix.
+func GetEnvPassthrough() []string {
+	return ParseEnvPassthrough(OptionMap["EnvPassthrough"])
+}
+
+// ParseEnvPassthrough splits an EnvPassthrough value separated by commas or whitespace
+func ParseEnvPassthrough(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
@@ -17,6 +17,11 @@ var HomePageLink = ""
 // Any options with "Secret", "Token" in its key won't be return by GetOptions
 
 var SessionSecret = uuid.New().String()
+
+// SecretEncryptionKey encrypts credentials stored in the database, such as upstream OAuth tokens.
+// Set by LoadSecretEncryptionKey; stored credentials cannot be read anymore once it changes, so
+// none are encrypted while it is empty.
+var SecretEncryptionKey = ""
 var SQLitePath = "data/toWers.db"
 
 var OptionMap = make(map[string]string)
@@ -1,6 +1,20 @@
 package common
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 func Password2Hash(password string) (string, error) {
 	passwordBytes := []byte(password)
@@ -12,3 +26,98 @@ func ValidatePasswordAndHash(password string, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// ErrNoSecretEncryptionKey is returned when credentials are encrypted or decrypted without a stable key
+var ErrNoSecretEncryptionKey = errors.New("no SECRET_ENCRYPTION_KEY is configured")
+
+// LoadSecretEncryptionKey sets SecretEncryptionKey, unless it was configured, from the secret.key
+// file next to the database, generating the file on first start so the key survives restarts
+func LoadSecretEncryptionKey() error {
+	if SecretEncryptionKey != "" {
+		return nil
+	}
+	if SQLitePath == ":memory:" {
+		return ErrNoSecretEncryptionKey
+	}
+	path := filepath.Join(filepath.Dir(SQLitePath), "secret.key")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		data = []byte(hex.EncodeToString(key))
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return fmt.Errorf("failed to save the generated key to %s: %w", path, err)
+		}
+		SysLog("[Secrets] Generated the secret encryption key in " + path + ", keep it along with the database")
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	SecretEncryptionKey = strings.TrimSpace(string(data))
+	if SecretEncryptionKey == "" {
+		return fmt.Errorf("%s is empty", path)
+	}
+	return nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	if SecretEncryptionKey == "" {
+		return nil, ErrNoSecretEncryptionKey
+	}
+	key := sha256.Sum256([]byte(SecretEncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret encrypts a credential with SecretEncryptionKey for storage
+func EncryptSecret(plaintext string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+// DecryptSecret decrypts a credential encrypted by EncryptSecret
+func DecryptSecret(ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("secret cannot be decrypted, was SECRET_ENCRYPTION_KEY changed?")
+	}
+	return string(plaintext), nil
+}
+
+// GenerateSecretToken returns a random token starting with prefix, for credentials handed to clients
+func GenerateSecretToken(prefix string) (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// HashToken returns the SHA-256 of a token, which is what gets stored of credentials that are
+// only ever compared
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
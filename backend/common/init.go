@@ -20,6 +20,9 @@ var (
 // UploadPath Maybe override by ENV_VAR
 var UploadPath = "upload"
 
+// SandboxBaseDir holds the work directories of sandboxed stdio services. Maybe override by ENV_VAR
+var SandboxBaseDir = "data/sandbox"
+
 func PrintHelp() {
 	fmt.Println("Copyright (C) 2025 Buru. All rights reserved.")
 	fmt.Println("GitHub: https://github.com/burugo/toWers")
@@ -45,6 +48,9 @@ func init() {
 	if os.Getenv("UPLOAD_PATH") != "" {
 		UploadPath = os.Getenv("UPLOAD_PATH")
 	}
+	if os.Getenv("SANDBOX_DIR") != "" {
+		SandboxBaseDir = os.Getenv("SANDBOX_DIR")
+	}
 	if os.Getenv("JWT_SECRET") != "" {
 		JWTSecret = os.Getenv("JWT_SECRET")
 	}
@@ -53,6 +59,12 @@ func init() {
 	} else if os.Getenv("JWT_SECRET") != "" {
 		JWTRefreshSecret = os.Getenv("JWT_SECRET")
 	}
+	if os.Getenv("SECRET_ENCRYPTION_KEY") != "" {
+		SecretEncryptionKey = os.Getenv("SECRET_ENCRYPTION_KEY")
+	} else if os.Getenv("SESSION_SECRET") != "" {
+		// A configured session secret is as stable as a dedicated key, and encrypted what earlier versions stored
+		SecretEncryptionKey = SessionSecret
+	}
 	if os.Getenv("PORT") != "" {
 		portInt, err := strconv.Atoi(os.Getenv("PORT"))
 		if err != nil {
@@ -34,6 +34,7 @@ type InstallationTask struct {
 	Command          string                // Command
 	Args             []string              // Arguments list
 	EnvVars          map[string]string     // Environment variables
+	SandboxPolicy    model.SandboxPolicy   // Execution policy the package is probed under
 	Status           InstallationStatus    // Status
 	StartTime        time.Time             // Start time
 	EndTime          time.Time             // End time
@@ -119,9 +120,12 @@ func (m *InstallationManager) runInstallationTask(task *InstallationTask) {
 	var output string
 	var serverInfo *MCPServerInfo
 
+	// Probe the package under the execution policy it was installed with
+	sandboxPolicy := task.SandboxPolicy
+
 	switch task.PackageManager {
 	case "npm":
-		serverInfo, err = InstallNPMPackage(ctx, task.PackageName, task.Version, task.Command, task.Args, "", task.EnvVars)
+		serverInfo, err = InstallNPMPackage(ctx, task.PackageName, task.Version, task.Command, task.Args, "", task.EnvVars, sandboxPolicy)
 		if err == nil && serverInfo != nil {
 			output = fmt.Sprintf("NPM package %s initialized. Server: %s, Version: %s, Protocol: %s", task.PackageName, serverInfo.Name, serverInfo.Version, serverInfo.ProtocolVersion)
 		} else if err == nil {
@@ -130,7 +134,7 @@ func (m *InstallationManager) runInstallationTask(task *InstallationTask) {
 			output = fmt.Sprintf("InstallNPMPackage error: %v", err)
 		}
 	case "pypi", "uv", "pip":
-		serverInfo, err = InstallPyPIPackage(ctx, task.PackageName, task.Version, task.Command, task.Args, "", task.EnvVars)
+		serverInfo, err = InstallPyPIPackage(ctx, task.PackageName, task.Version, task.Command, task.Args, "", task.EnvVars, sandboxPolicy)
 		if err == nil && serverInfo != nil {
 			output = fmt.Sprintf("PyPI package %s initialized. Server: %s, Version: %s, Protocol: %s", task.PackageName, serverInfo.Name, serverInfo.Version, serverInfo.ProtocolVersion)
 		} else if err == nil {
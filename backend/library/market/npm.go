@@ -16,9 +16,11 @@ import (
 	"time"
 
 	"toWers/backend/common"
+	"toWers/backend/library/sandbox"
 	"toWers/backend/model"
 
 	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
 	"github.com/mark3labs/mcp-go/mcp"
 )
 
@@ -404,23 +406,26 @@ func ConvertNPMToSearchResult(ctx context.Context, npmResult *NPMSearchResult, i
 
 // InstallNPMPackage is a placeholder for the actual implementation of installing an npm package.
 // It will handle the installation and then attempt to initialize it as an MCP server.
-func InstallNPMPackage(ctx context.Context, packageName, version, command string, args []string, workDir string, envVars map[string]string) (*MCPServerInfo, error) {
+func InstallNPMPackage(ctx context.Context, packageName, version, command string, args []string, workDir string, envVars map[string]string, policy model.SandboxPolicy) (*MCPServerInfo, error) {
 	// If a specific version is requested, we might need to adjust the package name for installation,
 	// but for now, the primary command execution relies on the provided `command` and `args`.
 	// The installation logic via `npx` implicitly handles fetching the package.
 
-	// Prepare effective environment variables
-	env := os.Environ()
+	// Prepare the package's own environment variables; the launcher adds the inherited baseline
+	env := make([]string, 0, len(envVars))
 	for key, value := range envVars {
 		env = append(env, fmt.Sprintf("%s=%s", key, value))
 	}
 
 	// Use the provided command and args to create the stdio client
 	// The logic assumes that if `command` is 'npx', the installation will be handled automatically.
-	mcpClient, err := client.NewStdioMCPClient(command, env, args...)
+	// The probe runs under the same execution policy as the installed service will
+	launcher := sandbox.New(packageName, policy)
+	mcpClient, err := client.NewStdioMCPClientWithOptions(command, env, args, transport.WithCommandFunc(launcher.Command))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MCP client: %w", err)
 	}
+	launcher.Watch(ctx)
 	defer mcpClient.Close()
 
 	// Set context and timeout for MCP initialization
@@ -6,6 +6,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"toWers/backend/model"
 )
 
 func TestFindMCPConfigInReadme(t *testing.T) {
@@ -219,7 +221,7 @@ func TestInstallNPMPackage(t *testing.T) {
 		"TEST_ENV_VAR": "test_value",
 	}
 
-	serverInfo, err := InstallNPMPackage(ctx, packageName, version, command, args, workDir, envVars)
+	serverInfo, err := InstallNPMPackage(ctx, packageName, version, command, args, workDir, envVars, model.SandboxPolicy{})
 	if err != nil {
 		t.Fatalf("Failed to install npm package: %v", err)
 	}
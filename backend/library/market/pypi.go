@@ -9,7 +9,11 @@ import (
 	"path/filepath"
 	"time"
 
+	"toWers/backend/library/sandbox"
+	"toWers/backend/model"
+
 	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
 	"github.com/mark3labs/mcp-go/mcp"
 	// Assuming MCPServerInfo is in the same package, or import if it's moved to a common place.
 	// For now, let's assume it's accessible as it's in the same package 'market'
@@ -34,7 +38,7 @@ func CheckUVXAvailable() bool {
 // InstallPyPIPackage installs a Python package using uv, creates a virtual environment,
 // and then attempts to initialize it as an MCP server.
 // workDir is currently unused, venvsBaseDir is used instead.
-func InstallPyPIPackage(ctx context.Context, packageName, version, command string, args []string, workDir string, envVars map[string]string) (*MCPServerInfo, error) {
+func InstallPyPIPackage(ctx context.Context, packageName, version, command string, args []string, workDir string, envVars map[string]string, policy model.SandboxPolicy) (*MCPServerInfo, error) {
 	if !CheckUVXAvailable() {
 		return nil, fmt.Errorf("uv command is not available")
 	}
@@ -46,8 +50,10 @@ func InstallPyPIPackage(ctx context.Context, packageName, version, command strin
 
 	pkgVenvDir := filepath.Join(pythonVenvsBaseDir, packageName, "venv")
 
-	// Create virtual environment using uv
+	// Create virtual environment using uv. Like the MCP processes, uv gets the inherited baseline
+	// and passthrough variables only, not the secrets in the environment of toWers.
 	venvCmd := exec.CommandContext(ctx, "uv", "venv", pkgVenvDir)
+	venvCmd.Env = sandbox.Environment(nil)
 	var stderrVenv bytes.Buffer
 	venvCmd.Stderr = &stderrVenv
 	if err := venvCmd.Run(); err != nil {
@@ -63,6 +69,7 @@ func InstallPyPIPackage(ctx context.Context, packageName, version, command strin
 
 	pythonExecutable := filepath.Join(pkgVenvDir, "bin", "python")
 	pipInstallCmd := exec.CommandContext(ctx, "uv", "pip", "install", packageToInstall, "--python", pythonExecutable)
+	pipInstallCmd.Env = sandbox.Environment(nil)
 	var stdoutPip, stderrPip bytes.Buffer
 	pipInstallCmd.Stdout = &stdoutPip
 	pipInstallCmd.Stderr = &stderrPip
@@ -92,16 +99,20 @@ func InstallPyPIPackage(ctx context.Context, packageName, version, command strin
 	}
 
 	// Prepare environment variables for the MCP client
-	effectiveEnv := os.Environ() // Get current environment
+	// The launcher adds the inherited baseline
+	effectiveEnv := make([]string, 0, len(envVars))
 	for key, value := range envVars {
 		effectiveEnv = append(effectiveEnv, fmt.Sprintf("%s=%s", key, value))
 	}
 
 	// Use mark3labs/mcp-go to create stdio client with proper command and args
-	mcpClient, err := client.NewStdioMCPClient(mcpCommandPath, effectiveEnv, args...)
+	// The probe runs under the same execution policy as the installed service will
+	launcher := sandbox.New(packageName, policy)
+	mcpClient, err := client.NewStdioMCPClientWithOptions(mcpCommandPath, effectiveEnv, args, transport.WithCommandFunc(launcher.Command))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MCP client for %s: %w", packageName, err)
 	}
+	launcher.Watch(ctx)
 	defer mcpClient.Close()
 
 	// Set context and timeout for MCP initialization
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// capabilityFilterFunc returns the filter currently configured for a service.
+// It is evaluated on every list and call, so admin changes apply without restarting the instance.
+type capabilityFilterFunc func() model.CapabilityFilter
+
+// allowAllCapabilities is used where no service filter applies
+func allowAllCapabilities() model.CapabilityFilter {
+	return model.CapabilityFilter{}
+}
+
+// capabilityFilterCache holds the filters resolved by liveCapabilityFilter by service ID. It is
+// emptied when model.AccessVersion changes, i.e. when a service or its permissions are saved.
+var capabilityFilterCache = struct {
+	sync.Mutex
+	version int64
+	filters map[int64]model.CapabilityFilter
+}{filters: make(map[int64]model.CapabilityFilter)}
+
+// liveCapabilityFilter returns the service's current filter, read from the database once per change
+// of the access settings, falling back to the filter the instance was created with if the lookup fails.
+func liveCapabilityFilter(svc *model.MCPService) capabilityFilterFunc {
+	fallback, err := svc.GetCapabilityFilter()
+	if err != nil {
+		common.SysError(fmt.Sprintf("Invalid FilterJSON for service %s (ID: %d): %v. No capability filter applied.", svc.Name, svc.ID, err))
+	}
+	if svc.ID == 0 {
+		return func() model.CapabilityFilter { return fallback }
+	}
+	serviceID := svc.ID
+	return func() model.CapabilityFilter {
+		if model.MCPServiceDB == nil {
+			return fallback
+		}
+		version := model.AccessVersion()
+		capabilityFilterCache.Lock()
+		if capabilityFilterCache.version != version {
+			capabilityFilterCache.version = version
+			capabilityFilterCache.filters = make(map[int64]model.CapabilityFilter)
+		}
+		filter, cached := capabilityFilterCache.filters[serviceID]
+		capabilityFilterCache.Unlock()
+		if cached {
+			return filter
+		}
+
+		current, err := model.GetServiceByID(serviceID)
+		if err != nil || current == nil {
+			return fallback
+		}
+		filter, err = current.GetCapabilityFilter()
+		if err != nil {
+			return fallback
+		}
+		capabilityFilterCache.Lock()
+		// A change saved while reading bumped the version; the next evaluation reads it again
+		if capabilityFilterCache.version == version {
+			capabilityFilterCache.filters[serviceID] = filter
+		}
+		capabilityFilterCache.Unlock()
+		return filter
+	}
+}
+
+// AccessResolver reports whether the caller of a request may use a service, and the capability
+// filter that applies to them within it.
+type AccessResolver func(serviceID int64) (model.CapabilityFilter, bool)
+
+type accessResolverKey struct{}
+
+// WithAccessResolver attaches the caller's access resolver to a request context.
+// Handlers of the proxied MCP servers consult it before listing or forwarding anything.
+func WithAccessResolver(ctx context.Context, resolver AccessResolver) context.Context {
+	return context.WithValue(ctx, accessResolverKey{}, resolver)
+}
+
+// NewUserAccessResolver resolves access for user through model.ResolveServiceAccess,
+// memoizing decisions for the lifetime of the resolver (one request).
+// Lookup failures deny access.
+func NewUserAccessResolver(user *model.User) AccessResolver {
+	type decision struct {
+		filter  model.CapabilityFilter
+		allowed bool
+	}
+	var mu sync.Mutex
+	decisions := make(map[int64]decision)
+	return func(serviceID int64) (model.CapabilityFilter, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d, ok := decisions[serviceID]; ok {
+			return d.filter, d.allowed
+		}
+		var d decision
+		svc, err := model.GetServiceByID(serviceID)
+		if err == nil && svc != nil {
+			d.filter, d.allowed, err = model.ResolveServiceAccess(user, svc)
+		}
+		if err != nil {
+			common.SysError(fmt.Sprintf("[Access] Failed to resolve access of user %d to service %d: %v", user.ID, serviceID, err))
+			d = decision{}
+		}
+		decisions[serviceID] = d
+		return d.filter, d.allowed
+	}
+}
+
+// callerAccess returns the access filter of the caller in ctx for a service.
+// Requests without a resolver (internal calls such as health checks) are unrestricted.
+func callerAccess(ctx context.Context, serviceID int64) (model.CapabilityFilter, bool) {
+	resolver, ok := ctx.Value(accessResolverKey{}).(AccessResolver)
+	if !ok || resolver == nil {
+		return model.CapabilityFilter{}, true
+	}
+	return resolver(serviceID)
+}
+
+type readOnlyKey struct{}
+
+// WithReadOnly marks the caller of a request as limited to read-only tools, such as a request
+// authenticated with a read-only API token.
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+// readOnlyAllows reports whether the caller in ctx may use tool: read-only callers only get tools
+// annotated read-only, as exposed after overrides.
+func readOnlyAllows(ctx context.Context, tool mcp.Tool) bool {
+	if readOnly, _ := ctx.Value(readOnlyKey{}).(bool); !readOnly {
+		return true
+	}
+	return tool.Annotations.ReadOnlyHint != nil && *tool.Annotations.ReadOnlyHint
+}
+
+// capabilityGuard combines a service's own capability filter with the per-caller access filter.
+// Filters always refer to upstream names; aliases translates tool names rewritten by overrides.
+// retired holds resource templates the upstream stopped listing, which mcp-go cannot unregister.
+type capabilityGuard struct {
+	serviceID int64
+	filter    capabilityFilterFunc
+	aliases   *toolAliases
+	retired   *nameSet
+}
+
+func (g capabilityGuard) allowsTool(ctx context.Context, name string) bool {
+	access, ok := callerAccess(ctx, g.serviceID)
+	return ok && g.filter().Tools.Allows(name) && access.Tools.Allows(name)
+}
+
+func (g capabilityGuard) allowsPrompt(ctx context.Context, name string) bool {
+	access, ok := callerAccess(ctx, g.serviceID)
+	return ok && g.filter().Prompts.Allows(name) && access.Prompts.Allows(name)
+}
+
+func (g capabilityGuard) allowsResource(ctx context.Context, uri string) bool {
+	access, ok := callerAccess(ctx, g.serviceID)
+	return ok && g.filter().Resources.Allows(uri) && access.Resources.Allows(uri)
+}
+
+func (g capabilityGuard) allowsTemplate(ctx context.Context, template string) bool {
+	return !g.retired.has(template) && g.allowsResource(ctx, template)
+}
+
+// allowsTemplateRead checks a concrete URI read through a resource template:
+// the template must be allowed, and the URI itself must not be explicitly denied.
+func (g capabilityGuard) allowsTemplateRead(ctx context.Context, template, uri string) bool {
+	access, ok := callerAccess(ctx, g.serviceID)
+	if !ok || g.filter().Resources.Denies(uri) || access.Resources.Denies(uri) {
+		return false
+	}
+	return g.allowsTemplate(ctx, template)
+}
+
+// withCapabilityToolFilter hides tools the caller may not use from tools/list at request time.
+func withCapabilityToolFilter(guard capabilityGuard) mcpserver.ServerOption {
+	return mcpserver.WithToolFilter(func(ctx context.Context, tools []mcp.Tool) []mcp.Tool {
+		allowed := make([]mcp.Tool, 0, len(tools))
+		for _, tool := range tools {
+			if guard.allowsTool(ctx, guard.aliases.upstreamName(tool.Name)) && readOnlyAllows(ctx, tool) {
+				allowed = append(allowed, tool)
+			}
+		}
+		return allowed
+	})
+}
+
+// withCapabilityListHooks hides prompts, resources and resource templates the caller may not use
+// from the corresponding list results at request time.
+func withCapabilityListHooks(guard capabilityGuard) mcpserver.ServerOption {
+	hooks := &mcpserver.Hooks{}
+	addCapabilityListHooks(hooks, guard)
+	return mcpserver.WithHooks(hooks)
+}
+
+// addCapabilityListHooks registers the list filtering hooks of withCapabilityListHooks on hooks,
+// for servers that need other hooks as well (mcp-go keeps a single Hooks per server).
+func addCapabilityListHooks(hooks *mcpserver.Hooks, guard capabilityGuard) {
+	hooks.AddAfterListPrompts(func(ctx context.Context, id any, message *mcp.ListPromptsRequest, result *mcp.ListPromptsResult) {
+		allowed := make([]mcp.Prompt, 0, len(result.Prompts))
+		for _, prompt := range result.Prompts {
+			if guard.allowsPrompt(ctx, prompt.Name) {
+				allowed = append(allowed, prompt)
+			}
+		}
+		result.Prompts = allowed
+	})
+	hooks.AddAfterListResources(func(ctx context.Context, id any, message *mcp.ListResourcesRequest, result *mcp.ListResourcesResult) {
+		allowed := make([]mcp.Resource, 0, len(result.Resources))
+		for _, resource := range result.Resources {
+			if guard.allowsResource(ctx, resource.URI) {
+				allowed = append(allowed, resource)
+			}
+		}
+		result.Resources = allowed
+	})
+	hooks.AddAfterListResourceTemplates(func(ctx context.Context, id any, message *mcp.ListResourceTemplatesRequest, result *mcp.ListResourceTemplatesResult) {
+		allowed := make([]mcp.ResourceTemplate, 0, len(result.ResourceTemplates))
+		for _, template := range result.ResourceTemplates {
+			if template.URITemplate == nil || guard.allowsTemplate(ctx, template.URITemplate.Raw()) {
+				allowed = append(allowed, template)
+			}
+		}
+		result.ResourceTemplates = allowed
+	})
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterRule_Allows(t *testing.T) {
+	rule := model.FilterRule{Deny: []string{"delete_*"}}
+	assert.True(t, rule.Allows("create_issue"))
+	assert.False(t, rule.Allows("delete_repository"))
+
+	rule = model.FilterRule{Allow: []string{"get_*", "search"}, Deny: []string{"get_secret"}}
+	assert.True(t, rule.Allows("get_issue"))
+	assert.True(t, rule.Allows("search"))
+	assert.False(t, rule.Allows("get_secret"), "deny takes precedence over allow")
+	assert.False(t, rule.Allows("create_issue"))
+
+	assert.Error(t, model.FilterRule{Allow: []string{"["}}.Validate())
+}
+
+func TestAddClientToolsToMCPServer_AppliesFilter(t *testing.T) {
+	ctx := context.Background()
+	upstream := newInProcessUpstream(t, "create_issue", "delete_repository")
+
+	filter := model.CapabilityFilter{Tools: model.FilterRule{Deny: []string{"delete_*"}}}
+	guard := capabilityGuard{filter: func() model.CapabilityFilter { return filter }}
+	server := mcpserver.NewMCPServer("filtered", "1.0.0", withCapabilityToolFilter(guard))
+	_, err := addClientToolsToMCPServer(ctx, upstream, server, "filtered", guard, nil)
+	require.NoError(t, err)
+
+	downstream := newInProcessDownstream(t, server)
+	tools, err := downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tools.Tools, 1)
+	assert.Equal(t, "create_issue", tools.Tools[0].Name)
+
+	// Denying a tool after registration hides it from listing and rejects calls
+	filter = model.CapabilityFilter{Tools: model.FilterRule{Deny: []string{"create_issue", "delete_*"}}}
+	tools, err = downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, tools.Tools)
+
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "create_issue"
+	_, err = downstream.CallTool(ctx, callRequest)
+	assert.Error(t, err)
+
+	// Tools denied at registration appear once the filter is widened
+	filter = model.CapabilityFilter{}
+	tools, err = downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, tools.Tools, 2)
+}
+
+func TestCapabilityGuard_CallerAccess(t *testing.T) {
+	ctx := context.Background()
+	upstream := newInProcessUpstream(t, "create_issue", "delete_repository")
+
+	guard := capabilityGuard{serviceID: 7, filter: allowAllCapabilities}
+	server := mcpserver.NewMCPServer("guarded", "1.0.0", withCapabilityToolFilter(guard), withCapabilityListHooks(guard))
+	_, err := addClientToolsToMCPServer(ctx, upstream, server, "guarded", guard, nil)
+	require.NoError(t, err)
+	downstream := newInProcessDownstream(t, server)
+
+	contractor := WithAccessResolver(ctx, func(serviceID int64) (model.CapabilityFilter, bool) {
+		assert.Equal(t, int64(7), serviceID)
+		return model.CapabilityFilter{Tools: model.FilterRule{Allow: []string{"create_*"}}}, true
+	})
+	tools, err := downstream.ListTools(contractor, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tools.Tools, 1)
+	assert.Equal(t, "create_issue", tools.Tools[0].Name)
+
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "delete_repository"
+	_, err = downstream.CallTool(contractor, callRequest)
+	assert.Error(t, err, "tools hidden from the caller must not be callable")
+
+	// Internal callers without a resolver are unrestricted
+	tools, err = downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, tools.Tools, 2)
+}
+
+func TestCapabilityGuard_ReadOnlyCaller(t *testing.T) {
+	ctx := context.Background()
+	upstream := newInProcessUpstream(t, "get_issue", "delete_repository")
+
+	readOnlyHint := true
+	overrides := map[string]model.ToolOverride{"get_issue": {ReadOnlyHint: &readOnlyHint}}
+	guard := capabilityGuard{filter: allowAllCapabilities}
+	server := mcpserver.NewMCPServer("guarded", "1.0.0", withCapabilityToolFilter(guard))
+	_, err := addClientToolsToMCPServer(ctx, upstream, server, "guarded", guard, overrides)
+	require.NoError(t, err)
+	downstream := newInProcessDownstream(t, server)
+
+	readOnly := WithReadOnly(ctx)
+	tools, err := downstream.ListTools(readOnly, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tools.Tools, 1)
+	assert.Equal(t, "get_issue", tools.Tools[0].Name)
+
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "delete_repository"
+	_, err = downstream.CallTool(readOnly, callRequest)
+	assert.Error(t, err, "tools without the read-only annotation must not be callable")
+	callRequest.Params.Name = "get_issue"
+	_, err = downstream.CallTool(readOnly, callRequest)
+	assert.NoError(t, err)
+
+	tools, err = downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, tools.Tools, 2)
+}
+
+func TestLiveCapabilityFilter_CachedUntilAccessChanges(t *testing.T) {
+	savedPath := common.SQLitePath
+	common.SQLitePath = ":memory:"
+	t.Cleanup(func() { common.SQLitePath = savedPath })
+	require.NoError(t, model.InitDB())
+
+	svc := &model.MCPService{Name: "filtered", Type: model.ServiceTypeStdio, Command: "echo", FilterJSON: `{"tools":{"deny":["delete_*"]}}`}
+	require.NoError(t, model.CreateService(svc))
+	filter := liveCapabilityFilter(svc)
+	assert.False(t, filter().Tools.Allows("delete_repository"))
+
+	// Writes that bypass the model are not seen until the access settings change
+	stored, err := model.GetServiceByID(svc.ID)
+	require.NoError(t, err)
+	stored.FilterJSON = `{}`
+	require.NoError(t, model.MCPServiceDB.Save(stored))
+	assert.False(t, filter().Tools.Allows("delete_repository"))
+
+	require.NoError(t, model.SaveServicePermission(&model.ServicePermission{ServiceID: svc.ID, SubjectType: model.PermissionSubjectRole, SubjectID: 1}))
+	assert.True(t, filter().Tools.Allows("delete_repository"))
+}
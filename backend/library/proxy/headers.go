@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+)
+
+// The headers of an SSE or streamable HTTP service may take values from the configuration of the
+// user an instance is started for, e.g. "Authorization": "Bearer ${user.GITHUB_TOKEN}". Such a
+// service gets an instance per user, like a stdio service does, and the values are passed the same
+// way as a stdio instance's environment.
+
+// remoteHeaders returns the headers sent to an SSE or streamable HTTP upstream, their ${user.KEY}
+// placeholders resolved from the environment the instance is started with
+func remoteHeaders(svc *model.MCPService) map[string]string {
+	values := make(map[string]string)
+	if svc.DefaultEnvsJSON != "" && svc.DefaultEnvsJSON != "{}" {
+		if errJson := json.Unmarshal([]byte(svc.DefaultEnvsJSON), &values); errJson != nil {
+			common.SysError(fmt.Sprintf("Failed to unmarshal header values for %s service %s (ID: %d): %v. Placeholders stay unresolved.", svc.Type, svc.Name, svc.ID, errJson))
+		}
+	}
+	headers, missing, err := svc.ResolveHeaders(values)
+	if err != nil {
+		common.SysError(fmt.Sprintf("Failed to unmarshal HeadersJSON for %s service %s (ID: %d): %v. Proceeding without custom headers.", svc.Type, svc.Name, svc.ID, err))
+		return nil
+	}
+	if len(missing) > 0 {
+		common.SysLog(fmt.Sprintf("WARN: Headers of %s service %s (ID: %d) using %v are not sent, these values are not configured", svc.Type, svc.Name, svc.ID, missing))
+	}
+	return headers
+}
+
+// headerNames lists the names of headers for logging, their values may be credentials
+func headerNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type authorizationKey struct{}
+
+// authorizationEcho is an upstream whose "whoami" tool answers with the Authorization header of the
+// request it received
+func authorizationEcho() *mcpserver.MCPServer {
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0")
+	upstream.AddTool(mcp.NewTool("whoami"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		authorization, _ := ctx.Value(authorizationKey{}).(string)
+		return mcp.NewToolResultText(authorization), nil
+	})
+	return upstream
+}
+
+func withAuthorization(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, authorizationKey{}, r.Header.Get("Authorization"))
+}
+
+func TestRemoteHeaders_ResolvedPerUser(t *testing.T) {
+	streamable := httptest.NewServer(mcpserver.NewStreamableHTTPServer(authorizationEcho(), mcpserver.WithHTTPContextFunc(withAuthorization)))
+	defer streamable.Close()
+	sse := mcpserver.NewTestServer(authorizationEcho(), mcpserver.WithSSEContextFunc(withAuthorization))
+	defer sse.Close()
+
+	for _, svc := range []*model.MCPService{
+		{Name: "remote-streamable", Type: model.ServiceTypeStreamableHTTP, Command: streamable.URL},
+		{Name: "remote-sse", Type: model.ServiceTypeSSE, Command: sse.URL + "/sse"},
+	} {
+		t.Run(string(svc.Type), func(t *testing.T) {
+			svc.ID = -9601
+			svc.AllowUserOverride = true
+			svc.HeadersJSON = `{"Authorization":"Bearer ${user.GITHUB_TOKEN}"}`
+			require.True(t, svc.HasUserHeaders())
+			ctx := context.Background()
+
+			whoami := func(cacheKey, envs string) string {
+				instance, err := startSharedInstance(ctx, svc, cacheKey, cacheKey, envs)
+				require.NoError(t, err)
+				defer instance.retire("test done")
+				return callWorker(t, ctx, instance.Client, "whoami")
+			}
+			assert.Equal(t, "Bearer alice-token", whoami("user-1-service--9601-shared", `{"GITHUB_TOKEN":"alice-token"}`))
+			assert.Equal(t, "Bearer bob-token", whoami("user-2-service--9601-shared", `{"GITHUB_TOKEN":"bob-token"}`))
+			assert.Empty(t, whoami("global-service--9601-shared", ""), "a header whose value is not configured is not sent")
+
+			svc.HeadersJSON = `{"Authorization":"Bearer static-token"}`
+			assert.False(t, svc.HasUserHeaders())
+			assert.Equal(t, "Bearer static-token", whoami("global-service--9601-shared", ""))
+		})
+	}
+}
+
+func TestResolveHeaders(t *testing.T) {
+	svc := &model.MCPService{Type: model.ServiceTypeStreamableHTTP, HeadersJSON: `{"Authorization":"token ${user.A}:${user.B}","X-Team":"${user.TEAM}","X-Static":"fixed"}`}
+	headers, missing, err := svc.ResolveHeaders(map[string]string{"A": "a", "B": "b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Authorization": "token a:b", "X-Static": "fixed"}, headers)
+	assert.Equal(t, []string{"TEAM"}, missing)
+	assert.Equal(t, []string{"Authorization", "X-Static"}, headerNames(headers))
+
+	assert.NoError(t, svc.ValidateHeaders())
+	svc.HeadersJSON = `{"Authorization":"Bearer ${GITHUB_TOKEN}"}`
+	assert.Error(t, svc.ValidateHeaders())
+	svc.HeadersJSON = `{"Authorization":1}`
+	assert.Error(t, svc.ValidateHeaders())
+}
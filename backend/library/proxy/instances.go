@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// Instances in sharedMCPServers start on their first request, except the global instance of services
+// with MinInstances, which starts at boot and is restarted by the reaper whenever it is gone. The
+// reaper shuts down the instances idle for longer than their service's idle timeout, keeping the
+// service's MinInstances running, and creating an instance beyond the service's MaxInstances or the
+// global MaxLiveInstances option evicts the least recently used idle instance first.
+
+// ErrInstanceLimitReached is returned when an instance cannot be started because the instance cap is
+// reached and every running instance is busy
+var ErrInstanceLimitReached = errors.New("instance limit reached")
+
+const (
+	instanceReapInterval    = time.Minute
+	instanceShutdownTimeout = 10 * time.Second
+)
+
+func newSharedMcpInstance(server *mcpserver.MCPServer, client mcpclient.MCPClient, svc *model.MCPService, cacheKey string) *SharedMcpInstance {
+	instance := &SharedMcpInstance{
+		Server:      server,
+		Client:      client,
+		serviceID:   svc.ID,
+		serviceName: svc.Name,
+		serviceType: svc.Type,
+		cacheKey:    cacheKey,
+		userID:      instanceOwner(cacheKey),
+		policy:      svc.GetInstancePolicy(),
+		createdAt:   time.Now(),
+		stopped:     make(chan struct{}),
+	}
+	instance.touch()
+	return instance
+}
+
+// instanceOwner returns the user of a user-specific cache key (user-<user>-service-<service>-shared),
+// 0 for any other key
+func instanceOwner(cacheKey string) int64 {
+	var userID, serviceID int64
+	if n, _ := fmt.Sscanf(cacheKey, "user-%d-service-%d-shared", &userID, &serviceID); n != 2 {
+		return 0
+	}
+	return userID
+}
+
+// touch records a use of the instance
+func (s *SharedMcpInstance) touch() {
+	s.lastUsed.Store(time.Now().UnixNano())
+}
+
+// busy reports whether the instance serves a request or a client holds a stream open on it
+func (s *SharedMcpInstance) busy() bool {
+	return s.inFlight.Load() > 0 || s.openStreams.Load() > 0
+}
+
+// idleFor returns how long the instance has not been used, 0 while it is busy
+func (s *SharedMcpInstance) idleFor(now time.Time) time.Duration {
+	if s.busy() {
+		return 0
+	}
+	return now.Sub(time.Unix(0, s.lastUsed.Load()))
+}
+
+// isRetired reports whether the instance was shut down by retire
+func (s *SharedMcpInstance) isRetired() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackedHandler is a proxy handler built on an instance, which keeps the instance alive while it
+// serves requests
+type trackedHandler struct {
+	instance *SharedMcpInstance
+	key      string
+	handler  http.Handler
+}
+
+// trackHandler wraps a proxy handler built on the instance so requests keep it alive. Requests that
+// are still open when the instance is shut down, such as SSE streams, are ended. The handler cache
+// entry is dropped along with the instance.
+func (s *SharedMcpInstance) trackHandler(cacheKey string, handler http.Handler) http.Handler {
+	tracked := &trackedHandler{instance: s, key: cacheKey, handler: handler}
+	s.handlerMu.Lock()
+	if s.handlers == nil {
+		s.handlers = make(map[string]*trackedHandler)
+	}
+	s.handlers[cacheKey] = tracked
+	s.handlerMu.Unlock()
+	return tracked
+}
+
+func (t *trackedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Sessions opened on an instance that is being replaced stay on it until it is drained
+	if draining := drainingHandler(t.key, r); draining != nil && draining != t {
+		draining.ServeHTTP(w, r)
+		return
+	}
+
+	s := t.instance
+	s.touch()
+	defer s.touch()
+	// An open stream keeps its session alive, so the instance is in use until the client disconnects
+	switch r.Method {
+	case http.MethodPost:
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+	case http.MethodGet:
+		s.openStreams.Add(1)
+		defer s.openStreams.Add(-1)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	t.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// detachHandlers drops the proxy handler cache entries that still serve the instance's handlers,
+// so the next request builds a handler on the instance now cached under its key
+func (s *SharedMcpInstance) detachHandlers() {
+	s.handlerMu.Lock()
+	handlers := make([]*trackedHandler, 0, len(s.handlers))
+	for _, handler := range s.handlers {
+		handlers = append(handlers, handler)
+	}
+	s.handlerMu.Unlock()
+
+	sseWrappersMutex.Lock()
+	for _, handler := range handlers {
+		if current, ok := initializedSSEProxyWrappers[handler.key]; ok && current == http.Handler(handler) {
+			delete(initializedSSEProxyWrappers, handler.key)
+		}
+	}
+	sseWrappersMutex.Unlock()
+	httpWrappersMutex.Lock()
+	for _, handler := range handlers {
+		if current, ok := initializedHTTPProxyWrappers[handler.key]; ok && current == http.Handler(handler) {
+			delete(initializedHTTPProxyWrappers, handler.key)
+		}
+	}
+	httpWrappersMutex.Unlock()
+}
+
+// retire shuts down an instance that was removed from sharedMCPServers, along with the proxy
+// handlers built on it. It must not be called with sharedMCPServersMutex held.
+func (s *SharedMcpInstance) retire(reason string) {
+	s.stopOnce.Do(func() {
+		if s.stopped != nil {
+			close(s.stopped)
+		}
+		if s.processLog != nil {
+			s.processLog.release()
+		}
+	})
+	s.detachHandlers()
+
+	common.SysLog(fmt.Sprintf("[Instances] Shutting down %s: %s", s.cacheKey, reason))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), instanceShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			common.SysError(fmt.Sprintf("[Instances] Error shutting down %s: %v", s.cacheKey, err))
+		}
+	}()
+}
+
+// removeSharedInstanceLocked removes an instance from the cache. sharedMCPServersMutex must be held;
+// the caller retires the instance once the lock is released.
+func removeSharedInstanceLocked(instance *SharedMcpInstance) {
+	if current, ok := sharedMCPServers[instance.cacheKey]; ok && current == instance {
+		delete(sharedMCPServers, instance.cacheKey)
+	}
+}
+
+// liveInstancesLocked counts the cached and starting instances of a service
+func liveInstancesLocked(serviceID int64) int {
+	count := 0
+	for _, instance := range sharedMCPServers {
+		if instance.serviceID == serviceID {
+			count++
+		}
+	}
+	for _, start := range instanceStarts {
+		if start.serviceID == serviceID {
+			count++
+		}
+	}
+	return count
+}
+
+// leastRecentlyUsedIdleLocked returns the least recently used idle instance accepted by evictable
+func leastRecentlyUsedIdleLocked(evictable func(*SharedMcpInstance) bool) *SharedMcpInstance {
+	var victim *SharedMcpInstance
+	for _, instance := range sharedMCPServers {
+		if instance.busy() || !evictable(instance) {
+			continue
+		}
+		if victim == nil || instance.lastUsed.Load() < victim.lastUsed.Load() {
+			victim = instance
+		}
+	}
+	return victim
+}
+
+// makeRoomLocked evicts idle instances until one more instance of svc fits under the service's
+// MaxInstances and the global MaxLiveInstances. It returns the evicted instances for the caller to retire.
+func makeRoomLocked(svc *model.MCPService) ([]*SharedMcpInstance, error) {
+	var evicted []*SharedMcpInstance
+	policy := svc.GetInstancePolicy()
+	if policy.MaxInstances > 0 {
+		for liveInstancesLocked(svc.ID) >= policy.MaxInstances {
+			victim := leastRecentlyUsedIdleLocked(func(instance *SharedMcpInstance) bool { return instance.serviceID == svc.ID })
+			if victim == nil {
+				return evicted, fmt.Errorf("%w: %s allows %d instances and all are busy", ErrInstanceLimitReached, svc.Name, policy.MaxInstances)
+			}
+			removeSharedInstanceLocked(victim)
+			evicted = append(evicted, victim)
+		}
+	}
+	if limit := common.GetMaxLiveInstances(); limit > 0 {
+		for len(sharedMCPServers)+len(instanceStarts) >= limit {
+			victim := leastRecentlyUsedIdleLocked(func(instance *SharedMcpInstance) bool {
+				return instance.serviceID == svc.ID || liveInstancesLocked(instance.serviceID) > instance.policy.MinInstances
+			})
+			if victim == nil {
+				return evicted, fmt.Errorf("%w: %d instances are running and none can be stopped", ErrInstanceLimitReached, limit)
+			}
+			removeSharedInstanceLocked(victim)
+			evicted = append(evicted, victim)
+		}
+	}
+	return evicted, nil
+}
+
+// reapIdleInstances shuts down the instances idle for longer than their idle timeout, least recently
+// used first, while keeping MinInstances of each service
+func reapIdleInstances(now time.Time) {
+	sharedMCPServersMutex.Lock()
+	candidates := make([]*SharedMcpInstance, 0, len(sharedMCPServers))
+	for _, instance := range sharedMCPServers {
+		if instance.policy.IdleTimeout > 0 && instance.idleFor(now) > instance.policy.IdleTimeout {
+			candidates = append(candidates, instance)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Load() < candidates[j].lastUsed.Load()
+	})
+	var reaped []*SharedMcpInstance
+	for _, instance := range candidates {
+		if liveInstancesLocked(instance.serviceID) <= instance.policy.MinInstances {
+			continue
+		}
+		removeSharedInstanceLocked(instance)
+		reaped = append(reaped, instance)
+	}
+	sharedMCPServersMutex.Unlock()
+
+	for _, instance := range reaped {
+		instance.retire(fmt.Sprintf("idle for %s", instance.idleFor(now).Round(time.Second)))
+	}
+}
+
+// warmMinInstances starts the global instance of each service that keeps instances running and has
+// fewer than its MinInstances. User-specific instances need their user's credentials, so they only
+// start on the user's first request.
+func warmMinInstances(ctx context.Context, services []*model.MCPService) {
+	for _, svc := range services {
+		switch svc.Type {
+		case model.ServiceTypeStdio, model.ServiceTypeSSE, model.ServiceTypeStreamableHTTP:
+		default:
+			continue
+		}
+		cacheKey := fmt.Sprintf("global-service-%d-shared", svc.ID)
+		if !svc.Enabled || lookupSharedInstance(cacheKey) != nil || liveInstanceCount(svc.ID) >= svc.GetInstancePolicy().MinInstances {
+			continue
+		}
+		instanceNameDetail := fmt.Sprintf("global-shared-svc-%d", svc.ID)
+		_, err := GetOrCreateSharedMcpInstanceWithKey(ctx, svc, cacheKey, instanceNameDetail, svc.DefaultEnvsJSON)
+		if err != nil && !errors.Is(err, ErrCrashLooping) {
+			common.SysError(fmt.Sprintf("[Instances] Failed to start %s for min_instances of %s: %v", cacheKey, svc.Name, err))
+		}
+	}
+}
+
+// StartInstanceReaper periodically shuts down idle instances and starts the ones MinInstances keeps
+// running until ctx is done
+func StartInstanceReaper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(instanceReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				reapIdleInstances(now)
+				services, err := model.GetEnabledServices()
+				if err != nil {
+					common.SysError(fmt.Sprintf("[Instances] Failed to load services to keep min_instances running: %v", err))
+					continue
+				}
+				warmMinInstances(ctx, services)
+			}
+		}
+	}()
+}
+
+// lookupSharedInstance returns the cached instance for a key without starting one
+func lookupSharedInstance(cacheKey string) *SharedMcpInstance {
+	sharedMCPServersMutex.Lock()
+	defer sharedMCPServersMutex.Unlock()
+	return sharedMCPServers[cacheKey]
+}
+
+// liveInstanceCount returns the number of running instances of a service
+func liveInstanceCount(serviceID int64) int {
+	sharedMCPServersMutex.Lock()
+	defer sharedMCPServersMutex.Unlock()
+	return liveInstancesLocked(serviceID)
+}
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withInstanceCache runs the test against an empty instance cache holding the given instances
+func withInstanceCache(t *testing.T, instances ...*SharedMcpInstance) {
+	t.Helper()
+	sharedMCPServersMutex.Lock()
+	saved := sharedMCPServers
+	sharedMCPServers = make(map[string]*SharedMcpInstance)
+	for _, instance := range instances {
+		sharedMCPServers[instance.cacheKey] = instance
+	}
+	sharedMCPServersMutex.Unlock()
+	t.Cleanup(func() {
+		sharedMCPServersMutex.Lock()
+		sharedMCPServers = saved
+		sharedMCPServersMutex.Unlock()
+	})
+}
+
+func idleInstance(svc *model.MCPService, cacheKey string, idle time.Duration) *SharedMcpInstance {
+	instance := newSharedMcpInstance(nil, nil, svc, cacheKey)
+	instance.lastUsed.Store(time.Now().Add(-idle).UnixNano())
+	return instance
+}
+
+func cachedKeys() []string {
+	sharedMCPServersMutex.Lock()
+	defer sharedMCPServersMutex.Unlock()
+	keys := make([]string, 0, len(sharedMCPServers))
+	for key := range sharedMCPServers {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestReapIdleInstances(t *testing.T) {
+	keepOne := &model.MCPService{Name: "keep-one", MinInstances: 1, IdleTimeoutSeconds: 60}
+	keepOne.ID = 1
+	neverIdle := &model.MCPService{Name: "never-idle"}
+	neverIdle.ID = 2
+	busy := &model.MCPService{Name: "busy", IdleTimeoutSeconds: 60}
+	busy.ID = 3
+
+	oldest := idleInstance(keepOne, "user-1-service-1-shared", 3*time.Minute)
+	recent := idleInstance(keepOne, "global-service-1-shared", 2*time.Minute)
+	fresh := idleInstance(keepOne, "user-2-service-1-shared", time.Second)
+	forever := idleInstance(neverIdle, "global-service-2-shared", time.Hour)
+	inFlight := idleInstance(busy, "global-service-3-shared", time.Hour)
+	inFlight.inFlight.Add(1)
+	withInstanceCache(t, oldest, recent, fresh, forever, inFlight)
+
+	reapIdleInstances(time.Now())
+
+	assert.ElementsMatch(t, []string{"user-2-service-1-shared", "global-service-2-shared", "global-service-3-shared"}, cachedKeys())
+	assert.True(t, oldest.isRetired())
+	assert.True(t, recent.isRetired())
+	assert.False(t, fresh.isRetired())
+
+	// MinInstances keeps the last instance of the service running however long it is idle
+	fresh.lastUsed.Store(time.Now().Add(-time.Hour).UnixNano())
+	reapIdleInstances(time.Now())
+	assert.False(t, fresh.isRetired())
+	assert.Contains(t, cachedKeys(), "user-2-service-1-shared")
+}
+
+func TestMakeRoomLocked(t *testing.T) {
+	svc := &model.MCPService{Name: "capped", MaxInstances: 2}
+	svc.ID = 7
+	older := idleInstance(svc, "user-1-service-7-shared", 2*time.Minute)
+	newer := idleInstance(svc, "user-2-service-7-shared", time.Minute)
+	withInstanceCache(t, older, newer)
+
+	sharedMCPServersMutex.Lock()
+	evicted, err := makeRoomLocked(svc)
+	sharedMCPServersMutex.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, []*SharedMcpInstance{older}, evicted, "the least recently used instance makes room")
+
+	newer.inFlight.Add(1)
+	busy := idleInstance(svc, "user-3-service-7-shared", 0)
+	busy.inFlight.Add(1)
+	sharedMCPServersMutex.Lock()
+	sharedMCPServers[busy.cacheKey] = busy
+	_, err = makeRoomLocked(svc)
+	sharedMCPServersMutex.Unlock()
+	assert.ErrorIs(t, err, ErrInstanceLimitReached)
+}
+
+func TestTrackHandler_EndsOpenRequestsOnRetire(t *testing.T) {
+	svc := &model.MCPService{Name: "streaming"}
+	instance := newSharedMcpInstance(nil, nil, svc, "global-service-0-shared")
+	withInstanceCache(t, instance)
+
+	streamEnded := make(chan struct{})
+	handler := instance.trackHandler("global-service-0-shared-sseproxy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(streamEnded)
+	}))
+	sseWrappersMutex.Lock()
+	initializedSSEProxyWrappers["global-service-0-shared-sseproxy"] = handler
+	sseWrappersMutex.Unlock()
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/sse", nil))
+	instance.retire("test")
+
+	select {
+	case <-streamEnded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("open stream was not ended when the instance was retired")
+	}
+	_, found := initializedSSEProxyWrappers["global-service-0-shared-sseproxy"]
+	assert.False(t, found, "the handler built on a retired instance must not be served again")
+}
+
+func TestGetOrCreateSharedInstance_StartsOutsideTheLock(t *testing.T) {
+	cachedSvc := &model.MCPService{Name: "cached"}
+	cached := newSharedMcpInstance(nil, nil, cachedSvc, "global-service--9802-shared")
+	withInstanceCache(t, cached)
+
+	release := make(chan struct{})
+	upstream := mcpserver.NewStreamableHTTPServer(authorizationEcho())
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		upstream.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	svc := &model.MCPService{Name: "slow", Type: model.ServiceTypeStreamableHTTP, Command: slow.URL}
+	svc.ID = -9801
+	cacheKey := "global-service--9801-shared"
+
+	// Callers asking for an instance being started wait for that one
+	started := make(chan *SharedMcpInstance, 2)
+	for range 2 {
+		go func() {
+			instance, err := GetOrCreateSharedMcpInstanceWithKey(context.Background(), svc, cacheKey, cacheKey, "")
+			assert.NoError(t, err)
+			started <- instance
+		}()
+	}
+	require.Eventually(t, func() bool {
+		sharedMCPServersMutex.Lock()
+		defer sharedMCPServersMutex.Unlock()
+		return instanceStarts[cacheKey] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Meanwhile the instances of other services are served
+	found, err := GetOrCreateSharedMcpInstanceWithKey(context.Background(), cachedSvc, cached.cacheKey, cached.cacheKey, "")
+	require.NoError(t, err)
+	assert.Same(t, cached, found)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = GetOrCreateSharedMcpInstanceWithKey(ctx, svc, cacheKey, cacheKey, "")
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "a caller stops waiting when its context ends")
+
+	close(release)
+	first, second := <-started, <-started
+	require.NotNil(t, first)
+	defer first.retire("test done")
+	assert.Same(t, first, second)
+	assert.Same(t, first, lookupSharedInstance(cacheKey))
+}
+
+func TestReapIdleInstances_KeepsOpenStreams(t *testing.T) {
+	svc := &model.MCPService{Name: "streaming", IdleTimeoutSeconds: 60}
+	instance := idleInstance(svc, "global-service-0-shared", time.Hour)
+	withInstanceCache(t, instance)
+
+	release := make(chan struct{})
+	handler := instance.trackHandler("global-service-0-shared-sseproxy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	served := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/sse", nil))
+		close(served)
+	}()
+	require.Eventually(t, instance.busy, 5*time.Second, 10*time.Millisecond)
+
+	reapIdleInstances(time.Now().Add(time.Hour))
+	assert.Same(t, instance, lookupSharedInstance(instance.cacheKey), "an instance with an open stream is in use")
+
+	close(release)
+	<-served
+	reapIdleInstances(time.Now().Add(time.Hour))
+	assert.Nil(t, lookupSharedInstance(instance.cacheKey), "the instance is idle once the stream is closed")
+}
+
+func TestWarmMinInstances(t *testing.T) {
+	withInstanceCache(t)
+	upstream := mcpserver.NewTestStreamableHTTPServer(authorizationEcho())
+	defer upstream.Close()
+
+	warm := &model.MCPService{Name: "warm", Type: model.ServiceTypeStreamableHTTP, Command: upstream.URL, Enabled: true, MinInstances: 1}
+	warm.ID = -9811
+	cold := &model.MCPService{Name: "cold", Type: model.ServiceTypeStreamableHTTP, Command: upstream.URL, Enabled: true}
+	cold.ID = -9812
+	warmMinInstances(context.Background(), []*model.MCPService{warm, cold})
+
+	instance := lookupSharedInstance("global-service--9811-shared")
+	require.NotNil(t, instance, "a service with min_instances is started before its first request")
+	defer instance.retire("test done")
+	assert.Nil(t, lookupSharedInstance("global-service--9812-shared"), "a service that scales to zero starts on demand")
+
+	warmMinInstances(context.Background(), []*model.MCPService{warm})
+	assert.Same(t, instance, lookupSharedInstance("global-service--9811-shared"), "a running instance is kept")
+}
+
+// credentialInstance returns an instance whose "whoami" tool answers with the API key it was started with
+func credentialInstance(svc *model.MCPService, cacheKey, apiKey string) *SharedMcpInstance {
+	server := mcpserver.NewMCPServer(svc.Name, "1.0.0")
+	server.AddTool(mcp.NewTool("whoami"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText(apiKey), nil
+	})
+	return newSharedMcpInstance(server, nil, svc, cacheKey)
+}
+
+func TestProxyHandlers_IsolatedPerUser(t *testing.T) {
+	svc := &model.MCPService{Name: "per-user", Type: model.ServiceTypeStdio, AllowUserOverride: true}
+	svc.ID = -9501
+	alice := credentialInstance(svc, "user-1-service--9501-shared", "alice-key")
+	global := credentialInstance(svc, "global-service--9501-shared", "default-key")
+	bob := credentialInstance(svc, "user-2-service--9501-shared", "bob-key")
+	withInstanceCache(t, alice, global, bob)
+	for _, instance := range []*SharedMcpInstance{alice, global, bob} {
+		defer instance.retire("test done")
+	}
+
+	ctx := context.Background()
+	sessions := make(map[string]string)
+	urls := make(map[string]string)
+	for _, instance := range []*SharedMcpInstance{alice, global, bob} {
+		handler, err := GetOrCreateProxyToHTTPHandler(ctx, svc, instance)
+		require.NoError(t, err)
+		cached, err := GetOrCreateProxyToHTTPHandler(ctx, svc, instance)
+		require.NoError(t, err)
+		assert.Same(t, handler, cached)
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		client := connectDownstream(t, server.URL)
+		defer client.Close()
+		urls[instance.cacheKey] = server.URL
+		sessions[instance.cacheKey] = client.GetSessionId()
+	}
+	for key, want := range map[string]string{alice.cacheKey: "alice-key", global.cacheKey: "default-key", bob.cacheKey: "bob-key"} {
+		client := connectDownstream(t, urls[key])
+		assert.Equal(t, want, callWorker(t, ctx, client, "whoami"), key)
+		client.Close()
+	}
+
+	// A call presenting Alice's session ID through Bob's handler still runs on Bob's instance
+	call := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"whoami"}}`
+	request, err := http.NewRequest(http.MethodPost, urls[bob.cacheKey], strings.NewReader(call))
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(mcpserver.HeaderKeySessionID, sessions[alice.cacheKey])
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NotContains(t, string(body), "alice-key")
+	assert.Contains(t, string(body), "bob-key")
+
+	aliceSSE, err := GetOrCreateProxyToSSEHandler(ctx, svc, alice)
+	require.NoError(t, err)
+	bobSSE, err := GetOrCreateProxyToSSEHandler(ctx, svc, bob)
+	require.NoError(t, err)
+	assert.Same(t, alice, aliceSSE.(*trackedHandler).instance)
+	assert.Same(t, bob, bobSSE.(*trackedHandler).instance)
+}
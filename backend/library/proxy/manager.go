@@ -29,6 +29,7 @@ type ServiceManager struct {
 	mutex         sync.RWMutex
 	healthChecker *HealthChecker
 	initialized   bool
+	stopReaper    context.CancelFunc
 }
 
 // globalManager is the global service manager instance
@@ -59,6 +60,11 @@ func (m *ServiceManager) Initialize(ctx context.Context) error {
 	// Start auto-restart daemon thread
 	m.StartDaemon()
 
+	// Start shutting down idle MCP instances
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	m.stopReaper = stopReaper
+	StartInstanceReaper(reaperCtx)
+
 	// Load and register all enabled services
 	services, err := model.GetEnabledServices()
 	if err != nil {
@@ -72,6 +78,8 @@ func (m *ServiceManager) Initialize(ctx context.Context) error {
 			continue
 		}
 	}
+	// Retry the global instances that failed to start while registering and MinInstances keeps running
+	warmMinInstances(ctx, services)
 
 	m.initialized = true
 	return nil
@@ -81,6 +89,9 @@ func (m *ServiceManager) Initialize(ctx context.Context) error {
 func (m *ServiceManager) Shutdown(ctx context.Context) error {
 	// Stop health checker
 	m.healthChecker.Stop()
+	if m.stopReaper != nil {
+		m.stopReaper()
+	}
 
 	// Stop all services
 	m.mutex.Lock()
@@ -154,6 +165,9 @@ func (m *ServiceManager) UnregisterService(ctx context.Context, serviceID int64)
 
 	// Remove from health checker
 	m.healthChecker.UnregisterService(serviceID)
+	dropRestartStates(serviceID)
+	dropProcessLogs(serviceID)
+	RefreshVirtualServersWithMember(serviceID)
 
 	// Remove from health status cache
 	cacheManager := GetHealthCacheManager()
@@ -229,6 +243,8 @@ func (m *ServiceManager) RestartService(ctx context.Context, serviceID int64) er
 			return fmt.Errorf("failed to stop service during restart: %w", err)
 		}
 	}
+	// A restart requested for a crash looping service tries again
+	resetServiceCrashLoops(serviceID)
 
 	// Start service
 	if err := service.Start(ctx); err != nil {
@@ -0,0 +1,537 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"toWers/backend/common"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	methodNotificationProgress  = "notifications/progress"
+	methodNotificationMessage   = "notifications/message"
+	methodNotificationCancelled = "notifications/cancelled"
+
+	// downstreamRequestIDField carries the downstream JSON-RPC id of a tools/call from the
+	// BeforeCallTool hook to the tool handler. It is removed before the call is forwarded.
+	downstreamRequestIDField = "towers/downstreamRequestId"
+
+	// upstreamNotifyTimeout bounds notifications and log level changes sent to the upstream
+	upstreamNotifyTimeout = 5 * time.Second
+)
+
+// relayedCall is a tools/call forwarded upstream and still waiting for its result
+type relayedCall struct {
+	ctx           context.Context // downstream request context, carries the downstream session
+	progressToken mcp.ProgressToken
+	cancel        context.CancelFunc
+	worker        int // stdio pool worker running the call, or anyWorker
+}
+
+// notificationRelay connects the upstream client and the downstream MCPServer of an instance for
+// everything that is not a plain request/response: progress and log notifications emitted by the
+// upstream during a call are routed back to the downstream session that made it, downstream
+// notifications/cancelled aborts the upstream request, and logging/setLevel is forwarded upstream.
+// It also relays requests the upstream sends to its client, see server_requests.go.
+type notificationRelay struct {
+	name   string
+	client mcpclient.MCPClient // set once the upstream client is created
+	server *mcpserver.MCPServer
+	guard  capabilityGuard
+	nextID atomic.Int64
+
+	relaysServerRequests bool
+	resilience           callResilience // timeout, retries and circuit breaker applied to tool calls
+
+	mu               sync.Mutex
+	upstream         mcp.ServerCapabilities // declared by the upstream during initialization
+	upstreamLevel    mcp.LoggingLevel
+	calls            map[string]*relayedCall                    // by upstream progress token
+	downstreamCalls  map[string]*relayedCall                    // by downstream session ID and request ID
+	subscriberLevels map[string]mcp.LoggingLevel                // log level set by each downstream session
+	subscriptions    map[string]map[string]*mcpserver.MCPServer // resource URI to subscribed downstream session IDs and their server
+	processes        map[int]int                                // PIDs of the stdio processes by worker
+	exitHandler      func(worker int)                           // called when a tracked process exits
+	pendingExits     []int                                      // workers that exited before exitHandler was set
+	sessions         map[string]struct{}                        // downstream sessions registered on the server
+	private          bool                                       // the instance serves a single user
+}
+
+func newNotificationRelay(name string, guard capabilityGuard) *notificationRelay {
+	return &notificationRelay{
+		name:             name,
+		guard:            guard,
+		subscriptions:    make(map[string]map[string]*mcpserver.MCPServer),
+		calls:            make(map[string]*relayedCall),
+		downstreamCalls:  make(map[string]*relayedCall),
+		subscriberLevels: make(map[string]mcp.LoggingLevel),
+		processes:        make(map[int]int),
+		sessions:         make(map[string]struct{}),
+	}
+}
+
+// trackProcess records the process started for a worker, replacing the one it had before
+func (r *notificationRelay) trackProcess(worker, pid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processes[worker] = pid
+}
+
+// processExited records the exit of a tracked process. Exits of processes that were already
+// replaced, such as the old process of a respawned worker, are ignored.
+func (r *notificationRelay) processExited(worker, pid int) {
+	r.mu.Lock()
+	if r.processes[worker] != pid {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.processes, worker)
+	handler := r.exitHandler
+	if handler == nil {
+		r.pendingExits = append(r.pendingExits, worker)
+	}
+	r.mu.Unlock()
+	if handler != nil {
+		handler(worker)
+	}
+}
+
+// onProcessExit sets the handler of process exits. It is called in the background for the exits
+// it missed, since the handler may need locks held by the caller.
+func (r *notificationRelay) onProcessExit(handler func(worker int)) {
+	r.mu.Lock()
+	r.exitHandler = handler
+	missed := r.pendingExits
+	r.pendingExits = nil
+	r.mu.Unlock()
+	for _, worker := range missed {
+		go handler(worker)
+	}
+}
+
+// hasSession reports whether a downstream session is registered on the server
+func (r *notificationRelay) hasSession(sessionID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.sessions[sessionID]
+	return ok
+}
+
+// sessionCount returns the number of downstream sessions registered on the server
+func (r *notificationRelay) sessionCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// processIDs returns the PIDs of the stdio processes by worker
+func (r *notificationRelay) processIDs() map[int]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pids := make(map[int]int, len(r.processes))
+	for worker, pid := range r.processes {
+		pids[worker] = pid
+	}
+	return pids
+}
+
+// addHooks registers the hooks the relay needs on the downstream server
+func (r *notificationRelay) addHooks(hooks *mcpserver.Hooks) {
+	hooks.AddBeforeCallTool(func(ctx context.Context, id any, message *mcp.CallToolRequest) {
+		if id == nil {
+			return
+		}
+		if message.Params.Meta == nil {
+			message.Params.Meta = &mcp.Meta{}
+		}
+		if message.Params.Meta.AdditionalFields == nil {
+			message.Params.Meta.AdditionalFields = make(map[string]any)
+		}
+		message.Params.Meta.AdditionalFields[downstreamRequestIDField] = id
+	})
+	hooks.AddAfterSetLevel(func(ctx context.Context, id any, message *mcp.SetLevelRequest, result *mcp.EmptyResult) {
+		session := mcpserver.ClientSessionFromContext(ctx)
+		if session == nil {
+			return
+		}
+		r.mu.Lock()
+		r.subscriberLevels[session.SessionID()] = message.Params.Level
+		r.mu.Unlock()
+		r.syncUpstreamLevel()
+	})
+	hooks.AddOnRegisterSession(func(ctx context.Context, session mcpserver.ClientSession) {
+		r.mu.Lock()
+		r.sessions[session.SessionID()] = struct{}{}
+		r.mu.Unlock()
+	})
+	hooks.AddOnUnregisterSession(func(ctx context.Context, session mcpserver.ClientSession) {
+		r.mu.Lock()
+		delete(r.subscriberLevels, session.SessionID())
+		delete(r.sessions, session.SessionID())
+		r.mu.Unlock()
+		r.syncUpstreamLevel()
+		r.dropSubscriptions(session.SessionID())
+		if pool, ok := r.client.(*stdioPool); ok {
+			pool.releaseSession(session.SessionID())
+		}
+	})
+	hooks.AddOnRequestInitialization(r.handleSubscription)
+}
+
+// attach binds the relay to the downstream server once it is created
+func (r *notificationRelay) attach(server *mcpserver.MCPServer) {
+	r.server = server
+	server.AddNotificationHandler(methodNotificationCancelled, r.handleCancelled)
+	server.AddNotificationHandler(mcp.MethodNotificationRootsListChanged, r.forwardRootsListChanged)
+}
+
+// setUpstreamCapabilities records the capabilities the upstream declared during initialization
+func (r *notificationRelay) setUpstreamCapabilities(capabilities mcp.ServerCapabilities) {
+	r.mu.Lock()
+	r.upstream = capabilities
+	r.mu.Unlock()
+}
+
+// syncUpstreamLevel sets the upstream log level to the most verbose level requested by a downstream session
+func (r *notificationRelay) syncUpstreamLevel() {
+	r.mu.Lock()
+	if r.upstream.Logging == nil || len(r.subscriberLevels) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	var level mcp.LoggingLevel
+	for _, requested := range r.subscriberLevels {
+		if level == "" || (requested != level && level.ShouldSendTo(requested)) {
+			level = requested
+		}
+	}
+	if level == r.upstreamLevel {
+		r.mu.Unlock()
+		return
+	}
+	r.upstreamLevel = level
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamNotifyTimeout)
+	defer cancel()
+	request := mcp.SetLevelRequest{}
+	request.Params.Level = level
+	if err := r.client.SetLevel(ctx, request); err != nil {
+		common.SysError(fmt.Sprintf("[Relay] Failed to set log level %s on %s: %v", level, r.name, err))
+	}
+}
+
+// callTool forwards a tools/call upstream under a request ID and progress token owned by the relay,
+// so that progress can be routed back and the call can be cancelled upstream.
+// The call is bounded by the service's timeout and the service's circuit breaker rejects it
+// outright while open. It is never retried, as tools may not be idempotent.
+// Calls to a stdio worker pool run on the worker chosen by the pool.
+// Clients whose transport is not reachable fall back to a plain CallTool.
+func (r *notificationRelay) callTool(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	downstreamID, hasDownstreamID := takeDownstreamRequestID(&request)
+
+	callCtx, cancel := r.resilience.callContext(ctx)
+	defer cancel()
+
+	client, worker := r.client, anyWorker
+	pool, pooled := r.client.(*stdioPool)
+	if pooled {
+		var release func()
+		var err error
+		client, worker, release, err = pool.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	withTransport, ok := client.(interface{ GetTransport() transport.Interface })
+	if !ok || withTransport.GetTransport() == nil {
+		var result *mcp.CallToolResult
+		err := r.resilience.do(callCtx, func() (bool, error) {
+			var err error
+			result, err = client.CallTool(callCtx, request)
+			return false, err
+		})
+		return result, err
+	}
+	upstream := withTransport.GetTransport()
+
+	token := fmt.Sprintf("towers-%d", r.nextID.Add(1))
+	upstreamID := mcp.NewRequestId(token)
+	call := &relayedCall{ctx: ctx, cancel: cancel, worker: worker}
+	if request.Params.Meta != nil {
+		meta := *request.Params.Meta
+		if meta.ProgressToken != nil {
+			call.progressToken = meta.ProgressToken
+			meta.ProgressToken = token
+		}
+		request.Params.Meta = &meta
+	}
+
+	downstreamKey := ""
+	if session := mcpserver.ClientSessionFromContext(ctx); session != nil && hasDownstreamID {
+		downstreamKey = downstreamCallKey(session.SessionID(), downstreamID)
+	}
+	r.mu.Lock()
+	r.calls[token] = call
+	if downstreamKey != "" {
+		r.downstreamCalls[downstreamKey] = call
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.calls, token)
+		if downstreamKey != "" {
+			delete(r.downstreamCalls, downstreamKey)
+		}
+		r.mu.Unlock()
+	}()
+
+	var response *transport.JSONRPCResponse
+	err := r.resilience.do(callCtx, func() (bool, error) {
+		var err error
+		response, err = upstream.SendRequest(callCtx, transport.JSONRPCRequest{
+			JSONRPC: mcp.JSONRPC_VERSION,
+			ID:      upstreamID,
+			Method:  string(mcp.MethodToolsCall),
+			Params:  request.Params,
+		})
+		if err != nil {
+			if pooled && callCtx.Err() == nil {
+				pool.reportFailure(worker, err)
+			}
+			return false, err
+		}
+		if response.Error != nil {
+			return true, errors.New(response.Error.Message)
+		}
+		return true, nil
+	})
+	if err != nil {
+		if callCtx.Err() != nil {
+			r.cancelUpstream(upstream, upstreamID, callCtx.Err())
+		}
+		return nil, err
+	}
+	return mcp.ParseCallToolResult(&response.Result)
+}
+
+// cancelUpstream tells the upstream to stop working on a request we no longer wait for
+func (r *notificationRelay) cancelUpstream(upstream transport.Interface, id mcp.RequestId, reason error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamNotifyTimeout)
+	defer cancel()
+	notification := mcp.JSONRPCNotification{
+		JSONRPC: mcp.JSONRPC_VERSION,
+		Notification: mcp.Notification{
+			Method: methodNotificationCancelled,
+			Params: mcp.NotificationParams{
+				AdditionalFields: map[string]any{
+					"requestId": id.Value(),
+					"reason":    reason.Error(),
+				},
+			},
+		},
+	}
+	if err := upstream.SendNotification(ctx, notification); err != nil {
+		common.SysError(fmt.Sprintf("[Relay] Failed to send cancellation of %s to %s: %v", id.String(), r.name, err))
+	}
+}
+
+// handleCancelled cancels the upstream call of a downstream request the client gave up on
+func (r *notificationRelay) handleCancelled(ctx context.Context, notification mcp.JSONRPCNotification) {
+	session := mcpserver.ClientSessionFromContext(ctx)
+	if session == nil {
+		return
+	}
+	requestID, ok := notification.Params.AdditionalFields["requestId"]
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	call := r.downstreamCalls[downstreamCallKey(session.SessionID(), requestID)]
+	r.mu.Unlock()
+	if call != nil {
+		call.cancel()
+	}
+}
+
+// handleNotification routes upstream progress and log notifications to downstream sessions
+func (r *notificationRelay) handleNotification(notification mcp.JSONRPCNotification) {
+	switch notification.Method {
+	case methodNotificationProgress:
+		r.forwardProgress(notification)
+	case methodNotificationMessage:
+		r.forwardLog(notification)
+	case mcp.MethodNotificationResourceUpdated:
+		r.forwardResourceUpdated(notification)
+	}
+}
+
+func (r *notificationRelay) forwardProgress(notification mcp.JSONRPCNotification) {
+	params := notification.Params.AdditionalFields
+	r.mu.Lock()
+	call := r.calls[fmt.Sprint(params["progressToken"])]
+	r.mu.Unlock()
+	if call == nil || call.progressToken == nil || r.server == nil {
+		return
+	}
+	forwarded := make(map[string]any, len(params))
+	for k, v := range params {
+		forwarded[k] = v
+	}
+	forwarded["progressToken"] = call.progressToken
+	if err := r.server.SendNotificationToClient(call.ctx, methodNotificationProgress, forwarded); err != nil {
+		common.SysLog(fmt.Sprintf("WARN: [Relay] Dropped progress notification from %s: %v", r.name, err))
+	}
+}
+
+// forwardLog delivers an upstream log message, subject to each session's log level. Log messages
+// do not say which request they belong to, so a message goes to the session with calls in flight
+// when there is exactly one. Otherwise it goes to the sessions that set a log level if the instance
+// serves a single user, and is dropped on shared instances, whose sessions belong to other users.
+func (r *notificationRelay) forwardLog(notification mcp.JSONRPCNotification) {
+	if r.server == nil {
+		return
+	}
+	params := notification.Params.AdditionalFields
+	level := mcp.LoggingLevel(fmt.Sprint(params["level"]))
+
+	r.mu.Lock()
+	callers := make(map[string]*relayedCall)
+	for _, call := range r.calls {
+		if session := mcpserver.ClientSessionFromContext(call.ctx); session != nil {
+			callers[session.SessionID()] = call
+		}
+	}
+	private := r.private
+	subscribers := make(map[string]mcp.LoggingLevel, len(r.subscriberLevels))
+	for sessionID, minLevel := range r.subscriberLevels {
+		subscribers[sessionID] = minLevel
+	}
+	r.mu.Unlock()
+
+	if len(callers) == 1 {
+		for _, call := range callers {
+			session := mcpserver.ClientSessionFromContext(call.ctx)
+			if logging, ok := session.(mcpserver.SessionWithLogging); ok && !level.ShouldSendTo(logging.GetLogLevel()) {
+				return
+			}
+			_ = r.server.SendNotificationToClient(call.ctx, methodNotificationMessage, params)
+		}
+		return
+	}
+	if !private {
+		return
+	}
+	for sessionID, minLevel := range subscribers {
+		if !level.ShouldSendTo(minLevel) {
+			continue
+		}
+		// Sessions that are not connected right now (e.g. between streamable HTTP requests) are skipped
+		_ = r.server.SendNotificationToSpecificClient(sessionID, methodNotificationMessage, params)
+	}
+}
+
+// markPrivate records that the instance serves a single user, whose sessions may all receive the
+// upstream's log messages
+func (r *notificationRelay) markPrivate() {
+	r.mu.Lock()
+	r.private = true
+	r.mu.Unlock()
+}
+
+// takeDownstreamRequestID removes the downstream request ID recorded by the BeforeCallTool hook
+func takeDownstreamRequestID(request *mcp.CallToolRequest) (any, bool) {
+	meta := request.Params.Meta
+	if meta == nil {
+		return nil, false
+	}
+	id, ok := meta.AdditionalFields[downstreamRequestIDField]
+	if !ok {
+		return nil, false
+	}
+	fields := make(map[string]any, len(meta.AdditionalFields))
+	for k, v := range meta.AdditionalFields {
+		if k != downstreamRequestIDField {
+			fields[k] = v
+		}
+	}
+	if len(fields) == 0 && meta.ProgressToken == nil {
+		request.Params.Meta = nil
+	} else {
+		request.Params.Meta = &mcp.Meta{ProgressToken: meta.ProgressToken, AdditionalFields: fields}
+	}
+	return id, true
+}
+
+// downstreamCallKey identifies a downstream request; JSON numbers decode the same way in the hook
+// and in the cancellation notification, so formatting both with %v matches.
+func downstreamCallKey(sessionID string, requestID any) string {
+	return fmt.Sprintf("%s/%v", sessionID, requestID)
+}
+
+// relayedClient routes tool calls of an upstream client through its notification relay, and its
+// safe requests through the retries of the service's call policy
+type relayedClient struct {
+	mcpclient.MCPClient
+	relay *notificationRelay
+	stop  context.CancelFunc // ends the lifetime of the instance, and so its ping loop, if set
+}
+
+func (c relayedClient) Close() error {
+	if c.stop != nil {
+		c.stop()
+	}
+	return c.MCPClient.Close()
+}
+
+func (c relayedClient) CallTool(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return c.relay.callTool(ctx, request)
+}
+
+func (c relayedClient) ListTools(ctx context.Context, request mcp.ListToolsRequest) (*mcp.ListToolsResult, error) {
+	return retrySafe(ctx, c.relay, mcp.MethodToolsList, func() (*mcp.ListToolsResult, error) {
+		return c.MCPClient.ListTools(ctx, request)
+	})
+}
+
+func (c relayedClient) ListPrompts(ctx context.Context, request mcp.ListPromptsRequest) (*mcp.ListPromptsResult, error) {
+	return retrySafe(ctx, c.relay, mcp.MethodPromptsList, func() (*mcp.ListPromptsResult, error) {
+		return c.MCPClient.ListPrompts(ctx, request)
+	})
+}
+
+func (c relayedClient) ListResources(ctx context.Context, request mcp.ListResourcesRequest) (*mcp.ListResourcesResult, error) {
+	return retrySafe(ctx, c.relay, mcp.MethodResourcesList, func() (*mcp.ListResourcesResult, error) {
+		return c.MCPClient.ListResources(ctx, request)
+	})
+}
+
+func (c relayedClient) ListResourceTemplates(ctx context.Context, request mcp.ListResourceTemplatesRequest) (*mcp.ListResourceTemplatesResult, error) {
+	return retrySafe(ctx, c.relay, mcp.MethodResourcesTemplatesList, func() (*mcp.ListResourceTemplatesResult, error) {
+		return c.MCPClient.ListResourceTemplates(ctx, request)
+	})
+}
+
+func (c relayedClient) ReadResource(ctx context.Context, request mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	return retrySafe(ctx, c.relay, mcp.MethodResourcesRead, func() (*mcp.ReadResourceResult, error) {
+		return c.MCPClient.ReadResource(ctx, request)
+	})
+}
+
+func (c relayedClient) Ping(ctx context.Context) error {
+	_, err := retrySafe(ctx, c.relay, mcp.MethodPing, func() (struct{}, error) {
+		return struct{}{}, c.MCPClient.Ping(ctx)
+	})
+	return err
+}
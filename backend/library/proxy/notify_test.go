@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relayFixture is an upstream SSE server proxied by a real service instance, itself served over SSE.
+type relayFixture struct {
+	downstream    *mcpclient.Client
+	notifications chan mcp.JSONRPCNotification
+	levels        chan mcp.LoggingLevel
+	started       chan struct{}
+	cancelled     chan any
+}
+
+func newRelayFixture(t *testing.T) *relayFixture {
+	t.Helper()
+	f := &relayFixture{
+		notifications: make(chan mcp.JSONRPCNotification, 16),
+		levels:        make(chan mcp.LoggingLevel, 4),
+		started:       make(chan struct{}, 1),
+		cancelled:     make(chan any, 1),
+	}
+	release := make(chan struct{})
+
+	hooks := &mcpserver.Hooks{}
+	hooks.AddAfterSetLevel(func(ctx context.Context, id any, message *mcp.SetLevelRequest, result *mcp.EmptyResult) {
+		f.levels <- message.Params.Level
+	})
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0", mcpserver.WithLogging(), mcpserver.WithHooks(hooks))
+	upstream.AddTool(mcp.NewTool("work"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		server := mcpserver.ServerFromContext(ctx)
+		if request.Params.Meta != nil && request.Params.Meta.ProgressToken != nil {
+			_ = server.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+				"progressToken": request.Params.Meta.ProgressToken,
+				"progress":      1,
+				"total":         2,
+			})
+		}
+		_ = server.SendNotificationToClient(ctx, "notifications/message", map[string]any{
+			"level": "info",
+			"data":  "working",
+		})
+		// Give the notifications a head start over the response on the SSE stream
+		time.Sleep(50 * time.Millisecond)
+		return mcp.NewToolResultText("done"), nil
+	})
+	upstream.AddTool(mcp.NewTool("block"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		f.started <- struct{}{}
+		<-release
+		return mcp.NewToolResultText("released"), nil
+	})
+	upstream.AddNotificationHandler("notifications/cancelled", func(ctx context.Context, notification mcp.JSONRPCNotification) {
+		f.cancelled <- notification.Params.AdditionalFields["requestId"]
+	})
+	upstreamHTTP := mcpserver.NewTestServer(upstream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := &model.MCPService{Name: "relayed", Type: model.ServiceTypeSSE, Command: upstreamHTTP.URL + "/sse"}
+	proxied, upstreamClient, err := createActualMcpGoServerAndClientUncached(ctx, svc, "test")
+	require.NoError(t, err)
+	proxiedHTTP := mcpserver.NewTestServer(proxied)
+
+	downstream, err := mcpclient.NewSSEMCPClient(proxiedHTTP.URL + "/sse")
+	require.NoError(t, err)
+	require.NoError(t, downstream.Start(ctx))
+	downstream.OnNotification(func(notification mcp.JSONRPCNotification) {
+		f.notifications <- notification
+	})
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "downstream", Version: "1.0.0"}
+	_, err = downstream.Initialize(ctx, initRequest)
+	require.NoError(t, err)
+	f.downstream = downstream
+
+	t.Cleanup(func() {
+		close(release)
+		downstream.Close()
+		proxiedHTTP.Close()
+		upstreamClient.Close()
+		upstreamHTTP.Close()
+		cancel()
+	})
+	return f
+}
+
+// next returns the next downstream notification with the given method
+func (f *relayFixture) next(t *testing.T, method string) mcp.JSONRPCNotification {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case notification := <-f.notifications:
+			if notification.Method == method {
+				return notification
+			}
+		case <-timeout:
+			t.Fatalf("no %s notification received", method)
+			return mcp.JSONRPCNotification{}
+		}
+	}
+}
+
+func TestNotificationRelay_ForwardsProgressAndLogs(t *testing.T) {
+	f := newRelayFixture(t)
+	ctx := context.Background()
+
+	setLevel := mcp.SetLevelRequest{}
+	setLevel.Params.Level = mcp.LoggingLevelDebug
+	require.NoError(t, f.downstream.SetLevel(ctx, setLevel))
+	select {
+	case level := <-f.levels:
+		assert.Equal(t, mcp.LoggingLevelDebug, level, "logging/setLevel must be forwarded upstream")
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging/setLevel was not forwarded upstream")
+	}
+
+	request := mcp.CallToolRequest{}
+	request.Params.Name = "work"
+	request.Params.Meta = &mcp.Meta{ProgressToken: "downstream-token"}
+	result, err := f.downstream.CallTool(ctx, request)
+	require.NoError(t, err)
+	require.Len(t, result.Content, 1)
+	assert.Equal(t, "done", result.Content[0].(mcp.TextContent).Text)
+
+	progress := f.next(t, "notifications/progress")
+	assert.Equal(t, "downstream-token", progress.Params.AdditionalFields["progressToken"], "the downstream progress token must be restored")
+	assert.EqualValues(t, 1, progress.Params.AdditionalFields["progress"])
+
+	message := f.next(t, "notifications/message")
+	assert.Equal(t, "working", message.Params.AdditionalFields["data"])
+}
+
+func TestNotificationRelay_PropagatesCancellation(t *testing.T) {
+	f := newRelayFixture(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		_, _ = f.downstream.GetTransport().SendRequest(callCtx, transport.JSONRPCRequest{
+			JSONRPC: mcp.JSONRPC_VERSION,
+			ID:      mcp.NewRequestId("call-1"),
+			Method:  string(mcp.MethodToolsCall),
+			Params:  map[string]any{"name": "block"},
+		})
+	}()
+
+	select {
+	case <-f.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream tool was not called")
+	}
+
+	require.NoError(t, f.downstream.GetTransport().SendNotification(ctx, mcp.JSONRPCNotification{
+		JSONRPC: mcp.JSONRPC_VERSION,
+		Notification: mcp.Notification{
+			Method: "notifications/cancelled",
+			Params: mcp.NotificationParams{AdditionalFields: map[string]any{"requestId": "call-1"}},
+		},
+	}))
+
+	select {
+	case requestID := <-f.cancelled:
+		assert.Contains(t, requestID, "towers-", "the upstream must be told to cancel the relayed request")
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancellation was not propagated upstream")
+	}
+}
+
+func TestTakeDownstreamRequestID(t *testing.T) {
+	request := mcp.CallToolRequest{}
+	request.Params.Meta = &mcp.Meta{AdditionalFields: map[string]any{downstreamRequestIDField: float64(7)}}
+	id, ok := takeDownstreamRequestID(&request)
+	require.True(t, ok)
+	assert.Equal(t, "s/7", downstreamCallKey("s", id))
+	assert.Nil(t, request.Params.Meta, "an otherwise empty _meta must not be forwarded")
+}
+
+// testSession is a downstream session that records the notifications sent to it
+type testSession struct {
+	id            string
+	notifications chan mcp.JSONRPCNotification
+}
+
+func newTestSession(id string) *testSession {
+	return &testSession{id: id, notifications: make(chan mcp.JSONRPCNotification, 4)}
+}
+
+func (s *testSession) SessionID() string { return s.id }
+func (s *testSession) NotificationChannel() chan<- mcp.JSONRPCNotification {
+	return s.notifications
+}
+func (s *testSession) Initialize()       {}
+func (s *testSession) Initialized() bool { return true }
+
+func (s *testSession) received() bool {
+	select {
+	case <-s.notifications:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestNotificationRelay_ScopesLogsToTheirCaller(t *testing.T) {
+	ctx := context.Background()
+	server := mcpserver.NewMCPServer("relayed", "1.0.0")
+	relay := newNotificationRelay("relayed", capabilityGuard{filter: allowAllCapabilities})
+	relay.attach(server)
+	alice, bob := newTestSession("alice"), newTestSession("bob")
+	require.NoError(t, server.RegisterSession(ctx, alice))
+	require.NoError(t, server.RegisterSession(ctx, bob))
+	relay.subscriberLevels["alice"] = mcp.LoggingLevelDebug
+	relay.subscriberLevels["bob"] = mcp.LoggingLevelDebug
+	message := mcp.JSONRPCNotification{Notification: mcp.Notification{
+		Method: methodNotificationMessage,
+		Params: mcp.NotificationParams{AdditionalFields: map[string]any{"level": "info", "data": "secret"}},
+	}}
+
+	// A log received while a single session has calls in flight goes to that session only
+	relay.calls["1"] = &relayedCall{ctx: server.WithContext(ctx, alice)}
+	relay.forwardLog(message)
+	assert.True(t, alice.received())
+	assert.False(t, bob.received())
+
+	// Otherwise a shared instance cannot tell whose log it is and drops it
+	relay.calls["2"] = &relayedCall{ctx: server.WithContext(ctx, bob)}
+	relay.forwardLog(message)
+	delete(relay.calls, "1")
+	delete(relay.calls, "2")
+	relay.forwardLog(message)
+	assert.False(t, alice.received())
+	assert.False(t, bob.received())
+
+	// The sessions of an instance serving a single user all belong to that user
+	relay.markPrivate()
+	relay.forwardLog(message)
+	assert.True(t, alice.received())
+	assert.True(t, bob.received())
+}
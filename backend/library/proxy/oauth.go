@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+)
+
+// A service with OAuthEnabled authorizes to its SSE or streamable HTTP upstream as an OAuth 2.1
+// client, following the MCP authorization spec: the authorization server is discovered from the
+// upstream, toWers registers itself dynamically unless a client ID is configured, and access is
+// granted with the authorization code flow and PKCE, started from the UI. Tokens are stored
+// encrypted, per user or for everyone, and refreshed shortly before they expire.
+
+// OAuthCallbackPath is where authorization servers redirect back to once access is granted
+const OAuthCallbackPath = "/api/oauth/upstream/callback"
+
+var (
+	// ErrOAuthAuthorizationRequired is returned when an instance cannot start before its upstream is authorized
+	ErrOAuthAuthorizationRequired = transport.ErrOAuthAuthorizationRequired
+	// ErrOAuthNotEnabled is returned when authorizing a service that does not use OAuth
+	ErrOAuthNotEnabled = errors.New("service does not authorize with OAuth")
+	// ErrOAuthFlowNotFound is returned for a callback that matches no pending authorization
+	ErrOAuthFlowNotFound = errors.New("authorization request not found or expired")
+	// ErrOAuthFlowWrongBrowser is returned for a callback reaching another browser than the one
+	// of the user who started the authorization
+	ErrOAuthFlowWrongBrowser = errors.New("authorization was started from another browser")
+)
+
+var (
+	oauthRefreshMargin = time.Minute
+	oauthFlowTimeout   = 10 * time.Minute
+)
+
+type oauthTokenKey struct {
+	serviceID int64
+	userID    int64
+}
+
+var (
+	oauthTokens   = make(map[oauthTokenKey]*transport.Token)
+	oauthTokensMu sync.Mutex
+)
+
+// oauthTokenStore keeps the token of a service and user in the database, cached in memory
+type oauthTokenStore struct {
+	key oauthTokenKey
+}
+
+func (s oauthTokenStore) GetToken(ctx context.Context) (*transport.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	token, err := loadOAuthToken(s.key)
+	if err != nil {
+		return nil, err
+	}
+	// A token that can be refreshed is reported expired a little early, so it is refreshed before
+	// a request is sent with it rather than after the upstream rejected it
+	if token.RefreshToken != "" && !token.ExpiresAt.IsZero() {
+		early := *token
+		early.ExpiresAt = token.ExpiresAt.Add(-oauthRefreshMargin)
+		return &early, nil
+	}
+	return token, nil
+}
+
+func (s oauthTokenStore) SaveToken(ctx context.Context, token *transport.Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	oauthTokensMu.Lock()
+	defer oauthTokensMu.Unlock()
+	if err := model.SaveUpstreamOAuthToken(s.key.serviceID, s.key.userID, string(tokenJSON)); err != nil {
+		return err
+	}
+	saved := *token
+	oauthTokens[s.key] = &saved
+	return nil
+}
+
+func loadOAuthToken(key oauthTokenKey) (*transport.Token, error) {
+	oauthTokensMu.Lock()
+	defer oauthTokensMu.Unlock()
+	if token, ok := oauthTokens[key]; ok {
+		return token, nil
+	}
+	stored, err := model.GetUpstreamOAuthToken(key.serviceID, key.userID)
+	if errors.Is(err, model.ErrUpstreamOAuthTokenNotFound) {
+		return nil, transport.ErrNoToken
+	} else if err != nil {
+		return nil, err
+	}
+	tokenJSON, err := stored.GetToken()
+	if err != nil {
+		return nil, err
+	}
+	var token transport.Token
+	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
+		return nil, err
+	}
+	oauthTokens[key] = &token
+	return &token, nil
+}
+
+func forgetOAuthToken(key oauthTokenKey) {
+	oauthTokensMu.Lock()
+	delete(oauthTokens, key)
+	oauthTokensMu.Unlock()
+}
+
+// oauthTokenOwner returns the user whose token an instance started for userID uses: the user for
+// services authorized per user, 0 (everyone) otherwise
+func oauthTokenOwner(svc *model.MCPService, userID int64) int64 {
+	if svc.OAuthPerUser {
+		return userID
+	}
+	return 0
+}
+
+func oauthRedirectURI() string {
+	common.OptionMapRWMutex.RLock()
+	serverAddress := common.OptionMap["ServerAddress"]
+	common.OptionMapRWMutex.RUnlock()
+	if serverAddress == "" {
+		serverAddress = common.ServerAddress
+	}
+	return strings.TrimSuffix(serverAddress, "/") + OAuthCallbackPath
+}
+
+// oauthConfig returns the OAuth client configuration of the instances of svc started for userID
+func oauthConfig(svc *model.MCPService, userID int64) (transport.OAuthConfig, error) {
+	secret, err := svc.GetOAuthClientSecret()
+	if err != nil {
+		return transport.OAuthConfig{}, fmt.Errorf("failed to read the OAuth client secret of %s: %w", svc.Name, err)
+	}
+	return transport.OAuthConfig{
+		ClientID:              svc.OAuthClientID,
+		ClientSecret:          secret,
+		RedirectURI:           oauthRedirectURI(),
+		Scopes:                svc.GetOAuthScopes(),
+		TokenStore:            oauthTokenStore{key: oauthTokenKey{serviceID: svc.ID, userID: oauthTokenOwner(svc, userID)}},
+		AuthServerMetadataURL: svc.OAuthMetadataURL,
+		PKCEEnabled:           true,
+	}, nil
+}
+
+// upstreamOAuthConfig returns the OAuth client configuration of the instance being started, nil
+// if its service does not authorize with OAuth
+func upstreamOAuthConfig(ctx context.Context, svc *model.MCPService) (*transport.OAuthConfig, error) {
+	if !svc.OAuthEnabled {
+		return nil, nil
+	}
+	cacheKey, _ := ctx.Value(instanceKey{}).(string)
+	config, err := oauthConfig(svc, instanceOwner(cacheKey))
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// upstreamBaseURL returns the origin of an upstream URL, where authorization metadata is discovered
+func upstreamBaseURL(upstreamURL string) (string, error) {
+	parsed, err := url.Parse(upstreamURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid upstream URL %q", upstreamURL)
+	}
+	return fmt.Sprintf("%s://%s", parsed.Scheme, parsed.Host), nil
+}
+
+// oauthFlow is an authorization started from the UI, waiting for the authorization server to
+// redirect back
+type oauthFlow struct {
+	handler   *transport.OAuthHandler
+	serviceID int64
+	userID    int64 // Token owner, 0 for everyone
+	verifier  string
+	expires   time.Time
+	// Random key given to the browser that started the flow, so that its authorization URL
+	// cannot be sent to someone else to complete
+	browserKey string
+}
+
+var (
+	oauthFlows   = make(map[string]*oauthFlow)
+	oauthFlowsMu sync.Mutex
+	// Serializes dynamic client registrations, so a service registers a single client
+	oauthRegistrationMu sync.Mutex
+)
+
+// StartOAuthAuthorization returns the URL to send a browser to, to authorize toWers to call the
+// upstream of svc on behalf of userID, or of everyone when the service is not authorized per user.
+// browserKey identifies the browser of userID: only a callback from it completes the authorization.
+func StartOAuthAuthorization(ctx context.Context, svc *model.MCPService, userID int64, browserKey string) (string, error) {
+	if browserKey == "" {
+		return "", ErrOAuthFlowWrongBrowser
+	}
+	if !svc.OAuthEnabled {
+		return "", ErrOAuthNotEnabled
+	}
+	baseURL, err := upstreamBaseURL(svc.Command)
+	if err != nil {
+		return "", err
+	}
+	if err := registerOAuthClient(ctx, svc, baseURL); err != nil {
+		return "", err
+	}
+
+	config, err := oauthConfig(svc, userID)
+	if err != nil {
+		return "", err
+	}
+	handler := transport.NewOAuthHandler(config)
+	handler.SetBaseURL(baseURL)
+	verifier, err := transport.GenerateCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+	state, err := transport.GenerateState()
+	if err != nil {
+		return "", err
+	}
+	authorizationURL, err := handler.GetAuthorizationURL(ctx, state, transport.GenerateCodeChallenge(verifier))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	oauthFlowsMu.Lock()
+	for key, flow := range oauthFlows {
+		if now.After(flow.expires) {
+			delete(oauthFlows, key)
+		}
+	}
+	oauthFlows[state] = &oauthFlow{
+		handler:    handler,
+		serviceID:  svc.ID,
+		userID:     oauthTokenOwner(svc, userID),
+		verifier:   verifier,
+		expires:    now.Add(oauthFlowTimeout),
+		browserKey: browserKey,
+	}
+	oauthFlowsMu.Unlock()
+	return authorizationURL, nil
+}
+
+// registerOAuthClient registers toWers with the authorization server of a service that has no
+// client ID yet, and saves the client credentials on the service
+func registerOAuthClient(ctx context.Context, svc *model.MCPService, baseURL string) error {
+	if svc.OAuthClientID != "" {
+		return nil
+	}
+	oauthRegistrationMu.Lock()
+	defer oauthRegistrationMu.Unlock()
+	// Registered by a concurrent authorization
+	if saved, err := model.GetServiceByID(svc.ID); err == nil && saved.OAuthClientID != "" {
+		svc.OAuthClientID, svc.OAuthClientSecret = saved.OAuthClientID, saved.OAuthClientSecret
+		return nil
+	}
+
+	config, err := oauthConfig(svc, 0)
+	if err != nil {
+		return err
+	}
+	handler := transport.NewOAuthHandler(config)
+	handler.SetBaseURL(baseURL)
+	if err := handler.RegisterClient(ctx, common.SystemName); err != nil {
+		return fmt.Errorf("dynamic client registration failed: %w", err)
+	}
+	svc.OAuthClientID = handler.GetClientID()
+	if err := svc.SetOAuthClientSecret(handler.GetClientSecret()); err != nil {
+		return err
+	}
+	if err := model.UpdateService(svc); err != nil {
+		return err
+	}
+	common.SysLog(fmt.Sprintf("[OAuth] Registered client %s for %s", svc.OAuthClientID, svc.Name))
+	return nil
+}
+
+// CompleteOAuthAuthorization exchanges the code an authorization server redirected back with for a
+// token and stores it, if browserKey is the key of the browser that started the authorization.
+// It returns the service and the user (0 for everyone) it authorized.
+func CompleteOAuthAuthorization(ctx context.Context, state, code, browserKey string) (int64, int64, error) {
+	oauthFlowsMu.Lock()
+	flow := oauthFlows[state]
+	delete(oauthFlows, state)
+	oauthFlowsMu.Unlock()
+	if flow == nil || time.Now().After(flow.expires) {
+		return 0, 0, ErrOAuthFlowNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(browserKey), []byte(flow.browserKey)) != 1 {
+		common.SysLog(fmt.Sprintf("WARN: [OAuth] Rejected the authorization of service %d started by another browser", flow.serviceID))
+		return 0, 0, ErrOAuthFlowWrongBrowser
+	}
+	if err := flow.handler.ProcessAuthorizationResponse(ctx, code, state, flow.verifier); err != nil {
+		return 0, 0, err
+	}
+	common.SysLog(fmt.Sprintf("[OAuth] Authorized service %d for user %d", flow.serviceID, flow.userID))
+	return flow.serviceID, flow.userID, nil
+}
+
+// OAuthStatus describes the authorization of a service's upstream for a user
+type OAuthStatus struct {
+	Enabled     bool       `json:"enabled"`
+	PerUser     bool       `json:"per_user"`
+	Authorized  bool       `json:"authorized"`
+	Refreshable bool       `json:"refreshable"`
+	Scope       string     `json:"scope,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// GetOAuthStatus returns whether toWers holds a token for calling the upstream of svc on behalf of userID
+func GetOAuthStatus(svc *model.MCPService, userID int64) (OAuthStatus, error) {
+	status := OAuthStatus{Enabled: svc.OAuthEnabled, PerUser: svc.OAuthPerUser}
+	if !svc.OAuthEnabled {
+		return status, nil
+	}
+	token, err := loadOAuthToken(oauthTokenKey{serviceID: svc.ID, userID: oauthTokenOwner(svc, userID)})
+	if errors.Is(err, transport.ErrNoToken) {
+		return status, nil
+	} else if err != nil {
+		return status, err
+	}
+	status.Refreshable = token.RefreshToken != ""
+	status.Authorized = status.Refreshable || !token.IsExpired()
+	status.Scope = token.Scope
+	if !token.ExpiresAt.IsZero() {
+		expiresAt := token.ExpiresAt
+		status.ExpiresAt = &expiresAt
+	}
+	return status, nil
+}
+
+// RevokeOAuthAuthorization deletes the token held for calling the upstream of svc on behalf of
+// userID, and shuts down the instances that used it
+func RevokeOAuthAuthorization(svc *model.MCPService, userID int64) error {
+	owner := oauthTokenOwner(svc, userID)
+	if err := model.DeleteUpstreamOAuthToken(svc.ID, owner); err != nil {
+		return err
+	}
+	forgetOAuthToken(oauthTokenKey{serviceID: svc.ID, userID: owner})
+
+	sharedMCPServersMutex.Lock()
+	var revoked []*SharedMcpInstance
+	for _, instance := range sharedMCPServers {
+		if instance.serviceID == svc.ID && oauthTokenOwner(svc, instance.userID) == owner {
+			revoked = append(revoked, instance)
+		}
+	}
+	for _, instance := range revoked {
+		removeSharedInstanceLocked(instance)
+	}
+	sharedMCPServersMutex.Unlock()
+	for _, instance := range revoked {
+		instance.retire("OAuth authorization revoked")
+	}
+	return nil
+}
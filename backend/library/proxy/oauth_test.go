@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockAuthorizationServer is an MCP upstream that is also its own OAuth authorization server. It
+// grants any authorization request right away, and only serves MCP requests bearing a token it issued.
+type mockAuthorizationServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	challenges map[string]string // Code challenge by authorization code
+	tokens     map[string]bool   // Access tokens issued
+	issued     int
+	registered atomic.Int32
+	refreshed  atomic.Int32
+}
+
+func newMockAuthorizationServer(t *testing.T) *mockAuthorizationServer {
+	t.Helper()
+	m := &mockAuthorizationServer{challenges: make(map[string]string), tokens: make(map[string]bool)}
+	mcpHandler := mcpserver.NewStreamableHTTPServer(authorizationEcho(), mcpserver.WithHTTPContextFunc(withAuthorization))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/oauth-protected-resource", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"resource": m.URL, "authorization_servers": []string{m.URL}})
+	})
+	mux.HandleFunc("/.well-known/oauth-authorization-server", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                           m.URL,
+			"authorization_endpoint":           m.URL + "/authorize",
+			"token_endpoint":                   m.URL + "/token",
+			"registration_endpoint":            m.URL + "/register",
+			"code_challenge_methods_supported": []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		m.registered.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"client_id": "mock-client", "client_secret": "mock-secret"})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != "mock-client" || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.issued++
+		code := fmt.Sprintf("code-%d", m.issued)
+		m.challenges[code] = query.Get("code_challenge")
+		m.mu.Unlock()
+		redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("client_id") != "mock-client" || r.PostForm.Get("client_secret") != "mock-secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			challenge, ok := m.challenges[r.PostForm.Get("code")]
+			delete(m.challenges, r.PostForm.Get("code"))
+			verified := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if !ok || base64.RawURLEncoding.EncodeToString(verified[:]) != challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		case "refresh_token":
+			if !strings.HasPrefix(r.PostForm.Get("refresh_token"), "refresh-") {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			m.refreshed.Add(1)
+		default:
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		m.issued++
+		access := fmt.Sprintf("access-%d", m.issued)
+		m.tokens[access] = true
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  access,
+			"token_type":    "bearer",
+			"expires_in":    3600,
+			"refresh_token": fmt.Sprintf("refresh-%d", m.issued),
+			"scope":         "tools",
+		})
+	})
+	mux.Handle("/mcp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		valid := m.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		m.mu.Unlock()
+		if !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer resource_metadata="`+m.URL+`/.well-known/oauth-protected-resource"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mcpHandler.ServeHTTP(w, r)
+	}))
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize runs the authorization flow of svc for userID like a browser would
+func (m *mockAuthorizationServer) authorize(t *testing.T, svc *model.MCPService, userID int64) {
+	t.Helper()
+	authorizationURL, err := StartOAuthAuthorization(context.Background(), svc, userID, "browser-key")
+	require.NoError(t, err)
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(authorizationURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, OAuthCallbackPath, callback.Path)
+
+	serviceID, owner, err := CompleteOAuthAuthorization(context.Background(), callback.Query().Get("state"), callback.Query().Get("code"), "browser-key")
+	require.NoError(t, err)
+	assert.Equal(t, svc.ID, serviceID)
+	assert.Equal(t, oauthTokenOwner(svc, userID), owner)
+}
+
+func TestUpstreamOAuth_AuthorizesRefreshesAndRevokes(t *testing.T) {
+	savedPath, savedKey := common.SQLitePath, common.SecretEncryptionKey
+	common.SQLitePath, common.SecretEncryptionKey = ":memory:", ""
+	t.Cleanup(func() { common.SQLitePath, common.SecretEncryptionKey = savedPath, savedKey })
+	require.NoError(t, model.InitDB())
+	withInstanceCache(t)
+	upstream := newMockAuthorizationServer(t)
+
+	svc := &model.MCPService{Name: "oauth-upstream", DisplayName: "OAuth upstream", Type: model.ServiceTypeStreamableHTTP, Command: upstream.URL + "/mcp",
+		OAuthEnabled: true, OAuthPerUser: true, OAuthScopes: "tools"}
+	// Tokens are not stored without a key that survives restarts
+	assert.ErrorIs(t, svc.ValidateOAuth(), common.ErrNoSecretEncryptionKey)
+	common.SecretEncryptionKey = "test-key"
+	require.NoError(t, svc.ValidateOAuth())
+	require.NoError(t, model.CreateService(svc))
+	defer model.DeleteService(svc.ID)
+	ctx := context.Background()
+	cacheKey := func(userID int64) string { return fmt.Sprintf("user-%d-service-%d-shared", userID, svc.ID) }
+
+	upstream.authorize(t, svc, 1)
+	assert.EqualValues(t, 1, upstream.registered.Load())
+	saved, err := model.GetServiceByID(svc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "mock-client", saved.OAuthClientID)
+	assert.NotContains(t, saved.OAuthClientSecret, "mock-secret", "the client secret is stored encrypted")
+	stored, err := model.GetUpstreamOAuthToken(svc.ID, 1)
+	require.NoError(t, err)
+	assert.NotContains(t, stored.TokenJSON, "access-", "the token is stored encrypted")
+
+	status, err := GetOAuthStatus(saved, 1)
+	require.NoError(t, err)
+	assert.True(t, status.Authorized)
+	assert.Equal(t, "tools", status.Scope)
+
+	instance, err := startSharedInstance(ctx, saved, cacheKey(1), cacheKey(1), "")
+	require.NoError(t, err)
+	defer instance.retire("test done")
+	assert.Equal(t, "Bearer access-2", callWorker(t, ctx, instance.Client, "whoami"))
+
+	// Expiring within the refresh margin: refreshed before the next request
+	key := oauthTokenKey{serviceID: svc.ID, userID: 1}
+	token, err := loadOAuthToken(key)
+	require.NoError(t, err)
+	expiring := *token
+	expiring.ExpiresAt = time.Now().Add(oauthRefreshMargin / 2)
+	require.NoError(t, oauthTokenStore{key: key}.SaveToken(ctx, &expiring))
+	assert.Equal(t, "Bearer access-3", callWorker(t, ctx, instance.Client, "whoami"))
+	assert.EqualValues(t, 1, upstream.refreshed.Load())
+	forgetOAuthToken(key)
+	token, err = loadOAuthToken(key)
+	require.NoError(t, err)
+	assert.Equal(t, "access-3", token.AccessToken, "the refreshed token is saved")
+
+	_, err = startSharedInstance(ctx, saved, cacheKey(2), cacheKey(2), "")
+	assert.True(t, errors.Is(err, ErrOAuthAuthorizationRequired), "user 2 has not authorized: %v", err)
+
+	sharedMCPServersMutex.Lock()
+	sharedMCPServers[cacheKey(1)] = instance
+	sharedMCPServersMutex.Unlock()
+	require.NoError(t, RevokeOAuthAuthorization(saved, 1))
+	assert.True(t, instance.isRetired())
+	assert.Nil(t, lookupSharedInstance(cacheKey(1)))
+	status, err = GetOAuthStatus(saved, 1)
+	require.NoError(t, err)
+	assert.False(t, status.Authorized)
+
+	_, _, err = CompleteOAuthAuthorization(ctx, "unknown-state", "code", "browser-key")
+	assert.True(t, errors.Is(err, ErrOAuthFlowNotFound))
+
+	// An authorization URL sent to someone else does not complete in their browser
+	authorizationURL, err := StartOAuthAuthorization(ctx, saved, 1, "browser-key")
+	require.NoError(t, err)
+	started, err := url.Parse(authorizationURL)
+	require.NoError(t, err)
+	_, _, err = CompleteOAuthAuthorization(ctx, started.Query().Get("state"), "code", "other-browser")
+	assert.ErrorIs(t, err, ErrOAuthFlowWrongBrowser)
+	_, _, err = CompleteOAuthAuthorization(ctx, started.Query().Get("state"), "code", "browser-key")
+	assert.ErrorIs(t, err, ErrOAuthFlowNotFound, "a rejected callback ends the authorization")
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"toWers/backend/common"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	methodResourcesSubscribe   = "resources/subscribe"
+	methodResourcesUnsubscribe = "resources/unsubscribe"
+)
+
+var (
+	_ mcpserver.PromptCompletionProvider   = (*notificationRelay)(nil)
+	_ mcpserver.ResourceCompletionProvider = (*notificationRelay)(nil)
+)
+
+// subscriptionRequestKey carries a rewritten resources/subscribe or resources/unsubscribe request
+// from withSubscriptionPassthrough to the relay's OnRequestInitialization hook.
+type subscriptionRequestKey struct{}
+
+type subscriptionRequest struct {
+	method string
+	uri    string
+}
+
+// withSubscriptionPassthrough lets a proxied MCPServer answer resources/subscribe and resources/unsubscribe.
+// mcp-go advertises the subscribe capability but has no handler for either method, so the request is
+// rewritten into a ping, which answers with the same empty result over the right transport, and the
+// original is recorded in the request context. The relay's hook then performs it against the upstream
+// and turns a failure into a JSON-RPC error.
+func withSubscriptionPassthrough(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var message map[string]json.RawMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var method string
+		_ = json.Unmarshal(message["method"], &method)
+		if method != methodResourcesSubscribe && method != methodResourcesUnsubscribe {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var params struct {
+			URI string `json:"uri"`
+		}
+		_ = json.Unmarshal(message["params"], &params)
+		message["method"] = json.RawMessage(`"` + string(mcp.MethodPing) + `"`)
+		delete(message, "params")
+		rewritten, err := json.Marshal(message)
+		if err != nil {
+			http.Error(w, "Failed to rewrite request", http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(rewritten))
+		r.ContentLength = int64(len(rewritten))
+		ctx := context.WithValue(r.Context(), subscriptionRequestKey{}, subscriptionRequest{method: method, uri: params.URI})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// handleSubscription performs a subscription request rewritten by withSubscriptionPassthrough
+func (r *notificationRelay) handleSubscription(ctx context.Context, id any, message any) error {
+	request, ok := ctx.Value(subscriptionRequestKey{}).(subscriptionRequest)
+	if !ok {
+		return nil
+	}
+	session := mcpserver.ClientSessionFromContext(ctx)
+	if session == nil {
+		return fmt.Errorf("%s requires a session", request.method)
+	}
+	if request.uri == "" {
+		return fmt.Errorf("%s: uri is required", request.method)
+	}
+	if request.method == methodResourcesUnsubscribe {
+		return r.unsubscribe(ctx, session.SessionID(), request.uri)
+	}
+	return r.subscribe(ctx, r.server, session.SessionID(), request.uri)
+}
+
+// subscribe records a downstream subscription of a session of server, which is the relay's own
+// server or a virtual server composing it; the upstream is subscribed once per URI.
+func (r *notificationRelay) subscribe(ctx context.Context, server *mcpserver.MCPServer, sessionID, uri string) error {
+	if !r.guard.allowsResource(ctx, uri) {
+		return fmt.Errorf("resource %s is not allowed on %s", uri, r.name)
+	}
+	r.mu.Lock()
+	if r.upstream.Resources == nil || !r.upstream.Resources.Subscribe {
+		r.mu.Unlock()
+		return fmt.Errorf("%s does not support resource subscriptions", r.name)
+	}
+	sessions := r.subscriptions[uri]
+	if sessions == nil {
+		sessions = make(map[string]*mcpserver.MCPServer)
+		r.subscriptions[uri] = sessions
+	}
+	first := len(sessions) == 0
+	sessions[sessionID] = server
+	r.mu.Unlock()
+	if !first {
+		return nil
+	}
+
+	// The upstream call is made without holding the lock: its response is read by the loop that also
+	// delivers notifications to this relay.
+	request := mcp.SubscribeRequest{}
+	request.Params.URI = uri
+	if err := r.client.Subscribe(ctx, request); err != nil {
+		r.mu.Lock()
+		delete(sessions, sessionID)
+		if len(sessions) == 0 {
+			delete(r.subscriptions, uri)
+		}
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// unsubscribe removes a downstream subscription, unsubscribing the upstream when it was the last one.
+func (r *notificationRelay) unsubscribe(ctx context.Context, sessionID, uri string) error {
+	r.mu.Lock()
+	sessions := r.subscriptions[uri]
+	if _, ok := sessions[sessionID]; !ok {
+		r.mu.Unlock()
+		return nil
+	}
+	delete(sessions, sessionID)
+	last := len(sessions) == 0
+	if last {
+		delete(r.subscriptions, uri)
+	}
+	r.mu.Unlock()
+	if !last {
+		return nil
+	}
+	request := mcp.UnsubscribeRequest{}
+	request.Params.URI = uri
+	return r.client.Unsubscribe(ctx, request)
+}
+
+// dropSubscriptions removes every subscription of a downstream session that went away
+func (r *notificationRelay) dropSubscriptions(sessionID string) {
+	r.mu.Lock()
+	var uris []string
+	for uri, sessions := range r.subscriptions {
+		if _, ok := sessions[sessionID]; ok {
+			uris = append(uris, uri)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, uri := range uris {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamNotifyTimeout)
+		if err := r.unsubscribe(ctx, sessionID, uri); err != nil {
+			common.SysError(fmt.Sprintf("[Relay] Failed to unsubscribe %s on %s: %v", uri, r.name, err))
+		}
+		cancel()
+	}
+}
+
+// forwardResourceUpdated delivers notifications/resources/updated to the sessions subscribed to the resource
+func (r *notificationRelay) forwardResourceUpdated(notification mcp.JSONRPCNotification) {
+	params := notification.Params.AdditionalFields
+	uri := fmt.Sprint(params["uri"])
+	r.mu.Lock()
+	sessions := make(map[string]*mcpserver.MCPServer, len(r.subscriptions[uri]))
+	for sessionID, server := range r.subscriptions[uri] {
+		sessions[sessionID] = server
+	}
+	r.mu.Unlock()
+
+	for sessionID, server := range sessions {
+		if server == nil {
+			continue
+		}
+		if err := server.SendNotificationToSpecificClient(sessionID, mcp.MethodNotificationResourceUpdated, params); err != nil {
+			common.SysLog(fmt.Sprintf("WARN: [Relay] Dropped resource update of %s for session %s: %v", uri, sessionID, err))
+		}
+	}
+}
+
+// CompletePromptArgument forwards completion/complete for a prompt argument to the upstream
+func (r *notificationRelay) CompletePromptArgument(ctx context.Context, promptName string, argument mcp.CompleteArgument, completeContext mcp.CompleteContext) (*mcp.Completion, error) {
+	if !r.guard.allowsPrompt(ctx, promptName) {
+		return nil, fmt.Errorf("prompt %s is not allowed on %s", promptName, r.name)
+	}
+	return r.complete(ctx, mcp.PromptReference{Type: "ref/prompt", Name: promptName}, argument, completeContext)
+}
+
+// CompleteResourceArgument forwards completion/complete for a resource template argument to the upstream
+func (r *notificationRelay) CompleteResourceArgument(ctx context.Context, uri string, argument mcp.CompleteArgument, completeContext mcp.CompleteContext) (*mcp.Completion, error) {
+	if !r.guard.allowsTemplate(ctx, uri) {
+		return nil, fmt.Errorf("resource template %s is not allowed on %s", uri, r.name)
+	}
+	return r.complete(ctx, mcp.ResourceReference{Type: "ref/resource", URI: uri}, argument, completeContext)
+}
+
+// complete asks the upstream for completions, returning none when it does not offer them
+func (r *notificationRelay) complete(ctx context.Context, ref any, argument mcp.CompleteArgument, completeContext mcp.CompleteContext) (*mcp.Completion, error) {
+	r.mu.Lock()
+	supported := r.upstream.Completions != nil
+	r.mu.Unlock()
+	completer, ok := r.client.(interface {
+		Complete(ctx context.Context, request mcp.CompleteRequest) (*mcp.CompleteResult, error)
+	})
+	if !supported || !ok {
+		return &mcp.Completion{Values: []string{}}, nil
+	}
+
+	request := mcp.CompleteRequest{}
+	request.Params.Ref = ref
+	request.Params.Argument = argument
+	request.Params.Context = completeContext
+	result, err := completer.Complete(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &result.Completion, nil
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubPromptCompletions struct{}
+
+func (stubPromptCompletions) CompletePromptArgument(ctx context.Context, promptName string, argument mcp.CompleteArgument, completeContext mcp.CompleteContext) (*mcp.Completion, error) {
+	return &mcp.Completion{Values: []string{promptName + ":" + argument.Value + "-completed"}}, nil
+}
+
+func TestPassthrough_SubscriptionsAndCompletion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The upstream records subscriptions through the same passthrough the proxy uses,
+	// since mcp-go's server does not implement them either.
+	subscriptions := make(chan subscriptionRequest, 4)
+	hooks := &mcpserver.Hooks{}
+	hooks.AddOnRequestInitialization(func(ctx context.Context, id any, message any) error {
+		if request, ok := ctx.Value(subscriptionRequestKey{}).(subscriptionRequest); ok {
+			subscriptions <- request
+		}
+		return nil
+	})
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0",
+		mcpserver.WithResourceCapabilities(true, true),
+		mcpserver.WithCompletions(),
+		mcpserver.WithPromptCompletionProvider(stubPromptCompletions{}),
+		mcpserver.WithHooks(hooks),
+	)
+	upstream.AddPrompt(mcp.NewPrompt("greet", mcp.WithArgument("name")), func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		return mcp.NewGetPromptResult("greet", nil), nil
+	})
+	upstreamHTTP := httptest.NewServer(withSubscriptionPassthrough(mcpserver.NewStreamableHTTPServer(upstream)))
+	defer upstreamHTTP.Close()
+
+	svc := &model.MCPService{Name: "relayed", Type: model.ServiceTypeStreamableHTTP, Command: upstreamHTTP.URL}
+	proxied, upstreamClient, err := createActualMcpGoServerAndClientUncached(ctx, svc, "test")
+	require.NoError(t, err)
+	defer upstreamClient.Close()
+	proxiedHTTP, err := createHTTPProxyHttpHandler(proxied, svc)
+	require.NoError(t, err)
+	proxiedServer := httptest.NewServer(proxiedHTTP)
+	defer proxiedServer.Close()
+
+	httpTransport, err := transport.NewStreamableHTTP(proxiedServer.URL, transport.WithContinuousListening())
+	require.NoError(t, err)
+	downstream := mcpclient.NewClient(httpTransport)
+	require.NoError(t, downstream.Start(ctx))
+	defer downstream.Close()
+	updates := make(chan string, 4)
+	downstream.OnNotification(func(notification mcp.JSONRPCNotification) {
+		if notification.Method == mcp.MethodNotificationResourceUpdated {
+			updates <- notification.Params.AdditionalFields["uri"].(string)
+		}
+	})
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "downstream", Version: "1.0.0"}
+	_, err = downstream.Initialize(ctx, initRequest)
+	require.NoError(t, err)
+
+	subscribe := mcp.SubscribeRequest{}
+	subscribe.Params.URI = "file:///live.txt"
+	require.NoError(t, downstream.Subscribe(ctx, subscribe))
+	select {
+	case request := <-subscriptions:
+		assert.Equal(t, subscriptionRequest{method: methodResourcesSubscribe, uri: "file:///live.txt"}, request)
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not forwarded upstream")
+	}
+
+	// The proxy's listening stream to the upstream may still be connecting, so keep notifying until it arrives
+	deadline := time.After(5 * time.Second)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case uri := <-updates:
+			assert.Equal(t, "file:///live.txt", uri)
+			break wait
+		case <-ticker.C:
+			upstream.SendNotificationToAllClients(mcp.MethodNotificationResourceUpdated, map[string]any{"uri": "file:///live.txt"})
+		case <-deadline:
+			t.Fatal("resource update was not relayed to the subscriber")
+		}
+	}
+
+	unsubscribe := mcp.UnsubscribeRequest{}
+	unsubscribe.Params.URI = "file:///live.txt"
+	require.NoError(t, downstream.Unsubscribe(ctx, unsubscribe))
+	select {
+	case request := <-subscriptions:
+		assert.Equal(t, methodResourcesUnsubscribe, request.method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("unsubscription was not forwarded upstream")
+	}
+
+	complete := mcp.CompleteRequest{}
+	complete.Params.Ref = mcp.PromptReference{Type: "ref/prompt", Name: "greet"}
+	complete.Params.Argument = mcp.CompleteArgument{Name: "name", Value: "al"}
+	result, err := downstream.Complete(ctx, complete)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"greet:al-completed"}, result.Completion.Values)
+}
@@ -0,0 +1,556 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"toWers/backend/common"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// A stdio process serves one request at a time in practice, so a stdio service with WorkerPoolSize > 1
+// runs that many processes behind one instance. Tool calls go to the least busy healthy worker, or,
+// with StickySessions, to the worker a downstream session was first given, for servers that keep
+// state between calls. Everything else (lists, resources, prompts, completion) is served by the
+// primary worker, the first healthy one. Failed workers are respawned in the background.
+
+// ErrNoHealthyWorker is returned when every worker of a pool has failed and none could be respawned yet
+var ErrNoHealthyWorker = errors.New("no healthy worker")
+
+// WorkerHealth is the state of one process of a stdio worker pool
+type WorkerHealth struct {
+	Index     int    `json:"index"`
+	Healthy   bool   `json:"healthy"`
+	InFlight  int32  `json:"in_flight"`
+	Calls     int64  `json:"calls"`
+	Sessions  int    `json:"sessions,omitempty"` // downstream sessions pinned to the worker
+	Restarts  int    `json:"restarts,omitempty"`
+	Retired   bool   `json:"retired,omitempty"` // crash looping and no longer respawned
+	LastError string `json:"last_error,omitempty"`
+}
+
+// stdioWorker is one process of a pool; its fields other than the counters are guarded by the pool's mu
+type stdioWorker struct {
+	index      int
+	client     *mcpclient.Client
+	busy       atomic.Int32
+	calls      atomic.Int64
+	healthy    bool
+	respawning bool
+	retired    bool
+	restarts   int
+	lastError  string
+}
+
+// stdioPool implements mcpclient.MCPClient over a set of stdio worker processes
+type stdioPool struct {
+	name   string
+	ctx    context.Context // lifetime of the instance, bounds background respawns
+	spawn  func(ctx context.Context, index int) (*mcpclient.Client, error)
+	sticky bool
+
+	mu          sync.Mutex
+	workers     []*stdioWorker
+	sessions    map[string]*stdioWorker // downstream session ID to pinned worker
+	initRequest *mcp.InitializeRequest  // replayed on respawned workers
+	handlers    []func(mcp.JSONRPCNotification)
+	closed      bool
+}
+
+var _ mcpclient.MCPClient = (*stdioPool)(nil)
+
+// newStdioPool spawns size workers. It fails only if none of them starts; the others are respawned later.
+func newStdioPool(ctx context.Context, name string, size int, sticky bool, spawn func(ctx context.Context, index int) (*mcpclient.Client, error)) (*stdioPool, error) {
+	pool := &stdioPool{
+		name:     name,
+		ctx:      ctx,
+		spawn:    spawn,
+		sticky:   sticky,
+		sessions: make(map[string]*stdioWorker),
+	}
+	var firstErr error
+	started := 0
+	for i := 0; i < size; i++ {
+		worker := &stdioWorker{index: i}
+		client, err := spawn(ctx, i)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[Pool] Failed to start worker %d of %s: %v", i, name, err))
+			worker.lastError = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			worker.client = client
+			worker.healthy = true
+			started++
+		}
+		pool.workers = append(pool.workers, worker)
+	}
+	if started == 0 {
+		return nil, firstErr
+	}
+	common.SysLog(fmt.Sprintf("[Pool] Started %d of %d workers for %s", started, size, name))
+	return pool, nil
+}
+
+// Initialize initializes every worker and returns the result of the first one that succeeds
+func (p *stdioPool) Initialize(ctx context.Context, request mcp.InitializeRequest) (*mcp.InitializeResult, error) {
+	p.mu.Lock()
+	p.initRequest = &request
+	workers := p.healthyWorkersLocked()
+	p.mu.Unlock()
+
+	var result *mcp.InitializeResult
+	var firstErr error
+	for _, worker := range workers {
+		workerResult, err := worker.client.Initialize(ctx, request)
+		if err != nil {
+			p.reportFailure(worker.index, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if result == nil {
+			result = workerResult
+		}
+	}
+	if result == nil {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+func (p *stdioPool) healthyWorkersLocked() []*stdioWorker {
+	workers := make([]*stdioWorker, 0, len(p.workers))
+	for _, worker := range p.workers {
+		if worker.healthy && worker.client != nil {
+			workers = append(workers, worker)
+		}
+	}
+	return workers
+}
+
+// primary returns the client of the first healthy worker
+func (p *stdioPool) primary() (*mcpclient.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, worker := range p.workers {
+		if worker.healthy && worker.client != nil {
+			return worker.client, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", p.name, ErrNoHealthyWorker)
+}
+
+// acquire picks the worker for a tool call: the one pinned to the caller's session when sessions are
+// sticky, otherwise the healthy worker with the fewest calls in flight. release must be called once
+// the call is done.
+func (p *stdioPool) acquire(ctx context.Context) (client *mcpclient.Client, index int, release func(), err error) {
+	sessionID := ""
+	if session := mcpserver.ClientSessionFromContext(ctx); session != nil && p.sticky {
+		sessionID = session.SessionID()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	worker := p.sessions[sessionID]
+	if worker == nil || !worker.healthy || worker.client == nil {
+		worker = nil
+		for _, candidate := range p.healthyWorkersLocked() {
+			if worker == nil || candidate.busy.Load() < worker.busy.Load() {
+				worker = candidate
+			}
+		}
+		if worker == nil {
+			return nil, anyWorker, nil, fmt.Errorf("%s: %w", p.name, ErrNoHealthyWorker)
+		}
+		if sessionID != "" {
+			p.sessions[sessionID] = worker
+		}
+	}
+	worker.busy.Add(1)
+	worker.calls.Add(1)
+	return worker.client, worker.index, func() { worker.busy.Add(-1) }, nil
+}
+
+// releaseSession forgets the worker pinned to a downstream session that went away
+func (p *stdioPool) releaseSession(sessionID string) {
+	p.mu.Lock()
+	delete(p.sessions, sessionID)
+	p.mu.Unlock()
+}
+
+// reportFailure marks a worker unhealthy after a transport failure and respawns it in the background.
+// Sessions pinned to it move to another worker on their next call.
+func (p *stdioPool) reportFailure(index int, err error) {
+	p.failWorker(index, err, 0)
+}
+
+// failWorker marks a worker unhealthy and respawns it after delay
+func (p *stdioPool) failWorker(index int, err error, delay time.Duration) {
+	p.mu.Lock()
+	if index < 0 || index >= len(p.workers) || p.closed {
+		p.mu.Unlock()
+		return
+	}
+	worker := p.workers[index]
+	worker.lastError = err.Error()
+	wasHealthy := worker.healthy
+	worker.healthy = false
+	p.mu.Unlock()
+
+	if wasHealthy {
+		common.SysLog(fmt.Sprintf("WARN: [Pool] Worker %d of %s failed: %v", index, p.name, err))
+		time.AfterFunc(delay, func() { p.respawn(index) })
+	}
+}
+
+// retireWorker stops using a worker whose process keeps exiting and never respawns it. It returns
+// how many workers are left.
+func (p *stdioPool) retireWorker(index int, err error) int {
+	p.mu.Lock()
+	var exited *mcpclient.Client
+	left := 0
+	for _, worker := range p.workers {
+		if worker.index == index {
+			exited, worker.client = worker.client, nil
+			worker.healthy = false
+			worker.retired = true
+			worker.lastError = err.Error()
+		}
+		if !worker.retired {
+			left++
+		}
+	}
+	for sessionID, pinned := range p.sessions {
+		if pinned.index == index {
+			delete(p.sessions, sessionID)
+		}
+	}
+	p.mu.Unlock()
+
+	if exited != nil {
+		exited.Close()
+	}
+	return left
+}
+
+// respawn replaces a failed worker with a new process, initialized like the others
+func (p *stdioPool) respawn(index int) error {
+	p.mu.Lock()
+	worker := p.workers[index]
+	if p.closed || worker.healthy || worker.respawning || worker.retired {
+		p.mu.Unlock()
+		return nil
+	}
+	worker.respawning = true
+	initRequest := p.initRequest
+	handlers := append([]func(mcp.JSONRPCNotification){}, p.handlers...)
+	p.mu.Unlock()
+
+	client, err := p.spawn(p.ctx, index)
+	if err == nil && initRequest != nil {
+		ctx, cancel := context.WithTimeout(p.ctx, 30*time.Second)
+		if _, err = client.Initialize(ctx, *initRequest); err != nil {
+			client.Close()
+		}
+		cancel()
+	}
+	if err == nil {
+		for _, handler := range handlers {
+			client.OnNotification(handler)
+		}
+	}
+
+	p.mu.Lock()
+	worker.respawning = false
+	if err != nil {
+		worker.lastError = err.Error()
+		p.mu.Unlock()
+		common.SysError(fmt.Sprintf("[Pool] Failed to respawn worker %d of %s: %v", index, p.name, err))
+		return err
+	}
+	if p.closed || worker.retired {
+		p.mu.Unlock()
+		client.Close()
+		return nil
+	}
+	old := worker.client
+	worker.client = client
+	worker.healthy = true
+	worker.restarts++
+	for sessionID, pinned := range p.sessions {
+		if pinned == worker {
+			delete(p.sessions, sessionID)
+		}
+	}
+	p.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	common.SysLog(fmt.Sprintf("[Pool] Respawned worker %d of %s", index, p.name))
+	return nil
+}
+
+// Ping pings every worker, respawning the ones that fail. The pool is healthy while any worker is.
+func (p *stdioPool) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	workers := append([]*stdioWorker{}, p.workers...)
+	p.mu.Unlock()
+
+	healthy := 0
+	var lastErr error
+	for _, worker := range workers {
+		p.mu.Lock()
+		client, ok, retired := worker.client, worker.healthy, worker.retired
+		p.mu.Unlock()
+		if retired {
+			continue
+		}
+		if ok && client != nil {
+			if err := client.Ping(ctx); err != nil {
+				p.reportFailure(worker.index, err)
+				lastErr = err
+				continue
+			}
+			healthy++
+			continue
+		}
+		if err := p.respawn(worker.index); err != nil {
+			lastErr = err
+			continue
+		}
+		p.mu.Lock()
+		if worker.healthy {
+			healthy++
+		}
+		p.mu.Unlock()
+	}
+	if healthy == 0 {
+		if lastErr == nil {
+			lastErr = ErrNoHealthyWorker
+		}
+		return fmt.Errorf("all %d workers of %s are down: %w", len(workers), p.name, lastErr)
+	}
+	return nil
+}
+
+// health reports the state of every worker
+func (p *stdioPool) health() []WorkerHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pinned := make(map[*stdioWorker]int)
+	for _, worker := range p.sessions {
+		pinned[worker]++
+	}
+	health := make([]WorkerHealth, 0, len(p.workers))
+	for _, worker := range p.workers {
+		health = append(health, WorkerHealth{
+			Index:     worker.index,
+			Healthy:   worker.healthy,
+			InFlight:  worker.busy.Load(),
+			Calls:     worker.calls.Load(),
+			Sessions:  pinned[worker],
+			Restarts:  worker.restarts,
+			Retired:   worker.retired,
+			LastError: worker.lastError,
+		})
+	}
+	return health
+}
+
+// CallTool runs a tool call on the worker chosen by acquire. The relay normally dispatches calls
+// itself to keep its own request IDs; this serves callers that bypass it.
+func (p *stdioPool) CallTool(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, index, release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	result, err := client.CallTool(ctx, request)
+	var transportErr *transport.Error
+	if err != nil && ctx.Err() == nil && errors.As(err, &transportErr) {
+		p.reportFailure(index, err)
+	}
+	return result, err
+}
+
+func (p *stdioPool) ListResourcesByPage(ctx context.Context, request mcp.ListResourcesRequest) (*mcp.ListResourcesResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListResourcesByPage(ctx, request)
+}
+
+func (p *stdioPool) ListResources(ctx context.Context, request mcp.ListResourcesRequest) (*mcp.ListResourcesResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListResources(ctx, request)
+}
+
+func (p *stdioPool) ListResourceTemplatesByPage(ctx context.Context, request mcp.ListResourceTemplatesRequest) (*mcp.ListResourceTemplatesResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListResourceTemplatesByPage(ctx, request)
+}
+
+func (p *stdioPool) ListResourceTemplates(ctx context.Context, request mcp.ListResourceTemplatesRequest) (*mcp.ListResourceTemplatesResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListResourceTemplates(ctx, request)
+}
+
+func (p *stdioPool) ReadResource(ctx context.Context, request mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadResource(ctx, request)
+}
+
+func (p *stdioPool) Subscribe(ctx context.Context, request mcp.SubscribeRequest) error {
+	client, err := p.primary()
+	if err != nil {
+		return err
+	}
+	return client.Subscribe(ctx, request)
+}
+
+func (p *stdioPool) Unsubscribe(ctx context.Context, request mcp.UnsubscribeRequest) error {
+	client, err := p.primary()
+	if err != nil {
+		return err
+	}
+	return client.Unsubscribe(ctx, request)
+}
+
+func (p *stdioPool) ListPromptsByPage(ctx context.Context, request mcp.ListPromptsRequest) (*mcp.ListPromptsResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListPromptsByPage(ctx, request)
+}
+
+func (p *stdioPool) ListPrompts(ctx context.Context, request mcp.ListPromptsRequest) (*mcp.ListPromptsResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListPrompts(ctx, request)
+}
+
+func (p *stdioPool) GetPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetPrompt(ctx, request)
+}
+
+func (p *stdioPool) ListToolsByPage(ctx context.Context, request mcp.ListToolsRequest) (*mcp.ListToolsResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListToolsByPage(ctx, request)
+}
+
+func (p *stdioPool) ListTools(ctx context.Context, request mcp.ListToolsRequest) (*mcp.ListToolsResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListTools(ctx, request)
+}
+
+func (p *stdioPool) Complete(ctx context.Context, request mcp.CompleteRequest) (*mcp.CompleteResult, error) {
+	client, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	return client.Complete(ctx, request)
+}
+
+// SetLevel sets the log level on every worker, since any of them may be running a call
+func (p *stdioPool) SetLevel(ctx context.Context, request mcp.SetLevelRequest) error {
+	return p.broadcast(func(client *mcpclient.Client) error { return client.SetLevel(ctx, request) })
+}
+
+// RootListChanges tells every worker the downstream roots changed
+func (p *stdioPool) RootListChanges(ctx context.Context) error {
+	return p.broadcast(func(client *mcpclient.Client) error { return client.RootListChanges(ctx) })
+}
+
+func (p *stdioPool) broadcast(send func(client *mcpclient.Client) error) error {
+	p.mu.Lock()
+	workers := p.healthyWorkersLocked()
+	clients := make([]*mcpclient.Client, 0, len(workers))
+	for _, worker := range workers {
+		clients = append(clients, worker.client)
+	}
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, client := range clients {
+		if err := send(client); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// OnNotification registers a handler on every worker, including the ones respawned later
+func (p *stdioPool) OnNotification(handler func(notification mcp.JSONRPCNotification)) {
+	p.mu.Lock()
+	p.handlers = append(p.handlers, handler)
+	var clients []*mcpclient.Client
+	for _, worker := range p.workers {
+		if worker.client != nil {
+			clients = append(clients, worker.client)
+		}
+	}
+	p.mu.Unlock()
+	for _, client := range clients {
+		client.OnNotification(handler)
+	}
+}
+
+// Close stops every worker
+func (p *stdioPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	var clients []*mcpclient.Client
+	for _, worker := range p.workers {
+		if worker.client != nil {
+			clients = append(clients, worker.client)
+		}
+		worker.healthy = false
+	}
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, client := range clients {
+		if err := client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
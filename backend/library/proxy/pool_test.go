@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// breakableTransport fails every request once broken, like a stdio process that exited
+type breakableTransport struct {
+	transport.Interface
+	broken atomic.Bool
+}
+
+func (t *breakableTransport) SendRequest(ctx context.Context, request transport.JSONRPCRequest) (*transport.JSONRPCResponse, error) {
+	if t.broken.Load() {
+		return nil, errors.New("broken pipe")
+	}
+	return t.Interface.SendRequest(ctx, request)
+}
+
+// testWorkers spawns in-process workers whose "whoami" tool returns the worker index and whose
+// "block" tool waits until release is closed
+type testWorkers struct {
+	release    chan struct{}
+	spawned    atomic.Int32
+	transports []*breakableTransport
+}
+
+func (w *testWorkers) spawn(ctx context.Context, index int) (*mcpclient.Client, error) {
+	w.spawned.Add(1)
+	server := mcpserver.NewMCPServer(fmt.Sprintf("worker-%d", index), "1.0.0")
+	server.AddTool(mcp.NewTool("whoami"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText(strconv.Itoa(index)), nil
+	})
+	server.AddTool(mcp.NewTool("block"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		<-w.release
+		return mcp.NewToolResultText(strconv.Itoa(index)), nil
+	})
+	breakable := &breakableTransport{Interface: transport.NewInProcessTransport(server)}
+	w.transports = append(w.transports, breakable)
+	client := mcpclient.NewClient(breakable)
+	if err := client.Start(ctx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func newTestPool(t *testing.T, size int, sticky bool) (*stdioPool, *testWorkers) {
+	t.Helper()
+	workers := &testWorkers{release: make(chan struct{})}
+	pool, err := newStdioPool(context.Background(), "pooled", size, sticky, workers.spawn)
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "proxy", Version: "1.0.0"}
+	_, err = pool.Initialize(context.Background(), initRequest)
+	require.NoError(t, err)
+	return pool, workers
+}
+
+// fakeSession stands for a downstream session in the context of a relayed call
+type fakeSession struct {
+	id            string
+	notifications chan mcp.JSONRPCNotification
+}
+
+func (s fakeSession) Initialize()                                         {}
+func (s fakeSession) Initialized() bool                                   { return true }
+func (s fakeSession) NotificationChannel() chan<- mcp.JSONRPCNotification { return s.notifications }
+func (s fakeSession) SessionID() string                                   { return s.id }
+
+func sessionContext(id string) context.Context {
+	server := mcpserver.NewMCPServer("downstream", "1.0.0")
+	return server.WithContext(context.Background(), fakeSession{id: id, notifications: make(chan mcp.JSONRPCNotification, 8)})
+}
+
+func callWorker(t *testing.T, ctx context.Context, client mcpclient.MCPClient, tool string) string {
+	t.Helper()
+	request := mcp.CallToolRequest{}
+	request.Params.Name = tool
+	result, err := client.CallTool(ctx, request)
+	require.NoError(t, err)
+	return result.Content[0].(mcp.TextContent).Text
+}
+
+func waitInFlight(t *testing.T, pool *stdioPool, want ...int32) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		for i, worker := range pool.health() {
+			if worker.InFlight != want[i] {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStdioPool_DispatchesToLeastBusyWorker(t *testing.T) {
+	pool, workers := newTestPool(t, 3, false)
+
+	done := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() { done <- callWorker(t, context.Background(), pool, "block") }()
+	}
+	waitInFlight(t, pool, 1, 1, 1)
+	close(workers.release)
+
+	served := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		served[<-done] = true
+	}
+	assert.Len(t, served, 3, "concurrent calls are spread over every worker")
+	for _, worker := range pool.health() {
+		assert.Equal(t, int64(1), worker.Calls)
+	}
+}
+
+func TestStdioPool_StickySessions(t *testing.T) {
+	pool, workers := newTestPool(t, 2, true)
+	alice, bob := sessionContext("alice"), sessionContext("bob")
+
+	assert.Equal(t, "0", callWorker(t, alice, pool, "whoami"))
+	// While alice's worker is busy, bob is given the other one and alice keeps hers
+	go callWorker(t, alice, pool, "block")
+	waitInFlight(t, pool, 1, 0)
+	assert.Equal(t, "1", callWorker(t, bob, pool, "whoami"))
+	assert.Equal(t, "1", callWorker(t, bob, pool, "whoami"))
+	close(workers.release)
+	waitInFlight(t, pool, 0, 0)
+	assert.Equal(t, "0", callWorker(t, alice, pool, "whoami"))
+	assert.Equal(t, 1, pool.health()[0].Sessions)
+
+	pool.releaseSession("alice")
+	assert.Zero(t, pool.health()[0].Sessions)
+}
+
+func TestStdioPool_RespawnsFailedWorker(t *testing.T) {
+	pool, workers := newTestPool(t, 2, false)
+	relay := newNotificationRelay("pooled", capabilityGuard{})
+	relay.client = pool
+
+	workers.transports[0].broken.Store(true)
+	request := mcp.CallToolRequest{}
+	request.Params.Name = "whoami"
+	_, err := relay.callTool(context.Background(), request)
+	require.Error(t, err)
+
+	// Calls go to the healthy worker while the failed one is replaced
+	assert.Equal(t, "1", callWorker(t, context.Background(), relayedClient{MCPClient: pool, relay: relay}, "whoami"))
+	require.Eventually(t, func() bool {
+		health := pool.health()[0]
+		return health.Healthy && health.Restarts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "broken pipe", pool.health()[0].LastError)
+	assert.Equal(t, int32(3), workers.spawned.Load())
+	require.NoError(t, pool.Ping(context.Background()))
+}
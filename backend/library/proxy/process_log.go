@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+)
+
+// The stderr of every stdio process is kept in a bounded buffer per instance, so admins can see why
+// a package fails without shell access. The buffer outlives restarts of the instance's processes
+// and is dropped along with the instance. With --log-dir it is also appended to
+// <log-dir>/mcp/<instance>.log, which is rotated to <instance>.log.1 once it reaches processLogFileMax.
+
+const (
+	processLogLines   = 1000
+	processLogLineMax = 4096
+	processLogFileMax = 10 << 20
+)
+
+// ProcessLogLine is a line written by a stdio process
+type ProcessLogLine struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Source   string    `json:"source,omitempty"` // worker of a pool, or toWers for lifecycle events
+	Text     string    `json:"text"`
+}
+
+// processLog is the ring buffer of one instance
+type processLog struct {
+	serviceID int64
+	instance  string
+	refs      int // instances using the log, guarded by processLogsMu
+
+	mu       sync.Mutex
+	lines    []ProcessLogLine
+	next     int // position of the next line once the buffer is full
+	file     *os.File
+	fileSize int64
+}
+
+// processLogFollower receives the lines of a service's instances, or of one instance when it is set
+type processLogFollower struct {
+	instance string
+	lines    chan ProcessLogLine
+}
+
+var (
+	processLogs   = make(map[int64]map[string]*processLog) // by service ID and instance
+	processLogsMu sync.Mutex
+
+	// Followers are kept per service rather than per log, so they also receive the lines of
+	// instances started after they began following. Lines are appended with the read lock held.
+	processLogFollowers   = make(map[int64]map[*processLogFollower]struct{})
+	processLogFollowersMu sync.RWMutex
+)
+
+// instanceKey carries the cache key of the instance being created to createActualMcpGoServerAndClientUncached
+type instanceKey struct{}
+
+func withInstanceKey(ctx context.Context, cacheKey string) context.Context {
+	return context.WithValue(ctx, instanceKey{}, cacheKey)
+}
+
+// processLogKey carries the log acquired for the instance being created
+type processLogKey struct{}
+
+func withProcessLog(ctx context.Context, log *processLog) context.Context {
+	return context.WithValue(ctx, processLogKey{}, log)
+}
+
+// processLogFor returns the log of an instance of a service, creating it on first use. Every call
+// must be paired with a call to release.
+func processLogFor(serviceID int64, instance string) *processLog {
+	processLogsMu.Lock()
+	defer processLogsMu.Unlock()
+	logs := processLogs[serviceID]
+	if logs == nil {
+		logs = make(map[string]*processLog)
+		processLogs[serviceID] = logs
+	}
+	log := logs[instance]
+	if log == nil {
+		log = &processLog{serviceID: serviceID, instance: instance}
+		log.file, log.fileSize = openProcessLogFile(instance)
+		logs[instance] = log
+	}
+	log.refs++
+	return log
+}
+
+// release drops the log once the last instance using it is gone
+func (l *processLog) release() {
+	processLogsMu.Lock()
+	l.refs--
+	last := l.refs <= 0
+	if last && processLogs[l.serviceID][l.instance] == l {
+		delete(processLogs[l.serviceID], l.instance)
+		if len(processLogs[l.serviceID]) == 0 {
+			delete(processLogs, l.serviceID)
+		}
+	}
+	processLogsMu.Unlock()
+	if last {
+		l.closeFile()
+	}
+}
+
+func (l *processLog) closeFile() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// dropProcessLogs drops the logs of a deleted service and ends the following of them
+func dropProcessLogs(serviceID int64) {
+	processLogsMu.Lock()
+	logs := processLogs[serviceID]
+	delete(processLogs, serviceID)
+	processLogsMu.Unlock()
+	for _, log := range logs {
+		log.closeFile()
+	}
+
+	processLogFollowersMu.Lock()
+	defer processLogFollowersMu.Unlock()
+	for follower := range processLogFollowers[serviceID] {
+		close(follower.lines)
+	}
+	delete(processLogFollowers, serviceID)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func processLogPath(instance string) string {
+	if common.LogDir == nil || *common.LogDir == "" {
+		return ""
+	}
+	return filepath.Join(*common.LogDir, "mcp", unsafeFileChars.ReplaceAllString(instance, "_")+".log")
+}
+
+// openProcessLogFile opens the log file of an instance for appending and returns it with its size
+func openProcessLogFile(instance string) (*os.File, int64) {
+	path := processLogPath(instance)
+	if path == "" {
+		return nil, 0
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		common.SysError(fmt.Sprintf("[ProcessLog] Failed to create %s: %v", filepath.Dir(path), err))
+		return nil, 0
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[ProcessLog] Failed to open %s: %v", path, err))
+		return nil, 0
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	return file, size
+}
+
+// rotateLocked moves a full log file aside and starts a new one; l.mu must be held
+func (l *processLog) rotateLocked() {
+	l.file.Close()
+	path := processLogPath(l.instance)
+	if err := os.Rename(path, path+".1"); err != nil {
+		common.SysError(fmt.Sprintf("[ProcessLog] Failed to rotate %s: %v", path, err))
+	}
+	l.file, l.fileSize = openProcessLogFile(l.instance)
+}
+
+// append records a line and hands it to the followers of the log
+func (l *processLog) append(source, text string) {
+	if len(text) > processLogLineMax {
+		text = text[:processLogLineMax] + "…"
+	}
+	line := ProcessLogLine{Time: time.Now(), Instance: l.instance, Source: source, Text: text}
+
+	processLogFollowersMu.RLock()
+	defer processLogFollowersMu.RUnlock()
+	l.mu.Lock()
+	if len(l.lines) < processLogLines {
+		l.lines = append(l.lines, line)
+	} else {
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % processLogLines
+	}
+	if l.file != nil {
+		prefix := ""
+		if source != "" {
+			prefix = "[" + source + "] "
+		}
+		n, _ := fmt.Fprintf(l.file, "%s %s%s\n", line.Time.Format(time.RFC3339), prefix, text)
+		l.fileSize += int64(n)
+		if l.fileSize >= processLogFileMax {
+			l.rotateLocked()
+		}
+	}
+	l.mu.Unlock()
+	for follower := range processLogFollowers[l.serviceID] {
+		if follower.instance != "" && follower.instance != l.instance {
+			continue
+		}
+		select {
+		case follower.lines <- line:
+		default:
+			// A follower that cannot keep up misses lines rather than blocking the process
+		}
+	}
+}
+
+// capture copies the lines of stream, typically a process's stderr, into the log until it is closed.
+// The returned channel is closed along with the stream, which for stderr means the process exited.
+func (l *processLog) capture(source string, stream io.Reader) <-chan struct{} {
+	closed := make(chan struct{})
+	if stream == nil {
+		return closed
+	}
+	l.append("toWers", lifecycleText(source, "started"))
+	go func() {
+		defer close(closed)
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			l.append(source, scanner.Text())
+		}
+		l.append("toWers", lifecycleText(source, "exited"))
+	}()
+	return closed
+}
+
+func lifecycleText(source, event string) string {
+	if source == "" {
+		return "process " + event
+	}
+	return source + " process " + event
+}
+
+// tail returns the last n lines, oldest first
+func (l *processLog) tail(n int) []ProcessLogLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tailLocked(n)
+}
+
+func (l *processLog) tailLocked(n int) []ProcessLogLine {
+	ordered := append(append([]ProcessLogLine{}, l.lines[l.next:]...), l.lines[:l.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// serviceProcessLogs returns the logs of a service's instances, or of one instance when it is given
+func serviceProcessLogs(serviceID int64, instance string) []*processLog {
+	processLogsMu.Lock()
+	defer processLogsMu.Unlock()
+	var logs []*processLog
+	for name, log := range processLogs[serviceID] {
+		if instance == "" || name == instance {
+			logs = append(logs, log)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].instance < logs[j].instance })
+	return logs
+}
+
+// ProcessLogInstances lists the instances of a service that have captured output
+func ProcessLogInstances(serviceID int64) []string {
+	logs := serviceProcessLogs(serviceID, "")
+	names := make([]string, 0, len(logs))
+	for _, log := range logs {
+		names = append(names, log.instance)
+	}
+	return names
+}
+
+// TailProcessLogs returns the last n lines written by the stdio processes of a service, oldest first.
+// instance restricts them to one instance; n <= 0 returns every buffered line.
+func TailProcessLogs(serviceID int64, instance string, n int) []ProcessLogLine {
+	var lines []ProcessLogLine
+	for _, log := range serviceProcessLogs(serviceID, instance) {
+		lines = append(lines, log.tail(n)...)
+	}
+	return lastLines(lines, n)
+}
+
+// FollowProcessLogs returns the last n lines like TailProcessLogs and a channel receiving the lines
+// written from then on, including those of instances started later, until ctx is done or the
+// service is deleted.
+func FollowProcessLogs(ctx context.Context, serviceID int64, instance string, n int) ([]ProcessLogLine, <-chan ProcessLogLine) {
+	follower := &processLogFollower{instance: instance, lines: make(chan ProcessLogLine, 256)}
+	processLogFollowersMu.Lock()
+	var lines []ProcessLogLine
+	for _, log := range serviceProcessLogs(serviceID, instance) {
+		lines = append(lines, log.tail(n)...)
+	}
+	if processLogFollowers[serviceID] == nil {
+		processLogFollowers[serviceID] = make(map[*processLogFollower]struct{})
+	}
+	processLogFollowers[serviceID][follower] = struct{}{}
+	processLogFollowersMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		processLogFollowersMu.Lock()
+		defer processLogFollowersMu.Unlock()
+		if _, ok := processLogFollowers[serviceID][follower]; ok {
+			delete(processLogFollowers[serviceID], follower)
+			if len(processLogFollowers[serviceID]) == 0 {
+				delete(processLogFollowers, serviceID)
+			}
+			close(follower.lines)
+		}
+	}()
+	return lastLines(lines, n), follower.lines
+}
+
+func lastLines(lines []ProcessLogLine, n int) []ProcessLogLine {
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time.Before(lines[j].Time) })
+	if n > 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// stderrExcerpt returns the last lines of a log for an error message about its process
+func stderrExcerpt(l *processLog) string {
+	var excerpt strings.Builder
+	for _, line := range l.tail(5) {
+		if line.Source != "toWers" {
+			excerpt.WriteString("\n  " + line.Text)
+		}
+	}
+	if excerpt.Len() == 0 {
+		return ""
+	}
+	return "; stderr:" + excerpt.String()
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"toWers/backend/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func texts(lines []ProcessLogLine) []string {
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		result = append(result, line.Text)
+	}
+	return result
+}
+
+func TestProcessLog_KeepsLastLines(t *testing.T) {
+	log := processLogFor(-9101, "global-service--9101-shared")
+	for i := 0; i < processLogLines+5; i++ {
+		log.append("", fmt.Sprintf("line %d", i))
+	}
+
+	lines := TailProcessLogs(-9101, "", 0)
+	require.Len(t, lines, processLogLines)
+	assert.Equal(t, "line 5", lines[0].Text, "the oldest lines are dropped first")
+	assert.Equal(t, []string{"line 1002", "line 1003", "line 1004"}, texts(TailProcessLogs(-9101, "", 3)))
+	assert.Empty(t, TailProcessLogs(-9101, "user-1-service--9101-shared", 3))
+}
+
+func TestProcessLog_CapturesAndFollowsStderr(t *testing.T) {
+	stderr, writer := io.Pipe()
+	log := processLogFor(-9102, "user-1-service--9102-shared")
+	log.capture("", stderr)
+	fmt.Fprintln(writer, "Error: GITHUB_TOKEN is not set")
+
+	require.Eventually(t, func() bool { return len(TailProcessLogs(-9102, "", 0)) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"process started", "Error: GITHUB_TOKEN is not set"}, texts(TailProcessLogs(-9102, "", 0)))
+	assert.Equal(t, "; stderr:\n  Error: GITHUB_TOKEN is not set", stderrExcerpt(log))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tail, followed := FollowProcessLogs(ctx, -9102, "user-1-service--9102-shared", 1)
+	assert.Equal(t, []string{"Error: GITHUB_TOKEN is not set"}, texts(tail))
+	writer.Close()
+	select {
+	case line := <-followed:
+		assert.Equal(t, "process exited", line.Text)
+		assert.Equal(t, "toWers", line.Source)
+	case <-time.After(5 * time.Second):
+		t.Fatal("followers did not receive the new line")
+	}
+
+	cancel()
+	select {
+	case _, open := <-followed:
+		assert.False(t, open, "following ends with the request")
+	case <-time.After(5 * time.Second):
+		t.Fatal("following did not end")
+	}
+}
+
+func TestProcessLog_FollowsLaterInstancesAndDropsReleasedLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tail, followed := FollowProcessLogs(ctx, -9103, "", 10)
+	assert.Empty(t, tail)
+
+	// An instance started after following began is followed too
+	log := processLogFor(-9103, "global-service--9103-shared")
+	log.append("", "listening on stdio")
+	select {
+	case line := <-followed:
+		assert.Equal(t, "listening on stdio", line.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("followers did not receive the line of a new instance")
+	}
+
+	// The log is dropped with its last instance
+	log.release()
+	assert.Empty(t, ProcessLogInstances(-9103))
+
+	// Deleting the service ends the following
+	dropProcessLogs(-9103)
+	select {
+	case _, open := <-followed:
+		assert.False(t, open)
+	case <-time.After(5 * time.Second):
+		t.Fatal("following did not end with the service")
+	}
+}
+
+func TestProcessLog_RotatesFullFiles(t *testing.T) {
+	savedDir := *common.LogDir
+	*common.LogDir = t.TempDir()
+	t.Cleanup(func() { *common.LogDir = savedDir })
+
+	log := processLogFor(-9104, "global-service--9104-shared")
+	defer log.release()
+	line := strings.Repeat("x", processLogLineMax)
+	for i := 0; i < processLogFileMax/processLogLineMax+1; i++ {
+		log.append("", line)
+	}
+
+	path := processLogPath(log.instance)
+	rotated, err := os.Stat(path + ".1")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, rotated.Size(), int64(processLogFileMax))
+	current, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Less(t, current.Size(), int64(processLogFileMax))
+}
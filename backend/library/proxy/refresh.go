@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// upstreamRefreshTimeout bounds a re-sync triggered by an upstream list_changed notification
+const upstreamRefreshTimeout = 30 * time.Second
+
+// nameSet is a concurrency-safe set of names
+type nameSet struct {
+	mu    sync.RWMutex
+	names map[string]bool
+}
+
+func newNameSet() *nameSet {
+	return &nameSet{names: make(map[string]bool)}
+}
+
+func (s *nameSet) has(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.names[name]
+}
+
+func (s *nameSet) set(name string, present bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if present {
+		s.names[name] = true
+	} else {
+		delete(s.names, name)
+	}
+}
+
+// upstreamMirror keeps the tools, prompts, resources and resource templates of an MCPServer in sync
+// with its upstream client. It records what is currently mirrored so a re-sync can delete what the
+// upstream no longer lists.
+type upstreamMirror struct {
+	mu        sync.Mutex
+	client    mcpclient.MCPClient
+	server    *mcpserver.MCPServer
+	name      string
+	guard     capabilityGuard
+	overrides map[string]model.ToolOverride
+
+	tools     map[string]bool
+	prompts   map[string]bool
+	resources map[string]bool
+	templates map[string]bool
+}
+
+func newUpstreamMirror(client mcpclient.MCPClient, server *mcpserver.MCPServer, name string, guard capabilityGuard, overrides map[string]model.ToolOverride) *upstreamMirror {
+	return &upstreamMirror{
+		client:    client,
+		server:    server,
+		name:      name,
+		guard:     guard,
+		overrides: overrides,
+		tools:     make(map[string]bool),
+		prompts:   make(map[string]bool),
+		resources: make(map[string]bool),
+		templates: make(map[string]bool),
+	}
+}
+
+// populate performs the initial copy of every capability list. Failures are logged, not returned,
+// since an upstream may legitimately not support some of them.
+func (m *upstreamMirror) populate(ctx context.Context, instanceNameDetail string) {
+	for _, method := range []string{
+		mcp.MethodNotificationToolsListChanged,
+		mcp.MethodNotificationPromptsListChanged,
+		mcp.MethodNotificationResourcesListChanged,
+	} {
+		if err := m.refresh(ctx, method); err != nil {
+			common.SysError(fmt.Sprintf("Failed to populate %s for %s (%s): %v", method, m.name, instanceNameDetail, err))
+		}
+	}
+}
+
+// handleNotification re-syncs the affected list, and the virtual servers composing the service, when
+// the upstream reports a change.
+// The re-sync runs in its own goroutine: the client dispatches notifications from its read loop,
+// so calling back into the client synchronously would block on our own response.
+func (m *upstreamMirror) handleNotification(notification mcp.JSONRPCNotification) {
+	switch notification.Method {
+	case mcp.MethodNotificationToolsListChanged,
+		mcp.MethodNotificationPromptsListChanged,
+		mcp.MethodNotificationResourcesListChanged:
+	default:
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamRefreshTimeout)
+		defer cancel()
+		common.SysLog(fmt.Sprintf("Upstream %s sent %s, re-syncing", m.name, notification.Method))
+		if err := m.refresh(ctx, notification.Method); err != nil {
+			common.SysError(fmt.Sprintf("Failed to re-sync %s after %s: %v", m.name, notification.Method, err))
+		}
+		refreshVirtualServersWithMember(m.guard.serviceID)
+	}()
+}
+
+// refresh re-lists one kind of capability from the upstream, registers what it lists and removes what it
+// no longer lists. Add and delete on the MCPServer notify connected downstream sessions with list_changed.
+func (m *upstreamMirror) refresh(ctx context.Context, method string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch method {
+	case mcp.MethodNotificationToolsListChanged:
+		names, err := addClientToolsToMCPServer(ctx, m.client, m.server, m.name, m.guard, m.overrides)
+		if err != nil {
+			return err
+		}
+		current, stale := diffNames(m.tools, names)
+		if len(stale) > 0 {
+			m.server.DeleteTools(stale...)
+		}
+		m.tools = current
+
+	case mcp.MethodNotificationPromptsListChanged:
+		names, err := addClientPromptsToMCPServer(ctx, m.client, m.server, m.name, m.guard)
+		if err != nil {
+			return err
+		}
+		current, stale := diffNames(m.prompts, names)
+		if len(stale) > 0 {
+			m.server.DeletePrompts(stale...)
+		}
+		m.prompts = current
+
+	case mcp.MethodNotificationResourcesListChanged:
+		// Resources and resource templates share the same notification, and are synced independently
+		names, resourcesErr := addClientResourcesToMCPServer(ctx, m.client, m.server, m.name, m.guard)
+		if resourcesErr == nil {
+			current, stale := diffNames(m.resources, names)
+			for _, uri := range stale {
+				m.server.RemoveResource(uri)
+			}
+			m.resources = current
+		}
+
+		templateNames, err := addClientResourceTemplatesToMCPServer(ctx, m.client, m.server, m.name, m.guard)
+		if err != nil {
+			// Many servers do not implement templates; report the resource outcome only
+			common.SysLog(fmt.Sprintf("WARN: ListResourceTemplates sync failed for %s: %v", m.name, err))
+			return resourcesErr
+		}
+		currentTemplates, staleTemplates := diffNames(m.templates, templateNames)
+		// mcp-go cannot unregister a resource template, so removed templates are retired in the guard instead
+		for _, raw := range templateNames {
+			if m.guard.retired != nil {
+				m.guard.retired.set(raw, false)
+			}
+		}
+		for _, raw := range staleTemplates {
+			if m.guard.retired != nil {
+				m.guard.retired.set(raw, true)
+			}
+		}
+		if len(staleTemplates) > 0 {
+			m.server.SendNotificationToAllClients(mcp.MethodNotificationResourcesListChanged, nil)
+		}
+		m.templates = currentTemplates
+		return resourcesErr
+
+	default:
+		return fmt.Errorf("unsupported list_changed method %s", method)
+	}
+	return nil
+}
+
+// diffNames returns the set of names and those previously present but missing from names
+func diffNames(previous map[string]bool, names []string) (map[string]bool, []string) {
+	current := make(map[string]bool, len(names))
+	for _, name := range names {
+		current[name] = true
+	}
+	var stale []string
+	for name := range previous {
+		if !current[name] {
+			stale = append(stale, name)
+		}
+	}
+	return current, stale
+}
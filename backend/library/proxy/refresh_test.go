@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamMirror_RefreshAddsAndDeletesTools(t *testing.T) {
+	ctx := context.Background()
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0")
+	echo := func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText(request.Params.Name), nil
+	}
+	upstream.AddTool(mcp.NewTool("old_tool"), echo)
+	upstreamClient := newInProcessDownstream(t, upstream)
+
+	guard := capabilityGuard{filter: allowAllCapabilities, aliases: newToolAliases(), retired: newNameSet()}
+	proxied := mcpserver.NewMCPServer("proxied", "1.0.0", mcpserver.WithToolCapabilities(true), withCapabilityToolFilter(guard))
+	mirror := newUpstreamMirror(upstreamClient, proxied, "proxied", guard, nil)
+	mirror.populate(ctx, "test")
+
+	downstream := newInProcessDownstream(t, proxied)
+	tools, err := downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tools.Tools, 1)
+	assert.Equal(t, "old_tool", tools.Tools[0].Name)
+
+	upstream.DeleteTools("old_tool")
+	upstream.AddTool(mcp.NewTool("new_tool"), echo)
+	require.NoError(t, mirror.refresh(ctx, mcp.MethodNotificationToolsListChanged))
+
+	tools, err = downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tools.Tools, 1)
+	assert.Equal(t, "new_tool", tools.Tools[0].Name)
+
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "old_tool"
+	_, err = downstream.CallTool(ctx, callRequest)
+	assert.Error(t, err, "deleted tools must no longer be callable")
+}
+
+func TestDiffNames(t *testing.T) {
+	current, stale := diffNames(map[string]bool{"a": true, "b": true}, []string{"b", "c"})
+	assert.Equal(t, map[string]bool{"b": true, "c": true}, current)
+	assert.Equal(t, []string{"a"}, stale)
+}
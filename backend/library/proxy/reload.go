@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// A configuration change is applied to the running instances of a service by a rolling restart:
+// each instance whose configuration differs is replaced by a new one under the same cache key, so new
+// sessions start on the new instance, while requests of the sessions opened on the old one are still
+// routed to it. The old instance is shut down once its sessions end, or after instanceDrainTimeout.
+
+var (
+	instanceDrainTimeout = 5 * time.Minute
+	drainCheckInterval   = time.Second
+	reloadTimeout        = 2 * time.Minute
+)
+
+var (
+	drainingInstances   = make(map[*SharedMcpInstance]struct{})
+	drainingInstancesMu sync.Mutex
+)
+
+// instanceConfig returns a fingerprint of the parts of a service's configuration that an instance
+// is created with, so that instances can tell whether they are outdated
+func instanceConfig(svc *model.MCPService, envsJSON string) string {
+	config := struct {
+		Type        model.ServiceType
+		Command     string
+		ArgsJSON    string
+		Envs        string
+		HeadersJSON string
+		CallPolicy  model.CallPolicy
+		PoolSize    int
+		Sticky      bool
+		Sandbox     model.SandboxPolicy
+		OAuth       []string
+	}{
+		Type:        svc.Type,
+		Command:     svc.Command,
+		ArgsJSON:    svc.ArgsJSON,
+		HeadersJSON: svc.HeadersJSON,
+		CallPolicy:  svc.GetCallPolicy(),
+		PoolSize:    svc.GetWorkerPoolSize(),
+		Sticky:      svc.StickySessions,
+		Sandbox:     svc.GetSandboxPolicy(),
+	}
+	if svc.OAuthEnabled {
+		config.OAuth = []string{fmt.Sprint(svc.OAuthPerUser), svc.OAuthScopes, svc.OAuthMetadataURL, svc.OAuthClientID, svc.OAuthClientSecret}
+	}
+	if svc.Type == model.ServiceTypeStdio || svc.HasUserHeaders() {
+		config.Envs = envsJSON
+		if config.Envs == "" {
+			config.Envs = svc.DefaultEnvsJSON
+		}
+	}
+	fingerprint, _ := json.Marshal(config)
+	return string(fingerprint)
+}
+
+// UserEnvsJSON returns the environment of a user's instance of a service: the service's default
+// environment, overridden by the values the user's teams configured, overridden by the values the
+// user configured
+func UserEnvsJSON(svc *model.MCPService, userID int64) string {
+	envs := make(map[string]string)
+	if svc.DefaultEnvsJSON != "" && svc.DefaultEnvsJSON != "{}" {
+		if err := json.Unmarshal([]byte(svc.DefaultEnvsJSON), &envs); err != nil {
+			common.SysError(fmt.Sprintf("[Instances] Error unmarshalling DefaultEnvsJSON for %s (user-specific): %v", svc.Name, err))
+			envs = make(map[string]string)
+		}
+	}
+
+	teamEnvs, err := model.GetTeamEnvsForUser(userID, svc.ID)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[Instances] Error fetching team ENVs for user %d, service %s: %v", userID, svc.Name, err))
+	}
+	for k, v := range teamEnvs {
+		envs[k] = v
+	}
+
+	userEnvs, err := model.GetUserSpecificEnvs(userID, svc.ID)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[Instances] Error fetching user-specific ENVs for user %d, service %s: %v", userID, svc.Name, err))
+	}
+	for k, v := range userEnvs {
+		envs[k] = v // User-specific ENVs override DefaultEnvsJSON
+	}
+
+	envsJSON, err := json.Marshal(envs)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[Instances] Error marshalling merged ENVs for user %d, service %s: %v. Proceeding with original DefaultEnvsJSON.", userID, svc.Name, err))
+		return svc.DefaultEnvsJSON
+	}
+	return string(envsJSON)
+}
+
+// currentEnvs returns the environment the instance would be created with today
+func (s *SharedMcpInstance) currentEnvs(svc *model.MCPService) string {
+	if s.userID == 0 {
+		return svc.DefaultEnvsJSON
+	}
+	return UserEnvsJSON(svc, s.userID)
+}
+
+// ReloadService applies the saved configuration of a service to its running instances, restarting
+// the ones created with a different configuration one after the other in the background, and to the
+// virtual servers composing it.
+// It returns the number of instances being restarted.
+func ReloadService(svc *model.MCPService) int {
+	RefreshVirtualServersWithMember(svc.ID)
+	return reloadInstances(svc, func(*SharedMcpInstance) bool { return true })
+}
+
+// ReloadUserInstance applies a user's changed environment to their running instance of a service
+func ReloadUserInstance(svc *model.MCPService, userID int64) int {
+	return reloadInstances(svc, func(instance *SharedMcpInstance) bool { return instance.userID == userID })
+}
+
+func reloadInstances(svc *model.MCPService, match func(*SharedMcpInstance) bool) int {
+	sharedMCPServersMutex.Lock()
+	var candidates []*SharedMcpInstance
+	for _, instance := range sharedMCPServers {
+		if instance.serviceID == svc.ID && match(instance) {
+			candidates = append(candidates, instance)
+		}
+	}
+	sharedMCPServersMutex.Unlock()
+
+	type reload struct {
+		instance *SharedMcpInstance
+		envs     string
+	}
+	var outdated []reload
+	for _, instance := range candidates {
+		envs := instance.currentEnvs(svc)
+		if instance.config != instanceConfig(svc, envs) {
+			outdated = append(outdated, reload{instance, envs})
+		}
+	}
+	if len(outdated) == 0 {
+		return 0
+	}
+
+	common.SysLog(fmt.Sprintf("[Instances] Configuration of %s changed, restarting %d instances", svc.Name, len(outdated)))
+	go func() {
+		for _, r := range outdated {
+			ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+			if err := replaceInstance(ctx, r.instance, svc, r.envs); err != nil {
+				common.SysError(fmt.Sprintf("[Instances] Failed to reload %s, it keeps its previous configuration: %v", r.instance.cacheKey, err))
+			}
+			cancel()
+		}
+	}()
+	return len(outdated)
+}
+
+// replaceInstance starts a new instance with the configuration of svc in place of old, then drains
+// old. old keeps serving if the new instance cannot be started.
+func replaceInstance(ctx context.Context, old *SharedMcpInstance, svc *model.MCPService, envs string) error {
+	replacement, err := startSharedInstance(ctx, svc, old.cacheKey, old.detail, envs)
+	if err != nil {
+		return err
+	}
+
+	sharedMCPServersMutex.Lock()
+	if sharedMCPServers[old.cacheKey] != old {
+		// Shut down or replaced while the new instance was starting
+		sharedMCPServersMutex.Unlock()
+		replacement.retire("superseded while starting")
+		return nil
+	}
+	sharedMCPServers[old.cacheKey] = replacement
+	sharedMCPServersMutex.Unlock()
+
+	common.SysLog(fmt.Sprintf("[Instances] Started %s with the new configuration of %s, draining the previous instance", old.cacheKey, svc.Name))
+	old.drain()
+	return nil
+}
+
+// drain shuts the instance down once the sessions opened on it have ended and no request is in
+// flight, or after instanceDrainTimeout. It must have been removed from sharedMCPServers already.
+func (s *SharedMcpInstance) drain() {
+	drainingInstancesMu.Lock()
+	drainingInstances[s] = struct{}{}
+	drainingInstancesMu.Unlock()
+	s.detachHandlers()
+
+	go func() {
+		ticker := time.NewTicker(drainCheckInterval)
+		defer ticker.Stop()
+		deadline := time.After(instanceDrainTimeout)
+		reason := "drained after a configuration change"
+	wait:
+		for !s.drained() {
+			select {
+			case <-ticker.C:
+			case <-s.stopped:
+				break wait
+			case <-deadline:
+				reason = fmt.Sprintf("not drained within %s of a configuration change", instanceDrainTimeout)
+				break wait
+			}
+		}
+		drainingInstancesMu.Lock()
+		delete(drainingInstances, s)
+		drainingInstancesMu.Unlock()
+		s.retire(reason)
+	}()
+}
+
+// drained reports whether the instance has no open session nor request in flight
+func (s *SharedMcpInstance) drained() bool {
+	if s.inFlight.Load() > 0 {
+		return false
+	}
+	relayed, ok := s.Client.(relayedClient)
+	return !ok || relayed.relay == nil || relayed.relay.sessionCount() == 0
+}
+
+func (s *SharedMcpInstance) isDraining() bool {
+	drainingInstancesMu.Lock()
+	defer drainingInstancesMu.Unlock()
+	_, ok := drainingInstances[s]
+	return ok
+}
+
+// drainingHandler returns the handler of a draining instance that owns the session of a request
+// served under the handler cache key, nil if there is none
+func drainingHandler(key string, r *http.Request) *trackedHandler {
+	sessionID := r.URL.Query().Get("sessionId") // SSE message endpoint
+	if sessionID == "" {
+		sessionID = r.Header.Get(mcpserver.HeaderKeySessionID) // streamable HTTP
+	}
+	if sessionID == "" {
+		return nil
+	}
+
+	drainingInstancesMu.Lock()
+	instances := make([]*SharedMcpInstance, 0, len(drainingInstances))
+	for instance := range drainingInstances {
+		instances = append(instances, instance)
+	}
+	drainingInstancesMu.Unlock()
+
+	for _, instance := range instances {
+		relayed, ok := instance.Client.(relayedClient)
+		if !ok || relayed.relay == nil || !relayed.relay.hasSession(sessionID) {
+			continue
+		}
+		instance.handlerMu.Lock()
+		handler := instance.handlers[key]
+		instance.handlerMu.Unlock()
+		if handler != nil {
+			return handler
+		}
+	}
+	return nil
+}
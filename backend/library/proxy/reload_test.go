@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versionedUpstream serves a "version" tool returning version
+func versionedUpstream(t *testing.T, version string) string {
+	t.Helper()
+	upstream := mcpserver.NewMCPServer("upstream", version)
+	upstream.AddTool(mcp.NewTool("version"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText(version), nil
+	})
+	server := httptest.NewServer(mcpserver.NewStreamableHTTPServer(upstream))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func connectDownstream(t *testing.T, url string) *mcpclient.Client {
+	t.Helper()
+	client, err := mcpclient.NewStreamableHttpClient(url)
+	require.NoError(t, err)
+	require.NoError(t, client.Start(context.Background()))
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "downstream", Version: "1.0.0"}
+	_, err = client.Initialize(context.Background(), initRequest)
+	require.NoError(t, err)
+	return client
+}
+
+func TestReloadService_DrainsOpenSessions(t *testing.T) {
+	savedInterval := drainCheckInterval
+	drainCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { drainCheckInterval = savedInterval })
+	withInstanceCache(t)
+
+	svc := &model.MCPService{Name: "reloaded", Type: model.ServiceTypeStreamableHTTP, Command: versionedUpstream(t, "v1")}
+	svc.ID = -9401
+	cacheKey := "global-service--9401-shared"
+	// Serves every request like the proxy handler does, through the instance currently cached
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance, err := GetOrCreateSharedMcpInstanceWithKey(r.Context(), svc, cacheKey, "global-shared-svc--9401", svc.DefaultEnvsJSON)
+		require.NoError(t, err)
+		handler, err := GetOrCreateProxyToHTTPHandler(r.Context(), svc, instance)
+		require.NoError(t, err)
+		handler.ServeHTTP(w, r)
+	}))
+	defer proxied.Close()
+
+	before := connectDownstream(t, proxied.URL)
+	old := lookupSharedInstance(cacheKey)
+	require.NotNil(t, old)
+	assert.Equal(t, "v1", callWorker(t, context.Background(), before, "version"))
+	assert.Zero(t, ReloadService(svc), "nothing changed")
+
+	reloaded := *svc
+	reloaded.Command = versionedUpstream(t, "v2")
+	*svc = reloaded
+	require.Equal(t, 1, ReloadService(svc))
+	require.Eventually(t, func() bool { return lookupSharedInstance(cacheKey) != old }, 5*time.Second, 10*time.Millisecond)
+	replacement := lookupSharedInstance(cacheKey)
+	defer replacement.retire("test done")
+
+	after := connectDownstream(t, proxied.URL)
+	defer after.Close()
+	assert.Equal(t, "v2", callWorker(t, context.Background(), after, "version"), "new sessions use the new configuration")
+	assert.Equal(t, "v1", callWorker(t, context.Background(), before, "version"), "open sessions stay on the old instance")
+	assert.False(t, old.isRetired())
+
+	require.NoError(t, before.Close())
+	require.Eventually(t, old.isRetired, 5*time.Second, 10*time.Millisecond, "the old instance is shut down once drained")
+	assert.Equal(t, "v2", callWorker(t, context.Background(), after, "version"))
+	assert.Same(t, replacement, lookupSharedInstance(cacheKey))
+}
+
+func TestStartSharedInstance_OutlivesStartContext(t *testing.T) {
+	sse := mcpserver.NewTestServer(authorizationEcho())
+	defer sse.Close()
+	svc := &model.MCPService{Name: "remote-sse", Type: model.ServiceTypeSSE, Command: sse.URL + "/sse"}
+	svc.ID = -9701
+
+	// Started like a reload or a request: the context ends once the instance is up
+	ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+	instance, err := startSharedInstance(ctx, svc, "global-service--9701-shared", "global-service--9701-shared", "")
+	cancel()
+	require.NoError(t, err)
+	defer instance.retire("test done")
+
+	callCtx, callCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer callCancel()
+	assert.Empty(t, callWorker(t, callCtx, instance.Client, "whoami"), "the SSE stream is still open")
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// CircuitState is the state of a service's circuit breaker
+type CircuitState string
+
+const (
+	// CircuitClosed lets calls through
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen fails calls immediately until the cooldown has passed
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single trial call through to decide whether to close again
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// ErrCircuitOpen is returned for calls rejected by an open circuit breaker
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker counts consecutive failed calls to an upstream and, once threshold is reached,
+// rejects calls for cooldown before letting a trial call through.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	state               CircuitState
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+}
+
+// Circuit breakers are kept per service, so the health monitor sees the breaker of the instances serving its calls
+var (
+	serviceBreakers   = make(map[int64]*circuitBreaker)
+	serviceBreakersMu sync.Mutex
+)
+
+// breakerForService returns the circuit breaker of a service, applying the current policy,
+// or nil when the policy disables it.
+func breakerForService(serviceID int64, policy model.CallPolicy) *circuitBreaker {
+	serviceBreakersMu.Lock()
+	defer serviceBreakersMu.Unlock()
+	if policy.BreakerThreshold <= 0 {
+		delete(serviceBreakers, serviceID)
+		return nil
+	}
+	breaker, ok := serviceBreakers[serviceID]
+	if !ok {
+		breaker = &circuitBreaker{state: CircuitClosed}
+		serviceBreakers[serviceID] = breaker
+	}
+	breaker.mu.Lock()
+	breaker.threshold = policy.BreakerThreshold
+	breaker.cooldown = policy.BreakerCooldown
+	breaker.mu.Unlock()
+	return breaker
+}
+
+// lookupBreaker returns the circuit breaker of a service if one was created
+func lookupBreaker(serviceID int64) *circuitBreaker {
+	serviceBreakersMu.Lock()
+	defer serviceBreakersMu.Unlock()
+	return serviceBreakers[serviceID]
+}
+
+// allow reports whether a call may proceed. A caller that is allowed must report the outcome to record.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		retryIn := b.cooldown - time.Since(b.openedAt)
+		if retryIn > 0 {
+			return fmt.Errorf("%w after %d consecutive failures, retry in %s", ErrCircuitOpen, b.consecutiveFailures, retryIn.Round(time.Second))
+		}
+		b.state = CircuitHalfOpen
+		b.trialInFlight = true
+		return nil
+	case CircuitHalfOpen:
+		if b.trialInFlight {
+			return fmt.Errorf("%w, a trial call is in progress", ErrCircuitOpen)
+		}
+		b.trialInFlight = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialInFlight = false
+	if !failed {
+		b.state = CircuitClosed
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == CircuitHalfOpen || b.consecutiveFailures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends an allowed call without an outcome, such as one cancelled by its caller
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialInFlight = false
+}
+
+// snapshot returns the breaker state for ServiceHealth
+func (b *circuitBreaker) snapshot() (CircuitState, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.consecutiveFailures
+}
+
+// callResilience applies a service's call policy to the requests relayed to its upstream: tool
+// calls get the timeout and the circuit breaker, and safe requests (lists, reads and pings) the
+// retries. Tool calls are never retried, since they may not be idempotent.
+type callResilience struct {
+	name    string
+	policy  model.CallPolicy
+	retries bool // whether transport failures may be retried, only for network upstreams
+	breaker *circuitBreaker
+}
+
+func newCallResilience(svc *model.MCPService) callResilience {
+	policy := svc.GetCallPolicy()
+	return callResilience{
+		name:    svc.Name,
+		policy:  policy,
+		retries: svc.Type == model.ServiceTypeSSE || svc.Type == model.ServiceTypeStreamableHTTP,
+		breaker: breakerForService(svc.ID, policy),
+	}
+}
+
+// callContext derives the context of a call, bounded by the policy's timeout
+func (c callResilience) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.policy.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.policy.Timeout)
+}
+
+// retryDelay returns how long to wait before retrying after the given failed attempt (0-based),
+// and false when no retry is left.
+func (c callResilience) retryDelay(attempt int) (time.Duration, bool) {
+	if !c.retries || attempt >= c.policy.MaxRetries {
+		return 0, false
+	}
+	return c.policy.RetryBackoff << attempt, true
+}
+
+// do runs a tool call under the breaker, once.
+// call reports whether its error came from the upstream itself (a JSON-RPC error), which
+// proves the upstream reachable and is not counted against the breaker.
+func (c callResilience) do(ctx context.Context, call func() (upstreamAnswered bool, err error)) error {
+	if err := c.breaker.allow(); err != nil {
+		return fmt.Errorf("%s is unavailable: %w", c.name, err)
+	}
+
+	answered, err := call()
+	switch {
+	case err == nil:
+		c.breaker.record(false)
+	case errors.Is(ctx.Err(), context.Canceled):
+		// A call abandoned by the caller says nothing about the upstream
+		c.breaker.release()
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("call to %s timed out after %s: %w", c.name, c.policy.Timeout, err)
+		c.breaker.record(true)
+	default:
+		c.breaker.record(!answered)
+	}
+	return err
+}
+
+// retry runs a safe request, retrying transport failures with backoff as the policy allows.
+// Errors answered by the upstream, such as an unsupported method, are returned at once.
+func (c callResilience) retry(ctx context.Context, method string, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || upstreamAnswered(err) || ctx.Err() != nil {
+			return err
+		}
+		delay, retry := c.retryDelay(attempt)
+		if !retry {
+			return err
+		}
+		common.SysLog(fmt.Sprintf("WARN: [Resilience] %s on %s failed (attempt %d): %v, retrying in %s", method, c.name, attempt+1, err, delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// upstreamAnswered reports whether err is a JSON-RPC error returned by the upstream
+func upstreamAnswered(err error) bool {
+	for _, answered := range []error{
+		mcp.ErrParseError,
+		mcp.ErrInvalidRequest,
+		mcp.ErrMethodNotFound,
+		mcp.ErrInvalidParams,
+		mcp.ErrInternalError,
+		mcp.ErrRequestInterrupted,
+		mcp.ErrResourceNotFound,
+	} {
+		if errors.Is(err, answered) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrySafe runs a safe request through the retries of the relay's resilience
+func retrySafe[T any](ctx context.Context, r *notificationRelay, method mcp.MCPMethod, call func() (T, error)) (T, error) {
+	var result T
+	err := r.resilience.retry(ctx, string(method), func() error {
+		var err error
+		result, err = call()
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMCPService_GetCallPolicy(t *testing.T) {
+	policy := (&model.MCPService{}).GetCallPolicy()
+	assert.Zero(t, policy.Timeout, "resilience features are opt-in")
+	assert.Zero(t, policy.MaxRetries)
+	assert.Zero(t, policy.BreakerThreshold)
+
+	policy = (&model.MCPService{CallTimeoutSeconds: 30, MaxRetries: 4, BreakerThreshold: -1}).GetCallPolicy()
+	assert.Equal(t, 30*time.Second, policy.Timeout)
+	assert.Equal(t, 4, policy.MaxRetries)
+	assert.Equal(t, model.DefaultRetryBackoff, policy.RetryBackoff)
+	assert.Zero(t, policy.BreakerThreshold, "negative values saved earlier disable the feature")
+	assert.Error(t, (&model.MCPService{BreakerThreshold: -1}).ValidateCallPolicy())
+}
+
+func TestCircuitBreaker_OpensAndRecovers(t *testing.T) {
+	breaker := breakerForService(-9001, model.CallPolicy{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, breaker.allow())
+		breaker.record(true)
+	}
+	state, failures := breaker.snapshot()
+	assert.Equal(t, CircuitOpen, state)
+	assert.Equal(t, 2, failures)
+	assert.ErrorIs(t, breaker.allow(), ErrCircuitOpen)
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, breaker.allow(), "a trial call is let through after the cooldown")
+	assert.ErrorIs(t, breaker.allow(), ErrCircuitOpen, "only one trial call at a time")
+	breaker.record(false)
+	state, failures = breaker.snapshot()
+	assert.Equal(t, CircuitClosed, state)
+	assert.Zero(t, failures)
+}
+
+func TestCallResilience_RetriesTransportFailuresOnly(t *testing.T) {
+	ctx := context.Background()
+	resilience := callResilience{name: "flaky", retries: true, policy: model.CallPolicy{MaxRetries: 2, RetryBackoff: time.Millisecond}}
+
+	attempts := 0
+	err := resilience.retry(ctx, "tools/list", func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = resilience.retry(ctx, "prompts/list", func() error {
+		attempts++
+		return fmt.Errorf("%w: prompts not supported", mcp.ErrMethodNotFound)
+	})
+	assert.ErrorIs(t, err, mcp.ErrMethodNotFound)
+	assert.Equal(t, 1, attempts, "errors returned by the upstream are not retried")
+
+	attempts = 0
+	err = resilience.do(ctx, func() (bool, error) {
+		attempts++
+		return false, errors.New("connection reset")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts, "tool calls are never retried")
+}
+
+func TestRelayedCallTool_TimesOutAndOpensCircuit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	defer close(release)
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0")
+	upstream.AddTool(mcp.NewTool("hang"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return mcp.NewToolResultText("too late"), nil
+	})
+	upstreamHTTP := mcpserver.NewTestStreamableHTTPServer(upstream)
+	defer upstreamHTTP.Close()
+
+	svc := &model.MCPService{Name: "hanging", Type: model.ServiceTypeStreamableHTTP, Command: upstreamHTTP.URL,
+		CallTimeoutSeconds: 1, BreakerThreshold: 1, BreakerCooldownSeconds: 60}
+	svc.ID = -9002
+	_, client, err := createActualMcpGoServerAndClientUncached(ctx, svc, "test")
+	require.NoError(t, err)
+	defer client.Close()
+
+	request := mcp.CallToolRequest{}
+	request.Params.Name = "hang"
+	started := time.Now()
+	_, err = client.CallTool(ctx, request)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.Less(t, time.Since(started), 5*time.Second)
+
+	started = time.Now()
+	_, err = client.CallTool(ctx, request)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Less(t, time.Since(started), 100*time.Millisecond, "an open circuit fails fast")
+
+	health := NewMonitoredProxiedService(NewBaseService(svc.ID, svc.Name, svc.Type), nil, svc).GetHealth()
+	assert.Equal(t, CircuitOpen, health.CircuitState)
+	assert.Equal(t, 1, health.ConsecutiveFailures)
+}
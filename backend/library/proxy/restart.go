@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+)
+
+// A stdio process that exits while its instance is in use is restarted right away, after an
+// exponential backoff once it keeps exiting. A process that exits crashLoopThreshold times within
+// crashLoopWindow is crash looping. The worker of a pool that loops is retired while the others keep
+// serving; an instance whose single process or every worker loops is not restarted again, nor
+// started on demand, until an administrator restarts its service or instance.
+
+// ErrCrashLooping is returned when an instance is not started because its processes keep exiting
+var ErrCrashLooping = errors.New("instance is crash looping")
+
+var (
+	restartBackoffBase = time.Second
+	restartBackoffMax  = time.Minute
+	crashLoopThreshold = 5
+	crashLoopWindow    = 5 * time.Minute
+)
+
+// restartState records the unexpected exits of the processes of one instance, by cache key
+type restartState struct {
+	serviceID int64
+
+	mu           sync.Mutex
+	crashes      map[int][]time.Time // within crashLoopWindow, by pool worker or anyWorker
+	restarts     int
+	lastExit     time.Time
+	crashLooping bool
+}
+
+var (
+	restartStates   = make(map[string]*restartState)
+	restartStatesMu sync.Mutex
+)
+
+func restartStateFor(serviceID int64, cacheKey string) *restartState {
+	restartStatesMu.Lock()
+	defer restartStatesMu.Unlock()
+	state := restartStates[cacheKey]
+	if state == nil {
+		state = &restartState{serviceID: serviceID}
+		restartStates[cacheKey] = state
+	}
+	return state
+}
+
+func lookupRestartState(cacheKey string) *restartState {
+	restartStatesMu.Lock()
+	defer restartStatesMu.Unlock()
+	return restartStates[cacheKey]
+}
+
+// dropRestartStates forgets the exits of the instances of a service that was unregistered
+func dropRestartStates(serviceID int64) {
+	restartStatesMu.Lock()
+	defer restartStatesMu.Unlock()
+	for key, state := range restartStates {
+		if state.serviceID == serviceID {
+			delete(restartStates, key)
+		}
+	}
+}
+
+// recordCrash counts an exit of the process of a pool worker, or of the instance's only process
+// with anyWorker, and returns how long to wait before restarting it, or false once it is crash looping
+func (r *restartState) recordCrash(worker int, now time.Time) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.crashes == nil {
+		r.crashes = make(map[int][]time.Time)
+	}
+	var recent []time.Time
+	for _, crash := range r.crashes[worker] {
+		if now.Sub(crash) < crashLoopWindow {
+			recent = append(recent, crash)
+		}
+	}
+	recent = append(recent, now)
+	r.crashes[worker] = recent
+	r.lastExit = now
+	if len(recent) >= crashLoopThreshold {
+		return 0, false
+	}
+	if len(recent) == 1 {
+		return 0, true
+	}
+	delay := restartBackoffBase << (len(recent) - 2)
+	if delay > restartBackoffMax {
+		delay = restartBackoffMax
+	}
+	return delay, true
+}
+
+func (r *restartState) recordRestart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restarts++
+}
+
+// markCrashLooping stops the instance from being started until its crash loop is reset
+func (r *restartState) markCrashLooping() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.crashLooping = true
+}
+
+func (r *restartState) isCrashLooping() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.crashLooping
+}
+
+// checkCrashLoop returns ErrCrashLooping for an instance that must not be started
+func checkCrashLoop(cacheKey string) error {
+	if state := lookupRestartState(cacheKey); state != nil && state.isCrashLooping() {
+		return fmt.Errorf("%w: %s exited %d times within %s", ErrCrashLooping, cacheKey, crashLoopThreshold, crashLoopWindow)
+	}
+	return nil
+}
+
+// resetCrashLoop lets an instance be started again, keeping its restart count
+func resetCrashLoop(cacheKey string) {
+	if state := lookupRestartState(cacheKey); state != nil {
+		state.mu.Lock()
+		state.crashes = nil
+		state.crashLooping = false
+		state.mu.Unlock()
+	}
+}
+
+// resetServiceCrashLoops lets every instance of a service be started again
+func resetServiceCrashLoops(serviceID int64) {
+	restartStatesMu.Lock()
+	var keys []string
+	for key, state := range restartStates {
+		if state.serviceID == serviceID {
+			keys = append(keys, key)
+		}
+	}
+	restartStatesMu.Unlock()
+	for _, key := range keys {
+		resetCrashLoop(key)
+	}
+}
+
+// restartCounts summarizes the restarts of the instances of a service
+type restartCounts struct {
+	restarts int
+	lastExit time.Time
+}
+
+func serviceRestartCounts(serviceID int64) restartCounts {
+	restartStatesMu.Lock()
+	var states []*restartState
+	for _, state := range restartStates {
+		if state.serviceID == serviceID {
+			states = append(states, state)
+		}
+	}
+	restartStatesMu.Unlock()
+
+	var counts restartCounts
+	for _, state := range states {
+		state.mu.Lock()
+		counts.restarts += state.restarts
+		if state.lastExit.After(counts.lastExit) {
+			counts.lastExit = state.lastExit
+		}
+		state.mu.Unlock()
+	}
+	return counts
+}
+
+// processExited handles the exit of one of the instance's processes. Processes stopped by
+// shutting the instance down are expected to exit.
+func (s *SharedMcpInstance) processExited(worker int) {
+	if s.isRetired() {
+		return
+	}
+	if s.isDraining() {
+		// Already replaced; its sessions move to the new instance
+		s.retire("process exited while draining")
+		return
+	}
+	state := restartStateFor(s.serviceID, s.cacheKey)
+	delay, restart := state.recordCrash(worker, time.Now())
+
+	if pool := s.pool(); pool != nil && worker != anyWorker {
+		if restart {
+			common.SysLog(fmt.Sprintf("WARN: [Instances] Worker %d of %s exited, restarting it in %s", worker, s.cacheKey, delay))
+			state.recordRestart()
+			pool.failWorker(worker, errors.New("process exited"), delay)
+			return
+		}
+		err := fmt.Errorf("crash looping after %d exits within %s", crashLoopThreshold, crashLoopWindow)
+		if pool.retireWorker(worker, err) > 0 {
+			common.SysError(fmt.Sprintf("[Instances] Worker %d of %s is %v, retiring it", worker, s.cacheKey, err))
+			return
+		}
+	}
+
+	sharedMCPServersMutex.Lock()
+	removeSharedInstanceLocked(s)
+	sharedMCPServersMutex.Unlock()
+	if !restart {
+		state.markCrashLooping()
+		common.SysError(fmt.Sprintf("[Instances] %s is crash looping after %d exits within %s, not restarting it", s.cacheKey, crashLoopThreshold, crashLoopWindow))
+		s.retire("crash looping")
+		return
+	}
+	s.retire("process exited")
+	common.SysLog(fmt.Sprintf("WARN: [Instances] Process of %s exited, restarting it in %s", s.cacheKey, delay))
+	time.AfterFunc(delay, func() { restartExited(s, state) })
+}
+
+// restartExited starts an instance again in place of one whose process exited
+func restartExited(exited *SharedMcpInstance, state *restartState) {
+	if lookupSharedInstance(exited.cacheKey) != nil {
+		return // started on demand in the meantime
+	}
+	svc, err := model.GetServiceByID(exited.serviceID)
+	if err != nil || !svc.Enabled {
+		common.SysLog(fmt.Sprintf("[Instances] Not restarting %s: its service is gone or disabled", exited.cacheKey))
+		return
+	}
+	state.recordRestart()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err := getOrCreateSharedMcpInstanceWithKeyInternal(ctx, svc, exited.cacheKey, exited.detail, exited.envsJSON); err != nil {
+		if errors.Is(err, ErrCrashLooping) {
+			return
+		}
+		common.SysError(fmt.Sprintf("[Instances] Failed to restart %s: %v", exited.cacheKey, err))
+		// A process that cannot even start counts as exiting again
+		if delay, restart := state.recordCrash(anyWorker, time.Now()); restart {
+			time.AfterFunc(delay, func() { restartExited(exited, state) })
+		} else {
+			state.markCrashLooping()
+			common.SysError(fmt.Sprintf("[Instances] %s is crash looping after %d exits within %s, not restarting it", exited.cacheKey, crashLoopThreshold, crashLoopWindow))
+		}
+	}
+}
+
+// pool returns the worker pool of a stdio instance, nil if it runs a single process
+func (s *SharedMcpInstance) pool() *stdioPool {
+	if relayed, ok := s.Client.(relayedClient); ok {
+		if pool, ok := relayed.MCPClient.(*stdioPool); ok {
+			return pool
+		}
+	}
+	return nil
+}
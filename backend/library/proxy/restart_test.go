@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func forgetRestartState(t *testing.T, cacheKey string) {
+	t.Cleanup(func() {
+		restartStatesMu.Lock()
+		delete(restartStates, cacheKey)
+		restartStatesMu.Unlock()
+	})
+}
+
+func TestRestartState_BacksOffThenCrashLoops(t *testing.T) {
+	state := &restartState{}
+	now := time.Now()
+	var delays []time.Duration
+	for i := 0; i < crashLoopThreshold-1; i++ {
+		delay, restart := state.recordCrash(anyWorker, now.Add(time.Duration(i)*time.Second))
+		require.True(t, restart)
+		delays = append(delays, delay)
+	}
+	assert.Equal(t, []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second}, delays)
+
+	// Exits spread over more than the window are not a crash loop
+	delay, restart := state.recordCrash(anyWorker, now.Add(crashLoopWindow+1500*time.Millisecond))
+	assert.True(t, restart)
+	assert.Equal(t, 2*time.Second, delay, "the two oldest exits are forgotten")
+
+	for i := 0; i < 3; i++ {
+		_, restart = state.recordCrash(anyWorker, now.Add(crashLoopWindow+2*time.Second))
+	}
+	assert.False(t, restart)
+
+	// Exits of pool workers are counted per worker
+	_, restart = state.recordCrash(1, now.Add(crashLoopWindow+2*time.Second))
+	assert.True(t, restart)
+}
+
+func TestProcessExited_RespawnsPoolWorker(t *testing.T) {
+	pool, workers := newTestPool(t, 2, false)
+	relay := newNotificationRelay("pooled", capabilityGuard{})
+	relay.client = pool
+	svc := &model.MCPService{Name: "pooled", Type: model.ServiceTypeStdio}
+	svc.ID = -9301
+	instance := newSharedMcpInstance(nil, relayedClient{MCPClient: pool, relay: relay}, svc, "global-service--9301-shared")
+	withInstanceCache(t, instance)
+	forgetRestartState(t, instance.cacheKey)
+
+	relay.trackProcess(1, 4242)
+	relay.onProcessExit(instance.processExited)
+	relay.processExited(1, 4241) // a process that was already replaced
+	assert.Equal(t, int32(2), workers.spawned.Load())
+
+	relay.processExited(1, 4242)
+	require.Eventually(t, func() bool {
+		health := pool.health()[1]
+		return health.Healthy && health.Restarts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "process exited", pool.health()[1].LastError)
+	assert.Equal(t, []string{instance.cacheKey}, cachedKeys(), "the instance keeps serving from its other worker")
+	assert.Equal(t, 1, serviceRestartCounts(svc.ID).restarts)
+}
+
+func TestProcessExited_RetiresLoopingPoolWorker(t *testing.T) {
+	pool, workers := newTestPool(t, 2, false)
+	relay := newNotificationRelay("pooled", capabilityGuard{})
+	relay.client = pool
+	svc := &model.MCPService{Name: "pooled", Type: model.ServiceTypeStdio}
+	svc.ID = -9303
+	instance := newSharedMcpInstance(nil, relayedClient{MCPClient: pool, relay: relay}, svc, "global-service--9303-shared")
+	withInstanceCache(t, instance)
+	forgetRestartState(t, instance.cacheKey)
+
+	state := restartStateFor(svc.ID, instance.cacheKey)
+	for i := 0; i < crashLoopThreshold-1; i++ {
+		state.recordCrash(1, time.Now())
+	}
+	relay.onProcessExit(instance.processExited)
+	relay.trackProcess(1, 4244)
+	relay.processExited(1, 4244)
+
+	require.Eventually(t, func() bool { return pool.health()[1].Retired }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, pool.health()[0].Healthy, "the other worker keeps serving")
+	assert.Equal(t, []string{instance.cacheKey}, cachedKeys())
+	assert.NoError(t, checkCrashLoop(instance.cacheKey))
+	assert.NoError(t, pool.Ping(context.Background()))
+	assert.Equal(t, int32(2), workers.spawned.Load(), "the retired worker is not respawned")
+
+	// Unregistering the service forgets its exits
+	dropRestartStates(svc.ID)
+	assert.Nil(t, lookupRestartState(instance.cacheKey))
+}
+
+func TestProcessExited_StopsRestartingCrashLoop(t *testing.T) {
+	svc := &model.MCPService{Name: "crashing", Type: model.ServiceTypeStdio}
+	svc.ID = -9302
+	cacheKey := "global-service--9302-shared"
+	client, err := mcpclient.NewInProcessClient(mcpserver.NewMCPServer(svc.Name, "1.0.0"))
+	require.NoError(t, err)
+	relay := newNotificationRelay(svc.Name, capabilityGuard{})
+	instance := newSharedMcpInstance(nil, relayedClient{MCPClient: client, relay: relay}, svc, cacheKey)
+	withInstanceCache(t, instance)
+	forgetRestartState(t, cacheKey)
+
+	state := restartStateFor(svc.ID, cacheKey)
+	for i := 0; i < crashLoopThreshold-1; i++ {
+		state.recordCrash(anyWorker, time.Now())
+	}
+	relay.trackProcess(anyWorker, 4243)
+	relay.processExited(anyWorker, 4243) // exits before the handler is set are not lost
+	relay.onProcessExit(instance.processExited)
+
+	require.Eventually(t, instance.isRetired, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, cachedKeys())
+	_, err = GetOrCreateSharedMcpInstanceWithKey(context.Background(), svc, cacheKey, "global-shared-svc--9302", "")
+	assert.True(t, errors.Is(err, ErrCrashLooping))
+
+	monitored := NewMonitoredProxiedService(NewBaseService(svc.ID, svc.Name, svc.Type), instance, svc)
+	health, err := monitored.CheckHealth(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, StatusCrashLooping, health.Status)
+
+	resetServiceCrashLoops(svc.ID)
+	assert.NoError(t, checkCrashLoop(cacheKey))
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"toWers/backend/common"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// anyWorker marks an upstream client that is not part of a stdio worker pool
+const anyWorker = -1
+
+// serverRequests answers the requests an upstream client receives (sampling, elicitation, roots)
+// by forwarding them through the relay to the downstream session that caused them. worker is the
+// index of the client in its stdio worker pool, or anyWorker.
+type serverRequests struct {
+	relay  *notificationRelay
+	worker int
+}
+
+var (
+	_ mcpclient.SamplingHandler    = serverRequests{}
+	_ mcpclient.ElicitationHandler = serverRequests{}
+	_ mcpclient.RootsHandler       = serverRequests{}
+)
+
+// clientOptions declares sampling, elicitation and roots on an upstream client and routes them through the relay.
+// Only transports that can carry server requests (stdio, streamable HTTP) should be given these options.
+func (r *notificationRelay) clientOptions(worker int) []mcpclient.ClientOption {
+	r.relaysServerRequests = true
+	handler := serverRequests{relay: r, worker: worker}
+	return []mcpclient.ClientOption{
+		mcpclient.WithSamplingHandler(handler),
+		mcpclient.WithElicitationHandler(handler),
+		mcpclient.WithRootsHandler(handler),
+	}
+}
+
+// CreateMessage relays sampling/createMessage to the downstream client
+func (h serverRequests) CreateMessage(ctx context.Context, request mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	downstream, err := h.relay.downstreamFor(ctx, h.worker, string(mcp.MethodSamplingCreateMessage), func(c mcp.ClientCapabilities) bool { return c.Sampling != nil })
+	if err != nil {
+		return nil, err
+	}
+	return h.relay.server.RequestSampling(downstream, request)
+}
+
+// Elicit relays elicitation/create to the downstream client
+func (h serverRequests) Elicit(ctx context.Context, request mcp.ElicitationRequest) (*mcp.ElicitationResult, error) {
+	downstream, err := h.relay.downstreamFor(ctx, h.worker, string(mcp.MethodElicitationCreate), func(c mcp.ClientCapabilities) bool { return c.Elicitation != nil })
+	if err != nil {
+		return nil, err
+	}
+	return h.relay.server.RequestElicitation(downstream, request)
+}
+
+// ListRoots relays roots/list to the downstream client
+func (h serverRequests) ListRoots(ctx context.Context, request mcp.ListRootsRequest) (*mcp.ListRootsResult, error) {
+	downstream, err := h.relay.downstreamFor(ctx, h.worker, string(mcp.MethodListRoots), func(c mcp.ClientCapabilities) bool { return c.Roots != nil })
+	if err != nil {
+		return nil, err
+	}
+	return h.relay.server.RequestRoots(downstream, request)
+}
+
+// downstreamFor finds the downstream session an upstream request belongs to, and checks it declared
+// the capability the request needs.
+// Over streamable HTTP the request arrives on the response stream of the relayed call, so ctx already
+// carries the caller's session. Otherwise (stdio) the request is routed to the only session with calls
+// in flight on the upstream process (worker); it is refused when several sessions are, rather than
+// risk sending one user's request to another.
+func (r *notificationRelay) downstreamFor(ctx context.Context, worker int, method string, supports func(mcp.ClientCapabilities) bool) (context.Context, error) {
+	if r.server == nil {
+		return nil, fmt.Errorf("%s: proxy for %s is not ready", method, r.name)
+	}
+
+	downstream := ctx
+	session := mcpserver.ClientSessionFromContext(ctx)
+	if session == nil {
+		r.mu.Lock()
+		for _, call := range r.calls {
+			callSession := mcpserver.ClientSessionFromContext(call.ctx)
+			if callSession == nil || (worker != anyWorker && call.worker != worker) {
+				continue
+			}
+			if session != nil && callSession.SessionID() != session.SessionID() {
+				r.mu.Unlock()
+				common.SysLog(fmt.Sprintf("WARN: [Relay] Refusing %s from %s: calls from several sessions are in flight", method, r.name))
+				return nil, fmt.Errorf("%s: cannot tell which client the request is for", method)
+			}
+			session = callSession
+			downstream = call.ctx
+		}
+		r.mu.Unlock()
+	}
+	if session == nil {
+		return nil, fmt.Errorf("%s: no client connected to %s", method, r.name)
+	}
+
+	if withInfo, ok := session.(mcpserver.SessionWithClientInfo); ok && !supports(withInfo.GetClientCapabilities()) {
+		return nil, fmt.Errorf("%s: the connected client does not support it", method)
+	}
+	return downstream, nil
+}
+
+// forwardRootsListChanged tells the upstream the downstream client's roots changed
+func (r *notificationRelay) forwardRootsListChanged(ctx context.Context, notification mcp.JSONRPCNotification) {
+	notifier, ok := r.client.(interface {
+		RootListChanges(ctx context.Context) error
+	})
+	if !ok || !r.relaysServerRequests {
+		return
+	}
+	notifyCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), upstreamNotifyTimeout)
+	defer cancel()
+	if err := notifier.RootListChanges(notifyCtx); err != nil {
+		common.SysError(fmt.Sprintf("[Relay] Failed to forward roots list change to %s: %v", r.name, err))
+	}
+}
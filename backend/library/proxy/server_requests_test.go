@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSampler struct{}
+
+func (stubSampler) CreateMessage(ctx context.Context, request mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	return &mcp.CreateMessageResult{
+		SamplingMessage: mcp.SamplingMessage{Role: mcp.RoleAssistant, Content: mcp.NewTextContent("sampled by downstream")},
+		Model:           "stub",
+	}, nil
+}
+
+type stubRoots struct{}
+
+func (stubRoots) ListRoots(ctx context.Context, request mcp.ListRootsRequest) (*mcp.ListRootsResult, error) {
+	return &mcp.ListRootsResult{Roots: []mcp.Root{{URI: "file:///workspace", Name: "workspace"}}}, nil
+}
+
+// newServerRequestFixture proxies an upstream whose tools call back into the client, over streamable HTTP
+// on both sides, and returns a downstream client that declares the given handlers.
+func newServerRequestFixture(t *testing.T, options ...mcpclient.ClientOption) *mcpclient.Client {
+	t.Helper()
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0")
+	upstream.AddTool(mcp.NewTool("ask"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		sampling := mcp.CreateMessageRequest{}
+		sampling.Messages = []mcp.SamplingMessage{{Role: mcp.RoleUser, Content: mcp.NewTextContent("hello")}}
+		sampling.MaxTokens = 10
+		result, err := mcpserver.ServerFromContext(ctx).RequestSampling(ctx, sampling)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText(result.Content.(mcp.TextContent).Text), nil
+	})
+	upstream.AddTool(mcp.NewTool("roots"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := mcpserver.ServerFromContext(ctx).RequestRoots(ctx, mcp.ListRootsRequest{})
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText(result.Roots[0].URI), nil
+	})
+	upstreamHTTP := mcpserver.NewTestStreamableHTTPServer(upstream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := &model.MCPService{Name: "relayed", Type: model.ServiceTypeStreamableHTTP, Command: upstreamHTTP.URL}
+	proxied, upstreamClient, err := createActualMcpGoServerAndClientUncached(ctx, svc, "test")
+	require.NoError(t, err)
+	proxiedHTTP := mcpserver.NewTestStreamableHTTPServer(proxied)
+
+	httpTransport, err := transport.NewStreamableHTTP(proxiedHTTP.URL, transport.WithContinuousListening())
+	require.NoError(t, err)
+	downstream := mcpclient.NewClient(httpTransport, options...)
+	require.NoError(t, downstream.Start(ctx))
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "downstream", Version: "1.0.0"}
+	_, err = downstream.Initialize(ctx, initRequest)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		downstream.Close()
+		proxiedHTTP.Close()
+		upstreamClient.Close()
+		upstreamHTTP.Close()
+		cancel()
+	})
+	return downstream
+}
+
+func callText(t *testing.T, client *mcpclient.Client, tool string) (string, bool) {
+	t.Helper()
+	request := mcp.CallToolRequest{}
+	request.Params.Name = tool
+	result, err := client.CallTool(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, result.Content, 1)
+	return result.Content[0].(mcp.TextContent).Text, result.IsError
+}
+
+func TestNotificationRelay_RelaysSamplingAndRoots(t *testing.T) {
+	downstream := newServerRequestFixture(t, mcpclient.WithSamplingHandler(stubSampler{}), mcpclient.WithRootsHandler(stubRoots{}))
+
+	text, isError := callText(t, downstream, "ask")
+	assert.False(t, isError, text)
+	assert.Equal(t, "sampled by downstream", text)
+
+	text, isError = callText(t, downstream, "roots")
+	assert.False(t, isError, text)
+	assert.Equal(t, "file:///workspace", text)
+}
+
+func TestNotificationRelay_RefusesUnsupportedCapability(t *testing.T) {
+	downstream := newServerRequestFixture(t)
+
+	text, isError := callText(t, downstream, "ask")
+	assert.True(t, isError, "a client without sampling must not be asked to sample")
+	assert.Contains(t, text, "does not support")
+}
@@ -7,21 +7,43 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"toWers/backend/common"
+	"toWers/backend/library/sandbox"
 	"toWers/backend/model"
 
 	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
 	"github.com/mark3labs/mcp-go/mcp"
 	mcpserver "github.com/mark3labs/mcp-go/server"
 )
 
 // SharedMcpInstance encapsulates a shared MCPServer and its MCPClient.
+// Instances in the sharedMCPServers cache also track their use, see instances.go.
 type SharedMcpInstance struct {
 	Server *mcpserver.MCPServer
 	Client mcpclient.MCPClient
-	// consider adding createdAt time.Time for future LRU cache policies
+
+	serviceID   int64
+	serviceName string
+	serviceType model.ServiceType
+	cacheKey    string
+	userID      int64  // owner of a user-specific instance, 0 for the global one
+	detail      string // instanceNameDetail it was created with
+	envsJSON    string // effective environment it was created with, to restart it
+	policy      model.InstancePolicy
+	createdAt   time.Time
+	lastUsed    atomic.Int64 // unix nanoseconds
+	inFlight    atomic.Int32 // requests being served
+	openStreams atomic.Int32 // SSE streams clients hold open
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	config      string // fingerprint of the configuration it was created with, see instanceConfig
+	handlerMu   sync.Mutex
+	handlers    map[string]*trackedHandler // proxy handlers built on this instance, by cache key
+	processLog  *processLog                // stderr of its stdio processes, released when it is retired
 }
 
 // Shutdown gracefully stops the server and closes the client.
@@ -66,6 +88,10 @@ const (
 	StatusStarting ServiceStatus = "starting"
 	// StatusStopped indicates service is stopped
 	StatusStopped ServiceStatus = "stopped"
+	// StatusIdle indicates service has scaled to zero and starts on its next request
+	StatusIdle ServiceStatus = "idle"
+	// StatusCrashLooping indicates the service's process keeps exiting and is no longer restarted
+	StatusCrashLooping ServiceStatus = "crash_looping"
 )
 
 // ServiceHealth contains service health related information
@@ -80,6 +106,14 @@ type ServiceHealth struct {
 	UpTime        int64         `json:"up_time_seconds,omitempty"` // seconds
 	WarningLevel  int           `json:"warning_level,omitempty"`   // 0-no warning, 1-minor, 2-moderate, 3-severe
 	InstanceCount int           `json:"instance_count,omitempty"`  // instance count (if multi-instance)
+	// Circuit breaker of the calls relayed to the upstream, empty when the service has none
+	CircuitState        CircuitState `json:"circuit_state,omitempty"`
+	ConsecutiveFailures int          `json:"consecutive_failures,omitempty"` // consecutive failed calls counted by the breaker
+	// Processes of a stdio worker pool, empty unless the service runs more than one
+	Workers []WorkerHealth `json:"workers,omitempty"`
+	// Automatic restarts of the service's instances after their process exited
+	Restarts   int       `json:"restarts,omitempty"`
+	LastExitAt time.Time `json:"last_exit_at,omitempty"`
 }
 
 // Service interface defines methods all MCP services must implement
@@ -316,12 +350,91 @@ func NewMonitoredProxiedService(base *BaseService, instance *SharedMcpInstance,
 }
 
 // CheckHealth for MonitoredProxiedService performs deep health checking using the shared MCP instance
+// and reports the state of the service's circuit breaker
 func (s *MonitoredProxiedService) CheckHealth(ctx context.Context) (*ServiceHealth, error) {
+	health, err := s.checkSharedInstance(ctx)
+	s.addRuntimeState(health)
+	return health, err
+}
+
+// GetHealth for MonitoredProxiedService adds the current circuit breaker state and instance count to the last health check
+func (s *MonitoredProxiedService) GetHealth() *ServiceHealth {
+	health := s.BaseService.GetHealth()
+	s.addRuntimeState(health)
+	return health
+}
+
+func (s *MonitoredProxiedService) addRuntimeState(health *ServiceHealth) {
+	if breaker := lookupBreaker(s.serviceID); breaker != nil {
+		health.CircuitState, health.ConsecutiveFailures = breaker.snapshot()
+	}
+	health.InstanceCount = liveInstanceCount(s.serviceID)
+	s.mu.RLock()
+	instance := s.sharedInstance
+	s.mu.RUnlock()
+	if instance != nil {
+		if pool := instance.pool(); pool != nil {
+			health.Workers = pool.health()
+		}
+	}
+	restarts := serviceRestartCounts(s.serviceID)
+	health.Restarts, health.LastExitAt = restarts.restarts, restarts.lastExit
+}
+
+// scalesToZero reports whether the service may run without instances, which then start on demand
+func (s *MonitoredProxiedService) scalesToZero() bool {
+	return s.dbServiceConfig != nil && s.dbServiceConfig.GetInstancePolicy().MinInstances == 0
+}
+
+// markIdle records that the service has no running instance; s.mu must be held
+func (s *MonitoredProxiedService) markIdle() *ServiceHealth {
+	s.health.Status = StatusIdle
+	s.health.ErrorMessage = ""
+	s.health.WarningLevel = 0
+	s.health.LastChecked = time.Now()
+	healthCopy := s.health
+	return &healthCopy
+}
+
+// markCrashLooping records that the service's instance is no longer restarted; s.mu must be held
+func (s *MonitoredProxiedService) markCrashLooping(err error) *ServiceHealth {
+	s.health.Status = StatusCrashLooping
+	s.health.ErrorMessage = err.Error()
+	s.health.WarningLevel = 3
+	s.health.FailureCount++
+	s.health.LastChecked = time.Now()
+	healthCopy := s.health
+	return &healthCopy
+}
+
+// checkSharedInstance pings the upstream through the shared MCP instance, re-creating the client of
+// network services whose ping fails
+func (s *MonitoredProxiedService) checkSharedInstance(ctx context.Context) (*ServiceHealth, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	startTime := time.Now()
 
+	// The instance may have been shut down for idleness or re-created since the last check.
+	// A service that scaled to zero is not started just to be checked.
+	if s.dbServiceConfig != nil {
+		cacheKey := fmt.Sprintf("global-service-%d-shared", s.dbServiceConfig.ID)
+		if current := lookupSharedInstance(cacheKey); current != nil {
+			s.sharedInstance = current
+		} else if err := checkCrashLoop(cacheKey); err != nil {
+			// The instance was shut down because its process keeps exiting
+			s.sharedInstance = nil
+			return s.markCrashLooping(err), err
+		} else if s.sharedInstance != nil && s.sharedInstance.isRetired() {
+			s.sharedInstance = nil
+			if s.scalesToZero() {
+				return s.markIdle(), nil
+			}
+		} else if s.sharedInstance == nil && s.health.Status == StatusIdle {
+			return s.markIdle(), nil
+		}
+	}
+
 	if s.sharedInstance == nil || s.sharedInstance.Client == nil {
 		s.health.Status = StatusUnhealthy
 		s.health.ErrorMessage = "Shared MCP instance or client is not initialized."
@@ -398,18 +511,14 @@ func (s *MonitoredProxiedService) CheckHealth(ctx context.Context) (*ServiceHeal
 				instanceToShutdown := s.sharedInstance
 
 				sharedMCPServersMutex.Lock()
-				delete(sharedMCPServers, cacheKey)
+				removeSharedInstanceLocked(instanceToShutdown)
 				sharedMCPServersMutex.Unlock()
 				common.SysLog(fmt.Sprintf("CheckHealth: Removed instance for %s (key: %s) from global cache.", s.serviceName, cacheKey))
 
 				s.sharedInstance = nil
 
-				if instanceToShutdown != nil {
-					common.SysLog(fmt.Sprintf("CheckHealth: Shutting down old shared instance for %s (ID: %d).", s.serviceName, s.serviceID))
-					if shutdownErr := instanceToShutdown.Shutdown(ctx); shutdownErr != nil {
-						common.SysError(fmt.Sprintf("CheckHealth: Error shutting down old instance for %s: %v. Proceeding with re-creation.", s.serviceName, shutdownErr))
-					}
-				}
+				// Also drops the proxy handlers built on the old instance, so they are rebuilt on the new one
+				instanceToShutdown.retire(fmt.Sprintf("ping failed: %v", originalPingErr))
 
 				common.SysLog(fmt.Sprintf("CheckHealth: Attempting to get/create new shared MCP instance for %s (ID: %d).", s.serviceName, s.serviceID))
 				instanceNameDetail := fmt.Sprintf("global-shared-svc-%d-recreated", s.dbServiceConfig.ID)
@@ -591,6 +700,15 @@ func createActualMcpGoServerAndClientUncached(
 	var mcpGoClient mcpclient.MCPClient
 	var err error
 	var needManualStart bool
+	var stderrLog *processLog // stderr of stdio processes
+	guard := capabilityGuard{
+		serviceID: serviceConfigForInstance.ID,
+		filter:    liveCapabilityFilter(serviceConfigForInstance),
+		aliases:   newToolAliases(),
+		retired:   newNameSet(),
+	}
+	relay := newNotificationRelay(serviceConfigForInstance.Name, guard)
+	relay.resilience = newCallResilience(serviceConfigForInstance)
 
 	switch serviceConfigForInstance.Type {
 	case model.ServiceTypeStdio:
@@ -623,7 +741,48 @@ func createActualMcpGoServerAndClientUncached(
 			}
 		}
 		common.SysLog(fmt.Sprintf("Stdio config for %s: Command=%s, Args=%v, Env=%v", serviceConfigForInstance.Name, stdioConf.Command, stdioConf.Args, stdioConf.Env))
-		mcpGoClient, err = mcpclient.NewStdioMCPClient(stdioConf.Command, stdioConf.Env, stdioConf.Args...)
+		sandboxPolicy := serviceConfigForInstance.GetSandboxPolicy()
+		var ok bool
+		if stderrLog, ok = ctx.Value(processLogKey{}).(*processLog); !ok {
+			stderrLog = processLogFor(serviceConfigForInstance.ID, instanceNameDetail)
+		}
+		spawn := func(ctx context.Context, worker int) (*mcpclient.Client, error) {
+			launcher := sandbox.New(serviceConfigForInstance.Name, sandboxPolicy)
+			stdioTransport := transport.NewStdioWithOptions(stdioConf.Command, stdioConf.Env, stdioConf.Args, transport.WithCommandFunc(launcher.Command))
+			if err := stdioTransport.Start(ctx); err != nil {
+				return nil, err
+			}
+			launcher.Watch(ctx)
+			pid := launcher.PID()
+			relay.trackProcess(worker, pid)
+			source := ""
+			if worker != anyWorker {
+				source = fmt.Sprintf("worker-%d", worker)
+			}
+			exited := stderrLog.capture(source, stdioTransport.Stderr())
+			go func() {
+				<-exited
+				relay.processExited(worker, pid)
+			}()
+			stdioClient := mcpclient.NewClient(stdioTransport, relay.clientOptions(worker)...)
+			// The transport is already running; Start only wires up the notification and server request handlers
+			if err := stdioClient.Start(ctx); err != nil {
+				stdioClient.Close()
+				return nil, err
+			}
+			return stdioClient, nil
+		}
+		if poolSize := serviceConfigForInstance.GetWorkerPoolSize(); poolSize > 1 {
+			var pool *stdioPool
+			if pool, err = newStdioPool(context.Background(), serviceConfigForInstance.Name, poolSize, serviceConfigForInstance.StickySessions, spawn); err == nil {
+				mcpGoClient = pool
+			}
+		} else {
+			var stdioClient *mcpclient.Client
+			if stdioClient, err = spawn(context.Background(), anyWorker); err == nil {
+				mcpGoClient = stdioClient
+			}
+		}
 		needManualStart = false
 
 	case model.ServiceTypeSSE:
@@ -631,18 +790,20 @@ func createActualMcpGoServerAndClientUncached(
 		if url == "" {
 			return nil, nil, fmt.Errorf("URL (from Command field) is empty for SSE service %s (ID: %d)", serviceConfigForInstance.Name, serviceConfigForInstance.ID)
 		}
-		var headers map[string]string
-		if serviceConfigForInstance.HeadersJSON != "" && serviceConfigForInstance.HeadersJSON != "{}" {
-			if errJson := json.Unmarshal([]byte(serviceConfigForInstance.HeadersJSON), &headers); errJson != nil {
-				common.SysError(fmt.Sprintf("Failed to unmarshal HeadersJSON for SSE service %s (ID: %d): %v. Proceeding without custom headers.", serviceConfigForInstance.Name, serviceConfigForInstance.ID, errJson))
-			}
+		headers := remoteHeaders(serviceConfigForInstance)
+		common.SysLog(fmt.Sprintf("SSE config for %s: URL=%s, Headers=%v", serviceConfigForInstance.Name, url, headerNames(headers)))
+		oauth, oauthErr := upstreamOAuthConfig(ctx, serviceConfigForInstance)
+		if oauthErr != nil {
+			return nil, nil, oauthErr
 		}
-		common.SysLog(fmt.Sprintf("SSE config for %s: URL=%s, Headers=%v", serviceConfigForInstance.Name, url, headers))
+		var options []transport.ClientOption
 		if len(headers) > 0 {
-			mcpGoClient, err = mcpclient.NewSSEMCPClient(url, mcpclient.WithHeaders(headers))
-		} else {
-			mcpGoClient, err = mcpclient.NewSSEMCPClient(url)
+			options = append(options, mcpclient.WithHeaders(headers))
+		}
+		if oauth != nil {
+			options = append(options, transport.WithOAuth(*oauth))
 		}
+		mcpGoClient, err = mcpclient.NewSSEMCPClient(url, options...)
 		needManualStart = true
 
 	case model.ServiceTypeStreamableHTTP:
@@ -650,25 +811,13 @@ func createActualMcpGoServerAndClientUncached(
 		if url == "" {
 			return nil, nil, fmt.Errorf("URL (from Command field) is empty for StreamableHTTP service %s (ID: %d)", serviceConfigForInstance.Name, serviceConfigForInstance.ID)
 		}
-		var headers map[string]string
-		if serviceConfigForInstance.HeadersJSON != "" && serviceConfigForInstance.HeadersJSON != "{}" {
-			if errJson := json.Unmarshal([]byte(serviceConfigForInstance.HeadersJSON), &headers); errJson != nil {
-				common.SysError(fmt.Sprintf("Failed to unmarshal HeadersJSON for StreamableHTTP service %s (ID: %d): %v. Proceeding without custom headers.", serviceConfigForInstance.Name, serviceConfigForInstance.ID, errJson))
-			}
-		}
-		common.SysLog(fmt.Sprintf("StreamableHTTP config for %s: URL=%s, Headers (raw)=%v", serviceConfigForInstance.Name, url, headers))
-		if len(headers) > 0 {
-			// TODO: Correctly apply HTTP headers.
-			// tdd.md and mcp-go patterns suggest `transport.WithHTTPHeaders(headers)`,
-			// which would require importing "github.com/mark3labs/mcp-go/client/transport".
-			// Due to current tool limitations on adding imports, this is omitted.
-			// mcpclient.WithHeaders is likely not the correct option for HTTP stream transport headers.
-			common.SysLog(fmt.Sprintf("WARNING: Custom headers for StreamableHTTP service %s are NOT being applied due to missing transport.WithHTTPHeaders option.", serviceConfigForInstance.Name))
-			// Call without header options as the correct option builder is unavailable without new imports.
-			mcpGoClient, err = mcpclient.NewStreamableHttpClient(url)
-		} else {
-			mcpGoClient, err = mcpclient.NewStreamableHttpClient(url)
+		headers := remoteHeaders(serviceConfigForInstance)
+		common.SysLog(fmt.Sprintf("StreamableHTTP config for %s: URL=%s, Headers=%v", serviceConfigForInstance.Name, url, headerNames(headers)))
+		oauth, oauthErr := upstreamOAuthConfig(ctx, serviceConfigForInstance)
+		if oauthErr != nil {
+			return nil, nil, oauthErr
 		}
+		mcpGoClient, err = newStreamableHTTPClient(url, headers, oauth, relay)
 		needManualStart = true
 
 	default:
@@ -681,24 +830,35 @@ func createActualMcpGoServerAndClientUncached(
 		return nil, nil, errors.New(errMsg)
 	}
 
+	// The instance outlives ctx, which only bounds starting and initializing it: remote streams
+	// and pings run until the instance is closed, not until a reload or a request ends
+	lifetime, stop := context.WithCancel(context.WithoutCancel(ctx))
+
 	// Call client.Start() if needed
 	if needManualStart {
 
 		var startErr error
 		switch cl := mcpGoClient.(type) {
 		case interface{ Start(context.Context) error }:
-			startErr = cl.Start(ctx)
+			started := make(chan error, 1)
+			go func() { started <- cl.Start(lifetime) }()
+			select {
+			case startErr = <-started:
+			case <-ctx.Done():
+				startErr = ctx.Err()
+			}
 		default:
 			startErr = fmt.Errorf("client type %T does not have a Start method, but needManualStart was true", mcpGoClient)
 		}
 
 		if startErr != nil {
-			errMsg := fmt.Sprintf("Failed to start mcp-go client for %s (%s): %v", serviceConfigForInstance.Name, instanceNameDetail, startErr)
-			common.SysError(errMsg)
+			startErr = fmt.Errorf("Failed to start mcp-go client for %s (%s): %w", serviceConfigForInstance.Name, instanceNameDetail, startErr)
+			common.SysError(startErr.Error())
+			stop()
 			if closeErr := mcpGoClient.Close(); closeErr != nil {
 				common.SysError(fmt.Sprintf("Failed to close mcp-go client for %s (%s) after Start() error: %v", serviceConfigForInstance.Name, instanceNameDetail, closeErr))
 			}
-			return nil, nil, errors.New(errMsg)
+			return nil, nil, startErr
 		}
 
 		// Start ping task for SSE and HTTP clients
@@ -708,11 +868,11 @@ func createActualMcpGoServerAndClientUncached(
 		PingLoop:
 			for {
 				select {
-				case <-ctx.Done():
+				case <-lifetime.Done():
 					common.SysLog(fmt.Sprintf("Context done, stopping ping for %s", serviceConfigForInstance.Name))
 					break PingLoop
 				case <-ticker.C:
-					if err := mcpGoClient.Ping(ctx); err != nil {
+					if err := mcpGoClient.Ping(lifetime); err != nil {
 						common.SysError(fmt.Sprintf("Ping failed for %s: %v", serviceConfigForInstance.Name, err))
 					}
 				}
@@ -720,11 +880,24 @@ func createActualMcpGoServerAndClientUncached(
 		}()
 	}
 
+	relay.client = mcpGoClient
+	hooks := &mcpserver.Hooks{}
+	addCapabilityListHooks(hooks, guard)
+	relay.addHooks(hooks)
 	mcpGoServer := mcpserver.NewMCPServer(
 		serviceConfigForInstance.Name,
 		serviceConfigForInstance.InstalledVersion,
+		mcpserver.WithToolCapabilities(true),
+		mcpserver.WithPromptCapabilities(true),
 		mcpserver.WithResourceCapabilities(true, true),
+		mcpserver.WithLogging(),
+		mcpserver.WithCompletions(),
+		mcpserver.WithPromptCompletionProvider(relay),
+		mcpserver.WithResourceCompletionProvider(relay),
+		withCapabilityToolFilter(guard),
+		mcpserver.WithHooks(hooks),
 	)
+	relay.attach(mcpGoServer)
 
 	clientInfo := mcp.Implementation{
 		Name:    fmt.Sprintf("toWers-proxy-for-%s-%s", serviceConfigForInstance.Name, instanceNameDetail),
@@ -735,32 +908,50 @@ func createActualMcpGoServerAndClientUncached(
 	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
 	initRequest.Params.ClientInfo = clientInfo
 
-	_, err = mcpGoClient.Initialize(ctx, initRequest)
+	initResult, err := mcpGoClient.Initialize(ctx, initRequest)
 	if err != nil {
+		stop()
 		closeErr := mcpGoClient.Close()
 		if closeErr != nil {
 			common.SysError(fmt.Sprintf("Failed to close mcp-go client for %s (%s) after initialization error: %v", serviceConfigForInstance.Name, instanceNameDetail, closeErr))
 		}
-		errMsg := fmt.Sprintf("Failed to initialize mcp-go client for %s (%s): %v", serviceConfigForInstance.Name, instanceNameDetail, err)
-		common.SysError(errMsg)
-		return nil, nil, errors.New(errMsg)
+		initErr := fmt.Errorf("Failed to initialize mcp-go client for %s (%s): %w", serviceConfigForInstance.Name, instanceNameDetail, err)
+		if stderrLog != nil {
+			initErr = fmt.Errorf("%w%s", initErr, stderrExcerpt(stderrLog))
+		}
+		common.SysError(initErr.Error())
+		return nil, nil, initErr
 	}
 
-	// Populate server with resources from client
-	if err := addClientToolsToMCPServer(ctx, mcpGoClient, mcpGoServer, serviceConfigForInstance.Name); err != nil {
-		common.SysError(fmt.Sprintf("Failed to add tools for %s (%s): %v", serviceConfigForInstance.Name, instanceNameDetail, err))
-	}
-	if err := addClientPromptsToMCPServer(ctx, mcpGoClient, mcpGoServer, serviceConfigForInstance.Name); err != nil {
-		common.SysError(fmt.Sprintf("Failed to add prompts for %s (%s): %v", serviceConfigForInstance.Name, instanceNameDetail, err))
+	// Forward progress and log notifications, and route tool calls through the relay so they can be cancelled
+	relay.setUpstreamCapabilities(initResult.Capabilities)
+	mcpGoClient.OnNotification(relay.handleNotification)
+
+	// Populate server with resources from client, and re-sync whenever the upstream reports a list change
+	// Callers of the returned client (e.g. virtual servers) go through the relay as well
+	relayed := relayedClient{MCPClient: mcpGoClient, relay: relay, stop: stop}
+	mirror := newUpstreamMirror(relayed, mcpGoServer, serviceConfigForInstance.Name, guard, serviceToolOverrides(serviceConfigForInstance))
+	mcpGoClient.OnNotification(mirror.handleNotification)
+	mirror.populate(ctx, instanceNameDetail)
+
+	return mcpGoServer, relayed, nil
+}
+
+// newStreamableHTTPClient creates a streamable HTTP client that relays server requests through relay.
+// A GET stream is kept open so server-initiated notifications such as list_changed reach us.
+func newStreamableHTTPClient(url string, headers map[string]string, oauth *transport.OAuthConfig, relay *notificationRelay) (*mcpclient.Client, error) {
+	options := []transport.StreamableHTTPCOption{transport.WithContinuousListening()}
+	if len(headers) > 0 {
+		options = append(options, transport.WithHTTPHeaders(headers))
 	}
-	if err := addClientResourcesToMCPServer(ctx, mcpGoClient, mcpGoServer, serviceConfigForInstance.Name); err != nil {
-		common.SysError(fmt.Sprintf("Failed to add resources for %s (%s): %v", serviceConfigForInstance.Name, instanceNameDetail, err))
+	if oauth != nil {
+		options = append(options, transport.WithHTTPOAuth(*oauth))
 	}
-	if err := addClientResourceTemplatesToMCPServer(ctx, mcpGoClient, mcpGoServer, serviceConfigForInstance.Name); err != nil {
-		common.SysError(fmt.Sprintf("Failed to add resource templates for %s (%s): %v", serviceConfigForInstance.Name, instanceNameDetail, err))
+	httpTransport, err := transport.NewStreamableHTTP(url, options...)
+	if err != nil {
+		return nil, err
 	}
-
-	return mcpGoServer, mcpGoClient, nil
+	return mcpclient.NewClient(httpTransport, relay.clientOptions(anyWorker)...), nil
 }
 
 // createSSEHttpHandler creates an SSE http.Handler from an mcpserver.MCPServer.
@@ -771,11 +962,23 @@ func createSSEHttpHandler(
 	if mcpGoServer == nil {
 		return nil, errors.New("mcpGoServer cannot be nil for createSSEHttpHandler")
 	}
-	oneMCPExternalBaseURL := common.OptionMap["ServerAddress"]
 	// The SSE base URL for user-specific instances might need reconsideration for proxying if the URL needs to be unique.
 	// For now, it uses the service name. The distinction happens by routing to this specific handler instance.
+	handler, err := createSSEHttpHandlerWithBasePath(mcpGoServer, mcpDBService.Name)
+	if err != nil {
+		return nil, err
+	}
+	return withSubscriptionPassthrough(handler), nil
+}
+
+// createSSEHttpHandlerWithBasePath creates an SSE http.Handler served under /proxy/<basePath>.
+func createSSEHttpHandlerWithBasePath(mcpGoServer *mcpserver.MCPServer, basePath string) (http.Handler, error) {
+	if mcpGoServer == nil {
+		return nil, errors.New("mcpGoServer cannot be nil for createSSEHttpHandlerWithBasePath")
+	}
+	oneMCPExternalBaseURL := common.OptionMap["ServerAddress"]
 	actualMCPGoSSEServer := mcpserver.NewSSEServer(mcpGoServer,
-		mcpserver.WithStaticBasePath(mcpDBService.Name),       // TODO: This might need to be more dynamic based on routing
+		mcpserver.WithStaticBasePath(basePath),                // TODO: This might need to be more dynamic based on routing
 		mcpserver.WithBaseURL(oneMCPExternalBaseURL+"/proxy"), // Path for client to connect back
 	)
 	return actualMCPGoSSEServer, nil
@@ -793,7 +996,7 @@ func createHTTPProxyHttpHandler(mcpGoServer *mcpserver.MCPServer, mcpDBService *
 	)
 
 	common.SysLog(fmt.Sprintf("Successfully created HTTP/MCP handler for %s (ID: %d)", mcpDBService.Name, mcpDBService.ID))
-	return actualMCPGoHTTPServer, nil
+	return withSubscriptionPassthrough(actualMCPGoHTTPServer), nil
 }
 
 // GetCachedHandler safely retrieves a handler from the cache.
@@ -844,13 +1047,19 @@ func ServiceFactory(mcpDBService *model.MCPService) (Service, error) {
 
 // --- Helper functions to add resources to mcp-go server (adapted from user's example) ---
 
-func addClientToolsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string) error {
+// addClientToolsToMCPServer mirrors the upstream tools into mcpGoServer, rewritten by the admin's overrides.
+// Renamed tools are recorded in guard.aliases and called upstream under their original name.
+// It returns the exposed names of the registered tools.
+func addClientToolsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string, guard capabilityGuard, overrides map[string]model.ToolOverride) ([]string, error) {
 	toolsRequest := mcp.ListToolsRequest{}
+	exposedNames := make(map[string]bool)
+	var serverTools []mcpserver.ServerTool
+	var registered []string
 	for {
 		tools, err := mcpGoClient.ListTools(ctx, toolsRequest)
 		if err != nil {
 			common.SysError(fmt.Sprintf("ListTools failed for %s: %v", mcpServerName, err))
-			return err
+			return nil, err
 		}
 		if tools == nil {
 			common.SysLog(fmt.Sprintf("ListTools returned nil tools for %s. No tools to add.", mcpServerName))
@@ -858,24 +1067,52 @@ func addClientToolsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPCli
 		}
 		common.SysLog(fmt.Sprintf("Listed %d tools for %s", len(tools.Tools), mcpServerName))
 		for _, tool := range tools.Tools {
-			common.SysLog(fmt.Sprintf("Adding tool %s to %s", tool.Name, mcpServerName))
-			mcpGoServer.AddTool(tool, mcpGoClient.CallTool)
+			upstreamName := tool.Name
+			exposed := tool
+			if override, ok := overrides[upstreamName]; ok {
+				exposed = applyToolOverride(tool, override)
+			}
+			if exposedNames[exposed.Name] {
+				common.SysLog(fmt.Sprintf("WARN: Skipping tool %s for %s: exposed name %s is already taken", upstreamName, mcpServerName, exposed.Name))
+				continue
+			}
+			exposedNames[exposed.Name] = true
+			if exposed.Name != upstreamName && guard.aliases != nil {
+				guard.aliases.set(exposed.Name, upstreamName)
+			}
+			common.SysLog(fmt.Sprintf("Adding tool %s to %s", exposed.Name, mcpServerName))
+			serverTools = append(serverTools, mcpserver.ServerTool{Tool: exposed, Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+				// Re-check at call time: the filter may have changed since registration, and access depends on the caller
+				if !guard.allowsTool(ctx, upstreamName) || !readOnlyAllows(ctx, exposed) {
+					return nil, fmt.Errorf("tool %s is not allowed on %s", request.Params.Name, mcpServerName)
+				}
+				request.Params.Name = upstreamName
+				return mcpGoClient.CallTool(ctx, request)
+			}})
+			registered = append(registered, exposed.Name)
 		}
 		if tools.NextCursor == "" {
 			break
 		}
 		toolsRequest.PaginatedRequest.Params.Cursor = tools.NextCursor
 	}
-	return nil
+	// Register in one batch so connected sessions get a single list_changed notification
+	if len(serverTools) > 0 {
+		mcpGoServer.AddTools(serverTools...)
+	}
+	return registered, nil
 }
 
-func addClientPromptsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string) error {
+// addClientPromptsToMCPServer mirrors the upstream prompts into mcpGoServer and returns the registered names.
+func addClientPromptsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string, guard capabilityGuard) ([]string, error) {
 	promptsRequest := mcp.ListPromptsRequest{}
+	var serverPrompts []mcpserver.ServerPrompt
+	var registered []string
 	for {
 		prompts, err := mcpGoClient.ListPrompts(ctx, promptsRequest)
 		if err != nil {
 			common.SysError(fmt.Sprintf("ListPrompts failed for %s: %v", mcpServerName, err))
-			return err
+			return nil, err
 		}
 		if prompts == nil {
 			common.SysLog(fmt.Sprintf("ListPrompts returned nil prompts for %s. No prompts to add.", mcpServerName))
@@ -884,14 +1121,23 @@ func addClientPromptsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPC
 		common.SysLog(fmt.Sprintf("Listed %d prompts for %s", len(prompts.Prompts), mcpServerName))
 		for _, prompt := range prompts.Prompts {
 			common.SysLog(fmt.Sprintf("Adding prompt %s to %s", prompt.Name, mcpServerName))
-			mcpGoServer.AddPrompt(prompt, mcpGoClient.GetPrompt)
+			serverPrompts = append(serverPrompts, mcpserver.ServerPrompt{Prompt: prompt, Handler: func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+				if !guard.allowsPrompt(ctx, request.Params.Name) {
+					return nil, fmt.Errorf("prompt %s is not allowed on %s", request.Params.Name, mcpServerName)
+				}
+				return mcpGoClient.GetPrompt(ctx, request)
+			}})
+			registered = append(registered, prompt.Name)
 		}
 		if prompts.NextCursor == "" {
 			break
 		}
 		promptsRequest.PaginatedRequest.Params.Cursor = prompts.NextCursor
 	}
-	return nil
+	if len(serverPrompts) > 0 {
+		mcpGoServer.AddPrompts(serverPrompts...)
+	}
+	return registered, nil
 }
 
 // TODO: Implement addClientResourcesToMCPServer and addClientResourceTemplatesToMCPServer
@@ -906,13 +1152,16 @@ func addClientPromptsToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPC
 
 // --- New Helper Functions ---
 
-func addClientResourcesToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string) error {
+// addClientResourcesToMCPServer mirrors the upstream resources into mcpGoServer and returns the registered URIs.
+func addClientResourcesToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string, guard capabilityGuard) ([]string, error) {
 	resourcesRequest := mcp.ListResourcesRequest{}
+	var serverResources []mcpserver.ServerResource
+	var registered []string
 	for {
 		resources, err := mcpGoClient.ListResources(ctx, resourcesRequest)
 		if err != nil {
 			common.SysError(fmt.Sprintf("ListResources failed for %s: %v", mcpServerName, err))
-			return err
+			return nil, err
 		}
 		if resources == nil {
 			common.SysLog(fmt.Sprintf("ListResources returned nil resources for %s. No resources to add.", mcpServerName))
@@ -923,29 +1172,39 @@ func addClientResourcesToMCPServer(ctx context.Context, mcpGoClient mcpclient.MC
 			// Capture range variable for closure
 			resource := resource
 			common.SysLog(fmt.Sprintf("Adding resource %s to %s", resource.Name, mcpServerName))
-			mcpGoServer.AddResource(resource, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+			serverResources = append(serverResources, mcpserver.ServerResource{Resource: resource, Handler: func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+				if !guard.allowsResource(ctx, request.Params.URI) {
+					return nil, fmt.Errorf("resource %s is not allowed on %s", request.Params.URI, mcpServerName)
+				}
 				readResource, e := mcpGoClient.ReadResource(ctx, request)
 				if e != nil {
 					return nil, e
 				}
 				return readResource.Contents, nil
-			})
+			}})
+			registered = append(registered, resource.URI)
 		}
 		if resources.NextCursor == "" {
 			break
 		}
 		resourcesRequest.PaginatedRequest.Params.Cursor = resources.NextCursor
 	}
-	return nil
+	if len(serverResources) > 0 {
+		mcpGoServer.AddResources(serverResources...)
+	}
+	return registered, nil
 }
 
-func addClientResourceTemplatesToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string) error {
+// addClientResourceTemplatesToMCPServer mirrors the upstream resource templates into mcpGoServer
+// and returns the registered raw URI templates.
+func addClientResourceTemplatesToMCPServer(ctx context.Context, mcpGoClient mcpclient.MCPClient, mcpGoServer *mcpserver.MCPServer, mcpServerName string, guard capabilityGuard) ([]string, error) {
 	resourceTemplatesRequest := mcp.ListResourceTemplatesRequest{}
+	var registered []string
 	for {
 		resourceTemplates, err := mcpGoClient.ListResourceTemplates(ctx, resourceTemplatesRequest)
 		if err != nil {
 			common.SysError(fmt.Sprintf("ListResourceTemplates failed for %s: %v", mcpServerName, err))
-			return err
+			return nil, err
 		}
 		if resourceTemplates == nil {
 			common.SysLog(fmt.Sprintf("ListResourceTemplates returned nil templates for %s. No templates to add.", mcpServerName))
@@ -955,8 +1214,16 @@ func addClientResourceTemplatesToMCPServer(ctx context.Context, mcpGoClient mcpc
 		for _, resourceTemplate := range resourceTemplates.ResourceTemplates {
 			// Capture range variable for closure
 			resourceTemplate := resourceTemplate
+			if resourceTemplate.URITemplate == nil {
+				common.SysLog(fmt.Sprintf("WARN: Skipping resource template %s for %s: missing URI template", resourceTemplate.Name, mcpServerName))
+				continue
+			}
+			raw := resourceTemplate.URITemplate.Raw()
 			common.SysLog(fmt.Sprintf("Adding resource template %s to %s", resourceTemplate.Name, mcpServerName))
 			mcpGoServer.AddResourceTemplate(resourceTemplate, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+				if !guard.allowsTemplateRead(ctx, raw, request.Params.URI) {
+					return nil, fmt.Errorf("resource %s is not allowed on %s", request.Params.URI, mcpServerName)
+				}
 				// Note: The callback for AddResourceTemplate in mcp-go server might expect a specific request type
 				// or the ReadResourceRequest might be generic enough.
 				// Assuming ReadResourceRequest is appropriate as per user's example.
@@ -967,13 +1234,14 @@ func addClientResourceTemplatesToMCPServer(ctx context.Context, mcpGoClient mcpc
 				}
 				return readResource.Contents, nil
 			})
+			registered = append(registered, raw)
 		}
 		if resourceTemplates.NextCursor == "" {
 			break
 		}
 		resourceTemplatesRequest.PaginatedRequest.Params.Cursor = resourceTemplates.NextCursor
 	}
-	return nil
+	return registered, nil
 }
 
 // --- End Helper Functions ---
@@ -984,51 +1252,148 @@ var GetOrCreateSharedMcpInstanceWithKey GetOrCreateSharedMcpInstanceWithKeyFuncT
 
 type GetOrCreateSharedMcpInstanceWithKeyFuncType func(ctx context.Context, originalDbService *model.MCPService, cacheKey string, instanceNameDetail string, effectiveEnvsJSONForStdio string) (*SharedMcpInstance, error)
 
+// instanceStart is an instance being started under a cache key. Callers asking for the key wait for
+// it instead of starting another one, without holding sharedMCPServersMutex meanwhile, so a slow
+// upstream does not hold up the lookups of every other service.
+type instanceStart struct {
+	serviceID int64
+	done      chan struct{}
+	instance  *SharedMcpInstance
+	err       error
+}
+
+var instanceStarts = make(map[string]*instanceStart) // by cache key, guarded by sharedMCPServersMutex
+
+// instanceStartTimeout bounds starting an instance. A start does not end with the request or call
+// that triggered it, as other callers may be waiting for the instance too.
+const instanceStartTimeout = 2 * time.Minute
+
 // getOrCreateSharedMcpInstanceWithKeyInternal is the actual implementation.
 func getOrCreateSharedMcpInstanceWithKeyInternal(ctx context.Context, originalDbService *model.MCPService, cacheKey string, instanceNameDetail string, effectiveEnvsJSONForStdio string) (*SharedMcpInstance, error) {
 	sharedMCPServersMutex.Lock()
-	defer sharedMCPServersMutex.Unlock()
-
 	if inst, found := sharedMCPServers[cacheKey]; found && inst != nil {
+		inst.touch()
+		sharedMCPServersMutex.Unlock()
 		return inst, nil
 	}
 
+	start := instanceStarts[cacheKey]
+	if start == nil {
+		if err := checkCrashLoop(cacheKey); err != nil {
+			sharedMCPServersMutex.Unlock()
+			return nil, err
+		}
+		evicted, err := makeRoomLocked(originalDbService)
+		if err == nil {
+			start = &instanceStart{serviceID: originalDbService.ID, done: make(chan struct{})}
+			instanceStarts[cacheKey] = start
+			go start.run(context.WithoutCancel(ctx), originalDbService, cacheKey, instanceNameDetail, effectiveEnvsJSONForStdio)
+		}
+		sharedMCPServersMutex.Unlock()
+		for _, instance := range evicted {
+			instance.retire(fmt.Sprintf("evicted to make room for %s", cacheKey))
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sharedMCPServersMutex.Unlock()
+	}
+
+	select {
+	case <-start.done:
+		return start.instance, start.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run starts the instance and caches it
+func (start *instanceStart) run(ctx context.Context, svc *model.MCPService, cacheKey string, instanceNameDetail string, effectiveEnvsJSONForStdio string) {
+	ctx, cancel := context.WithTimeout(ctx, instanceStartTimeout)
+	defer cancel()
+	instance, err := startSharedInstance(ctx, svc, cacheKey, instanceNameDetail, effectiveEnvsJSONForStdio)
+
+	sharedMCPServersMutex.Lock()
+	delete(instanceStarts, cacheKey)
+	if err == nil {
+		sharedMCPServers[cacheKey] = instance
+	}
+	sharedMCPServersMutex.Unlock()
+	if err == nil {
+		common.SysLog(fmt.Sprintf("Created new SharedMcpInstance for %s", svc.Name))
+	}
+
+	start.instance, start.err = instance, err
+	close(start.done)
+}
+
+// startSharedInstance creates the server and client of an instance without caching it
+func startSharedInstance(ctx context.Context, originalDbService *model.MCPService, cacheKey string, instanceNameDetail string, effectiveEnvsJSONForStdio string) (*SharedMcpInstance, error) {
 	// Prepare service config for creation
 	serviceConfigForCreation := *originalDbService // Shallow copy
 
-	// Apply user-specific environment variables for Stdio services
-	if originalDbService.Type == model.ServiceTypeStdio && effectiveEnvsJSONForStdio != "" {
+	// Apply user-specific environment variables for Stdio services, and the values of header
+	// placeholders for remote services
+	if (originalDbService.Type == model.ServiceTypeStdio || originalDbService.HasUserHeaders()) && effectiveEnvsJSONForStdio != "" {
 		serviceConfigForCreation.DefaultEnvsJSON = effectiveEnvsJSONForStdio
 	}
 
+	// The stderr of stdio processes is kept under the cache key for as long as the instance lives
+	ctx = withInstanceKey(ctx, cacheKey)
+	var log *processLog
+	if originalDbService.Type == model.ServiceTypeStdio {
+		log = processLogFor(originalDbService.ID, cacheKey)
+		ctx = withProcessLog(ctx, log)
+	}
+
 	// Create the actual server and client
 	srv, cli, err := createActualMcpGoServerAndClientUncached(ctx, &serviceConfigForCreation, instanceNameDetail)
 	if err != nil {
+		if log != nil {
+			log.release()
+		}
 		return nil, fmt.Errorf("failed to create MCP server and client for %s: %w", originalDbService.Name, err)
 	}
 
 	// Create shared instance
-	instance := &SharedMcpInstance{
-		Server: srv,
-		Client: cli,
+	instance := newSharedMcpInstance(srv, cli, originalDbService, cacheKey)
+	instance.detail = instanceNameDetail
+	instance.envsJSON = effectiveEnvsJSONForStdio
+	instance.config = instanceConfig(originalDbService, effectiveEnvsJSONForStdio)
+	instance.processLog = log
+	if relayed, ok := cli.(relayedClient); ok {
+		relayed.relay.onProcessExit(instance.processExited)
+		if instance.userID != 0 {
+			relayed.relay.markPrivate()
+		}
 	}
+	return instance, nil
+}
 
-	// Store in cache
-	sharedMCPServers[cacheKey] = instance
-	common.SysLog(fmt.Sprintf("Created new SharedMcpInstance for %s", originalDbService.Name))
+// proxyHandlerKey returns the handler cache key of a proxy handler built on an instance. Handlers
+// are keyed by the instance they wrap, so a user's handler, which serves the user's environment,
+// is never handed to another user or to the global path.
+func proxyHandlerKey(sharedInst *SharedMcpInstance, proxyType string) string {
+	return fmt.Sprintf("%s-%s", sharedInst.cacheKey, proxyType)
+}
 
-	return instance, nil
+// servesInstance reports whether a cached handler was built on the instance. An instance that
+// replaces another under the same cache key gets handlers of its own.
+func servesInstance(handler http.Handler, sharedInst *SharedMcpInstance) bool {
+	tracked, ok := handler.(*trackedHandler)
+	return !ok || tracked.instance == sharedInst
 }
 
 // GetOrCreateProxyToSSEHandler creates or retrieves a cached SSE http.Handler using shared MCP instance
 func GetOrCreateProxyToSSEHandler(ctx context.Context, mcpDBService *model.MCPService, sharedInst *SharedMcpInstance) (http.Handler, error) {
-	handlerCacheKey := fmt.Sprintf("service-%d-sseproxy", mcpDBService.ID)
+	handlerCacheKey := proxyHandlerKey(sharedInst, "sseproxy")
 
 	sseWrappersMutex.Lock()
 	defer sseWrappersMutex.Unlock()
 
 	// Check cache first
-	if existingHandler, found := initializedSSEProxyWrappers[handlerCacheKey]; found {
+	if existingHandler, found := initializedSSEProxyWrappers[handlerCacheKey]; found && servesInstance(existingHandler, sharedInst) {
 		return existingHandler, nil
 	}
 
@@ -1039,6 +1404,7 @@ func GetOrCreateProxyToSSEHandler(ctx context.Context, mcpDBService *model.MCPSe
 	}
 
 	// Cache the handler
+	handler = sharedInst.trackHandler(handlerCacheKey, handler)
 	initializedSSEProxyWrappers[handlerCacheKey] = handler
 
 	return handler, nil
@@ -1046,13 +1412,13 @@ func GetOrCreateProxyToSSEHandler(ctx context.Context, mcpDBService *model.MCPSe
 
 // GetOrCreateProxyToHTTPHandler creates or retrieves a cached HTTP/MCP http.Handler using shared MCP instance
 func GetOrCreateProxyToHTTPHandler(ctx context.Context, mcpDBService *model.MCPService, sharedInst *SharedMcpInstance) (http.Handler, error) {
-	handlerCacheKey := fmt.Sprintf("service-%d-httpproxy", mcpDBService.ID)
+	handlerCacheKey := proxyHandlerKey(sharedInst, "httpproxy")
 
 	httpWrappersMutex.Lock()
 	defer httpWrappersMutex.Unlock()
 
 	// Check cache first
-	if existingHandler, found := initializedHTTPProxyWrappers[handlerCacheKey]; found {
+	if existingHandler, found := initializedHTTPProxyWrappers[handlerCacheKey]; found && servesInstance(existingHandler, sharedInst) {
 		return existingHandler, nil
 	}
 
@@ -1063,6 +1429,7 @@ func GetOrCreateProxyToHTTPHandler(ctx context.Context, mcpDBService *model.MCPS
 	}
 
 	// Cache the handler
+	handler = sharedInst.trackHandler(handlerCacheKey, handler)
 	initializedHTTPProxyWrappers[handlerCacheKey] = handler
 
 	return handler, nil
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/library/sandbox"
+	"toWers/backend/model"
+)
+
+// The supervisor lets admins see every live instance in sharedMCPServers, global and user-specific
+// alike, and restart or kill one of them. A killed instance starts again on its next request.
+
+// ErrInstanceNotFound is returned for a cache key that has no live instance
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// ProcessInfo describes a stdio process of an instance
+type ProcessInfo struct {
+	Worker   string `json:"worker,omitempty"` // worker of a pool, as in ProcessLogLine.Source
+	PID      int    `json:"pid"`
+	RSSBytes int64  `json:"rss_bytes"` // resident memory of the process and its children
+}
+
+// InstanceInfo describes a live SharedMcpInstance
+type InstanceInfo struct {
+	CacheKey      string            `json:"cache_key"`
+	Instance      string            `json:"instance"`
+	ServiceID     int64             `json:"service_id"`
+	ServiceName   string            `json:"service_name"`
+	UserID        int64             `json:"user_id,omitempty"` // 0 for the global instance
+	Transport     model.ServiceType `json:"transport"`
+	Processes     []ProcessInfo     `json:"processes,omitempty"`
+	RSSBytes      int64             `json:"rss_bytes"`
+	StartedAt     time.Time         `json:"started_at"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	LastUsedAt    time.Time         `json:"last_used_at"`
+	InFlight      int32             `json:"in_flight"`
+	Restarts      int               `json:"restarts"` // automatic restarts after its process exited
+}
+
+// processes returns the running stdio processes of the instance
+func (s *SharedMcpInstance) processes() []ProcessInfo {
+	relayed, ok := s.Client.(relayedClient)
+	if !ok || relayed.relay == nil {
+		return nil
+	}
+	var processes []ProcessInfo
+	for worker, pid := range relayed.relay.processIDs() {
+		if pid == 0 {
+			continue
+		}
+		rss, alive := sandbox.ProcessMemory(pid)
+		if !alive {
+			continue
+		}
+		process := ProcessInfo{PID: pid, RSSBytes: rss}
+		if worker != anyWorker {
+			process.Worker = fmt.Sprintf("worker-%d", worker)
+		}
+		processes = append(processes, process)
+	}
+	sort.Slice(processes, func(i, j int) bool { return processes[i].Worker < processes[j].Worker })
+	return processes
+}
+
+func (s *SharedMcpInstance) info(now time.Time) InstanceInfo {
+	info := InstanceInfo{
+		CacheKey:      s.cacheKey,
+		Instance:      s.detail,
+		ServiceID:     s.serviceID,
+		ServiceName:   s.serviceName,
+		UserID:        s.userID,
+		Transport:     s.serviceType,
+		Processes:     s.processes(),
+		StartedAt:     s.createdAt,
+		UptimeSeconds: int64(now.Sub(s.createdAt).Seconds()),
+		LastUsedAt:    time.Unix(0, s.lastUsed.Load()),
+		InFlight:      s.inFlight.Load(),
+	}
+	for _, process := range info.Processes {
+		info.RSSBytes += process.RSSBytes
+	}
+	if state := lookupRestartState(s.cacheKey); state != nil {
+		state.mu.Lock()
+		info.Restarts = state.restarts
+		state.mu.Unlock()
+	}
+	return info
+}
+
+// ListInstances describes every live instance, ordered by service and cache key
+func ListInstances() []InstanceInfo {
+	sharedMCPServersMutex.Lock()
+	instances := make([]*SharedMcpInstance, 0, len(sharedMCPServers))
+	for _, instance := range sharedMCPServers {
+		instances = append(instances, instance)
+	}
+	sharedMCPServersMutex.Unlock()
+
+	now := time.Now()
+	infos := make([]InstanceInfo, 0, len(instances))
+	for _, instance := range instances {
+		infos = append(infos, instance.info(now))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ServiceID != infos[j].ServiceID {
+			return infos[i].ServiceID < infos[j].ServiceID
+		}
+		return infos[i].CacheKey < infos[j].CacheKey
+	})
+	return infos
+}
+
+// InspectInstance describes the live instance with the given cache key
+func InspectInstance(cacheKey string) (InstanceInfo, error) {
+	instance := lookupSharedInstance(cacheKey)
+	if instance == nil {
+		return InstanceInfo{}, fmt.Errorf("%w: %s", ErrInstanceNotFound, cacheKey)
+	}
+	return instance.info(time.Now()), nil
+}
+
+// takeSharedInstance removes the instance with the given cache key from the cache
+func takeSharedInstance(cacheKey string) (*SharedMcpInstance, error) {
+	sharedMCPServersMutex.Lock()
+	defer sharedMCPServersMutex.Unlock()
+	instance := sharedMCPServers[cacheKey]
+	if instance == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, cacheKey)
+	}
+	removeSharedInstanceLocked(instance)
+	return instance, nil
+}
+
+// RestartInstance shuts down the instance with the given cache key and starts it again with the
+// current configuration of its service and the environment it was created with
+func RestartInstance(ctx context.Context, cacheKey string) (InstanceInfo, error) {
+	instance := lookupSharedInstance(cacheKey)
+	if instance == nil {
+		return InstanceInfo{}, fmt.Errorf("%w: %s", ErrInstanceNotFound, cacheKey)
+	}
+	svc, err := model.GetServiceByID(instance.serviceID)
+	if err != nil {
+		return InstanceInfo{}, fmt.Errorf("failed to load service %d of %s: %w", instance.serviceID, cacheKey, err)
+	}
+	if instance, err = takeSharedInstance(cacheKey); err != nil {
+		return InstanceInfo{}, err
+	}
+	instance.retire("restarted by an administrator")
+	resetCrashLoop(cacheKey)
+
+	restarted, err := GetOrCreateSharedMcpInstanceWithKey(ctx, svc, cacheKey, instance.detail, instance.envsJSON)
+	if err != nil {
+		return InstanceInfo{}, fmt.Errorf("failed to restart %s: %w", cacheKey, err)
+	}
+	return restarted.info(time.Now()), nil
+}
+
+// KillInstance kills the processes of the instance with the given cache key at once, rather than
+// waiting for them to exit, and drops the instance. Its next request starts a new one.
+func KillInstance(cacheKey string) error {
+	instance, err := takeSharedInstance(cacheKey)
+	if err != nil {
+		return err
+	}
+	for _, process := range instance.processes() {
+		if p, err := os.FindProcess(process.PID); err == nil {
+			if err := p.Kill(); err != nil {
+				common.SysError(fmt.Sprintf("[Instances] Failed to kill process %d of %s: %v", process.PID, cacheKey, err))
+			}
+		}
+	}
+	instance.retire("killed by an administrator")
+	return nil
+}
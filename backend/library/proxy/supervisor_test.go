@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// supervisedInstance returns an instance whose stdio process is a sleeping child of the test, its PID
+// and a channel receiving its exit error
+func supervisedInstance(t *testing.T, svc *model.MCPService, cacheKey string) (*SharedMcpInstance, int, <-chan error) {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	pid := cmd.Process.Pid
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+
+	client, err := mcpclient.NewInProcessClient(mcpserver.NewMCPServer(svc.Name, "1.0.0"))
+	require.NoError(t, err)
+	relay := newNotificationRelay(svc.Name, capabilityGuard{})
+	relay.trackProcess(anyWorker, pid)
+	instance := newSharedMcpInstance(nil, relayedClient{MCPClient: client, relay: relay}, svc, cacheKey)
+	return instance, pid, exited
+}
+
+func TestListInstances_IncludesUserInstances(t *testing.T) {
+	svc := &model.MCPService{Name: "supervised", Type: model.ServiceTypeStdio}
+	svc.ID = -9201
+	global, pid, _ := supervisedInstance(t, svc, "global-service--9201-shared")
+	user := idleInstance(svc, "user-7-service--9201-shared", time.Minute)
+	user.inFlight.Add(2)
+	withInstanceCache(t, global, user)
+
+	instances := ListInstances()
+	require.Len(t, instances, 2)
+	assert.Equal(t, "global-service--9201-shared", instances[0].CacheKey)
+	assert.Zero(t, instances[0].UserID)
+	assert.Equal(t, model.ServiceTypeStdio, instances[0].Transport)
+	require.Len(t, instances[0].Processes, 1)
+	assert.Equal(t, pid, instances[0].Processes[0].PID)
+
+	assert.Equal(t, "user-7-service--9201-shared", instances[1].CacheKey)
+	assert.Equal(t, int64(7), instances[1].UserID)
+	assert.Equal(t, int32(2), instances[1].InFlight)
+	assert.Empty(t, instances[1].Processes)
+	assert.WithinDuration(t, time.Now().Add(-time.Minute), instances[1].LastUsedAt, time.Second)
+
+	_, err := InspectInstance("user-8-service--9201-shared")
+	assert.True(t, errors.Is(err, ErrInstanceNotFound))
+}
+
+func TestKillInstance_KillsItsProcesses(t *testing.T) {
+	svc := &model.MCPService{Name: "killed", Type: model.ServiceTypeStdio}
+	svc.ID = -9202
+	instance, _, exited := supervisedInstance(t, svc, "user-3-service--9202-shared")
+	withInstanceCache(t, instance)
+
+	require.NoError(t, KillInstance("user-3-service--9202-shared"))
+	assert.Empty(t, cachedKeys())
+	assert.True(t, instance.isRetired())
+	select {
+	case err := <-exited:
+		assert.Error(t, err, "the process is killed rather than exiting")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process of the killed instance is still running")
+	}
+
+	assert.True(t, errors.Is(KillInstance("user-3-service--9202-shared"), ErrInstanceNotFound))
+}
+
+func TestRestartInstance_RecreatesWithSameEnvironment(t *testing.T) {
+	savedPath := common.SQLitePath
+	common.SQLitePath = ":memory:"
+	t.Cleanup(func() { common.SQLitePath = savedPath })
+	require.NoError(t, model.InitDB())
+	svc := &model.MCPService{Name: "restarted", Type: model.ServiceTypeStdio, Command: "echo"}
+	require.NoError(t, model.CreateService(svc))
+	defer model.DeleteService(svc.ID)
+
+	cacheKey := fmt.Sprintf("user-5-service-%d-shared", svc.ID)
+	old := newSharedMcpInstance(nil, nil, svc, cacheKey)
+	old.detail = fmt.Sprintf("user-5-shared-svc-%d", svc.ID)
+	old.envsJSON = `{"API_KEY":"user-5"}`
+	withInstanceCache(t, old)
+
+	saved := GetOrCreateSharedMcpInstanceWithKey
+	t.Cleanup(func() { GetOrCreateSharedMcpInstanceWithKey = saved })
+	var gotDetail, gotEnvs string
+	GetOrCreateSharedMcpInstanceWithKey = func(ctx context.Context, service *model.MCPService, key, detail, envs string) (*SharedMcpInstance, error) {
+		gotDetail, gotEnvs = detail, envs
+		instance := newSharedMcpInstance(nil, nil, service, key)
+		sharedMCPServersMutex.Lock()
+		sharedMCPServers[key] = instance
+		sharedMCPServersMutex.Unlock()
+		return instance, nil
+	}
+
+	info, err := RestartInstance(context.Background(), cacheKey)
+	require.NoError(t, err)
+	assert.True(t, old.isRetired())
+	assert.Equal(t, int64(5), info.UserID)
+	assert.Equal(t, old.detail, gotDetail)
+	assert.Equal(t, `{"API_KEY":"user-5"}`, gotEnvs, "a user's instance keeps the user's environment")
+	assert.NotSame(t, old, lookupSharedInstance(cacheKey))
+}
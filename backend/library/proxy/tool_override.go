@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// toolAliases maps exposed tool names back to upstream names for tools renamed by an override.
+type toolAliases struct {
+	mu       sync.RWMutex
+	upstream map[string]string
+}
+
+func newToolAliases() *toolAliases {
+	return &toolAliases{upstream: make(map[string]string)}
+}
+
+func (a *toolAliases) set(exposed, upstream string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.upstream[exposed] = upstream
+}
+
+// upstreamName returns the upstream name of an exposed tool; names that were not renamed map to themselves.
+func (a *toolAliases) upstreamName(exposed string) string {
+	if a == nil {
+		return exposed
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if upstream, ok := a.upstream[exposed]; ok {
+		return upstream
+	}
+	return exposed
+}
+
+// serviceToolOverrides returns the tool overrides of a service, logging and ignoring malformed configuration.
+func serviceToolOverrides(svc *model.MCPService) map[string]model.ToolOverride {
+	overrides, err := svc.GetToolOverrides()
+	if err != nil {
+		common.SysError(fmt.Sprintf("Invalid ToolOverridesJSON for service %s (ID: %d): %v. Tools are exposed unchanged.", svc.Name, svc.ID, err))
+		return map[string]model.ToolOverride{}
+	}
+	return overrides
+}
+
+// applyToolOverride returns a copy of tool rewritten by override. The input schema's property map is
+// copied before property descriptions are replaced, so the upstream definition is never mutated.
+func applyToolOverride(tool mcp.Tool, override model.ToolOverride) mcp.Tool {
+	if override.Name != "" {
+		tool.Name = override.Name
+	}
+	if override.Title != "" {
+		tool.Annotations.Title = override.Title
+	}
+	if override.Description != "" {
+		tool.Description = override.Description
+	}
+	if override.ReadOnlyHint != nil {
+		readOnly := *override.ReadOnlyHint
+		tool.Annotations.ReadOnlyHint = &readOnly
+	}
+	if override.DestructiveHint != nil {
+		destructive := *override.DestructiveHint
+		tool.Annotations.DestructiveHint = &destructive
+	}
+
+	if len(override.PropertyDescriptions) > 0 && tool.InputSchema.Properties != nil {
+		properties := make(map[string]any, len(tool.InputSchema.Properties))
+		for name, schema := range tool.InputSchema.Properties {
+			properties[name] = schema
+		}
+		for name, description := range override.PropertyDescriptions {
+			schema, ok := properties[name].(map[string]any)
+			if !ok {
+				continue
+			}
+			rewritten := make(map[string]any, len(schema)+1)
+			for k, v := range schema {
+				rewritten[k] = v
+			}
+			rewritten["description"] = description
+			properties[name] = rewritten
+		}
+		tool.InputSchema.Properties = properties
+	}
+	return tool
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"toWers/backend/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyToolOverride(t *testing.T) {
+	tool := mcp.NewTool("search_repositories",
+		mcp.WithDescription("A very long upstream description"),
+		mcp.WithString("query", mcp.Description("q")),
+	)
+	readOnly := true
+	override := model.ToolOverride{
+		Name:                 "search_repos",
+		Title:                "Search repositories",
+		Description:          "Search GitHub repositories",
+		PropertyDescriptions: map[string]string{"query": "GitHub search syntax"},
+		ReadOnlyHint:         &readOnly,
+	}
+
+	rewritten := applyToolOverride(tool, override)
+	assert.Equal(t, "search_repos", rewritten.Name)
+	assert.Equal(t, "Search repositories", rewritten.Annotations.Title)
+	assert.Equal(t, "Search GitHub repositories", rewritten.Description)
+	require.NotNil(t, rewritten.Annotations.ReadOnlyHint)
+	assert.True(t, *rewritten.Annotations.ReadOnlyHint)
+	assert.Equal(t, "GitHub search syntax", rewritten.InputSchema.Properties["query"].(map[string]any)["description"])
+
+	// The upstream definition is left untouched
+	assert.Equal(t, "q", tool.InputSchema.Properties["query"].(map[string]any)["description"])
+}
+
+func TestAddClientToolsToMCPServer_RenamedToolCallsUpstreamName(t *testing.T) {
+	ctx := context.Background()
+	upstream := newInProcessUpstream(t, "delete_repository", "create_issue")
+
+	filter := model.CapabilityFilter{Tools: model.FilterRule{Deny: []string{"delete_repository"}}}
+	guard := capabilityGuard{filter: func() model.CapabilityFilter { return filter }, aliases: newToolAliases()}
+	server := mcpserver.NewMCPServer("overridden", "1.0.0", withCapabilityToolFilter(guard))
+	overrides := map[string]model.ToolOverride{"create_issue": {Name: "open_ticket"}}
+	_, err := addClientToolsToMCPServer(ctx, upstream, server, "overridden", guard, overrides)
+	require.NoError(t, err)
+
+	downstream := newInProcessDownstream(t, server)
+	tools, err := downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	require.Len(t, tools.Tools, 1)
+	assert.Equal(t, "open_ticket", tools.Tools[0].Name)
+
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "open_ticket"
+	result, err := downstream.CallTool(ctx, callRequest)
+	require.NoError(t, err)
+	assert.Equal(t, "create_issue", result.Content[0].(mcp.TextContent).Text)
+
+	// Filters keep referring to upstream names after a rename
+	filter = model.CapabilityFilter{Tools: model.FilterRule{Deny: []string{"create_issue", "delete_repository"}}}
+	tools, err = downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, tools.Tools)
+}
@@ -0,0 +1,699 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+)
+
+// VirtualNameSeparator joins a member prefix and an upstream tool/prompt name, e.g. github__create_issue
+const VirtualNameSeparator = "__"
+
+// virtualMemberRetryInterval is how long a virtual server waits before composing again the members
+// it skipped or could not reach
+var virtualMemberRetryInterval = 30 * time.Second
+
+var (
+	virtualMCPServers      = make(map[int64]*virtualServer)
+	virtualMCPServersMutex = &sync.Mutex{}
+)
+
+// virtualOrigin records which member service and upstream name an exposed tool, prompt or resource comes from
+type virtualOrigin struct {
+	guard    capabilityGuard
+	upstream string
+	client   memberClientFunc
+	template *mcp.URITemplate // set for resource templates
+}
+
+// memberClientFunc resolves the upstream client of a virtual server member at call time,
+// so that calls follow the member's shared instance when it is re-created by health checks.
+type memberClientFunc func(ctx context.Context) (mcpclient.MCPClient, error)
+
+// MemberCallTracker checks the caller's request limits on a member service of a virtual server
+// before a tool call is forwarded to it, and returns a function recording the call once it is done.
+type MemberCallTracker func(serviceID int64) (done func(err error), err error)
+
+type memberCallTrackerKey struct{}
+
+// WithMemberCallTracker attaches the caller's tracker to a request context. Virtual servers consult
+// it for each tool call they forward, so the call counts against its member service as a direct one.
+func WithMemberCallTracker(ctx context.Context, tracker MemberCallTracker) context.Context {
+	return context.WithValue(ctx, memberCallTrackerKey{}, tracker)
+}
+
+// trackMemberCall checks and starts recording a tool call of the caller in ctx to a member service.
+// Requests without a tracker (internal calls) are neither limited nor recorded.
+func trackMemberCall(ctx context.Context, serviceID int64) (func(err error), error) {
+	tracker, ok := ctx.Value(memberCallTrackerKey{}).(MemberCallTracker)
+	if !ok || tracker == nil {
+		return func(error) {}, nil
+	}
+	return tracker(serviceID)
+}
+
+// virtualServer is the composition of the members of a virtual server. It is composed again in place,
+// keeping the sessions connected to it, when a member service changes or reports a list change, and
+// while some of its members are skipped or unreachable.
+type virtualServer struct {
+	vs       *model.VirtualServer
+	members  []model.VirtualServerMember
+	server   *mcpserver.MCPServer
+	instance *SharedMcpInstance
+	retired  *nameSet // resource templates no longer composed, which mcp-go cannot unregister
+
+	composeMu sync.Mutex // serializes compositions
+
+	mu            sync.RWMutex
+	registered    map[string]virtualOrigin // exposed names to their origin, e.g. "tool:github__create_issue"
+	memberIDs     map[int64]bool
+	incomplete    bool // some members were skipped or unreachable at the last composition
+	composedAt    time.Time
+	recomposing   bool
+	subscriptions map[string]map[string]*notificationRelay // by session ID, subscribed URIs to the member relay
+}
+
+// VirtualName returns the namespaced name under which an upstream tool or prompt is exposed.
+func VirtualName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + VirtualNameSeparator + name
+}
+
+// GetOrCreateVirtualServerInstance composes the members of a virtual server into a single MCPServer.
+// Member services are reached through their global shared instances.
+func GetOrCreateVirtualServerInstance(ctx context.Context, vs *model.VirtualServer) (*SharedMcpInstance, error) {
+	virtualMCPServersMutex.Lock()
+	defer virtualMCPServersMutex.Unlock()
+
+	if v, found := virtualMCPServers[vs.ID]; found {
+		v.retryIncomplete()
+		return v.instance, nil
+	}
+
+	members, err := vs.GetMembers()
+	if err != nil {
+		return nil, fmt.Errorf("invalid members for virtual server %s: %w", vs.Name, err)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("virtual server %s has no members", vs.Name)
+	}
+
+	v := &virtualServer{
+		vs:            vs,
+		members:       members,
+		retired:       newNameSet(),
+		registered:    make(map[string]virtualOrigin),
+		subscriptions: make(map[string]map[string]*notificationRelay),
+	}
+	hooks := &mcpserver.Hooks{}
+	v.addHooks(hooks)
+	v.server = mcpserver.NewMCPServer(
+		vs.Name,
+		common.Version,
+		mcpserver.WithResourceCapabilities(true, true),
+		withVirtualToolFilter(v.origin),
+		mcpserver.WithHooks(hooks),
+	)
+	v.instance = &SharedMcpInstance{Server: v.server}
+	// Member instances outlive the request that composes the virtual server first
+	composeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), upstreamRefreshTimeout)
+	defer cancel()
+	v.compose(composeCtx)
+
+	virtualMCPServers[vs.ID] = v
+	common.SysLog(fmt.Sprintf("Created virtual server instance for %s with %d members", vs.Name, len(members)))
+	return v.instance, nil
+}
+
+// origin returns the origin of an exposed capability, keyed by kind and name
+func (v *virtualServer) origin(key string) (virtualOrigin, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	origin, ok := v.registered[key]
+	return origin, ok
+}
+
+// compose lists the capabilities of every member into the server, then removes those no member
+// lists anymore. AddTool, DeleteTools and the like notify connected sessions with list_changed.
+func (v *virtualServer) compose(ctx context.Context) {
+	v.composeMu.Lock()
+	defer v.composeMu.Unlock()
+
+	registered := make(map[string]virtualOrigin)
+	memberIDs := make(map[int64]bool, len(v.members))
+	incomplete := false
+	for _, member := range v.members {
+		memberIDs[member.ServiceID] = true
+		svc, err := model.GetServiceByID(member.ServiceID)
+		if err != nil || svc == nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] %s: member service %d not found, skipping: %v", v.vs.Name, member.ServiceID, err))
+			incomplete = true
+			continue
+		}
+		if !svc.Enabled {
+			common.SysLog(fmt.Sprintf("[VirtualServer] %s: member service %s is disabled, skipping", v.vs.Name, svc.Name))
+			incomplete = true
+			continue
+		}
+
+		cacheKey := fmt.Sprintf("global-service-%d-shared", svc.ID)
+		instanceNameDetail := fmt.Sprintf("global-shared-svc-%d", svc.ID)
+		memberSvc := svc
+		clientFn := func(ctx context.Context) (mcpclient.MCPClient, error) {
+			// The member instance is shared and outlives the call that starts it
+			inst, err := GetOrCreateSharedMcpInstanceWithKey(context.WithoutCancel(ctx), memberSvc, cacheKey, instanceNameDetail, memberSvc.DefaultEnvsJSON)
+			if err != nil {
+				return nil, err
+			}
+			if inst.Client == nil {
+				return nil, fmt.Errorf("shared instance for %s has no client", memberSvc.Name)
+			}
+			return inst.Client, nil
+		}
+
+		client, err := clientFn(ctx)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] %s: failed to get instance for member %s: %v", v.vs.Name, svc.Name, err))
+			incomplete = true
+			continue
+		}
+
+		prefix := member.Prefix
+		if prefix == "" {
+			prefix = svc.Name
+		}
+		guard := capabilityGuard{serviceID: svc.ID, filter: liveCapabilityFilter(svc), retired: v.retired}
+		composeVirtualMember(ctx, v.server, client, clientFn, guard, serviceToolOverrides(svc), member, prefix, registered)
+	}
+	for key := range registered {
+		if raw, ok := strings.CutPrefix(key, "template:"); ok {
+			v.retired.set(raw, false)
+		}
+	}
+
+	v.mu.Lock()
+	previous := v.registered
+	v.registered = registered
+	v.memberIDs = memberIDs
+	v.incomplete = incomplete
+	v.composedAt = time.Now()
+	v.mu.Unlock()
+
+	var staleTools, stalePrompts []string
+	for key := range previous {
+		if _, ok := registered[key]; ok {
+			continue
+		}
+		kind, name, _ := strings.Cut(key, ":")
+		switch kind {
+		case "tool":
+			staleTools = append(staleTools, name)
+		case "prompt":
+			stalePrompts = append(stalePrompts, name)
+		case "resource":
+			v.server.RemoveResource(name)
+		case "template":
+			v.retired.set(name, true)
+		}
+	}
+	if len(staleTools) > 0 {
+		v.server.DeleteTools(staleTools...)
+	}
+	if len(stalePrompts) > 0 {
+		v.server.DeletePrompts(stalePrompts...)
+	}
+}
+
+// recompose composes the virtual server again in the background
+func (v *virtualServer) recompose(reason string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamRefreshTimeout)
+		defer cancel()
+		common.SysLog(fmt.Sprintf("[VirtualServer] %s: composing again, %s", v.vs.Name, reason))
+		v.compose(ctx)
+		v.mu.Lock()
+		v.recomposing = false
+		v.mu.Unlock()
+	}()
+}
+
+// retryIncomplete composes the virtual server again when some members were skipped or unreachable,
+// at most once per virtualMemberRetryInterval
+func (v *virtualServer) retryIncomplete() {
+	v.mu.Lock()
+	due := v.incomplete && !v.recomposing && time.Since(v.composedAt) >= virtualMemberRetryInterval
+	if due {
+		v.recomposing = true
+	}
+	v.mu.Unlock()
+	if due {
+		v.recompose("retrying skipped or unreachable members")
+	}
+}
+
+// refreshVirtualServersWithMember is RefreshVirtualServersWithMember for upstream mirrors. It is set in
+// init, as referring to it directly would make GetOrCreateSharedMcpInstanceWithKey depend on itself.
+var refreshVirtualServersWithMember func(serviceID int64)
+
+func init() {
+	refreshVirtualServersWithMember = RefreshVirtualServersWithMember
+}
+
+// RefreshVirtualServersWithMember composes again, in the background, the virtual servers that
+// have the service as a member, after it was changed, toggled, deleted or reported a list change.
+func RefreshVirtualServersWithMember(serviceID int64) {
+	virtualMCPServersMutex.Lock()
+	var affected []*virtualServer
+	for _, v := range virtualMCPServers {
+		v.mu.RLock()
+		if v.memberIDs[serviceID] {
+			affected = append(affected, v)
+		}
+		v.mu.RUnlock()
+	}
+	virtualMCPServersMutex.Unlock()
+
+	for _, v := range affected {
+		v.mu.Lock()
+		v.recomposing = true
+		v.mu.Unlock()
+		v.recompose(fmt.Sprintf("member service %d changed", serviceID))
+	}
+}
+
+// composeVirtualMember mirrors the tools, prompts, resources and resource templates of one member
+// into the composed server. Tool overrides of the member service are applied before namespacing.
+// Everything the inclusion lists admit is registered; the member service's capability filter and the
+// caller's access apply at list and call time, so widening them exposes what they used to hide.
+// registered maps names already taken to their origin; collisions are skipped, not overwritten.
+func composeVirtualMember(
+	ctx context.Context,
+	mcpGoServer *mcpserver.MCPServer,
+	client mcpclient.MCPClient,
+	clientFn memberClientFunc,
+	guard capabilityGuard,
+	overrides map[string]model.ToolOverride,
+	member model.VirtualServerMember,
+	prefix string,
+	registered map[string]virtualOrigin,
+) {
+	toolsRequest := mcp.ListToolsRequest{}
+	for {
+		tools, err := client.ListTools(ctx, toolsRequest)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] ListTools failed for member %s: %v", prefix, err))
+			break
+		}
+		if tools == nil {
+			break
+		}
+		for _, tool := range tools.Tools {
+			if !includedInVirtualMember(member.IncludeTools, tool.Name) {
+				continue
+			}
+			upstreamName := tool.Name
+			exposed := tool
+			if override, ok := overrides[upstreamName]; ok {
+				exposed = applyToolOverride(tool, override)
+			}
+			exposed.Name = VirtualName(prefix, exposed.Name)
+			if _, taken := registered["tool:"+exposed.Name]; taken {
+				common.SysLog(fmt.Sprintf("WARN: [VirtualServer] tool name collision on %s, skipping", exposed.Name))
+				continue
+			}
+			registered["tool:"+exposed.Name] = virtualOrigin{guard: guard, upstream: upstreamName, client: clientFn}
+			mcpGoServer.AddTool(exposed, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+				if !guard.allowsTool(ctx, upstreamName) || !readOnlyAllows(ctx, exposed) {
+					return nil, fmt.Errorf("tool %s is not allowed", request.Params.Name)
+				}
+				done, err := trackMemberCall(ctx, guard.serviceID)
+				if err != nil {
+					return nil, err
+				}
+				upstream, err := clientFn(ctx)
+				if err != nil {
+					done(err)
+					return nil, err
+				}
+				request.Params.Name = upstreamName
+				result, err := upstream.CallTool(ctx, request)
+				done(err)
+				return result, err
+			})
+		}
+		if tools.NextCursor == "" {
+			break
+		}
+		toolsRequest.PaginatedRequest.Params.Cursor = tools.NextCursor
+	}
+
+	promptsRequest := mcp.ListPromptsRequest{}
+	for {
+		prompts, err := client.ListPrompts(ctx, promptsRequest)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] ListPrompts failed for member %s: %v", prefix, err))
+			break
+		}
+		if prompts == nil {
+			break
+		}
+		for _, prompt := range prompts.Prompts {
+			if !includedInVirtualMember(member.IncludePrompts, prompt.Name) {
+				continue
+			}
+			upstreamName := prompt.Name
+			exposed := prompt
+			exposed.Name = VirtualName(prefix, upstreamName)
+			if _, taken := registered["prompt:"+exposed.Name]; taken {
+				common.SysLog(fmt.Sprintf("WARN: [VirtualServer] prompt name collision on %s, skipping", exposed.Name))
+				continue
+			}
+			registered["prompt:"+exposed.Name] = virtualOrigin{guard: guard, upstream: upstreamName, client: clientFn}
+			mcpGoServer.AddPrompt(exposed, func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+				if !guard.allowsPrompt(ctx, upstreamName) {
+					return nil, fmt.Errorf("prompt %s is not allowed", request.Params.Name)
+				}
+				upstream, err := clientFn(ctx)
+				if err != nil {
+					return nil, err
+				}
+				request.Params.Name = upstreamName
+				return upstream.GetPrompt(ctx, request)
+			})
+		}
+		if prompts.NextCursor == "" {
+			break
+		}
+		promptsRequest.PaginatedRequest.Params.Cursor = prompts.NextCursor
+	}
+
+	readThrough := func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		upstream, err := clientFn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result, err := upstream.ReadResource(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return result.Contents, nil
+	}
+
+	resourcesRequest := mcp.ListResourcesRequest{}
+	for {
+		resources, err := client.ListResources(ctx, resourcesRequest)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] ListResources failed for member %s: %v", prefix, err))
+			break
+		}
+		if resources == nil {
+			break
+		}
+		for _, resource := range resources.Resources {
+			if !includedInVirtualMember(member.IncludeResources, resource.URI) {
+				continue
+			}
+			// Resource URIs are already globally meaningful, so they are not prefixed.
+			if _, taken := registered["resource:"+resource.URI]; taken {
+				common.SysLog(fmt.Sprintf("WARN: [VirtualServer] resource URI collision on %s, skipping", resource.URI))
+				continue
+			}
+			registered["resource:"+resource.URI] = virtualOrigin{guard: guard, upstream: resource.URI, client: clientFn}
+			uri := resource.URI
+			mcpGoServer.AddResource(resource, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+				if !guard.allowsResource(ctx, uri) {
+					return nil, fmt.Errorf("resource %s is not allowed", request.Params.URI)
+				}
+				return readThrough(ctx, request)
+			})
+		}
+		if resources.NextCursor == "" {
+			break
+		}
+		resourcesRequest.PaginatedRequest.Params.Cursor = resources.NextCursor
+	}
+
+	templatesRequest := mcp.ListResourceTemplatesRequest{}
+	for {
+		templates, err := client.ListResourceTemplates(ctx, templatesRequest)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] ListResourceTemplates failed for member %s: %v", prefix, err))
+			break
+		}
+		if templates == nil {
+			break
+		}
+		for _, template := range templates.ResourceTemplates {
+			raw := ""
+			if template.URITemplate != nil {
+				raw = template.URITemplate.Raw()
+			}
+			if !includedInVirtualMember(member.IncludeResources, raw) {
+				continue
+			}
+			if _, taken := registered["template:"+raw]; taken {
+				common.SysLog(fmt.Sprintf("WARN: [VirtualServer] resource template collision on %s, skipping", raw))
+				continue
+			}
+			registered["template:"+raw] = virtualOrigin{guard: guard, upstream: raw, client: clientFn, template: template.URITemplate}
+			templateRaw := raw
+			mcpGoServer.AddResourceTemplate(template, func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+				if !guard.allowsTemplateRead(ctx, templateRaw, request.Params.URI) {
+					return nil, fmt.Errorf("resource %s is not allowed", request.Params.URI)
+				}
+				return readThrough(ctx, request)
+			})
+		}
+		if templates.NextCursor == "" {
+			break
+		}
+		templatesRequest.PaginatedRequest.Params.Cursor = templates.NextCursor
+	}
+}
+
+// includedInVirtualMember reports whether name passes a member's inclusion list (empty list includes everything).
+func includedInVirtualMember(include []string, name string) bool {
+	if len(include) == 0 {
+		return true
+	}
+	for _, n := range include {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withVirtualToolFilter hides composed tools the caller may not use, judged by their member service.
+func withVirtualToolFilter(origin func(key string) (virtualOrigin, bool)) mcpserver.ServerOption {
+	return mcpserver.WithToolFilter(func(ctx context.Context, tools []mcp.Tool) []mcp.Tool {
+		allowed := make([]mcp.Tool, 0, len(tools))
+		for _, tool := range tools {
+			if origin, ok := origin("tool:" + tool.Name); ok && origin.guard.allowsTool(ctx, origin.upstream) && readOnlyAllows(ctx, tool) {
+				allowed = append(allowed, tool)
+			}
+		}
+		return allowed
+	})
+}
+
+// addHooks hides composed prompts, resources and resource templates the caller may not use, and
+// passes resource subscriptions through to the member exposing the resource.
+func (v *virtualServer) addHooks(hooks *mcpserver.Hooks) {
+	hooks.AddAfterListPrompts(func(ctx context.Context, id any, message *mcp.ListPromptsRequest, result *mcp.ListPromptsResult) {
+		allowed := make([]mcp.Prompt, 0, len(result.Prompts))
+		for _, prompt := range result.Prompts {
+			if origin, ok := v.origin("prompt:" + prompt.Name); ok && origin.guard.allowsPrompt(ctx, origin.upstream) {
+				allowed = append(allowed, prompt)
+			}
+		}
+		result.Prompts = allowed
+	})
+	hooks.AddAfterListResources(func(ctx context.Context, id any, message *mcp.ListResourcesRequest, result *mcp.ListResourcesResult) {
+		allowed := make([]mcp.Resource, 0, len(result.Resources))
+		for _, resource := range result.Resources {
+			if origin, ok := v.origin("resource:" + resource.URI); ok && origin.guard.allowsResource(ctx, origin.upstream) {
+				allowed = append(allowed, resource)
+			}
+		}
+		result.Resources = allowed
+	})
+	hooks.AddAfterListResourceTemplates(func(ctx context.Context, id any, message *mcp.ListResourceTemplatesRequest, result *mcp.ListResourceTemplatesResult) {
+		allowed := make([]mcp.ResourceTemplate, 0, len(result.ResourceTemplates))
+		for _, template := range result.ResourceTemplates {
+			if template.URITemplate == nil {
+				continue
+			}
+			if origin, ok := v.origin("template:" + template.URITemplate.Raw()); ok && origin.guard.allowsTemplate(ctx, origin.upstream) {
+				allowed = append(allowed, template)
+			}
+		}
+		result.ResourceTemplates = allowed
+	})
+	hooks.AddOnRequestInitialization(v.handleSubscription)
+	hooks.AddOnUnregisterSession(func(ctx context.Context, session mcpserver.ClientSession) {
+		v.dropSubscriptions(session.SessionID())
+	})
+}
+
+// resourceOrigin returns the origin of a resource URI, exposed as such or through a resource template
+func (v *virtualServer) resourceOrigin(uri string) (virtualOrigin, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if origin, ok := v.registered["resource:"+uri]; ok {
+		return origin, true
+	}
+	for _, origin := range v.registered {
+		if origin.template != nil && origin.template.Template != nil && origin.template.Regexp().MatchString(uri) {
+			return origin, true
+		}
+	}
+	return virtualOrigin{}, false
+}
+
+// handleSubscription performs a subscription request rewritten by withSubscriptionPassthrough
+// against the relay of the member exposing the resource, which delivers its updates to the session.
+func (v *virtualServer) handleSubscription(ctx context.Context, id any, message any) error {
+	request, ok := ctx.Value(subscriptionRequestKey{}).(subscriptionRequest)
+	if !ok {
+		return nil
+	}
+	session := mcpserver.ClientSessionFromContext(ctx)
+	if session == nil {
+		return fmt.Errorf("%s requires a session", request.method)
+	}
+	if request.uri == "" {
+		return fmt.Errorf("%s: uri is required", request.method)
+	}
+	sessionID := session.SessionID()
+	if request.method == methodResourcesUnsubscribe {
+		v.mu.Lock()
+		relay := v.subscriptions[sessionID][request.uri]
+		delete(v.subscriptions[sessionID], request.uri)
+		v.mu.Unlock()
+		if relay == nil {
+			return nil
+		}
+		return relay.unsubscribe(ctx, sessionID, request.uri)
+	}
+
+	origin, ok := v.resourceOrigin(request.uri)
+	if !ok {
+		return fmt.Errorf("resource %s is not exposed by %s", request.uri, v.vs.Name)
+	}
+	client, err := origin.client(ctx)
+	if err != nil {
+		return err
+	}
+	relayed, ok := client.(relayedClient)
+	if !ok {
+		return fmt.Errorf("the member of %s exposing %s does not support resource subscriptions", v.vs.Name, request.uri)
+	}
+	if err := relayed.relay.subscribe(ctx, v.server, sessionID, request.uri); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	if v.subscriptions[sessionID] == nil {
+		v.subscriptions[sessionID] = make(map[string]*notificationRelay)
+	}
+	v.subscriptions[sessionID][request.uri] = relayed.relay
+	v.mu.Unlock()
+	return nil
+}
+
+// dropSubscriptions removes every subscription of a session that went away from the member relays
+func (v *virtualServer) dropSubscriptions(sessionID string) {
+	v.mu.Lock()
+	subscriptions := v.subscriptions[sessionID]
+	delete(v.subscriptions, sessionID)
+	v.mu.Unlock()
+
+	for uri, relay := range subscriptions {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamNotifyTimeout)
+		if err := relay.unsubscribe(ctx, sessionID, uri); err != nil {
+			common.SysError(fmt.Sprintf("[VirtualServer] Failed to unsubscribe %s on %s: %v", uri, v.vs.Name, err))
+		}
+		cancel()
+	}
+}
+
+// GetOrCreateVirtualProxyHandler returns a cached SSE or HTTP/MCP handler for a virtual server.
+// proxyType should be "sseproxy" or "httpproxy"
+func GetOrCreateVirtualProxyHandler(ctx context.Context, vs *model.VirtualServer, proxyType string) (http.Handler, error) {
+	instance, err := GetOrCreateVirtualServerInstance(ctx, vs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyType {
+	case "sseproxy":
+		handlerCacheKey := fmt.Sprintf("virtual-%d-sseproxy", vs.ID)
+		sseWrappersMutex.Lock()
+		defer sseWrappersMutex.Unlock()
+		if existingHandler, found := initializedSSEProxyWrappers[handlerCacheKey]; found {
+			return existingHandler, nil
+		}
+		handler, err := createSSEHttpHandlerWithBasePath(instance.Server, vs.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSE handler for virtual server %s: %w", vs.Name, err)
+		}
+		initializedSSEProxyWrappers[handlerCacheKey] = withSubscriptionPassthrough(handler)
+		return initializedSSEProxyWrappers[handlerCacheKey], nil
+	case "httpproxy":
+		handlerCacheKey := fmt.Sprintf("virtual-%d-httpproxy", vs.ID)
+		httpWrappersMutex.Lock()
+		defer httpWrappersMutex.Unlock()
+		if existingHandler, found := initializedHTTPProxyWrappers[handlerCacheKey]; found {
+			return existingHandler, nil
+		}
+		if instance.Server == nil {
+			return nil, errors.New("virtual server instance has no MCPServer")
+		}
+		handler := withSubscriptionPassthrough(mcpserver.NewStreamableHTTPServer(instance.Server,
+			mcpserver.WithHeartbeatInterval(30*time.Second),
+		))
+		initializedHTTPProxyWrappers[handlerCacheKey] = handler
+		return handler, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy type for virtual server: %s", proxyType)
+	}
+}
+
+// InvalidateVirtualServer drops the composed instance and cached handlers of a virtual server,
+// so the next request rebuilds it from the current configuration.
+func InvalidateVirtualServer(ctx context.Context, id int64) {
+	virtualMCPServersMutex.Lock()
+	var instance *SharedMcpInstance
+	if v := virtualMCPServers[id]; v != nil {
+		instance = v.instance
+	}
+	delete(virtualMCPServers, id)
+	virtualMCPServersMutex.Unlock()
+
+	sseWrappersMutex.Lock()
+	delete(initializedSSEProxyWrappers, fmt.Sprintf("virtual-%d-sseproxy", id))
+	sseWrappersMutex.Unlock()
+
+	httpWrappersMutex.Lock()
+	delete(initializedHTTPProxyWrappers, fmt.Sprintf("virtual-%d-httpproxy", id))
+	httpWrappersMutex.Unlock()
+
+	if instance != nil {
+		// The composed instance has no client of its own; member instances stay cached for their services.
+		_ = instance.Shutdown(ctx)
+		common.SysLog(fmt.Sprintf("Invalidated virtual server instance %d", id))
+	}
+}
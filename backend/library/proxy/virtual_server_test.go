@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+
+	mcpclient "github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+	mcpserver "github.com/mark3labs/mcp-go/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newInProcessUpstream starts an in-process MCP server exposing the given tools, each echoing its own name,
+// and returns an initialized client connected to it.
+func newInProcessUpstream(t *testing.T, toolNames ...string) mcpclient.MCPClient {
+	t.Helper()
+	upstream := mcpserver.NewMCPServer("upstream", "1.0.0")
+	for _, name := range toolNames {
+		toolName := name
+		upstream.AddTool(mcp.NewTool(toolName), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			return mcp.NewToolResultText(toolName), nil
+		})
+	}
+
+	client, err := mcpclient.NewInProcessClient(upstream)
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, client.Start(ctx))
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "test", Version: "1.0.0"}
+	_, err = client.Initialize(ctx, initRequest)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newInProcessDownstream connects an initialized client to server, as a downstream MCP client would.
+func newInProcessDownstream(t *testing.T, server *mcpserver.MCPServer) mcpclient.MCPClient {
+	t.Helper()
+	client, err := mcpclient.NewInProcessClient(server)
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, client.Start(ctx))
+	initRequest := mcp.InitializeRequest{}
+	initRequest.Params.ProtocolVersion = mcp.LATEST_PROTOCOL_VERSION
+	initRequest.Params.ClientInfo = mcp.Implementation{Name: "downstream", Version: "1.0.0"}
+	_, err = client.Initialize(ctx, initRequest)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestComposeVirtualMember_NamespacesAndFilters(t *testing.T) {
+	ctx := context.Background()
+	github := newInProcessUpstream(t, "create_issue", "delete_repo")
+	slack := newInProcessUpstream(t, "post_message")
+
+	composed := mcpserver.NewMCPServer("virtual", "1.0.0")
+	registered := make(map[string]virtualOrigin)
+	composeVirtualMember(ctx, composed, github,
+		func(ctx context.Context) (mcpclient.MCPClient, error) { return github, nil }, capabilityGuard{filter: allowAllCapabilities}, nil,
+		model.VirtualServerMember{IncludeTools: []string{"create_issue"}}, "github", registered)
+	composeVirtualMember(ctx, composed, slack,
+		func(ctx context.Context) (mcpclient.MCPClient, error) { return slack, nil }, capabilityGuard{filter: allowAllCapabilities}, nil,
+		model.VirtualServerMember{}, "slack", registered)
+
+	downstream := newInProcessDownstream(t, composed)
+	tools, err := downstream.ListTools(ctx, mcp.ListToolsRequest{})
+	require.NoError(t, err)
+
+	var names []string
+	for _, tool := range tools.Tools {
+		names = append(names, tool.Name)
+	}
+	assert.ElementsMatch(t, []string{"github__create_issue", "slack__post_message"}, names)
+
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "github__create_issue"
+	result, err := downstream.CallTool(ctx, callRequest)
+	require.NoError(t, err)
+	require.Len(t, result.Content, 1)
+	text, ok := result.Content[0].(mcp.TextContent)
+	require.True(t, ok)
+	assert.Equal(t, "create_issue", text.Text, "call should be routed to the upstream name")
+}
+
+func TestComposeVirtualMember_TracksCallsPerMember(t *testing.T) {
+	ctx := context.Background()
+	github := newInProcessUpstream(t, "create_issue")
+	composed := mcpserver.NewMCPServer("virtual", "1.0.0")
+	composeVirtualMember(ctx, composed, github,
+		func(ctx context.Context) (mcpclient.MCPClient, error) { return github, nil }, capabilityGuard{serviceID: 7, filter: allowAllCapabilities}, nil,
+		model.VirtualServerMember{}, "github", make(map[string]virtualOrigin))
+	downstream := newInProcessDownstream(t, composed)
+
+	var tracked []int64
+	var recorded []error
+	limitReached := errors.New("daily request limit exceeded")
+	tracker := func(serviceID int64) (func(error), error) {
+		tracked = append(tracked, serviceID)
+		if len(tracked) > 1 {
+			return nil, limitReached
+		}
+		return func(err error) { recorded = append(recorded, err) }, nil
+	}
+	callCtx := WithMemberCallTracker(ctx, tracker)
+	callRequest := mcp.CallToolRequest{}
+	callRequest.Params.Name = "github__create_issue"
+
+	_, err := downstream.CallTool(callCtx, callRequest)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{7}, tracked, "the call is checked against its member service")
+	assert.Equal(t, []error{nil}, recorded, "the call is recorded once it is done")
+
+	_, err = downstream.CallTool(callCtx, callRequest)
+	require.Error(t, err, "a call over the member's limit is not forwarded")
+	assert.Len(t, recorded, 1)
+}
+
+func TestVirtualName(t *testing.T) {
+	assert.Equal(t, "github__create_issue", VirtualName("github", "create_issue"))
+	assert.Equal(t, "create_issue", VirtualName("", "create_issue"))
+}
+
+func TestVirtualServer_RecomposesOnMemberChanges(t *testing.T) {
+	savedPath := common.SQLitePath
+	common.SQLitePath = ":memory:"
+	t.Cleanup(func() { common.SQLitePath = savedPath })
+	require.NoError(t, model.InitDB())
+	ctx := context.Background()
+
+	github := &model.MCPService{Name: "github", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true}
+	require.NoError(t, model.CreateService(github))
+	slack := &model.MCPService{Name: "slack", Type: model.ServiceTypeStdio, Command: "echo", Enabled: true}
+	require.NoError(t, model.CreateService(slack))
+	vs := &model.VirtualServer{Name: "workspace", Enabled: true}
+	require.NoError(t, vs.SetMembers([]model.VirtualServerMember{{ServiceID: github.ID}, {ServiceID: slack.ID}}))
+	require.NoError(t, model.SaveVirtualServer(vs))
+	defer InvalidateVirtualServer(ctx, vs.ID)
+
+	githubUpstream := mcpserver.NewMCPServer("github", "1.0.0")
+	githubUpstream.AddTool(mcp.NewTool("create_issue"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText("create_issue"), nil
+	})
+	githubClient := newInProcessDownstream(t, githubUpstream)
+	slackClient := newInProcessUpstream(t, "post_message")
+
+	savedGetOrCreate := GetOrCreateSharedMcpInstanceWithKey
+	savedInterval := virtualMemberRetryInterval
+	t.Cleanup(func() {
+		GetOrCreateSharedMcpInstanceWithKey = savedGetOrCreate
+		virtualMemberRetryInterval = savedInterval
+	})
+	var slackUp atomic.Bool
+	GetOrCreateSharedMcpInstanceWithKey = func(ctx context.Context, service *model.MCPService, key, detail, envs string) (*SharedMcpInstance, error) {
+		switch {
+		case service.ID == github.ID:
+			return &SharedMcpInstance{Client: githubClient}, nil
+		case service.ID == slack.ID && slackUp.Load():
+			return &SharedMcpInstance{Client: slackClient}, nil
+		}
+		return nil, errors.New("upstream unavailable")
+	}
+	virtualMemberRetryInterval = 0
+
+	instance, err := GetOrCreateVirtualServerInstance(ctx, vs)
+	require.NoError(t, err)
+	downstream := newInProcessDownstream(t, instance.Server)
+	toolNames := func() []string {
+		tools, err := downstream.ListTools(ctx, mcp.ListToolsRequest{})
+		require.NoError(t, err)
+		var names []string
+		for _, tool := range tools.Tools {
+			names = append(names, tool.Name)
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"github__create_issue"}, toolNames())
+
+	// An unreachable member is retried on a later request, in place
+	slackUp.Store(true)
+	again, err := GetOrCreateVirtualServerInstance(ctx, vs)
+	require.NoError(t, err)
+	assert.Same(t, instance, again)
+	assert.Eventually(t, func() bool { return len(toolNames()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	// A member listing other tools is composed again
+	githubUpstream.AddTool(mcp.NewTool("close_issue"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText("close_issue"), nil
+	})
+	githubUpstream.DeleteTools("create_issue")
+	RefreshVirtualServersWithMember(github.ID)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"github__close_issue", "slack__post_message"}, sortedStrings(toolNames()))
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// A disabled member is removed from the composition
+	require.NoError(t, model.ToggleServiceEnabled(slack.ID))
+	RefreshVirtualServersWithMember(slack.ID)
+	assert.Eventually(t, func() bool { return len(toolNames()) == 1 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func sortedStrings(values []string) []string {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	return sorted
+}
@@ -0,0 +1,78 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"toWers/backend/common"
+)
+
+// MCP processes run third-party code, so they do not inherit the environment of toWers, which holds
+// its secrets (JWT_SECRET, SESSION_SECRET, database and Redis credentials). They get a minimal
+// baseline, the variables the administrator allows through the EnvPassthrough option, and the
+// service's own variables, in that order of precedence.
+
+// baseEnvironment lists the variables every MCP process inherits, when they are set.
+// The Windows ones are needed there to start processes at all.
+var baseEnvironment = []string{
+	"PATH", "HOME", "USER", "TMPDIR", "TZ",
+	"LANG", "LANGUAGE", "LC_ALL", "LC_CTYPE", "LC_MESSAGES",
+	"SystemRoot", "ComSpec", "PATHEXT", "TEMP", "TMP", "USERPROFILE", "APPDATA", "LOCALAPPDATA",
+}
+
+var passthroughPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\*?$`)
+
+// ValidatePassthrough checks the patterns of the EnvPassthrough option: variable names, optionally
+// ending with * to allow every variable with that prefix
+func ValidatePassthrough(patterns []string) error {
+	for _, pattern := range patterns {
+		if !passthroughPattern.MatchString(pattern) {
+			return fmt.Errorf("invalid environment variable pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Environment returns the environment of an MCP process: the inherited baseline and passthrough
+// variables, then env. Later entries win over earlier ones with the same name.
+func Environment(env []string) []string {
+	return environment(os.Environ(), common.GetEnvPassthrough(), env)
+}
+
+func environment(parent []string, passthrough []string, env []string) []string {
+	result := make([]string, 0, len(baseEnvironment)+len(env))
+	for _, entry := range parent {
+		name, _, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if matchesAny(name, baseEnvironment) || matchesAny(name, passthrough) {
+			result = append(result, entry)
+		}
+	}
+	return append(result, env...)
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+			if len(name) >= len(prefix) && sameName(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if sameName(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameName compares variable names, which are case-insensitive on Windows
+func sameName(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
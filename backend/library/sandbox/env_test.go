@@ -0,0 +1,37 @@
+package sandbox
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironment_KeepsSecretsOfToWers(t *testing.T) {
+	parent := []string{
+		"PATH=/usr/bin",
+		"JWT_SECRET=jwt",
+		"SESSION_SECRET=session",
+		"REDIS_CONN_STRING=redis://:password@localhost",
+		"LANG=C.UTF-8",
+		"NODE_EXTRA_CA_CERTS=/etc/ca.pem",
+		"HTTPS_PROXY=http://proxy:3128",
+	}
+
+	env := environment(parent, []string{"NODE_*", "HTTPS_PROXY"}, []string{"API_KEY=key", "PATH=/opt/bin"})
+
+	assert.Equal(t, []string{
+		"PATH=/usr/bin",
+		"LANG=C.UTF-8",
+		"NODE_EXTRA_CA_CERTS=/etc/ca.pem",
+		"HTTPS_PROXY=http://proxy:3128",
+		"API_KEY=key",
+		"PATH=/opt/bin",
+	}, env, "the service's own variables come last so they win")
+}
+
+func TestValidatePassthrough(t *testing.T) {
+	assert.NoError(t, ValidatePassthrough([]string{"HTTPS_PROXY", "NODE_*", "npm_config_*"}))
+	assert.Error(t, ValidatePassthrough([]string{"*"}))
+	assert.Error(t, ValidatePassthrough([]string{"A=B"}))
+	assert.Error(t, ValidatePassthrough([]string{"NODE_*_X"}))
+}
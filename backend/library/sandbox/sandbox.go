@@ -0,0 +1,77 @@
+// Package sandbox starts the stdio processes of MCP services under their execution policy:
+// a dedicated working directory, resource limits, namespace isolation and a read-only filesystem.
+// Policies are only enforced on Linux; elsewhere a process with an enabled policy is refused.
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+)
+
+// defaultMemoryCheckInterval is how often the memory of a process tree is measured against its limit
+const defaultMemoryCheckInterval = time.Second
+
+// Launcher starts one process under a policy. Its Command method is used as the command factory
+// of an mcp-go stdio transport; Watch must be called once the transport has started the process.
+type Launcher struct {
+	name   string
+	policy model.SandboxPolicy
+	cmd    *exec.Cmd
+
+	memoryCheckInterval time.Duration // How often Watch measures the memory of the process tree
+}
+
+// New returns a launcher for a process of the named service
+func New(name string, policy model.SandboxPolicy) *Launcher {
+	return &Launcher{name: name, policy: policy, memoryCheckInterval: defaultMemoryCheckInterval}
+}
+
+// Command builds the command that runs command with args under the policy, with env on top of the
+// environment inherited from toWers, see Environment. It has the signature of transport.CommandFunc.
+func (l *Launcher) Command(ctx context.Context, command string, env []string, args []string) (*exec.Cmd, error) {
+	if !l.policy.Enabled {
+		cmd := exec.CommandContext(ctx, command, args...)
+		cmd.Env = Environment(env)
+		l.cmd = cmd
+		return cmd, nil
+	}
+
+	workDir, err := filepath.Abs(l.policy.WorkDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sandbox work directory %s: %w", l.policy.WorkDir, err)
+	}
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create sandbox work directory %s: %w", workDir, err)
+	}
+	cmd, err := sandboxedCommand(ctx, l.policy, workDir, command, env, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sandbox %s: %w", l.name, err)
+	}
+	l.cmd = cmd
+	common.SysLog(fmt.Sprintf("[Sandbox] Starting %s in %s (memory=%dMB, cpu=%ds, files=%d, isolate=%t, read-only=%t)",
+		l.name, workDir, l.policy.MemoryMB, l.policy.CPUSeconds, l.policy.MaxOpenFiles, l.policy.Isolate, l.policy.ReadOnly))
+	return cmd, nil
+}
+
+// Watch enforces the limits that are checked while the process runs, until it exits or ctx is done
+func (l *Launcher) Watch(ctx context.Context) {
+	if !l.policy.Enabled || l.PID() == 0 || l.policy.MemoryMB <= 0 || !l.policy.KillOnExceed {
+		return
+	}
+	go watchMemory(ctx, l.name, l.PID(), int64(l.policy.MemoryMB)<<20, l.memoryCheckInterval)
+}
+
+// PID returns the process ID of the started process, 0 before it is started
+func (l *Launcher) PID() int {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return 0
+	}
+	return l.cmd.Process.Pid
+}
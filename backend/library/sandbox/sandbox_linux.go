@@ -0,0 +1,196 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+)
+
+// sandboxedCommand wraps command so that the policy is in place before it runs:
+// bubblewrap remounts the filesystem read-only, a shell applies the rlimits and execs command,
+// and the process group lets the whole tree be killed at once.
+func sandboxedCommand(ctx context.Context, policy model.SandboxPolicy, workDir, command string, env, args []string) (*exec.Cmd, error) {
+	name, argv := command, args
+	if limits := ulimitScript(policy); limits != "" {
+		argv = append([]string{"-c", limits + `exec "$0" "$@"`, command}, args...)
+		name = "/bin/sh"
+	}
+
+	env = Environment(env)
+	if policy.ReadOnly {
+		bwrap, err := exec.LookPath("bwrap")
+		if err != nil {
+			return nil, fmt.Errorf("a read-only filesystem requires bubblewrap (bwrap): %w", err)
+		}
+		argv = append(append(bubblewrapArgs(policy, workDir), "--", name), argv...)
+		name = bwrap
+		// Package managers write their caches under HOME, which is now read-only
+		env = append(env,
+			"HOME="+workDir,
+			"TMPDIR=/tmp",
+			"XDG_CACHE_HOME="+filepath.Join(workDir, ".cache"),
+			"npm_config_cache="+filepath.Join(workDir, ".npm"),
+		)
+	}
+
+	cmd := exec.CommandContext(ctx, name, argv...)
+	cmd.Dir = workDir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if policy.Isolate && !policy.ReadOnly {
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd, nil
+}
+
+// ulimitScript returns the shell commands setting the policy's rlimits. Without KillOnExceed the
+// memory limit caps the data segment, so allocations beyond it fail; with it, watchMemory kills
+// the process tree instead, which also covers memory that is mapped rather than allocated.
+func ulimitScript(policy model.SandboxPolicy) string {
+	var script strings.Builder
+	if policy.CPUSeconds > 0 {
+		fmt.Fprintf(&script, "ulimit -t %d || exit 126; ", policy.CPUSeconds)
+	}
+	if policy.MaxOpenFiles > 0 {
+		fmt.Fprintf(&script, "ulimit -n %d || exit 126; ", policy.MaxOpenFiles)
+	}
+	if policy.MemoryMB > 0 && !policy.KillOnExceed {
+		fmt.Fprintf(&script, "ulimit -d %d || exit 126; ", policy.MemoryMB*1024)
+	}
+	return script.String()
+}
+
+func bubblewrapArgs(policy model.SandboxPolicy, workDir string) []string {
+	args := []string{
+		"--ro-bind", "/", "/",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+		"--bind", workDir, workDir,
+		"--chdir", workDir,
+	}
+	if policy.Isolate {
+		args = append(args, "--unshare-user", "--unshare-pid", "--unshare-ipc", "--unshare-uts", "--proc", "/proc")
+	}
+	return args
+}
+
+// watchMemory kills the process group led by pid once its resident memory exceeds limit bytes,
+// measured every interval
+func watchMemory(ctx context.Context, name string, pid int, limit int64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		used, alive := groupMemory(pid)
+		if !alive {
+			return
+		}
+		if used > limit {
+			common.SysLog(fmt.Sprintf("WARN: [Sandbox] %s uses %dMB, more than its %dMB limit, killing it", name, used>>20, limit>>20))
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+			return
+		}
+	}
+}
+
+// procStat is the part of /proc/<pid>/stat used to measure process trees
+type procStat struct {
+	pid, ppid, pgid int
+	rss             int64 // bytes
+}
+
+// processes returns the live processes of the system
+func processes() []procStat {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var result []procStat
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces, the fields that follow it may not
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 22 || fields[0] == "Z" {
+			continue
+		}
+		process := procStat{pid: pid}
+		process.ppid, _ = strconv.Atoi(fields[1])
+		process.pgid, _ = strconv.Atoi(fields[2])
+		if pages, err := strconv.ParseInt(fields[21], 10, 64); err == nil {
+			process.rss = pages * int64(os.Getpagesize())
+		}
+		result = append(result, process)
+	}
+	return result
+}
+
+// groupMemory sums the resident memory of the processes in a process group,
+// and reports whether the group still has any process
+func groupMemory(pgid int) (int64, bool) {
+	var total int64
+	alive := false
+	for _, process := range processes() {
+		if process.pgid == pgid {
+			alive = true
+			total += process.rss
+		}
+	}
+	return total, alive
+}
+
+// ProcessMemory sums the resident memory of a process and its descendants,
+// and reports whether the process is still running
+func ProcessMemory(pid int) (int64, bool) {
+	all := processes()
+	tree := map[int]bool{pid: true}
+	// Children may be listed before their parents, so repeat until no process is added
+	for added := true; added; {
+		added = false
+		for _, process := range all {
+			if !tree[process.pid] && tree[process.ppid] {
+				tree[process.pid] = true
+				added = true
+			}
+		}
+	}
+	var total int64
+	alive := false
+	for _, process := range all {
+		if tree[process.pid] {
+			total += process.rss
+			alive = alive || process.pid == pid
+		}
+	}
+	return total, alive
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"toWers/backend/model"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLauncher_AppliesLimitsInWorkDir(t *testing.T) {
+	workDir := filepath.Join(t.TempDir(), "service-1")
+	launcher := New("limited", model.SandboxPolicy{Enabled: true, WorkDir: workDir, CPUSeconds: 30, MaxOpenFiles: 64})
+
+	cmd, err := launcher.Command(context.Background(), "sh", []string{"SANDBOX_TEST=1"}, []string{"-c", "ulimit -n; ulimit -t; pwd; echo $SANDBOX_TEST"})
+	require.NoError(t, err)
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"64", "30", workDir, "1"}, strings.Fields(string(output)))
+}
+
+func TestLauncher_KillsProcessTreeOverMemoryLimit(t *testing.T) {
+	launcher := New("greedy", model.SandboxPolicy{Enabled: true, WorkDir: t.TempDir(), MemoryMB: 1, KillOnExceed: true})
+	launcher.memoryCheckInterval = 10 * time.Millisecond
+	// The shell and its sleeping child together use more than a megabyte
+	cmd, err := launcher.Command(context.Background(), "sh", nil, []string{"-c", "sleep 30; echo done"})
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	launcher.Watch(context.Background())
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		var exitErr *exec.ExitError
+		require.True(t, errors.As(err, &exitErr), "unexpected error %v", err)
+		assert.Equal(t, syscall.SIGKILL, exitErr.Sys().(syscall.WaitStatus).Signal())
+	case <-time.After(5 * time.Second):
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		t.Fatal("process over its memory limit was not killed")
+	}
+}
+
+func TestLauncher_IsolatesNamespaces(t *testing.T) {
+	launcher := New("isolated", model.SandboxPolicy{Enabled: true, WorkDir: t.TempDir(), Isolate: true})
+	cmd, err := launcher.Command(context.Background(), "sh", nil, []string{"-c", "echo $$"})
+	require.NoError(t, err)
+	output, err := cmd.Output()
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skipf("user namespaces are not available: %v", err)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, "1", strings.TrimSpace(string(output)), "the process runs in its own PID namespace")
+}
+
+func TestLauncher_ReadOnlyNeedsBubblewrap(t *testing.T) {
+	if _, err := exec.LookPath("bwrap"); err == nil {
+		t.Skip("bubblewrap is installed")
+	}
+	launcher := New("read-only", model.SandboxPolicy{Enabled: true, WorkDir: t.TempDir(), ReadOnly: true})
+	_, err := launcher.Command(context.Background(), "sh", nil, nil)
+	assert.ErrorContains(t, err, "bubblewrap")
+}
+
+func TestProcessMemory_IncludesChildren(t *testing.T) {
+	launcher := New("tree", model.SandboxPolicy{Enabled: true, WorkDir: t.TempDir()})
+	cmd, err := launcher.Command(context.Background(), "sh", nil, []string{"-c", "sleep 30 & wait"})
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	defer func() { _ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }()
+	require.Equal(t, cmd.Process.Pid, launcher.PID())
+
+	require.Eventually(t, func() bool {
+		var shellRSS int64
+		for _, process := range processes() {
+			if process.pid == cmd.Process.Pid {
+				shellRSS = process.rss
+			}
+		}
+		total, alive := ProcessMemory(cmd.Process.Pid)
+		return alive && shellRSS > 0 && total > shellRSS
+	}, 5*time.Second, 10*time.Millisecond, "the sleeping child is counted")
+
+	require.NoError(t, syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL))
+	_ = cmd.Wait()
+	_, alive := ProcessMemory(cmd.Process.Pid)
+	assert.False(t, alive)
+}
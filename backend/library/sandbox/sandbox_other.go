@@ -0,0 +1,23 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"time"
+
+	"toWers/backend/model"
+)
+
+func sandboxedCommand(ctx context.Context, policy model.SandboxPolicy, workDir, command string, env, args []string) (*exec.Cmd, error) {
+	return nil, errors.New("sandboxed execution is only supported on Linux")
+}
+
+func watchMemory(ctx context.Context, name string, pid int, limit int64, interval time.Duration) {}
+
+// ProcessMemory is not measured outside Linux, where the process is assumed to be running
+func ProcessMemory(pid int) (int64, bool) {
+	return 0, true
+}
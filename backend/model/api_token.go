@@ -0,0 +1,200 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"toWers/backend/common"
+
+	"github.com/burugo/thing"
+)
+
+const (
+	// APITokenPrefix starts every API token, so a leaked token can be recognized
+	APITokenPrefix = "tw_pat_"
+	// DefaultAPITokenName names the full access token regenerated from the profile page
+	DefaultAPITokenName = "Default"
+	// apiTokenUseInterval limits how often the last use of a token is written back
+	apiTokenUseInterval = time.Minute
+)
+
+// APIToken is a named token a user creates to call /proxy endpoints. It may be limited to some
+// services or virtual servers, to read-only tools, and may expire. Only a hash of the token is
+// stored; the token itself is shown once, when it is created.
+type APIToken struct {
+	thing.BaseModel
+	UserID      int64  `json:"user_id" db:"user_id,index:idx_api_token_user"`
+	Name        string `json:"name" db:"name"`
+	TokenHash   string `json:"-" db:"token_hash,unique"`
+	TokenPrefix string `json:"token_prefix" db:"token_prefix"` // First characters of the token, to tell tokens apart
+	Scope       string `json:"scope" db:"scope"`               // Space separated mcp:<service> scopes, empty for every service
+	ReadOnly    bool   `json:"read_only" db:"read_only"`       // Only tools annotated read-only may be listed and called
+	ExpiresAt   int64  `json:"expires_at" db:"expires_at"`     // Unix seconds, 0 for never
+	LastUsedAt  int64  `json:"last_used_at" db:"last_used_at"` // Unix seconds, 0 if never used
+	LastUsedIP  string `json:"last_used_ip" db:"last_used_ip"`
+}
+
+// TableName sets the table name for the APIToken model
+func (t *APIToken) TableName() string {
+	return "api_tokens"
+}
+
+// AllowsService reports whether the token grants access to the /proxy service or virtual server name
+func (t *APIToken) AllowsService(name string) bool {
+	return t.Scope == "" || HasOAuthScope(t.Scope, OAuthScopePrefix+name)
+}
+
+// GetServices returns the services and virtual servers the token is limited to, empty for every service
+func (t *APIToken) GetServices() []string {
+	services := []string{}
+	for _, s := range strings.Fields(t.Scope) {
+		services = append(services, strings.TrimPrefix(s, OAuthScopePrefix))
+	}
+	return services
+}
+
+// IsExpired reports whether the token has expired
+func (t *APIToken) IsExpired() bool {
+	return t.ExpiresAt > 0 && time.Now().Unix() >= t.ExpiresAt
+}
+
+var APITokenDB *thing.Thing[*APIToken]
+
+// APITokenInit initializes APITokenDB
+func APITokenInit() error {
+	var err error
+	APITokenDB, err = thing.Use[*APIToken]()
+	if err != nil {
+		return fmt.Errorf("failed to initialize APITokenDB: %w", err)
+	}
+	return nil
+}
+
+// ErrAPITokenNotFound is returned for an unknown, expired or revoked token
+var ErrAPITokenNotFound = errors.New("api token not found")
+
+// CreateAPIToken creates a token for a user and returns it with the token itself, which is not stored.
+// services limits the token to those services and virtual servers; none grants every service.
+func CreateAPIToken(userID int64, name string, services []string, readOnly bool, expiresAt int64) (*APIToken, string, error) {
+	tokenString, err := common.GenerateSecretToken(APITokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	scopes := make([]string, 0, len(services))
+	for _, s := range services {
+		scopes = append(scopes, OAuthScopePrefix+s)
+	}
+	token := &APIToken{
+		UserID:      userID,
+		Name:        name,
+		TokenHash:   common.HashToken(tokenString),
+		TokenPrefix: tokenString[:len(APITokenPrefix)+4],
+		Scope:       strings.Join(scopes, " "),
+		ReadOnly:    readOnly,
+		ExpiresAt:   expiresAt,
+	}
+	if err := APITokenDB.Save(token); err != nil {
+		return nil, "", err
+	}
+	return token, tokenString, nil
+}
+
+// GetUserAPITokens returns the tokens of a user
+func GetUserAPITokens(userID int64) ([]*APIToken, error) {
+	return APITokenDB.Where("user_id = ?", userID).Order("id ASC").All()
+}
+
+// GetUserAPIToken returns a token of a user by ID
+func GetUserAPIToken(userID, id int64) (*APIToken, error) {
+	token, err := APITokenDB.ByID(id)
+	if err != nil || token == nil || token.UserID != userID {
+		return nil, ErrAPITokenNotFound
+	}
+	return token, nil
+}
+
+// DeleteAPIToken revokes a token
+func DeleteAPIToken(token *APIToken) error {
+	return APITokenDB.Delete(token)
+}
+
+// DeleteUserAPITokensByName revokes the tokens of a user with the given name
+func DeleteUserAPITokensByName(userID int64, name string) error {
+	tokens, err := APITokenDB.Where("user_id = ? AND name = ?", userID, name).All()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := APITokenDB.Delete(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateAPIToken returns the unexpired token tokenString and its enabled owner
+func ValidateAPIToken(tokenString string) (*APIToken, *User, error) {
+	if tokenString == "" {
+		return nil, nil, ErrAPITokenNotFound
+	}
+	tokens, err := APITokenDB.Where("token_hash = ?", common.HashToken(tokenString)).Fetch(0, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 || tokens[0].IsExpired() {
+		return nil, nil, ErrAPITokenNotFound
+	}
+	user, err := GetUserById(tokens[0].UserID, false)
+	if err != nil || user == nil || user.Status != common.UserStatusEnabled {
+		return nil, nil, ErrAPITokenNotFound
+	}
+	return tokens[0], user, nil
+}
+
+// RecordUse records that the token was used from ip. Writes are limited to one per
+// apiTokenUseInterval unless the address changes, so busy tokens do not write on every request.
+func (t *APIToken) RecordUse(ip string) error {
+	now := time.Now()
+	if t.LastUsedIP == ip && now.Sub(time.Unix(t.LastUsedAt, 0)) < apiTokenUseInterval {
+		return nil
+	}
+	t.LastUsedAt = now.Unix()
+	t.LastUsedIP = ip
+	return APITokenDB.Save(t)
+}
+
+// migrateUserTokens moves the plaintext token users had before API tokens into a hashed
+// token named "Default", so existing MCP client configurations keep working. A token migrated
+// by a run that failed before clearing the user's token is not created again.
+func migrateUserTokens() error {
+	users, err := UserDB.Where("token != ?", "").All()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		hash := common.HashToken(user.Token)
+		existing, err := APITokenDB.Where("token_hash = ?", hash).Fetch(0, 1)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			token := &APIToken{
+				UserID:      user.ID,
+				Name:        DefaultAPITokenName,
+				TokenHash:   hash,
+				TokenPrefix: user.Token[:min(4, len(user.Token))],
+			}
+			if err := APITokenDB.Save(token); err != nil {
+				return err
+			}
+		}
+		user.Token = ""
+		if err := UserDB.Save(user); err != nil {
+			return err
+		}
+		common.SysLog(fmt.Sprintf("[APIToken] Migrated the token of user %d", user.ID))
+	}
+	return nil
+}
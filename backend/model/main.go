@@ -34,7 +34,6 @@ func createRootAccountIfNeed() error {
 			Email:       "root@localhost",
 			GitHubId:    "",
 			WeChatId:    "",
-			// Token will be auto-generated by Insert method
 		}
 		err = rootUser.Insert()
 		if err != nil {
@@ -61,7 +60,7 @@ func InitDB() (err error) {
 
 	// 1. AutoMigrate all models first
 	thing.AllowDropColumn = true
-	err = thing.AutoMigrate(&User{}, &Option{}, &MCPService{}, &UserConfig{}, &ConfigService{}, &ProxyRequestStat{})
+	err = thing.AutoMigrate(&User{}, &Option{}, &MCPService{}, &UserConfig{}, &ConfigService{}, &ProxyRequestStat{}, &VirtualServer{}, &ServicePermission{}, &UpstreamOAuthToken{}, &OAuthClient{}, &OAuthConsent{}, &OAuthToken{}, &APIToken{}, &Team{}, &TeamMember{}, &TeamConfig{}, &CustomRole{})
 	if err != nil {
 		return err
 	}
@@ -85,8 +84,32 @@ func InitDB() (err error) {
 	if err := UserConfigInit(); err != nil {
 		return err
 	}
+	if err := VirtualServerInit(); err != nil {
+		return err
+	}
+	if err := ServicePermissionInit(); err != nil {
+		return err
+	}
+	if err := UpstreamOAuthTokenInit(); err != nil {
+		return err
+	}
+	if err := OAuthServerInit(); err != nil {
+		return err
+	}
+	if err := APITokenInit(); err != nil {
+		return err
+	}
+	if err := TeamInit(); err != nil {
+		return err
+	}
+	if err := CustomRoleInit(); err != nil {
+		return err
+	}
 
 	// 3. Perform data-dependent operations like creating a root account
+	if err := migrateUserTokens(); err != nil {
+		return err
+	}
 	return createRootAccountIfNeed()
 }
 
@@ -0,0 +1,232 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/burugo/thing"
+)
+
+// toWers is the OAuth authorization server of its /proxy endpoints. MCP clients register
+// dynamically as OAuthClient, users grant each client access to some services (OAuthConsent), and
+// the client calls those services with short-lived access tokens (OAuthToken).
+
+// OAuthScopePrefix starts the scope granting access to a /proxy service, e.g. "mcp:github"
+const OAuthScopePrefix = "mcp:"
+
+// OAuthClient is an MCP client registered through dynamic client registration
+type OAuthClient struct {
+	thing.BaseModel
+	ClientID         string `json:"client_id" db:"client_id,unique"`
+	ClientSecretHash string `json:"-" db:"client_secret_hash"` // SHA-256 of the secret, empty for public clients
+	ClientName       string `json:"client_name" db:"client_name"`
+	RedirectURIsJSON string `json:"-" db:"redirect_uris_json"` // JSON array of the allowed redirect URIs
+}
+
+// TableName sets the table name for the OAuthClient model
+func (c *OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// GetRedirectURIs returns the redirect URIs the client registered
+func (c *OAuthClient) GetRedirectURIs() []string {
+	var uris []string
+	if c.RedirectURIsJSON != "" {
+		json.Unmarshal([]byte(c.RedirectURIsJSON), &uris)
+	}
+	return uris
+}
+
+// SetRedirectURIs sets the RedirectURIsJSON field
+func (c *OAuthClient) SetRedirectURIs(uris []string) error {
+	data, err := json.Marshal(uris)
+	if err != nil {
+		return err
+	}
+	c.RedirectURIsJSON = string(data)
+	return nil
+}
+
+// HasRedirectURI reports whether uri is one of the client's redirect URIs, compared exactly
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.GetRedirectURIs() {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// OAuthConsent records the services a user allowed an MCP client to use
+type OAuthConsent struct {
+	thing.BaseModel
+	UserID   int64  `json:"user_id" db:"user_id,index:idx_oauth_consent"`
+	ClientID string `json:"client_id" db:"client_id,index:idx_oauth_consent"`
+	Scope    string `json:"scope" db:"scope"` // Space separated mcp:<service> scopes
+}
+
+// TableName sets the table name for the OAuthConsent model
+func (c *OAuthConsent) TableName() string {
+	return "oauth_consents"
+}
+
+// OAuthToken is an access token issued to an MCP client on behalf of a user, with the refresh
+// token that replaces it. Only hashes of the tokens are stored.
+type OAuthToken struct {
+	thing.BaseModel
+	AccessTokenHash  string `json:"-" db:"access_token_hash,unique"`
+	RefreshTokenHash string `json:"-" db:"refresh_token_hash,index:idx_oauth_token_refresh"`
+	ClientID         string `json:"client_id" db:"client_id,index:idx_oauth_token_client"`
+	UserID           int64  `json:"user_id" db:"user_id,index:idx_oauth_token_client"`
+	Scope            string `json:"scope" db:"scope"`
+	AccessExpiresAt  int64  `json:"access_expires_at" db:"access_expires_at"`   // Unix seconds
+	RefreshExpiresAt int64  `json:"refresh_expires_at" db:"refresh_expires_at"` // Unix seconds
+}
+
+// TableName sets the table name for the OAuthToken model
+func (t *OAuthToken) TableName() string {
+	return "oauth_tokens"
+}
+
+// AllowsService reports whether the token grants access to the /proxy service or virtual server name
+func (t *OAuthToken) AllowsService(name string) bool {
+	return HasOAuthScope(t.Scope, OAuthScopePrefix+name)
+}
+
+// HasOAuthScope reports whether a space separated scope contains want
+func HasOAuthScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	OAuthClientDB  *thing.Thing[*OAuthClient]
+	OAuthConsentDB *thing.Thing[*OAuthConsent]
+	OAuthTokenDB   *thing.Thing[*OAuthToken]
+)
+
+// OAuthServerInit initializes OAuthClientDB, OAuthConsentDB and OAuthTokenDB
+func OAuthServerInit() error {
+	var err error
+	if OAuthClientDB, err = thing.Use[*OAuthClient](); err != nil {
+		return fmt.Errorf("failed to initialize OAuthClientDB: %w", err)
+	}
+	if OAuthConsentDB, err = thing.Use[*OAuthConsent](); err != nil {
+		return fmt.Errorf("failed to initialize OAuthConsentDB: %w", err)
+	}
+	if OAuthTokenDB, err = thing.Use[*OAuthToken](); err != nil {
+		return fmt.Errorf("failed to initialize OAuthTokenDB: %w", err)
+	}
+	return nil
+}
+
+var (
+	// ErrOAuthClientNotFound is returned for an unknown client ID
+	ErrOAuthClientNotFound = errors.New("oauth client not found")
+	// ErrOAuthConsentNotFound is returned when a user never granted a client access
+	ErrOAuthConsentNotFound = errors.New("oauth consent not found")
+	// ErrOAuthTokenNotFound is returned for an unknown token
+	ErrOAuthTokenNotFound = errors.New("oauth token not found")
+)
+
+// GetOAuthClient returns the registered client with the given client ID
+func GetOAuthClient(clientID string) (*OAuthClient, error) {
+	clients, err := OAuthClientDB.Where("client_id = ?", clientID).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ErrOAuthClientNotFound
+	}
+	return clients[0], nil
+}
+
+// CreateOAuthClient saves a newly registered client
+func CreateOAuthClient(client *OAuthClient) error {
+	return OAuthClientDB.Save(client)
+}
+
+// GetOAuthConsent returns what a user granted a client
+func GetOAuthConsent(userID int64, clientID string) (*OAuthConsent, error) {
+	consents, err := OAuthConsentDB.Where("user_id = ? AND client_id = ?", userID, clientID).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(consents) == 0 {
+		return nil, ErrOAuthConsentNotFound
+	}
+	return consents[0], nil
+}
+
+// GetUserOAuthConsents returns the clients a user granted access to
+func GetUserOAuthConsents(userID int64) ([]*OAuthConsent, error) {
+	return OAuthConsentDB.Where("user_id = ?", userID).Order("id ASC").All()
+}
+
+// SaveOAuthConsent records that a user granted a client the scope, replacing a previous grant
+func SaveOAuthConsent(userID int64, clientID, scope string) error {
+	consent, err := GetOAuthConsent(userID, clientID)
+	if errors.Is(err, ErrOAuthConsentNotFound) {
+		consent = &OAuthConsent{UserID: userID, ClientID: clientID}
+	} else if err != nil {
+		return err
+	}
+	consent.Scope = scope
+	return OAuthConsentDB.Save(consent)
+}
+
+// DeleteOAuthConsent revokes what a user granted a client, along with the tokens issued to it
+func DeleteOAuthConsent(userID int64, clientID string) error {
+	tokens, err := OAuthTokenDB.Where("user_id = ? AND client_id = ?", userID, clientID).All()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := OAuthTokenDB.Delete(token); err != nil {
+			return err
+		}
+	}
+	consent, err := GetOAuthConsent(userID, clientID)
+	if errors.Is(err, ErrOAuthConsentNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return OAuthConsentDB.Delete(consent)
+}
+
+// GetOAuthTokenByAccessToken returns the unexpired token issued as accessToken
+func GetOAuthTokenByAccessToken(accessTokenHash string) (*OAuthToken, error) {
+	tokens, err := OAuthTokenDB.Where("access_token_hash = ?", accessTokenHash).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 || time.Now().Unix() >= tokens[0].AccessExpiresAt {
+		return nil, ErrOAuthTokenNotFound
+	}
+	return tokens[0], nil
+}
+
+// GetOAuthTokenByRefreshToken returns the token whose unexpired refresh token hashes to refreshTokenHash
+func GetOAuthTokenByRefreshToken(refreshTokenHash string) (*OAuthToken, error) {
+	tokens, err := OAuthTokenDB.Where("refresh_token_hash = ?", refreshTokenHash).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 || time.Now().Unix() >= tokens[0].RefreshExpiresAt {
+		return nil, ErrOAuthTokenNotFound
+	}
+	return tokens[0], nil
+}
+
+// SaveOAuthToken saves an issued or refreshed token
+func SaveOAuthToken(token *OAuthToken) error {
+	return OAuthTokenDB.Save(token)
+}
@@ -4,8 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"toWers/backend/common"
+
 	"github.com/burugo/thing"
 )
 
@@ -45,6 +52,80 @@ type EnvVarDefinition struct {
 	DefaultValue string `json:"default_value"`
 }
 
+// FilterRule is an allowlist/denylist of names. Entries are exact names or glob patterns (path.Match syntax).
+// Deny takes precedence over Allow; an empty Allow list allows everything not denied.
+type FilterRule struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Allows reports whether name passes the rule
+func (r FilterRule) Allows(name string) bool {
+	if r.Denies(name) {
+		return false
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	return matchesAnyPattern(r.Allow, name)
+}
+
+// Denies reports whether name matches an entry of the deny list
+func (r FilterRule) Denies(name string) bool {
+	return matchesAnyPattern(r.Deny, name)
+}
+
+// Validate checks that every pattern in the rule is well-formed
+func (r FilterRule) Validate() error {
+	for _, pattern := range append(append([]string{}, r.Allow...), r.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// CapabilityFilter limits the upstream capabilities a service exposes through the proxy.
+// Tools and prompts are matched by name, resources and resource templates by URI.
+type CapabilityFilter struct {
+	Tools     FilterRule `json:"tools"`
+	Prompts   FilterRule `json:"prompts"`
+	Resources FilterRule `json:"resources"`
+}
+
+// Validate checks that every pattern in the filter is well-formed
+func (f CapabilityFilter) Validate() error {
+	for _, rule := range []FilterRule{f.Tools, f.Prompts, f.Resources} {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == name {
+			return true
+		}
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ToolOverride rewrites how an upstream tool is presented to MCP clients.
+// Empty fields keep the upstream value.
+type ToolOverride struct {
+	Name                 string            `json:"name,omitempty"`                  // Exposed tool name, calls are mapped back to the upstream name
+	Title                string            `json:"title,omitempty"`                 // Display name (annotations.title)
+	Description          string            `json:"description,omitempty"`           // Tool description
+	PropertyDescriptions map[string]string `json:"property_descriptions,omitempty"` // Input schema property name to description
+	ReadOnlyHint         *bool             `json:"read_only_hint,omitempty"`        // annotations.readOnlyHint
+	DestructiveHint      *bool             `json:"destructive_hint,omitempty"`      // annotations.destructiveHint
+}
+
 // MCPService represents an MCP service that can be enabled or configured
 type MCPService struct {
 	thing.BaseModel
@@ -71,8 +152,78 @@ type MCPService struct {
 	LastHealthCheck       time.Time       `db:"-"`                       // Last health check time
 	HealthDetails         string          `db:"-"`                       // Health details JSON string
 	DefaultEnvsJSON       string          `db:"default_envs_json,default:'{}'"`
-	HeadersJSON           string          `json:"headers_json,omitempty" db:"headers_json,default:'{}'"` // JSON string for custom request headers map[string]string
-	RPDLimit              int             `json:"rpd_limit,omitempty" db:"rpd_limit,default:0"`          // Daily request limit (0 means no limit)
+	HeadersJSON           string          `json:"headers_json,omitempty" db:"headers_json,default:'{}'"`               // JSON string for custom request headers map[string]string, values may hold ${user.KEY} placeholders
+	RPDLimit              int             `json:"rpd_limit,omitempty" db:"rpd_limit,default:0"`                        // Daily request limit (0 means no limit)
+	FilterJSON            string          `json:"filter_json,omitempty" db:"filter_json,default:'{}'"`                 // JSON CapabilityFilter limiting which upstream tools, prompts and resources are exposed
+	ToolOverridesJSON     string          `json:"tool_overrides_json,omitempty" db:"tool_overrides_json,default:'{}'"` // JSON map of upstream tool name to ToolOverride
+	// Upstream call resilience, see GetCallPolicy. Every feature is opt-in: 0 disables it.
+	CallTimeoutSeconds     int `json:"call_timeout_seconds,omitempty" db:"call_timeout_seconds,default:0"`         // Tool call timeout
+	MaxRetries             int `json:"max_retries,omitempty" db:"max_retries,default:0"`                           // Retries of transport failures of list, read and ping requests on SSE/streamable HTTP upstreams; tool calls are never retried
+	RetryBackoffMs         int `json:"retry_backoff_ms,omitempty" db:"retry_backoff_ms,default:0"`                 // Delay before the first retry, doubled for each further one, DefaultRetryBackoff if 0
+	BreakerThreshold       int `json:"breaker_threshold,omitempty" db:"breaker_threshold,default:0"`               // Consecutive failed calls that open the circuit breaker
+	BreakerCooldownSeconds int `json:"breaker_cooldown_seconds,omitempty" db:"breaker_cooldown_seconds,default:0"` // Time the circuit stays open before a trial call is let through
+	// Instance lifecycle, see GetInstancePolicy
+	MinInstances       int `json:"min_instances,omitempty" db:"min_instances,default:0"`               // Instances kept running while idle, 0 lets the service scale to zero
+	MaxInstances       int `json:"max_instances,omitempty" db:"max_instances,default:0"`               // Cap on live instances, shared and per-user together (0 means no cap)
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds,omitempty" db:"idle_timeout_seconds,default:0"` // Idle time before an instance is shut down, 0 keeps idle instances running
+	// Stdio worker pool, see GetWorkerPoolSize
+	WorkerPoolSize int  `json:"worker_pool_size,omitempty" db:"worker_pool_size,default:0"`   // Stdio processes per instance sharing its tool calls (0 or 1 means a single process)
+	StickySessions bool `json:"sticky_sessions,omitempty" db:"sticky_sessions,default:false"` // Route all calls of a client session to the same stdio process
+	// Execution policy of stdio processes on Linux, see GetSandboxPolicy
+	SandboxEnabled      bool   `json:"sandbox_enabled,omitempty" db:"sandbox_enabled,default:false"`               // Run stdio processes under the policy below
+	SandboxWorkDir      string `json:"sandbox_work_dir,omitempty" db:"sandbox_work_dir,default:''"`                // Working and scratch directory (empty = data/sandbox/service-<id>)
+	SandboxMemoryMB     int    `json:"sandbox_memory_mb,omitempty" db:"sandbox_memory_mb,default:0"`               // Memory limit of the process tree (0 means no limit)
+	SandboxCPUSeconds   int    `json:"sandbox_cpu_seconds,omitempty" db:"sandbox_cpu_seconds,default:0"`           // CPU time limit per process (0 means no limit)
+	SandboxMaxOpenFiles int    `json:"sandbox_max_open_files,omitempty" db:"sandbox_max_open_files,default:0"`     // Open file limit per process (0 means no limit)
+	SandboxIsolate      bool   `json:"sandbox_isolate,omitempty" db:"sandbox_isolate,default:false"`               // Run in new user, PID, IPC and UTS namespaces
+	SandboxReadOnly     bool   `json:"sandbox_read_only,omitempty" db:"sandbox_read_only,default:false"`           // Mount the filesystem read-only except the work directory (needs bubblewrap)
+	SandboxKillOnExceed bool   `json:"sandbox_kill_on_exceed,omitempty" db:"sandbox_kill_on_exceed,default:false"` // Kill the process tree when it exceeds the memory limit instead of failing its allocations
+	// OAuth authorization to SSE/streamable HTTP upstreams, tokens are kept in UpstreamOAuthToken
+	OAuthEnabled      bool   `json:"oauth_enabled,omitempty" db:"oauth_enabled,default:false"`          // Authorize to the upstream with OAuth instead of static headers
+	OAuthPerUser      bool   `json:"oauth_per_user,omitempty" db:"oauth_per_user,default:false"`        // Each user authorizes with their own account, instead of an admin for everyone
+	OAuthScopes       string `json:"oauth_scopes,omitempty" db:"oauth_scopes,default:''"`               // Space separated scopes to request
+	OAuthMetadataURL  string `json:"oauth_metadata_url,omitempty" db:"oauth_metadata_url,default:''"`   // Authorization server metadata, discovered from the upstream when empty
+	OAuthClientID     string `json:"oauth_client_id,omitempty" db:"oauth_client_id,default:''"`         // Registered dynamically on the first authorization when empty
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty" db:"oauth_client_secret,default:''"` // Encrypted, see SetOAuthClientSecret
+}
+
+// SandboxPolicy is the effective execution policy of a service's stdio processes. Zero limits are not applied.
+type SandboxPolicy struct {
+	Enabled      bool
+	WorkDir      string
+	MemoryMB     int
+	CPUSeconds   int
+	MaxOpenFiles int
+	Isolate      bool
+	ReadOnly     bool
+	KillOnExceed bool
+}
+
+// MaxWorkerPoolSize caps the stdio processes a single instance may run
+const MaxWorkerPoolSize = 16
+
+// InstancePolicy is the effective lifecycle configuration of a service's running instances.
+// A zero IdleTimeout keeps idle instances running, a zero MaxInstances does not cap them.
+type InstancePolicy struct {
+	MinInstances int
+	MaxInstances int
+	IdleTimeout  time.Duration
+}
+
+// Defaults applied by GetCallPolicy to the delays of enabled resilience features
+const (
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// CallPolicy is the effective timeout, retry and circuit breaker configuration for calls to a service.
+// A zero Timeout, MaxRetries or BreakerThreshold disables that feature.
+type CallPolicy struct {
+	Timeout          time.Duration
+	MaxRetries       int
+	RetryBackoff     time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
 }
 
 // TableName sets the table name for the MCPService model
@@ -148,6 +299,318 @@ func (s *MCPService) GetRequiredEnvVars() ([]EnvVarDefinition, error) {
 	return envVars, nil
 }
 
+// GetCapabilityFilter returns the FilterJSON as a CapabilityFilter
+func (s *MCPService) GetCapabilityFilter() (CapabilityFilter, error) {
+	return parseCapabilityFilter(s.FilterJSON)
+}
+
+func parseCapabilityFilter(raw string) (CapabilityFilter, error) {
+	var filter CapabilityFilter
+	if raw == "" || raw == "{}" {
+		return filter, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+		return CapabilityFilter{}, err
+	}
+	return filter, nil
+}
+
+// SetCapabilityFilter sets the FilterJSON field from a CapabilityFilter
+func (s *MCPService) SetCapabilityFilter(filter CapabilityFilter) error {
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	s.FilterJSON = string(data)
+	return nil
+}
+
+// GetToolOverrides returns the ToolOverridesJSON as a map keyed by upstream tool name
+func (s *MCPService) GetToolOverrides() (map[string]ToolOverride, error) {
+	overrides := make(map[string]ToolOverride)
+	if s.ToolOverridesJSON == "" || s.ToolOverridesJSON == "{}" {
+		return overrides, nil
+	}
+	if err := json.Unmarshal([]byte(s.ToolOverridesJSON), &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// SetToolOverrides sets the ToolOverridesJSON field from a map keyed by upstream tool name
+func (s *MCPService) SetToolOverrides(overrides map[string]ToolOverride) error {
+	if overrides == nil {
+		overrides = make(map[string]ToolOverride)
+	}
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	s.ToolOverridesJSON = string(data)
+	return nil
+}
+
+// ValidateToolOverrides checks that no two overridden tools would be exposed under the same name
+func ValidateToolOverrides(overrides map[string]ToolOverride) error {
+	exposed := make(map[string]string)
+	for upstream, override := range overrides {
+		name := upstream
+		if override.Name != "" {
+			name = override.Name
+		}
+		if other, taken := exposed[name]; taken {
+			return fmt.Errorf("tools %s and %s would both be exposed as %s", other, upstream, name)
+		}
+		exposed[name] = upstream
+	}
+	return nil
+}
+
+// GetCallPolicy resolves the service's resilience settings. The timeout, retries and circuit breaker
+// stay disabled unless set; the delays of the enabled ones default when unset. Negative values saved
+// before 0 meant disabled are treated as 0.
+func (s *MCPService) GetCallPolicy() CallPolicy {
+	policy := CallPolicy{
+		Timeout:          time.Duration(max(s.CallTimeoutSeconds, 0)) * time.Second,
+		MaxRetries:       max(s.MaxRetries, 0),
+		RetryBackoff:     time.Duration(s.RetryBackoffMs) * time.Millisecond,
+		BreakerThreshold: max(s.BreakerThreshold, 0),
+		BreakerCooldown:  time.Duration(s.BreakerCooldownSeconds) * time.Second,
+	}
+	if policy.RetryBackoff <= 0 {
+		policy.RetryBackoff = DefaultRetryBackoff
+	}
+	if policy.BreakerCooldown <= 0 {
+		policy.BreakerCooldown = DefaultBreakerCooldown
+	}
+	return policy
+}
+
+// ValidateCallPolicy checks the resilience settings, which are disabled by 0 and never negative
+func (s *MCPService) ValidateCallPolicy() error {
+	for name, value := range map[string]int{
+		"call_timeout_seconds":     s.CallTimeoutSeconds,
+		"max_retries":              s.MaxRetries,
+		"retry_backoff_ms":         s.RetryBackoffMs,
+		"breaker_threshold":        s.BreakerThreshold,
+		"breaker_cooldown_seconds": s.BreakerCooldownSeconds,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// GetInstancePolicy resolves the service's instance lifecycle settings. Idle instances are only shut
+// down for services that opt in with an idle timeout; negative values saved when they meant "never"
+// keep meaning it.
+func (s *MCPService) GetInstancePolicy() InstancePolicy {
+	return InstancePolicy{
+		MinInstances: s.MinInstances,
+		MaxInstances: s.MaxInstances,
+		IdleTimeout:  time.Duration(max(s.IdleTimeoutSeconds, 0)) * time.Second,
+	}
+}
+
+// ValidateInstancePolicy checks the instance lifecycle settings
+func (s *MCPService) ValidateInstancePolicy() error {
+	if s.MinInstances < 0 || s.MaxInstances < 0 {
+		return errors.New("min_instances and max_instances must not be negative")
+	}
+	if s.IdleTimeoutSeconds < 0 {
+		return errors.New("idle_timeout_seconds must not be negative")
+	}
+	if s.MaxInstances > 0 && s.MaxInstances < s.MinInstances {
+		return fmt.Errorf("max_instances (%d) must not be lower than min_instances (%d)", s.MaxInstances, s.MinInstances)
+	}
+	return nil
+}
+
+// GetWorkerPoolSize returns the number of stdio processes an instance of the service runs
+func (s *MCPService) GetWorkerPoolSize() int {
+	if s.Type != ServiceTypeStdio || s.WorkerPoolSize < 1 {
+		return 1
+	}
+	return min(s.WorkerPoolSize, MaxWorkerPoolSize)
+}
+
+// ValidateWorkerPool checks the stdio worker pool settings
+func (s *MCPService) ValidateWorkerPool() error {
+	if s.WorkerPoolSize < 0 || s.WorkerPoolSize > MaxWorkerPoolSize {
+		return fmt.Errorf("worker_pool_size must be between 0 and %d", MaxWorkerPoolSize)
+	}
+	return nil
+}
+
+// GetSandboxPolicy returns the execution policy of the service's stdio processes
+func (s *MCPService) GetSandboxPolicy() SandboxPolicy {
+	if !s.SandboxEnabled {
+		return SandboxPolicy{}
+	}
+	workDir := s.SandboxWorkDir
+	if workDir == "" {
+		workDir = filepath.Join(common.SandboxBaseDir, fmt.Sprintf("service-%d", s.ID))
+	}
+	return SandboxPolicy{
+		Enabled:      true,
+		WorkDir:      workDir,
+		MemoryMB:     s.SandboxMemoryMB,
+		CPUSeconds:   s.SandboxCPUSeconds,
+		MaxOpenFiles: s.SandboxMaxOpenFiles,
+		Isolate:      s.SandboxIsolate,
+		ReadOnly:     s.SandboxReadOnly,
+		KillOnExceed: s.SandboxKillOnExceed,
+	}
+}
+
+// ValidateSandboxPolicy checks the execution policy settings
+func (s *MCPService) ValidateSandboxPolicy() error {
+	if s.SandboxMemoryMB < 0 || s.SandboxCPUSeconds < 0 || s.SandboxMaxOpenFiles < 0 {
+		return errors.New("sandbox limits must not be negative")
+	}
+	if s.SandboxWorkDir != "" && !filepath.IsAbs(s.SandboxWorkDir) {
+		return errors.New("sandbox_work_dir must be an absolute path")
+	}
+	if s.SandboxEnabled && s.Type != ServiceTypeStdio {
+		return errors.New("only stdio services can be sandboxed")
+	}
+	return nil
+}
+
+// headerPlaceholder matches the ${user.KEY} placeholders of a header value, KEY being a user
+// configuration key of the service
+var headerPlaceholder = regexp.MustCompile(`\$\{user\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// GetHeaders returns the custom request headers sent to an SSE or streamable HTTP upstream,
+// placeholders unresolved
+func (s *MCPService) GetHeaders() (map[string]string, error) {
+	headers := make(map[string]string)
+	if s.HeadersJSON == "" || s.HeadersJSON == "{}" {
+		return headers, nil
+	}
+	if err := json.Unmarshal([]byte(s.HeadersJSON), &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// HasUserHeaders reports whether the service's headers take values from the configuration of the
+// user an instance is started for
+func (s *MCPService) HasUserHeaders() bool {
+	if s.Type == ServiceTypeStdio {
+		return false
+	}
+	headers, err := s.GetHeaders()
+	if err != nil {
+		return false
+	}
+	for _, value := range headers {
+		if headerPlaceholder.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveHeaders returns the service's headers with their placeholders replaced by values. A header
+// with a placeholder whose value is not set is left out rather than sent incomplete; the missing
+// keys are returned.
+func (s *MCPService) ResolveHeaders(values map[string]string) (map[string]string, []string, error) {
+	headers, err := s.GetHeaders()
+	if err != nil {
+		return nil, nil, err
+	}
+	var missing []string
+	for name, value := range headers {
+		complete := true
+		headers[name] = headerPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+			key := headerPlaceholder.FindStringSubmatch(placeholder)[1]
+			resolved, ok := values[key]
+			if !ok || resolved == "" {
+				complete = false
+				missing = append(missing, key)
+			}
+			return resolved
+		})
+		if !complete {
+			delete(headers, name)
+		}
+	}
+	return headers, missing, nil
+}
+
+// ValidateHeaders checks the custom request headers and their placeholders
+func (s *MCPService) ValidateHeaders() error {
+	headers, err := s.GetHeaders()
+	if err != nil {
+		return fmt.Errorf("headers_json must be a JSON object of strings: %w", err)
+	}
+	for name, value := range headers {
+		if strings.Contains(headerPlaceholder.ReplaceAllString(value, ""), "${") {
+			return fmt.Errorf("header %s has an invalid placeholder, use ${user.KEY}", name)
+		}
+	}
+	return nil
+}
+
+// SetOAuthClientSecret stores the OAuth client secret encrypted
+func (s *MCPService) SetOAuthClientSecret(secret string) error {
+	if secret == "" {
+		s.OAuthClientSecret = ""
+		return nil
+	}
+	encrypted, err := common.EncryptSecret(secret)
+	if err != nil {
+		return err
+	}
+	s.OAuthClientSecret = encrypted
+	return nil
+}
+
+// GetOAuthClientSecret returns the decrypted OAuth client secret
+func (s *MCPService) GetOAuthClientSecret() (string, error) {
+	if s.OAuthClientSecret == "" {
+		return "", nil
+	}
+	return common.DecryptSecret(s.OAuthClientSecret)
+}
+
+// GetOAuthScopes returns the scopes to request from the authorization server
+func (s *MCPService) GetOAuthScopes() []string {
+	return strings.Fields(s.OAuthScopes)
+}
+
+// ValidateOAuth checks the upstream OAuth settings
+func (s *MCPService) ValidateOAuth() error {
+	if !s.OAuthEnabled {
+		return nil
+	}
+	if s.Type != ServiceTypeSSE && s.Type != ServiceTypeStreamableHTTP {
+		return errors.New("only SSE and streamable HTTP services can authorize with OAuth")
+	}
+	if common.SecretEncryptionKey == "" {
+		common.SysError(fmt.Sprintf("[OAuth] Refusing to enable OAuth on %s: set SECRET_ENCRYPTION_KEY so its tokens survive restarts", s.Name))
+		return fmt.Errorf("OAuth needs a stable encryption key for its tokens: %w", common.ErrNoSecretEncryptionKey)
+	}
+	if s.OAuthMetadataURL != "" {
+		if u, err := url.Parse(s.OAuthMetadataURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("oauth_metadata_url must be an absolute URL")
+		}
+	}
+	return nil
+}
+
+// HasUserInstances reports whether users get instances of their own: for stdio services, which run
+// with the user's environment, remote services whose headers take values from the user's
+// configuration, and remote services each user authorizes to with OAuth
+func (s *MCPService) HasUserInstances() bool {
+	if s.OAuthEnabled && s.OAuthPerUser {
+		return true
+	}
+	return s.AllowUserOverride && (s.Type == ServiceTypeStdio || s.HasUserHeaders())
+}
+
 var MCPServiceDB *thing.Thing[*MCPService]
 
 // MCPServiceInit initializes the MCPServiceDB
@@ -192,6 +655,7 @@ func CreateService(service *MCPService) error {
 
 // UpdateService updates an existing MCP service
 func UpdateService(service *MCPService) error {
+	defer accessChanged()
 	return MCPServiceDB.Save(service)
 }
 
@@ -201,6 +665,10 @@ func DeleteService(id int64) error {
 	if err != nil {
 		return err
 	}
+	if err := deleteServiceUpstreamOAuthTokens(id); err != nil {
+		return err
+	}
+	defer accessChanged()
 	return MCPServiceDB.Delete(service)
 }
 
@@ -212,6 +680,7 @@ func ToggleServiceEnabled(id int64) error {
 	}
 
 	service.Enabled = !service.Enabled
+	defer accessChanged()
 	return MCPServiceDB.Save(service)
 }
 
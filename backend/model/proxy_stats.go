@@ -148,9 +148,41 @@ func RecordRequestStat(serviceID int64, serviceName string, userID int64, reqTyp
 				common.SysLog(fmt.Sprintf("[RecordRequestStat-CACHE] User %d daily count for service %d: %d", userID, serviceID, userNewCount))
 			}
 		}
+
+		// Increment the counts of the user's teams, which share team-scoped limits
+		if userID > 0 {
+			incrementTeamDailyCounts(ctx, cacheClient, today, serviceID, userID)
+		}
 	} else {
 		common.SysLog(fmt.Sprintf("[RecordRequestStat-CACHE] Daily count for service %s (ID: %d) not incremented due to status code: %d", serviceName, serviceID, statusCode))
 	}
 }
 
+// TeamRequestCountKey is the cache key counting the requests of the members of a team to a service on a day
+func TeamRequestCountKey(day string, serviceID, teamID int64) string {
+	return fmt.Sprintf("team_request:%s:%d:%d:count", day, serviceID, teamID)
+}
+
+// incrementTeamDailyCounts increments the daily request count of a service for each team of a user
+func incrementTeamDailyCounts(ctx context.Context, cacheClient thing.CacheClient, today string, serviceID, userID int64) {
+	teamIDs, err := GetUserTeamIDs(userID)
+	if err != nil {
+		common.SysError(fmt.Sprintf("[RecordRequestStat-CACHE] Error getting teams of user %d: %v", userID, err))
+		return
+	}
+	for _, teamID := range teamIDs {
+		key := TeamRequestCountKey(today, serviceID, teamID)
+		count, err := cacheClient.Incr(ctx, key)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[RecordRequestStat-CACHE] Error incrementing team daily count for service %d, team %d: %v", serviceID, teamID, err))
+			continue
+		}
+		if count == 1 {
+			if err := cacheClient.Expire(ctx, key, 24*time.Hour); err != nil {
+				common.SysError(fmt.Sprintf("[RecordRequestStat-CACHE] Error setting expiration for team daily count key %s: %v", key, err))
+			}
+		}
+	}
+}
+
 // TODO: Consider if a separate model for aggregated stats is needed, or if aggregation will be done via queries.
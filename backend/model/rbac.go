@@ -0,0 +1,215 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"toWers/backend/common"
+
+	"github.com/burugo/thing"
+)
+
+// Permissions checked by the API. Built-in roles grant a fixed set of them; custom roles grant
+// any subset on top of the built-in role of a user.
+const (
+	PermissionServiceInstall      = "service.install"       // Install, import, create and uninstall services
+	PermissionServiceEdit         = "service.edit"          // Edit and toggle services, their default env and their permissions
+	PermissionServiceRestart      = "service.restart"       // List, restart and kill running instances
+	PermissionServiceViewLogs     = "service.view_logs"     // Read service logs
+	PermissionVirtualServerManage = "virtual_server.manage" // Create, edit and delete virtual servers
+	PermissionUserManage          = "user.manage"           // Manage users and service accounts
+	PermissionTeamManage          = "team.manage"           // Create, edit and delete teams and manage the members of any team
+	PermissionRoleManage          = "role.manage"           // Define custom roles and assign them to users
+	PermissionOptionEdit          = "option.edit"           // Edit system options
+	PermissionAnalyticsViewAll    = "analytics.view_all"    // View the request metrics of every user, not only one's own
+)
+
+// AllPermissions lists every permission, in display order
+var AllPermissions = []string{
+	PermissionServiceInstall,
+	PermissionServiceEdit,
+	PermissionServiceRestart,
+	PermissionServiceViewLogs,
+	PermissionVirtualServerManage,
+	PermissionUserManage,
+	PermissionTeamManage,
+	PermissionRoleManage,
+	PermissionOptionEdit,
+	PermissionAnalyticsViewAll,
+}
+
+// builtinRolePermissions returns the permissions granted by a built-in role level. Root users
+// have every permission and admins every permission but editing options and roles, as they
+// had before permissions existed.
+func builtinRolePermissions(role int) []string {
+	switch {
+	case role >= common.RoleRootUser:
+		return AllPermissions
+	case role >= common.RoleAdminUser:
+		return slices.DeleteFunc(slices.Clone(AllPermissions), func(p string) bool {
+			return p == PermissionOptionEdit || p == PermissionRoleManage
+		})
+	default:
+		return nil
+	}
+}
+
+// IsValidPermission reports whether permission is a known permission
+func IsValidPermission(permission string) bool {
+	return slices.Contains(AllPermissions, permission)
+}
+
+// CustomRole is a named set of permissions assigned to users on top of their built-in role
+type CustomRole struct {
+	thing.BaseModel
+	Name            string `json:"name" db:"name,unique"`
+	Description     string `json:"description" db:"description"`
+	PermissionsJSON string `json:"permissions_json" db:"permissions_json,default:'[]'"` // JSON array of permission names
+}
+
+// TableName sets the table name for the CustomRole model
+func (r *CustomRole) TableName() string {
+	return "custom_roles"
+}
+
+// GetPermissions returns the permissions of the role
+func (r *CustomRole) GetPermissions() []string {
+	permissions := []string{}
+	if r.PermissionsJSON != "" {
+		if err := json.Unmarshal([]byte(r.PermissionsJSON), &permissions); err != nil {
+			common.SysError(fmt.Sprintf("[RBAC] WARN: invalid permissions of role %s: %v", r.Name, err))
+		}
+	}
+	return permissions
+}
+
+// SetPermissions sets the PermissionsJSON field from a list of permissions
+func (r *CustomRole) SetPermissions(permissions []string) error {
+	if permissions == nil {
+		permissions = []string{}
+	}
+	data, err := json.Marshal(permissions)
+	if err != nil {
+		return err
+	}
+	r.PermissionsJSON = string(data)
+	return nil
+}
+
+var CustomRoleDB *thing.Thing[*CustomRole]
+
+// CustomRoleInit initializes CustomRoleDB
+func CustomRoleInit() error {
+	var err error
+	CustomRoleDB, err = thing.Use[*CustomRole]()
+	if err != nil {
+		return fmt.Errorf("failed to initialize CustomRoleDB: %w", err)
+	}
+	return nil
+}
+
+// ErrCustomRoleNotFound is returned for an unknown custom role
+var ErrCustomRoleNotFound = errors.New("custom role not found")
+
+// GetAllCustomRoles returns every custom role
+func GetAllCustomRoles() ([]*CustomRole, error) {
+	return CustomRoleDB.Order("id ASC").All()
+}
+
+// GetCustomRoleByID returns the custom role with the given ID
+func GetCustomRoleByID(id int64) (*CustomRole, error) {
+	role, err := CustomRoleDB.ByID(id)
+	if err != nil || role == nil {
+		return nil, ErrCustomRoleNotFound
+	}
+	return role, nil
+}
+
+// GetCustomRoleByName returns the custom role with the given name
+func GetCustomRoleByName(name string) (*CustomRole, error) {
+	roles, err := CustomRoleDB.Where("name = ?", name).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, ErrCustomRoleNotFound
+	}
+	return roles[0], nil
+}
+
+// SaveCustomRole creates or updates a custom role
+func SaveCustomRole(role *CustomRole) error {
+	return CustomRoleDB.Save(role)
+}
+
+// DeleteCustomRole deletes a custom role and unassigns it from its users
+func DeleteCustomRole(role *CustomRole) error {
+	users, err := UserDB.Where("custom_role_id = ?", role.ID).All()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		user.CustomRoleID = 0
+		if err := UserDB.Save(user); err != nil {
+			return err
+		}
+	}
+	return CustomRoleDB.Delete(role)
+}
+
+// GetPermissions returns the permissions of the user: those of their built-in role and of their
+// custom role, if any
+func (user *User) GetPermissions() []string {
+	permissions := slices.Clone(builtinRolePermissions(user.Role))
+	if user.CustomRoleID != 0 {
+		role, err := GetCustomRoleByID(user.CustomRoleID)
+		if err != nil {
+			common.SysError(fmt.Sprintf("[RBAC] WARN: custom role %d of user %d not found", user.CustomRoleID, user.ID))
+		} else {
+			for _, p := range role.GetPermissions() {
+				if !slices.Contains(permissions, p) {
+					permissions = append(permissions, p)
+				}
+			}
+		}
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+	return permissions
+}
+
+// HasPermission reports whether the user has the permission
+func (user *User) HasPermission(permission string) bool {
+	return slices.Contains(user.GetPermissions(), permission)
+}
+
+// HasAllPermissions reports whether the user has every one of the permissions
+func (user *User) HasAllPermissions(permissions []string) bool {
+	own := user.GetPermissions()
+	for _, p := range permissions {
+		if !slices.Contains(own, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// OutranksPermissions reports whether the user has every one of the permissions and at least
+// one more, so that nobody manages a peer with the same rights
+func (user *User) OutranksPermissions(permissions []string) bool {
+	for _, p := range user.GetPermissions() {
+		if !slices.Contains(permissions, p) {
+			return user.HasAllPermissions(permissions)
+		}
+	}
+	return false
+}
+
+// CanGrantRole reports whether the user outranks a built-in role level, so that giving it to
+// someone else grants less than they have themselves, as the role levels used to require
+func (user *User) CanGrantRole(role int) bool {
+	return user.OutranksPermissions(builtinRolePermissions(role))
+}
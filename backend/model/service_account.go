@@ -0,0 +1,132 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"toWers/backend/common"
+)
+
+// Service accounts are users flagged IsServiceAccount. They call /proxy with API tokens, so they
+// get their own env configs (UserConfig), RPD counters and request statistics, but have no
+// password and cannot log in to the web UI. An account owned by a team is a member of it, so it
+// reaches the team's services with its env config and limits, and the team's admins manage it.
+
+// ErrServiceAccountNotFound is returned for an unknown ID or the ID of a human user
+var ErrServiceAccountNotFound = errors.New("service account not found")
+
+// GetServiceAccounts lists service accounts, those of ownerID only unless it is 0
+func GetServiceAccounts(ownerID int64) ([]*User, error) {
+	if ownerID == 0 {
+		return UserDB.Where("is_service_account = ?", true).Order("id ASC").All()
+	}
+	return UserDB.Where("is_service_account = ? AND owner_id = ?", true, ownerID).Order("id ASC").All()
+}
+
+// GetServiceAccountByID returns the service account with the given ID
+func GetServiceAccountByID(id int64) (*User, error) {
+	user, err := GetUserById(id, false)
+	if err != nil || user == nil || !user.IsServiceAccount {
+		return nil, ErrServiceAccountNotFound
+	}
+	return user, nil
+}
+
+// GetTeamServiceAccounts lists the service accounts owned by a team
+func GetTeamServiceAccounts(teamID int64) ([]*User, error) {
+	return UserDB.Where("is_service_account = ? AND owner_team_id = ?", true, teamID).Order("id ASC").All()
+}
+
+// CreateServiceAccount saves a new enabled service account created by ownerID, owned by the team
+// teamID and added to it as a member unless teamID is 0
+func CreateServiceAccount(account *User, ownerID, teamID int64) error {
+	account.IsServiceAccount = true
+	account.OwnerID = ownerID
+	account.OwnerTeamID = teamID
+	account.Password = ""
+	account.Role = common.RoleCommonUser
+	account.Status = common.UserStatusEnabled
+	if err := UserDB.Save(account); err != nil {
+		return err
+	}
+	if teamID == 0 {
+		return nil
+	}
+	_, err := SaveTeamMember(teamID, account.ID, TeamRoleMember)
+	return err
+}
+
+// DeleteServiceAccount deletes a service account along with its API tokens, team memberships and env configs
+func DeleteServiceAccount(account *User) error {
+	tokens, err := GetUserAPITokens(account.ID)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := DeleteAPIToken(token); err != nil {
+			return err
+		}
+	}
+	memberships, err := GetUserTeamMemberships(account.ID)
+	if err != nil {
+		return err
+	}
+	for _, membership := range memberships {
+		if err := DeleteTeamMember(membership); err != nil {
+			return err
+		}
+	}
+	configs, err := GetUserConfigsForUser(account.ID)
+	if err != nil {
+		return err
+	}
+	for _, config := range configs {
+		if err := UserConfigDB.Delete(config); err != nil {
+			return err
+		}
+	}
+	return UserDB.SoftDelete(account)
+}
+
+// ServiceUsage summarizes the requests made to a service
+type ServiceUsage struct {
+	ServiceID      int64   `json:"service_id"`
+	ServiceName    string  `json:"service_name"`
+	Requests       int64   `json:"requests"`
+	Failures       int64   `json:"failures"`
+	AvgLatencyMs   float64 `json:"avg_latency_ms"`
+	LastRequestAt  int64   `json:"last_request_at"` // Unix seconds
+	totalLatencyMs int64
+}
+
+// GetServiceUsage summarizes the proxied requests of some users since the given time, per service
+func GetServiceUsage(userIDs []int64, since time.Time) ([]*ServiceUsage, error) {
+	statThing, err := GetProxyRequestStatThing()
+	if err != nil {
+		return nil, err
+	}
+	usage := []*ServiceUsage{}
+	byService := make(map[int64]*ServiceUsage)
+	for _, userID := range userIDs {
+		stats, err := statThing.Where("user_id = ? AND created_at >= ?", userID, since).Order("id ASC").All()
+		if err != nil {
+			return nil, err
+		}
+		for _, stat := range stats {
+			u, ok := byService[stat.ServiceID]
+			if !ok {
+				u = &ServiceUsage{ServiceID: stat.ServiceID, ServiceName: stat.ServiceName}
+				byService[stat.ServiceID] = u
+				usage = append(usage, u)
+			}
+			u.Requests++
+			if !stat.Success {
+				u.Failures++
+			}
+			u.totalLatencyMs += stat.ResponseTimeMs
+			u.AvgLatencyMs = float64(u.totalLatencyMs) / float64(u.Requests)
+			u.LastRequestAt = max(u.LastRequestAt, stat.CreatedAt.Unix())
+		}
+	}
+	return usage, nil
+}
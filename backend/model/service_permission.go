@@ -0,0 +1,187 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/burugo/thing"
+)
+
+// Subject types a ServicePermission can be granted to
+const (
+	PermissionSubjectUser = "user"
+	PermissionSubjectTeam = "team"
+	PermissionSubjectRole = "role"
+)
+
+// ServicePermission grants a user, a team or a role access to an MCPService, optionally limited to
+// a subset of its tools, prompts and resources.
+// A service without any permission entries stays open to every authenticated user.
+type ServicePermission struct {
+	thing.BaseModel
+	ServiceID   int64  `json:"service_id" db:"service_id,index:idx_service_permission_service"`
+	SubjectType string `json:"subject_type" db:"subject_type"`            // "user", "team" or "role"
+	SubjectID   int64  `json:"subject_id" db:"subject_id"`                // User or team ID, or the minimum role level for "role"
+	FilterJSON  string `json:"filter_json" db:"filter_json,default:'{}'"` // JSON CapabilityFilter, empty allows everything the service exposes
+}
+
+// TableName sets the table name for the ServicePermission model
+func (p *ServicePermission) TableName() string {
+	return "service_permissions"
+}
+
+// GetCapabilityFilter returns the FilterJSON as a CapabilityFilter
+func (p *ServicePermission) GetCapabilityFilter() (CapabilityFilter, error) {
+	return parseCapabilityFilter(p.FilterJSON)
+}
+
+// SetCapabilityFilter sets the FilterJSON field from a CapabilityFilter
+func (p *ServicePermission) SetCapabilityFilter(filter CapabilityFilter) error {
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	p.FilterJSON = string(data)
+	return nil
+}
+
+var ServicePermissionDB *thing.Thing[*ServicePermission]
+
+// ServicePermissionInit initializes the ServicePermissionDB
+func ServicePermissionInit() error {
+	var err error
+	ServicePermissionDB, err = thing.Use[*ServicePermission]()
+	if err != nil {
+		return fmt.Errorf("failed to initialize ServicePermissionDB: %w", err)
+	}
+	accessChanged()
+	return nil
+}
+
+// accessVersion is incremented whenever a service, its capability filter or its permissions change
+var accessVersion atomic.Int64
+
+// AccessVersion returns the current version of the access settings of services. Caches of resolved
+// capability filters stay valid while it is unchanged.
+func AccessVersion() int64 {
+	return accessVersion.Load()
+}
+
+func accessChanged() {
+	accessVersion.Add(1)
+}
+
+// GetServicePermissions returns all permission entries of a service
+func GetServicePermissions(serviceID int64) ([]*ServicePermission, error) {
+	return ServicePermissionDB.Where("service_id = ?", serviceID).Order("subject_type ASC, subject_id ASC").All()
+}
+
+// GetServicePermissionByID retrieves a specific permission entry by ID
+func GetServicePermissionByID(id int64) (*ServicePermission, error) {
+	return ServicePermissionDB.ByID(id)
+}
+
+// SaveServicePermission creates or updates a permission entry
+func SaveServicePermission(permission *ServicePermission) error {
+	defer accessChanged()
+	return ServicePermissionDB.Save(permission)
+}
+
+// DeleteServicePermission deletes a permission entry
+func DeleteServicePermission(id int64) error {
+	permission, err := GetServicePermissionByID(id)
+	if err != nil {
+		return err
+	}
+	defer accessChanged()
+	return ServicePermissionDB.Delete(permission)
+}
+
+// ResolveServiceAccess decides whether user may use service, and which capability filter applies to them.
+// Users who may edit services, and so their permissions, always have full access. AdminOnly
+// services are closed to everyone else.
+// A user-specific entry takes precedence over team entries, which take precedence over role
+// entries. Among team entries the oldest of the user's teams wins; among role entries the
+// highest role level not above the user's role wins.
+func ResolveServiceAccess(user *User, service *MCPService) (CapabilityFilter, bool, error) {
+	if user.HasPermission(PermissionServiceEdit) {
+		return CapabilityFilter{}, true, nil
+	}
+	if service.AdminOnly {
+		return CapabilityFilter{}, false, nil
+	}
+
+	permissions, err := GetServicePermissions(service.ID)
+	if err != nil {
+		return CapabilityFilter{}, false, err
+	}
+	if len(permissions) == 0 {
+		return CapabilityFilter{}, true, nil
+	}
+
+	teamIDs, err := GetUserTeamIDs(user.ID)
+	if err != nil {
+		return CapabilityFilter{}, false, err
+	}
+	inTeam := make(map[int64]bool, len(teamIDs))
+	for _, id := range teamIDs {
+		inTeam[id] = true
+	}
+
+	var match *ServicePermission
+	for _, p := range permissions {
+		switch p.SubjectType {
+		case PermissionSubjectUser:
+			if p.SubjectID == user.ID {
+				match = p
+			}
+		case PermissionSubjectTeam:
+			// Permissions are ordered by subject ID, so the oldest team wins as in GetTeamEnvsForUser
+			if inTeam[p.SubjectID] && (match == nil || match.SubjectType == PermissionSubjectRole) {
+				match = p
+			}
+		case PermissionSubjectRole:
+			if p.SubjectID <= int64(user.Role) && (match == nil || (match.SubjectType == PermissionSubjectRole && p.SubjectID > match.SubjectID)) {
+				match = p
+			}
+		}
+		if match != nil && match.SubjectType == PermissionSubjectUser {
+			break
+		}
+	}
+	if match == nil {
+		return CapabilityFilter{}, false, nil
+	}
+
+	filter, err := match.GetCapabilityFilter()
+	if err != nil {
+		return CapabilityFilter{}, false, err
+	}
+	return filter, true, nil
+}
+
+var (
+	// ErrProxyTargetNotFound is returned for a name that is neither a service nor a virtual server
+	ErrProxyTargetNotFound = errors.New("service not found")
+	// ErrProxyAccessDenied is returned for a service the user may not use
+	ErrProxyAccessDenied = errors.New("access denied to service")
+)
+
+// CheckProxyAccess checks name is a service or virtual server served under /proxy that user may use.
+// Members of a virtual server are checked per request instead, as for any caller of it.
+func CheckProxyAccess(user *User, name string) error {
+	if service, err := GetServiceByName(name); err == nil && service != nil {
+		if _, allowed, err := ResolveServiceAccess(user, service); err != nil {
+			return err
+		} else if !allowed {
+			return ErrProxyAccessDenied
+		}
+		return nil
+	}
+	if vs, err := GetVirtualServerByName(name); err == nil && vs != nil {
+		return nil
+	}
+	return ErrProxyTargetNotFound
+}
@@ -0,0 +1,279 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/burugo/thing"
+)
+
+// Roles of a user within a team
+const (
+	TeamRoleMember = "member"
+	TeamRoleAdmin  = "admin" // Manages the members and the env config of the team
+)
+
+// Team groups users sharing services, env config and request limits. Services are enabled for a
+// team with a ServicePermission of subject type "team"; team env config (TeamConfig) applies
+// between the service defaults and each member's own config.
+type Team struct {
+	thing.BaseModel
+	Name        string `json:"name" db:"name,unique"`
+	DisplayName string `json:"display_name" db:"display_name"`
+	Description string `json:"description" db:"description"`
+	RPDLimit    int    `json:"rpd_limit" db:"rpd_limit"` // Daily requests per service of all members together, 0 for no team limit
+}
+
+// TableName sets the table name for the Team model
+func (t *Team) TableName() string {
+	return "teams"
+}
+
+// TeamMember makes a user a member of a team
+type TeamMember struct {
+	thing.BaseModel
+	TeamID int64  `json:"team_id" db:"team_id,index:idx_team_member"`
+	UserID int64  `json:"user_id" db:"user_id,index:idx_team_member_user"`
+	Role   string `json:"role" db:"role"` // "member" or "admin"
+}
+
+// TableName sets the table name for the TeamMember model
+func (m *TeamMember) TableName() string {
+	return "team_members"
+}
+
+// TeamConfig is the value of a service setting for all members of a team
+type TeamConfig struct {
+	thing.BaseModel
+	TeamID    int64  `json:"team_id" db:"team_id,index:idx_team_config"`
+	ServiceID int64  `json:"service_id" db:"service_id,index:idx_team_config"`
+	ConfigID  int64  `json:"config_id" db:"config_id,index:idx_team_config"`
+	Value     string `json:"value" db:"value"`
+}
+
+// TableName sets the table name for the TeamConfig model
+func (c *TeamConfig) TableName() string {
+	return "team_configs"
+}
+
+var (
+	TeamDB       *thing.Thing[*Team]
+	TeamMemberDB *thing.Thing[*TeamMember]
+	TeamConfigDB *thing.Thing[*TeamConfig]
+)
+
+// TeamInit initializes TeamDB, TeamMemberDB and TeamConfigDB
+func TeamInit() error {
+	var err error
+	if TeamDB, err = thing.Use[*Team](); err != nil {
+		return fmt.Errorf("failed to initialize TeamDB: %w", err)
+	}
+	if TeamMemberDB, err = thing.Use[*TeamMember](); err != nil {
+		return fmt.Errorf("failed to initialize TeamMemberDB: %w", err)
+	}
+	if TeamConfigDB, err = thing.Use[*TeamConfig](); err != nil {
+		return fmt.Errorf("failed to initialize TeamConfigDB: %w", err)
+	}
+	return nil
+}
+
+var (
+	// ErrTeamNotFound is returned for an unknown team
+	ErrTeamNotFound = errors.New("team not found")
+	// ErrTeamMemberNotFound is returned for a user who is not a member of the team
+	ErrTeamMemberNotFound = errors.New("team member not found")
+)
+
+// GetAllTeams returns every team
+func GetAllTeams() ([]*Team, error) {
+	return TeamDB.Order("id ASC").All()
+}
+
+// GetTeamByID returns the team with the given ID
+func GetTeamByID(id int64) (*Team, error) {
+	team, err := TeamDB.ByID(id)
+	if err != nil || team == nil {
+		return nil, ErrTeamNotFound
+	}
+	return team, nil
+}
+
+// GetTeamByName returns the team with the given name
+func GetTeamByName(name string) (*Team, error) {
+	teams, err := TeamDB.Where("name = ?", name).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(teams) == 0 {
+		return nil, ErrTeamNotFound
+	}
+	return teams[0], nil
+}
+
+// SaveTeam creates or updates a team
+func SaveTeam(team *Team) error {
+	return TeamDB.Save(team)
+}
+
+// DeleteTeam deletes a team with its service accounts, memberships, env config and service permissions
+func DeleteTeam(team *Team) error {
+	accounts, err := GetTeamServiceAccounts(team.ID)
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		if err := DeleteServiceAccount(account); err != nil {
+			return err
+		}
+	}
+	members, err := GetTeamMembers(team.ID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if err := TeamMemberDB.Delete(member); err != nil {
+			return err
+		}
+	}
+	configs, err := TeamConfigDB.Where("team_id = ?", team.ID).All()
+	if err != nil {
+		return err
+	}
+	for _, config := range configs {
+		if err := TeamConfigDB.Delete(config); err != nil {
+			return err
+		}
+	}
+	permissions, err := ServicePermissionDB.Where("subject_type = ? AND subject_id = ?", PermissionSubjectTeam, team.ID).All()
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if err := ServicePermissionDB.Delete(permission); err != nil {
+			return err
+		}
+	}
+	accessChanged()
+	return TeamDB.Delete(team)
+}
+
+// GetTeamMembers returns the memberships of a team
+func GetTeamMembers(teamID int64) ([]*TeamMember, error) {
+	return TeamMemberDB.Where("team_id = ?", teamID).Order("id ASC").All()
+}
+
+// GetTeamMemberIDs returns the IDs of the members of a team
+func GetTeamMemberIDs(teamID int64) ([]int64, error) {
+	members, err := GetTeamMembers(teamID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.UserID)
+	}
+	return ids, nil
+}
+
+// GetTeamMember returns the membership of a user in a team
+func GetTeamMember(teamID, userID int64) (*TeamMember, error) {
+	members, err := TeamMemberDB.Where("team_id = ? AND user_id = ?", teamID, userID).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, ErrTeamMemberNotFound
+	}
+	return members[0], nil
+}
+
+// SaveTeamMember adds a user to a team with the given role, or changes their role
+func SaveTeamMember(teamID, userID int64, role string) (*TeamMember, error) {
+	member, err := GetTeamMember(teamID, userID)
+	if errors.Is(err, ErrTeamMemberNotFound) {
+		member = &TeamMember{TeamID: teamID, UserID: userID}
+	} else if err != nil {
+		return nil, err
+	}
+	member.Role = role
+	return member, TeamMemberDB.Save(member)
+}
+
+// DeleteTeamMember removes a user from a team
+func DeleteTeamMember(member *TeamMember) error {
+	return TeamMemberDB.Delete(member)
+}
+
+// GetUserTeamMemberships returns the memberships of a user, oldest team first
+func GetUserTeamMemberships(userID int64) ([]*TeamMember, error) {
+	return TeamMemberDB.Where("user_id = ?", userID).Order("team_id ASC").All()
+}
+
+// GetUserTeamIDs returns the IDs of the teams of a user, in ascending order
+func GetUserTeamIDs(userID int64) ([]int64, error) {
+	memberships, err := GetUserTeamMemberships(userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(memberships))
+	for _, membership := range memberships {
+		ids = append(ids, membership.TeamID)
+	}
+	return ids, nil
+}
+
+// IsTeamAdmin reports whether a user is an admin of a team
+func IsTeamAdmin(teamID, userID int64) bool {
+	member, err := GetTeamMember(teamID, userID)
+	return err == nil && member.Role == TeamRoleAdmin
+}
+
+// GetTeamConfigs returns the env config of a team for a service
+func GetTeamConfigs(teamID, serviceID int64) ([]*TeamConfig, error) {
+	return TeamConfigDB.Where("team_id = ? AND service_id = ?", teamID, serviceID).All()
+}
+
+// GetAllTeamConfigs returns the env config of a team for every service
+func GetAllTeamConfigs(teamID int64) ([]*TeamConfig, error) {
+	return TeamConfigDB.Where("team_id = ?", teamID).Order("id ASC").All()
+}
+
+// SaveTeamConfig creates or updates a team config value
+func SaveTeamConfig(config *TeamConfig) error {
+	existing, err := TeamConfigDB.Where("team_id = ? AND config_id = ?", config.TeamID, config.ConfigID).Fetch(0, 1)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		existing[0].Value = config.Value
+		return TeamConfigDB.Save(existing[0])
+	}
+	return TeamConfigDB.Save(config)
+}
+
+// GetTeamEnvsForUser returns the environment variables the teams of a user set for a service.
+// A user in several teams gets the values of the oldest team on conflicts, the team whose
+// permission ResolveServiceAccess applies.
+func GetTeamEnvsForUser(userID, serviceID int64) (map[string]string, error) {
+	envs := make(map[string]string)
+	teamIDs, err := GetUserTeamIDs(userID)
+	if err != nil {
+		return envs, err
+	}
+	for _, teamID := range teamIDs {
+		configs, err := GetTeamConfigs(teamID, serviceID)
+		if err != nil {
+			return envs, err
+		}
+		for _, config := range configs {
+			option, err := ConfigServiceDB.ByID(config.ConfigID)
+			if err != nil || option.Key == "" {
+				continue
+			}
+			if _, set := envs[option.Key]; !set {
+				envs[option.Key] = config.Value
+			}
+		}
+	}
+	return envs, nil
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"toWers/backend/common"
+
+	"github.com/burugo/thing"
+)
+
+// UpstreamOAuthToken holds the OAuth token toWers uses to call an upstream MCP server, on behalf
+// of one user or, with UserID 0, of everyone
+type UpstreamOAuthToken struct {
+	thing.BaseModel
+	ServiceID int64  `json:"service_id" db:"service_id,index:idx_upstream_oauth_token"`
+	UserID    int64  `json:"user_id" db:"user_id,index:idx_upstream_oauth_token"` // 0 for the token shared by every user
+	TokenJSON string `json:"-" db:"token_json"`                                   // Encrypted JSON token, see SetToken
+}
+
+// TableName sets the table name for the UpstreamOAuthToken model
+func (t *UpstreamOAuthToken) TableName() string {
+	return "upstream_oauth_tokens"
+}
+
+// SetToken stores the JSON token encrypted
+func (t *UpstreamOAuthToken) SetToken(tokenJSON string) error {
+	encrypted, err := common.EncryptSecret(tokenJSON)
+	if err != nil {
+		return err
+	}
+	t.TokenJSON = encrypted
+	return nil
+}
+
+// GetToken returns the decrypted JSON token
+func (t *UpstreamOAuthToken) GetToken() (string, error) {
+	return common.DecryptSecret(t.TokenJSON)
+}
+
+var UpstreamOAuthTokenDB *thing.Thing[*UpstreamOAuthToken]
+
+// UpstreamOAuthTokenInit initializes the UpstreamOAuthTokenDB
+func UpstreamOAuthTokenInit() error {
+	var err error
+	UpstreamOAuthTokenDB, err = thing.Use[*UpstreamOAuthToken]()
+	if err != nil {
+		return fmt.Errorf("failed to initialize UpstreamOAuthTokenDB: %w", err)
+	}
+	return nil
+}
+
+// ErrUpstreamOAuthTokenNotFound is returned when no token was stored for a service and user
+var ErrUpstreamOAuthTokenNotFound = errors.New("upstream oauth token not found")
+
+// GetUpstreamOAuthToken returns the token stored for a service and user
+func GetUpstreamOAuthToken(serviceID, userID int64) (*UpstreamOAuthToken, error) {
+	tokens, err := UpstreamOAuthTokenDB.Where("service_id = ? AND user_id = ?", serviceID, userID).Fetch(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrUpstreamOAuthTokenNotFound
+	}
+	return tokens[0], nil
+}
+
+// SaveUpstreamOAuthToken stores the JSON token of a service and user, replacing the previous one
+func SaveUpstreamOAuthToken(serviceID, userID int64, tokenJSON string) error {
+	token, err := GetUpstreamOAuthToken(serviceID, userID)
+	if errors.Is(err, ErrUpstreamOAuthTokenNotFound) {
+		token = &UpstreamOAuthToken{ServiceID: serviceID, UserID: userID}
+	} else if err != nil {
+		return err
+	}
+	if err := token.SetToken(tokenJSON); err != nil {
+		return err
+	}
+	return UpstreamOAuthTokenDB.Save(token)
+}
+
+// DeleteUpstreamOAuthToken deletes the token of a service and user, if any
+func DeleteUpstreamOAuthToken(serviceID, userID int64) error {
+	token, err := GetUpstreamOAuthToken(serviceID, userID)
+	if errors.Is(err, ErrUpstreamOAuthTokenNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return UpstreamOAuthTokenDB.Delete(token)
+}
+
+// deleteServiceUpstreamOAuthTokens deletes every token of a service
+func deleteServiceUpstreamOAuthTokens(serviceID int64) error {
+	tokens, err := UpstreamOAuthTokenDB.Where("service_id = ?", serviceID).All()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := UpstreamOAuthTokenDB.Delete(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,10 +4,8 @@ import (
 	"errors" // Added for logging
 	"toWers/backend/common"
 	"strconv"
-	"strings"
 
 	"github.com/burugo/thing"
-	"github.com/google/uuid"
 )
 
 // User represents the user model in the database.
@@ -25,7 +23,12 @@ type User struct {
 	GoogleId         string `json:"google_id" db:"google_id"`
 	WeChatId         string `json:"wechat_id" db:"wechat_id"`
 	VerificationCode string `json:"verification_code" db:"-"`
-	Token            string `json:"token" db:"token"`
+	Token            string `json:"-" db:"token"`                               // Deprecated: moved to APIToken on startup, see migrateUserTokens
+	IsServiceAccount bool   `json:"is_service_account" db:"is_service_account"` // Machine account calling /proxy with API tokens, cannot log in
+	OwnerID          int64  `json:"owner_id" db:"owner_id"`                     // Admin managing a service account
+	OwnerTeamID      int64  `json:"owner_team_id" db:"owner_team_id"`           // Team owning a service account, whose admins manage it; 0 for none
+	RPDLimit         int    `json:"rpd_limit" db:"rpd_limit"`                   // Daily request limit per service of a service account, 0 for the service's own
+	CustomRoleID     int64  `json:"custom_role_id" db:"custom_role_id"`         // Custom role granting permissions on top of Role, 0 for none
 
 	// Fields from example, consider if needed later:
 	// LarkId           string `json:"lark_id" gorm:"column:lark_id;index"`
@@ -58,23 +61,25 @@ func GetMaxUserId() int64 {
 	return users[0].ID
 }
 
+// GetAllUsers lists human users; service accounts are listed by GetServiceAccounts
 func GetAllUsers(startIdx int, num int) ([]*User, error) {
-	return UserDB.Order("id DESC").Fetch(startIdx, num)
+	return UserDB.Where("is_service_account = ?", false).Order("id DESC").Fetch(startIdx, num)
 }
 
+// SearchUsers searches human users
 func SearchUsers(keyword string) ([]*User, error) {
 	// Try to convert keyword to number
 	if id, err := strconv.ParseUint(keyword, 10, 64); err == nil {
 		// keyword is a number, include ID search
 		return UserDB.Where(
-			"id = ? OR username LIKE ? OR email LIKE ? OR display_name LIKE ?",
-			id, keyword+"%", keyword+"%", keyword+"%",
+			"is_service_account = ? AND (id = ? OR username LIKE ? OR email LIKE ? OR display_name LIKE ?)",
+			false, id, keyword+"%", keyword+"%", keyword+"%",
 		).Order("id DESC").Fetch(0, 100)
 	} else {
 		// keyword is not a number, only search string fields
 		return UserDB.Where(
-			"username LIKE ? OR email LIKE ? OR display_name LIKE ?",
-			keyword+"%", keyword+"%", keyword+"%",
+			"is_service_account = ? AND (username LIKE ? OR email LIKE ? OR display_name LIKE ?)",
+			false, keyword+"%", keyword+"%", keyword+"%",
 		).Order("id DESC").Fetch(0, 100)
 	}
 }
@@ -118,34 +123,9 @@ func (user *User) Insert() error {
 		}
 	}
 
-	// Generate token if not already set
-	if user.Token == "" {
-		user.Token = GenerateUserToken()
-	}
-
 	return UserDB.Save(user)
 }
 
-// GenerateUserToken creates a new UUID token without dashes and ensures its uniqueness
-func GenerateUserToken() string {
-	for {
-		token := uuid.New().String()
-		token = strings.Replace(token, "-", "", -1)
-
-		existingUsers, err := UserDB.Where("token = ?", token).Fetch(0, 1)
-		if err != nil {
-			// Log the error or handle it appropriately.
-			// For now, we return a non-unique token in case of DB error to avoid infinite loop
-			// or panic, but a more robust solution might involve retries or specific error handling.
-			return "" // Or panic, or return an error. Returning empty for now.
-		}
-		if len(existingUsers) == 0 {
-			return token // Token is unique
-		}
-		// Regenerate token if duplicate found
-	}
-}
-
 func (user *User) Update(updatePassword bool) error {
 	if updatePassword {
 		var err error
@@ -176,7 +156,7 @@ func (user *User) ValidateAndFill() error {
 
 	okay := common.ValidatePasswordAndHash(user.Password, found.Password)
 
-	if !okay || found.Status != common.UserStatusEnabled {
+	if !okay || found.Status != common.UserStatusEnabled || found.IsServiceAccount {
 		return errors.New("invalid_username_or_password")
 	}
 	*user = *found
@@ -264,22 +244,12 @@ func ValidateUserToken(token string) *User {
 	return nil
 }
 
-// ValidateUserTokenByTokenString validates a user token string and returns the user if valid
+// ValidateUserTokenByTokenString validates an API token string and returns its owner if valid
 func ValidateUserTokenByTokenString(tokenString string) *User {
-	if tokenString == "" {
-		return nil
-	}
-
-	users, err := UserDB.Where("token = ?", tokenString).Fetch(0, 1)
-	if err != nil || len(users) == 0 {
-		return nil
-	}
-
-	user := users[0]
-	if user.Status != common.UserStatusEnabled {
+	_, user, err := ValidateAPIToken(tokenString)
+	if err != nil {
 		return nil
 	}
-
 	return user
 }
 
@@ -0,0 +1,99 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/burugo/thing"
+)
+
+// VirtualServerMember describes how one MCPService is composed into a VirtualServer
+type VirtualServerMember struct {
+	ServiceID        int64    `json:"service_id"`
+	Prefix           string   `json:"prefix,omitempty"`            // Namespace prefix for tools and prompts, defaults to the service name
+	IncludeTools     []string `json:"include_tools,omitempty"`     // Upstream tool names to expose, empty means all
+	IncludePrompts   []string `json:"include_prompts,omitempty"`   // Upstream prompt names to expose, empty means all
+	IncludeResources []string `json:"include_resources,omitempty"` // Upstream resource / template URIs to expose, empty means all
+}
+
+// VirtualServer composes the tools, prompts and resources of several MCPServices behind one proxy endpoint
+type VirtualServer struct {
+	thing.BaseModel
+	Name        string `json:"name" db:"name,index:idx_virtual_server_name"`
+	DisplayName string `json:"display_name" db:"display_name"`
+	Description string `json:"description" db:"description"`
+	Enabled     bool   `json:"enabled" db:"enabled"`
+	MembersJSON string `json:"members_json" db:"members_json,default:'[]'"` // JSON array of VirtualServerMember
+}
+
+// TableName sets the table name for the VirtualServer model
+func (v *VirtualServer) TableName() string {
+	return "virtual_servers"
+}
+
+// GetMembers returns the MembersJSON as a slice of VirtualServerMember
+func (v *VirtualServer) GetMembers() ([]VirtualServerMember, error) {
+	if v.MembersJSON == "" {
+		return []VirtualServerMember{}, nil
+	}
+
+	var members []VirtualServerMember
+	if err := json.Unmarshal([]byte(v.MembersJSON), &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SetMembers sets the MembersJSON field from a slice of VirtualServerMember
+func (v *VirtualServer) SetMembers(members []VirtualServerMember) error {
+	if members == nil {
+		members = []VirtualServerMember{}
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	v.MembersJSON = string(data)
+	return nil
+}
+
+var VirtualServerDB *thing.Thing[*VirtualServer]
+
+// VirtualServerInit initializes the VirtualServerDB
+func VirtualServerInit() error {
+	var err error
+	VirtualServerDB, err = thing.Use[*VirtualServer]()
+	if err != nil {
+		return fmt.Errorf("failed to initialize VirtualServerDB: %w", err)
+	}
+	return nil
+}
+
+// GetAllVirtualServers returns all virtual servers
+func GetAllVirtualServers() ([]*VirtualServer, error) {
+	return VirtualServerDB.Order("name ASC").All()
+}
+
+// GetVirtualServerByID retrieves a specific virtual server by ID
+func GetVirtualServerByID(id int64) (*VirtualServer, error) {
+	return VirtualServerDB.ByID(id)
+}
+
+// GetVirtualServerByName retrieves a specific virtual server by name
+func GetVirtualServerByName(name string) (*VirtualServer, error) {
+	return VirtualServerDB.Where("name = ?", name).First()
+}
+
+// SaveVirtualServer creates or updates a virtual server
+func SaveVirtualServer(vs *VirtualServer) error {
+	return VirtualServerDB.Save(vs)
+}
+
+// DeleteVirtualServer deletes a virtual server
+func DeleteVirtualServer(id int64) error {
+	vs, err := GetVirtualServerByID(id)
+	if err != nil {
+		return err
+	}
+	return VirtualServerDB.Delete(vs)
+}
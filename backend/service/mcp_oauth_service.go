@@ -0,0 +1,459 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"toWers/backend/common"
+	"toWers/backend/model"
+)
+
+// toWers implements the MCP authorization spec for its /proxy endpoints: MCP clients register
+// dynamically, send the user to the authorization endpoint with a PKCE challenge, the user logs in
+// and picks the services the client may use, and the client exchanges the code for a short-lived
+// access token and a refresh token. Access tokens are scoped to the services the user consented to.
+
+// Token prefixes, which tell access tokens apart from the long-lived user tokens
+const (
+	MCPOAuthAccessTokenPrefix  = "tw_at_"
+	MCPOAuthRefreshTokenPrefix = "tw_rt_"
+)
+
+var (
+	MCPOAuthAccessTokenTTL  = time.Hour
+	MCPOAuthRefreshTokenTTL = 30 * 24 * time.Hour
+	mcpOAuthCodeTTL         = 5 * time.Minute
+	mcpOAuthRequestTTL      = 10 * time.Minute
+)
+
+// OAuthError is an error response of the authorization server, as defined by RFC 6749
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, format string, args ...interface{}) *OAuthError {
+	return &OAuthError{Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+// MCPOAuthIssuer returns the issuer identifier of toWers as an authorization server
+func MCPOAuthIssuer() string {
+	common.OptionMapRWMutex.RLock()
+	serverAddress := common.OptionMap["ServerAddress"]
+	common.OptionMapRWMutex.RUnlock()
+	if serverAddress == "" {
+		serverAddress = common.ServerAddress
+	}
+	return strings.TrimSuffix(serverAddress, "/")
+}
+
+// RegisterMCPOAuthClient registers an MCP client (RFC 7591). Clients authenticating at the token
+// endpoint get a secret, which is returned once; public clients rely on PKCE alone.
+func RegisterMCPOAuthClient(name string, redirectURIs []string, confidential bool) (*model.OAuthClient, string, error) {
+	if len(redirectURIs) == 0 {
+		return nil, "", oauthError("invalid_redirect_uri", "at least one redirect URI is required")
+	}
+	for _, uri := range redirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return nil, "", err
+		}
+	}
+
+	clientID, err := common.GenerateSecretToken("tw_client_")
+	if err != nil {
+		return nil, "", err
+	}
+	client := &model.OAuthClient{ClientID: clientID, ClientName: name}
+	if err := client.SetRedirectURIs(redirectURIs); err != nil {
+		return nil, "", err
+	}
+	var secret string
+	if confidential {
+		if secret, err = common.GenerateSecretToken("tw_secret_"); err != nil {
+			return nil, "", err
+		}
+		client.ClientSecretHash = common.HashToken(secret)
+	}
+	if err := model.CreateOAuthClient(client); err != nil {
+		return nil, "", err
+	}
+	common.SysLog(fmt.Sprintf("[MCPOAuth] Registered client %s (%s)", clientID, name))
+	return client, secret, nil
+}
+
+// validateRedirectURI accepts https URIs, http ones on the loopback interface and custom schemes of
+// native apps, as OAuth 2.1 requires
+func validateRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme == "" || parsed.Fragment != "" {
+		return oauthError("invalid_redirect_uri", "%q is not an absolute URI without fragment", uri)
+	}
+	if parsed.Scheme == "http" {
+		switch parsed.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+		default:
+			return oauthError("invalid_redirect_uri", "%q must use https", uri)
+		}
+	}
+	return nil
+}
+
+// AuthorizationRequest is an authorization a client asked for, waiting for the user's consent
+type AuthorizationRequest struct {
+	ID          string `json:"id"`
+	ClientID    string `json:"client_id"`
+	ClientName  string `json:"client_name"`
+	RedirectURI string `json:"redirect_uri"`
+	Scope       string `json:"scope"`              // Requested mcp:<service> scopes, possibly empty
+	Resource    string `json:"resource,omitempty"` // Requested /proxy endpoint (RFC 8707)
+
+	state         string
+	codeChallenge string
+	expires       time.Time
+}
+
+// authorizationCode is a code issued to a client once the user consented
+type authorizationCode struct {
+	clientID      string
+	redirectURI   string
+	userID        int64
+	scope         string
+	codeChallenge string
+	expires       time.Time
+}
+
+var (
+	authorizationRequests = make(map[string]*AuthorizationRequest)
+	authorizationCodes    = make(map[string]*authorizationCode)
+	authorizationMu       sync.Mutex
+)
+
+// StartMCPOAuthAuthorization validates the parameters of a request to the authorization endpoint and
+// keeps it until the user consents. The returned redirect URI is where errors are sent to, empty
+// when the client or redirect URI is invalid, and the error must be shown to the user instead.
+func StartMCPOAuthAuthorization(query url.Values) (*AuthorizationRequest, string, error) {
+	client, err := model.GetOAuthClient(query.Get("client_id"))
+	if errors.Is(err, model.ErrOAuthClientNotFound) {
+		return nil, "", oauthError("invalid_client", "unknown client_id")
+	} else if err != nil {
+		return nil, "", err
+	}
+	redirectURI := query.Get("redirect_uri")
+	if !client.HasRedirectURI(redirectURI) {
+		return nil, "", oauthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+
+	if query.Get("response_type") != "code" {
+		return nil, redirectURI, oauthError("unsupported_response_type", "only the code response type is supported")
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		return nil, redirectURI, oauthError("invalid_request", "PKCE with the S256 method is required")
+	}
+	scope, err := normalizeScope(query.Get("scope"))
+	if err != nil {
+		return nil, redirectURI, err
+	}
+
+	id, err := common.GenerateSecretToken("")
+	if err != nil {
+		return nil, redirectURI, err
+	}
+	request := &AuthorizationRequest{
+		ID:            id,
+		ClientID:      client.ClientID,
+		ClientName:    client.ClientName,
+		RedirectURI:   redirectURI,
+		Scope:         scope,
+		Resource:      query.Get("resource"),
+		state:         query.Get("state"),
+		codeChallenge: query.Get("code_challenge"),
+		expires:       time.Now().Add(mcpOAuthRequestTTL),
+	}
+	authorizationMu.Lock()
+	expireAuthorizationsLocked()
+	authorizationRequests[id] = request
+	authorizationMu.Unlock()
+	return request, redirectURI, nil
+}
+
+// normalizeScope keeps the mcp:<service> scopes of a requested scope, sorted and deduplicated.
+// Other scopes are rejected.
+func normalizeScope(scope string) (string, error) {
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !strings.HasPrefix(s, model.OAuthScopePrefix) || len(s) == len(model.OAuthScopePrefix) {
+			return "", oauthError("invalid_scope", "unknown scope %q, use %s<service>", s, model.OAuthScopePrefix)
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Strings(scopes)
+	return strings.Join(scopes, " "), nil
+}
+
+func expireAuthorizationsLocked() {
+	now := time.Now()
+	for id, request := range authorizationRequests {
+		if now.After(request.expires) {
+			delete(authorizationRequests, id)
+		}
+	}
+	for code, issued := range authorizationCodes {
+		if now.After(issued.expires) {
+			delete(authorizationCodes, code)
+		}
+	}
+}
+
+// ErrAuthorizationRequestNotFound is returned for an unknown or expired authorization request
+var ErrAuthorizationRequestNotFound = errors.New("authorization request not found or expired")
+
+// GetMCPOAuthRequest returns a pending authorization request
+func GetMCPOAuthRequest(id string) (*AuthorizationRequest, error) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	request := authorizationRequests[id]
+	if request == nil || time.Now().After(request.expires) {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+	return request, nil
+}
+
+func takeMCPOAuthRequest(id string) (*AuthorizationRequest, error) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	request := authorizationRequests[id]
+	delete(authorizationRequests, id)
+	if request == nil || time.Now().After(request.expires) {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+	return request, nil
+}
+
+// ApproveMCPOAuthRequest records that user allows the client of a pending request to use services,
+// given by their /proxy names, and returns the URL redirecting the user back to the client with an
+// authorization code
+func ApproveMCPOAuthRequest(id string, user *model.User, services []string) (string, error) {
+	scopes := make([]string, 0, len(services))
+	for _, name := range services {
+		if err := checkConsentService(user, name); err != nil {
+			return "", err
+		}
+		scopes = append(scopes, model.OAuthScopePrefix+name)
+	}
+	scope, err := normalizeScope(strings.Join(scopes, " "))
+	if err != nil {
+		return "", err
+	}
+	if scope == "" {
+		return "", oauthError("invalid_scope", "no service was selected")
+	}
+
+	request, err := takeMCPOAuthRequest(id)
+	if err != nil {
+		return "", err
+	}
+	if err := model.SaveOAuthConsent(user.ID, request.ClientID, scope); err != nil {
+		return "", err
+	}
+	code, err := common.GenerateSecretToken("")
+	if err != nil {
+		return "", err
+	}
+	authorizationMu.Lock()
+	authorizationCodes[code] = &authorizationCode{
+		clientID:      request.ClientID,
+		redirectURI:   request.RedirectURI,
+		userID:        user.ID,
+		scope:         scope,
+		codeChallenge: request.codeChallenge,
+		expires:       time.Now().Add(mcpOAuthCodeTTL),
+	}
+	authorizationMu.Unlock()
+	common.SysLog(fmt.Sprintf("[MCPOAuth] User %d allowed client %s: %s", user.ID, request.ClientID, scope))
+	return redirectWith(request.RedirectURI, url.Values{"code": {code}, "state": {request.state}, "iss": {MCPOAuthIssuer()}}), nil
+}
+
+// checkConsentService checks name is a service or virtual server user may use
+func checkConsentService(user *model.User, name string) error {
+	err := model.CheckProxyAccess(user, name)
+	switch {
+	case errors.Is(err, model.ErrProxyAccessDenied):
+		return oauthError("access_denied", "access denied to service %s", name)
+	case errors.Is(err, model.ErrProxyTargetNotFound):
+		return oauthError("invalid_scope", "service %s not found", name)
+	}
+	return err
+}
+
+// DenyMCPOAuthRequest drops a pending request and returns the URL telling the client access was denied
+func DenyMCPOAuthRequest(id string) (string, error) {
+	request, err := takeMCPOAuthRequest(id)
+	if err != nil {
+		return "", err
+	}
+	return redirectWith(request.RedirectURI, url.Values{"error": {"access_denied"}, "state": {request.state}, "iss": {MCPOAuthIssuer()}}), nil
+}
+
+// MCPOAuthErrorRedirect returns the URL sending an authorization error back to the client
+func MCPOAuthErrorRedirect(redirectURI, state string, err *OAuthError) string {
+	params := url.Values{"error": {err.Code}, "iss": {MCPOAuthIssuer()}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return redirectWith(redirectURI, params)
+}
+
+func redirectWith(redirectURI string, params url.Values) string {
+	if params.Get("state") == "" {
+		params.Del("state")
+	}
+	separator := "?"
+	if strings.Contains(redirectURI, "?") {
+		separator = "&"
+	}
+	return redirectURI + separator + params.Encode()
+}
+
+// MCPOAuthTokenResponse is the response of the token endpoint
+type MCPOAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// authenticateClient checks the credentials a client presented at the token endpoint
+func authenticateClient(clientID, clientSecret string) (*model.OAuthClient, error) {
+	client, err := model.GetOAuthClient(clientID)
+	if errors.Is(err, model.ErrOAuthClientNotFound) {
+		return nil, oauthError("invalid_client", "unknown client_id")
+	} else if err != nil {
+		return nil, err
+	}
+	if client.ClientSecretHash != "" &&
+		subtle.ConstantTimeCompare([]byte(common.HashToken(clientSecret)), []byte(client.ClientSecretHash)) != 1 {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	return client, nil
+}
+
+// ExchangeMCPOAuthCode redeems an authorization code for tokens (authorization_code grant)
+func ExchangeMCPOAuthCode(clientID, clientSecret, code, redirectURI, codeVerifier string) (*MCPOAuthTokenResponse, error) {
+	client, err := authenticateClient(clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	authorizationMu.Lock()
+	issued := authorizationCodes[code]
+	delete(authorizationCodes, code)
+	authorizationMu.Unlock()
+	if issued == nil || time.Now().After(issued.expires) || issued.clientID != client.ClientID {
+		return nil, oauthError("invalid_grant", "invalid or expired authorization code")
+	}
+	if issued.redirectURI != redirectURI {
+		return nil, oauthError("invalid_grant", "redirect_uri does not match the authorization request")
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	if codeVerifier == "" || base64.RawURLEncoding.EncodeToString(challenge[:]) != issued.codeChallenge {
+		return nil, oauthError("invalid_grant", "code_verifier does not match the code challenge")
+	}
+	return issueMCPOAuthToken(&model.OAuthToken{ClientID: client.ClientID, UserID: issued.userID, Scope: issued.scope})
+}
+
+// RefreshMCPOAuthToken issues new tokens in exchange for a refresh token (refresh_token grant). The
+// refresh token is rotated, and the scope is narrowed to what the user still consents to.
+func RefreshMCPOAuthToken(clientID, clientSecret, refreshToken string) (*MCPOAuthTokenResponse, error) {
+	client, err := authenticateClient(clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	token, err := model.GetOAuthTokenByRefreshToken(common.HashToken(refreshToken))
+	if errors.Is(err, model.ErrOAuthTokenNotFound) || (err == nil && token.ClientID != client.ClientID) {
+		return nil, oauthError("invalid_grant", "invalid or expired refresh token")
+	} else if err != nil {
+		return nil, err
+	}
+	consent, err := model.GetOAuthConsent(token.UserID, token.ClientID)
+	if errors.Is(err, model.ErrOAuthConsentNotFound) {
+		return nil, oauthError("invalid_grant", "access was revoked")
+	} else if err != nil {
+		return nil, err
+	}
+	var scopes []string
+	for _, s := range strings.Fields(token.Scope) {
+		if model.HasOAuthScope(consent.Scope, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, oauthError("invalid_grant", "access was revoked")
+	}
+	token.Scope = strings.Join(scopes, " ")
+	return issueMCPOAuthToken(token)
+}
+
+// issueMCPOAuthToken generates new access and refresh tokens for token and saves their hashes
+func issueMCPOAuthToken(token *model.OAuthToken) (*MCPOAuthTokenResponse, error) {
+	accessToken, err := common.GenerateSecretToken(MCPOAuthAccessTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := common.GenerateSecretToken(MCPOAuthRefreshTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	token.AccessTokenHash = common.HashToken(accessToken)
+	token.RefreshTokenHash = common.HashToken(refreshToken)
+	token.AccessExpiresAt = now.Add(MCPOAuthAccessTokenTTL).Unix()
+	token.RefreshExpiresAt = now.Add(MCPOAuthRefreshTokenTTL).Unix()
+	if err := model.SaveOAuthToken(token); err != nil {
+		return nil, err
+	}
+	return &MCPOAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(MCPOAuthAccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        token.Scope,
+	}, nil
+}
+
+// ValidateMCPOAuthAccessToken returns the token and enabled user an access token was issued for
+func ValidateMCPOAuthAccessToken(accessToken string) (*model.OAuthToken, *model.User, error) {
+	token, err := model.GetOAuthTokenByAccessToken(common.HashToken(accessToken))
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := model.GetUserById(token.UserID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Status != common.UserStatusEnabled {
+		return nil, nil, errors.New("user is disabled")
+	}
+	return token, user, nil
+}
@@ -49,9 +49,10 @@ const ServiceConfigModal: React.FC<ServiceConfigModalProps> = ({ open, service,
     const [copied, setCopied] = useState<{ [k: string]: boolean }>({});
     const [error, setError] = useState<string | null>(null);
     const [userToken, setUserToken] = useState<string>('');
+    const [creatingToken, setCreatingToken] = useState(false);
     const [showManualCopy, setShowManualCopy] = useState<{ [k: string]: boolean }>({});
     const serverAddress = useServerAddress();
-    const { currentUser, updateUserInfo } = useAuth();
+    const { currentUser } = useAuth();
     const { toast } = useToast();
     const [selectedEndpointType, setSelectedEndpointType] = useState<'sse' | 'streamableHttp'>('streamableHttp');
 
@@ -59,46 +60,40 @@ const ServiceConfigModal: React.FC<ServiceConfigModalProps> = ({ open, service,
         setEnvValues(getEnvVars(service));
     }, [service]);
 
-    // 获取用户token
+    // API tokens are only shown once, when they are created: create one for this service on request
     React.useEffect(() => {
-        const fetchUserToken = async () => {
-            try {
-                // 首先检查currentUser中是否已有token
-                if (currentUser?.token) {
-                    setUserToken(currentUser.token);
-                    return;
-                }
+        setUserToken('');
+    }, [service?.name]);
 
-                // 如果没有，从API获取
-                const response = await fetch('/api/user/self', {
-                    headers: {
-                        'Authorization': `Bearer ${localStorage.getItem('token')}`,
-                        'Content-Type': 'application/json'
-                    }
-                });
-
-                if (response.ok) {
-                    const data = await response.json();
-                    if (data.success && data.data?.token) {
-                        setUserToken(data.data.token);
-                        // 更新AuthContext中的用户信息
-                        if (currentUser) {
-                            updateUserInfo({
-                                ...currentUser,
-                                token: data.data.token
-                            });
-                        }
-                    }
-                }
-            } catch (error) {
-                console.error('Failed to fetch user token:', error);
+    const handleCreateToken = async () => {
+        if (!service?.name) return;
+        setCreatingToken(true);
+        try {
+            const response = await fetch('/api/user/tokens', {
+                method: 'POST',
+                headers: {
+                    'Authorization': `Bearer ${localStorage.getItem('token')}`,
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ name: service.name, services: [service.name] })
+            });
+            const data = await response.json();
+            if (response.ok && data.success && data.data?.token) {
+                setUserToken(data.data.token);
+            } else {
+                throw new Error(data.message);
             }
-        };
-
-        if (open && currentUser) {
-            fetchUserToken();
+        } catch (error) {
+            console.error('Failed to create API token:', error);
+            toast({
+                variant: "destructive",
+                title: t('serviceConfigModal.messages.createTokenFailed'),
+                description: error instanceof Error ? error.message : undefined
+            });
+        } finally {
+            setCreatingToken(false);
         }
-    }, [open, currentUser, updateUserInfo]);
+    };
 
     const handleChange = (name: string, value: string) => {
         setEnvValues((prev) => ({ ...prev, [name]: value }));
@@ -385,6 +380,16 @@ const ServiceConfigModal: React.FC<ServiceConfigModalProps> = ({ open, service,
                         </Button>
                     </div>
 
+                    {/* API token included in the copied configuration */}
+                    {!userToken && (
+                        <div className="mt-2 flex items-center justify-between gap-2">
+                            <p className="text-xs text-muted-foreground">{t('serviceConfigModal.messages.apiTokenHint')}</p>
+                            <Button size="sm" variant="outline" onClick={handleCreateToken} disabled={creatingToken || !service?.name}>
+                                {creatingToken ? t('common.loading') : t('serviceConfigModal.actions.createToken')}
+                            </Button>
+                        </div>
+                    )}
+
                     {/* Conditional SSE Header display and its copy button */}
                     {selectedEndpointType === 'sse' && userToken && (
                         <div className="mt-2 flex items-center gap-2">
@@ -19,7 +19,6 @@ interface UserInfo {
     display_name: string;
     role: number;
     status: number;
-    token: string;
     github_id?: string;
     google_id?: string;
     wechat_id?: string;
@@ -37,6 +36,9 @@ export function ProfilePage() {
     // const [editMode, setEditMode] = useState(true); // Edit mode no longer needed
     const [saving, setSaving] = useState(false);
     const [refreshingToken, setRefreshingToken] = useState(false);
+    // The API key is only returned when it is generated; afterwards only its prefix is known
+    const [apiKey, setApiKey] = useState('');
+    const [apiKeyPrefix, setApiKeyPrefix] = useState('');
 
     // Form data
     const [formData, setFormData] = useState({
@@ -75,7 +77,21 @@ export function ProfilePage() {
             }
         };
 
+        // The full access "Default" token replaces the API key users had before API tokens
+        const fetchApiKeyPrefix = async () => {
+            try {
+                const response: APIResponse = await api.get('/user/tokens');
+                if (response.success && Array.isArray(response.data)) {
+                    const defaultToken = response.data.find((token: { name: string }) => token.name === 'Default');
+                    setApiKeyPrefix(defaultToken?.token_prefix || '');
+                }
+            } catch {
+                setApiKeyPrefix('');
+            }
+        };
+
         fetchUserInfo();
+        fetchApiKeyPrefix();
     }, [toast]);
 
     // Determine login method
@@ -161,7 +177,8 @@ export function ProfilePage() {
         try {
             const response: APIResponse = await api.get('/user/token');
             if (response.success && response.data) {
-                setUserInfo(prev => prev ? { ...prev, token: response.data } : null);
+                setApiKey(response.data);
+                setShowApiKey(true);
                 toast({
                     title: t('profile.messages.apiKeyRefreshSuccess'),
                     description: t('profile.messages.apiKeyRefreshSuccess')
@@ -362,7 +379,7 @@ export function ProfilePage() {
                             <div className="flex gap-2">
                                 <Input
                                     id="apikey"
-                                    value={formatApiKey(userInfo?.token || '')}
+                                    value={apiKey ? formatApiKey(apiKey) : (apiKeyPrefix && apiKeyPrefix + '••••••••••••••••')}
                                     disabled
                                     className="bg-muted font-mono text-sm"
                                 />
@@ -393,6 +410,7 @@ export function ProfilePage() {
                                 <li>• {t('profile.notes.apiKeyNote1')}</li>
                                 <li>• {t('profile.notes.apiKeyNote2')}</li>
                                 <li>• {t('profile.notes.apiKeyNote3')}</li>
+                                <li>• {t('profile.notes.apiKeyNote4')}</li>
                             </ul>
                         </div>
                     </CardContent>
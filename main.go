@@ -52,6 +52,10 @@ func main() {
 	if err != nil {
 		common.FatalLog(err)
 	}
+	// Credentials stored in the database need a key that survives restarts
+	if err := common.LoadSecretEncryptionKey(); err != nil {
+		common.SysError("[Secrets] No stable secret encryption key, services cannot use OAuth until SECRET_ENCRYPTION_KEY is set: " + err.Error())
+	}
 	// Initialize SQL Database
 	err = model.InitDB()
 	if err != nil {